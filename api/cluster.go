@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v4"
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/raft"
+)
+
+// Where the handlers send writes: the local Db, or in a cluster the Raft
+// log through a raft.KV
+type Writer interface {
+	PutWithOptions(key, value []byte, opts kvdb.PutOptions) error
+	PutIfVersionWithOptions(key, value []byte, version uint64, opts kvdb.PutOptions) (uint64, error)
+	DeleteIfVersion(key []byte, version uint64) error
+	Write(batch *kvdb.WriteBatch) error
+	CommitTxn(txn *kvdb.Txn) error
+}
+
+// Writes straight to a Db
+type localWriter struct {
+	*kvdb.Db
+}
+
+func (w localWriter) CommitTxn(txn *kvdb.Txn) error {
+	return txn.Commit()
+}
+
+// Serve as a member of a Raft cluster.  Writes, transactions and
+// membership changes made on a follower are redirected to the leader,
+// which commits them through the log; reads are served from the local
+// Db, which lags the leader by whatever has yet to be applied.
+func (s *Server) SetCluster(kv *raft.KV) {
+	s.cluster = kv
+	s.writes = kv
+}
+
+// In a cluster reply with a redirect to the leader unless this is it,
+// or 503 if there is no leader yet.  Returns whether it replied.  307
+// keeps the method and body, so a client following it repeats the
+// request as made.
+func (s *Server) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.cluster == nil {
+		return false
+	}
+	node := s.cluster.Node()
+	leader, ok := node.Leader()
+	if ok && leader.ID == node.ID() {
+		return false
+	}
+	if !ok || leader.APIAddr == "" {
+		writeError(w, http.StatusServiceUnavailable, "no leader")
+		return true
+	}
+	w.Header().Set("Location", "http://"+leader.APIAddr+r.URL.RequestURI())
+	writeError(w, http.StatusTemporaryRedirect, "not the leader, try "+leader.APIAddr)
+	return true
+}
+
+// Handler for GET /v1/admin/cluster.  Replies with this member's
+// raft.Status: its state and term, the leader, its commit and applied
+// indexes and the members, and on the leader how far each follower has
+// got.  404 when not running in a cluster.
+func (s *Server) GetCluster() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			writeError(w, http.StatusNotFound, "not running in a cluster")
+			return
+		}
+		blob, err := json.Marshal(s.cluster.Node().Status())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
+
+// Handler for POST /v1/admin/cluster/members.  Adds the raft.Member in
+// the body, which should already be running with no peers, replying
+// once the change commits.  409 if it is already a member or another
+// change is in progress.
+func (s *Server) AddMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			writeError(w, http.StatusNotFound, "not running in a cluster")
+			return
+		}
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		var m raft.Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.ID == "" || m.Addr == "" {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := s.cluster.AddMember(m); err != nil {
+			fmt.Println("Add member failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handler for DELETE /v1/admin/cluster/members/{id}.  Replies 204 once
+// the member's removal commits, 404 if there is no such member.
+func (s *Server) RemoveMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			writeError(w, http.StatusNotFound, "not running in a cluster")
+			return
+		}
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		if err := s.cluster.RemoveMember(chi.URLParam(r, "id")); err != nil {
+			fmt.Println("Remove member failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
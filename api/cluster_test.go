@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/raft"
+)
+
+func getCluster(t *testing.T, url string) raft.Status {
+	res, err := http.Get(url + "/v1/admin/cluster")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/admin/cluster: %v %v", res, err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	var st raft.Status
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		t.Errorf("decoding status: %v", err)
+	}
+	return st
+}
+
+func TestCluster(t *testing.T) {
+	db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+	defer db.Close()
+	ts := httptest.NewServer(InitServer(db).router)
+	if res, _ := http.Get(ts.URL + "/v1/admin/cluster"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("cluster status when standalone replied %d", res.StatusCode)
+	}
+	ts.Close()
+
+	// Three members on an in-memory network, each with its own server
+	nw := raft.NewNetwork(1)
+	ids := []string{"a", "b", "c"}
+	servers := map[string]*Server{}
+	urls := map[string]string{}
+	members := raft.Membership{}
+	for _, id := range ids {
+		db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+		defer db.Close()
+		servers[id] = InitServer(db)
+		ts := httptest.NewServer(servers[id].router)
+		defer ts.Close()
+		urls[id] = ts.URL
+		members = append(members, raft.Member{ID: id, Addr: id, APIAddr: strings.TrimPrefix(ts.URL, "http://")})
+	}
+	for _, id := range ids {
+		kv, err := raft.NewKV(servers[id].db, raft.Config{ID: id, Members: members,
+			Storage: raft.NewMemoryStorage(), Transport: nw})
+		if err != nil {
+			t.Errorf("NewKV failed: %v", err)
+			t.FailNow()
+		}
+		defer kv.Node().Stop()
+		nw.Attach(kv.Node())
+		servers[id].SetCluster(kv)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				nw.Tick()
+			}
+		}
+	}()
+
+	var leader string
+	for i := 0; i < 1000 && leader == ""; i++ {
+		time.Sleep(time.Millisecond)
+		leader = servers["a"].cluster.Node().Status().Leader
+	}
+	follower := "a"
+	if leader == "a" {
+		follower = "b"
+	}
+	if st := getCluster(t, urls[follower]); st.State != "follower" || st.Leader != leader || len(st.Members) != 3 {
+		t.Errorf("follower's status %+v", st)
+	}
+
+	// A write to a follower is redirected to the leader
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, _ := http.NewRequest("PUT", urls[follower]+"/v1/k?x=1", strings.NewReader("v"))
+	res, _ := noFollow.Do(req)
+	if res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get("Location") != urls[leader]+"/v1/k?x=1" {
+		t.Errorf("PUT on a follower replied %d to %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	req, _ = http.NewRequest("PUT", urls[follower]+"/v1/k", strings.NewReader("v"))
+	if res, _ = http.DefaultClient.Do(req); res.StatusCode != http.StatusCreated {
+		t.Errorf("PUT following the redirect replied %d", res.StatusCode)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, _ := servers[follower].db.Get([]byte("k")); string(v) == "v" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if res, _ := http.Get(urls[follower] + "/v1/k"); res.StatusCode != http.StatusOK {
+		t.Errorf("GET on a follower replied %d", res.StatusCode)
+	}
+
+	// Transactions run on the leader
+	res, _ = noFollow.Post(urls[follower]+"/v1/txn", "application/json", nil)
+	if res.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("POST /v1/txn on a follower replied %d", res.StatusCode)
+	}
+	res, _ = http.Post(urls[follower]+"/v1/txn", "application/json", nil)
+	var body TxnReply
+	json.NewDecoder(res.Body).Decode(&body)
+	res.Body.Close()
+	http.Post(urls[leader]+"/v1/txn/"+body.ID, "application/json",
+		strings.NewReader(`{"ops":[{"op":"put","key":"t","value":"1"}]}`))
+	if res, _ := http.Post(urls[leader]+"/v1/txn/"+body.ID+"/commit", "", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("commit replied %d", res.StatusCode)
+	}
+	if v, _ := servers[leader].db.Get([]byte("t")); string(v) != "1" {
+		t.Errorf("t=%q after commit", v)
+	}
+
+	// Membership changes
+	req, _ = http.NewRequest("DELETE", urls[follower]+"/v1/admin/cluster/members/x", nil)
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusNotFound {
+		t.Errorf("removing a non-member replied %d", res.StatusCode)
+	}
+	res, _ = http.Post(urls[leader]+"/v1/admin/cluster/members", "application/json",
+		strings.NewReader(`{"id":"a"}`))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("adding a member without an address replied %d", res.StatusCode)
+	}
+	res, _ = http.Post(urls[leader]+"/v1/admin/cluster/members", "application/json",
+		strings.NewReader(`{"id":"a","addr":"a"}`))
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("adding an existing member replied %d", res.StatusCode)
+	}
+	req, _ = http.NewRequest("DELETE", urls[leader]+"/v1/admin/cluster/members/"+follower, nil)
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusNoContent {
+		t.Errorf("removing %s replied %d", follower, res.StatusCode)
+	}
+	if st := getCluster(t, urls[leader]); len(st.Members) != 2 {
+		t.Errorf("members after removing %s: %v", follower, st.Members)
+	}
+}
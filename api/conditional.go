@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The entity tag of a key's version, see kvdb.Db.GetVersion
+func versionETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// Whether the comma separated list of entity tags in header holds etag.
+// Weak comparison also matches W/ tags, as If-None-Match requires.
+func etagListContains(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate the If-Match and If-None-Match headers of r against the
+// current version of key.  Returns the current version, which a write
+// must still find for the preconditions to hold, whether r has any
+// preconditions, and whether they failed.
+func (s *Server) precondition(r *http.Request, key []byte) (uint64, bool, bool, error) {
+	_, version, err := s.reads.GetVersion(key)
+	if err != nil {
+		return 0, false, false, err
+	}
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return version, false, false, nil
+	}
+
+	etag := versionETag(version)
+	if ifMatch != "" {
+		if version == 0 || ifMatch != "*" && !etagListContains(ifMatch, etag, false) {
+			return version, true, true, nil
+		}
+	}
+	if ifNoneMatch != "" {
+		if ifNoneMatch == "*" && version != 0 ||
+			version != 0 && etagListContains(ifNoneMatch, etag, true) {
+			return version, true, true, nil
+		}
+	}
+	return version, true, false, nil
+}
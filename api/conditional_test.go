@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func conditionalRequest(t *testing.T, method, url, body string, header http.Header) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed %s: %v", method, err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	url := ts.URL + "/v1/a"
+
+	// Create only if missing
+	create := http.Header{"If-None-Match": {"*"}}
+	res := conditionalRequest(t, "PUT", url, "1", create)
+	first := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusCreated || first == "" {
+		t.Errorf("create %d %q", res.StatusCode, first)
+	}
+	if res := conditionalRequest(t, "PUT", url, "x", create); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("create over existing key %d", res.StatusCode)
+	}
+
+	res = conditionalRequest(t, "GET", url, "", nil)
+	if res.Header.Get("ETag") != first {
+		t.Errorf("GET ETag %q != %q", res.Header.Get("ETag"), first)
+	}
+
+	res = conditionalRequest(t, "PUT", url, "2", http.Header{"If-Match": {`"0", ` + first}})
+	second := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || second == first || string(db.GetString("a")) != "2" {
+		t.Errorf("update %d %q", res.StatusCode, second)
+	}
+
+	for _, header := range []http.Header{
+		{"If-Match": {first}},
+		{"If-None-Match": {second}},
+		{"If-None-Match": {"W/" + second}},
+	} {
+		for _, method := range []string{"PUT", "DELETE"} {
+			res := conditionalRequest(t, method, url, "stale", header)
+			if res.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("%s %v: %d", method, header, res.StatusCode)
+			}
+		}
+	}
+	if v := db.GetString("a"); string(v) != "2" {
+		t.Errorf("a = %s after stale writes", v)
+	}
+
+	res = conditionalRequest(t, "DELETE", url, "", http.Header{"If-Match": {second}})
+	if res.StatusCode != http.StatusNoContent || db.GetString("a") != nil {
+		t.Errorf("delete %d", res.StatusCode)
+	}
+	res = conditionalRequest(t, "PUT", url, "3", http.Header{"If-Match": {"*"}})
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-Match * on missing key %d", res.StatusCode)
+	}
+
+	// Unconditional writes always go through
+	res = conditionalRequest(t, "PUT", url, "4", nil)
+	if res.StatusCode != http.StatusCreated || string(db.GetString("a")) != "4" {
+		t.Errorf("unconditional put %d", res.StatusCode)
+	}
+}
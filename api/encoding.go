@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v4"
+)
+
+// How keys and values are carried in JSON strings.  JSON strings hold
+// only UTF-8, so as text any invalid byte is replaced, base64 carries
+// arbitrary bytes.
+type jsonEncoding string
+
+const (
+	encodingText   jsonEncoding = "text"
+	encodingBase64 jsonEncoding = "base64"
+)
+
+func parseEncoding(name string) (jsonEncoding, error) {
+	switch jsonEncoding(name) {
+	case "", encodingText:
+		return encodingText, nil
+	case encodingBase64:
+		return encodingBase64, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q", name)
+}
+
+// The encoding asked for by the encoding query parameter of r
+func queryEncoding(r *http.Request) (jsonEncoding, error) {
+	return parseEncoding(r.URL.Query().Get("encoding"))
+}
+
+func (e jsonEncoding) encode(b []byte) string {
+	if e == encodingBase64 {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func (e jsonEncoding) decode(s string) ([]byte, error) {
+	if e == encodingBase64 {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 %q", s)
+		}
+		return b, nil
+	}
+	return []byte(s), nil
+}
+
+// The key in the path of r.  Keys may hold any bytes percent encoded.
+// chi matches against the escaped path whenever it differs from the
+// decoded one, in which case the parameter must still be unescaped.
+func urlKey(r *http.Request) ([]byte, error) {
+	k := chi.URLParam(r, "key")
+	if r.URL.RawPath == "" {
+		return []byte(k), nil
+	}
+	u, err := url.PathUnescape(k)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(u), nil
+}
+
+// The media type of a Content-Type or offer, without parameters
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return t
+}
+
+// Pick the offer the Accept header of a request prefers, or "" if it
+// accepts none of them.  The most specific media range matching an offer
+// decides its quality and ties go to the earlier offer, so without an
+// Accept header the first offer is chosen.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		t string
+		q float64
+	}
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{t, q})
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		t := mediaType(offer)
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			s := -1
+			if mr.t == t {
+				s = 2
+			} else if strings.HasSuffix(mr.t, "/*") &&
+				strings.HasPrefix(t, strings.TrimSuffix(mr.t, "*")) {
+				s = 1
+			} else if mr.t == "*/*" {
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
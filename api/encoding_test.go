@@ -0,0 +1,184 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Not valid UTF-8 and holding NULs
+var binaryKey = []byte("k\x00\xff/")
+var binaryValue = []byte("\x00\xc3\x28\xff\x00")
+
+func binaryRequest(t *testing.T, method, url string, body []byte, header http.Header) (*http.Response, []byte) {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed %s: %v", method, err)
+		t.FailNow()
+	}
+	reply, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, reply
+}
+
+func TestBinaryPutGet(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	keyURL := ts.URL + "/v1/" + url.PathEscape(string(binaryKey))
+
+	octets := http.Header{"Content-Type": {"application/octet-stream"}}
+	res, _ := binaryRequest(t, "PUT", keyURL, binaryValue, octets)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("PUT %d", res.StatusCode)
+		t.FailNow()
+	}
+	if v, _ := db.Get(binaryKey); !bytes.Equal(v, binaryValue) {
+		t.Errorf("stored %q", v)
+	}
+
+	// The value comes back exactly as put, with its content type
+	for _, accept := range []string{"", "application/octet-stream", "*/*"} {
+		res, reply := binaryRequest(t, "GET", keyURL, nil, http.Header{"Accept": {accept}})
+		if res.StatusCode != http.StatusOK || !bytes.Equal(reply, binaryValue) ||
+			res.Header.Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("Accept %q: %d %q %q", accept, res.StatusCode, reply,
+				res.Header.Get("Content-Type"))
+		}
+	}
+
+	// JSON carries it intact only as base64
+	res, reply := binaryRequest(t, "GET", keyURL+"?encoding=base64", nil,
+		http.Header{"Accept": {"application/json"}})
+	body := map[string]string{}
+	json.Unmarshal(reply, &body)
+	v, err := base64.StdEncoding.DecodeString(body[base64.StdEncoding.EncodeToString(binaryKey)])
+	if res.StatusCode != http.StatusOK || err != nil || !bytes.Equal(v, binaryValue) {
+		t.Errorf("base64 GET %d %s", res.StatusCode, reply)
+	}
+
+	res, _ = binaryRequest(t, "GET", keyURL+"?encoding=hex", nil,
+		http.Header{"Accept": {"application/json"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown encoding %d", res.StatusCode)
+	}
+
+	res, _ = binaryRequest(t, "DELETE", keyURL, nil, nil)
+	if v, _ := db.Get(binaryKey); res.StatusCode != http.StatusNoContent || v != nil {
+		t.Errorf("DELETE %d", res.StatusCode)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	keyURL := ts.URL + "/v1/image"
+
+	png := "image/png"
+	binaryRequest(t, "PUT", keyURL, binaryValue, http.Header{"Content-Type": {png}})
+	db.Put([]byte("plain"), []byte("text"))
+
+	for _, test := range []struct {
+		key, accept, contentType string
+		status                   int
+	}{
+		{"image", "", png, http.StatusOK},
+		{"image", "image/*", png, http.StatusOK},
+		{"image", "application/json", "application/json", http.StatusOK},
+		{"image", "application/json;q=0.5, image/png", png, http.StatusOK},
+		{"image", "application/json, image/png;q=0.5", "application/json", http.StatusOK},
+		{"image", "application/octet-stream", "application/octet-stream", http.StatusOK},
+		{"image", "text/html", "application/json", http.StatusNotAcceptable},
+		// Written without a content type, so JSON by default
+		{"plain", "", "application/json", http.StatusOK},
+		{"plain", "*/*", "application/json", http.StatusOK},
+		{"plain", "application/octet-stream", "application/octet-stream", http.StatusOK},
+	} {
+		res, reply := binaryRequest(t, "GET", ts.URL+"/v1/"+test.key, nil,
+			http.Header{"Accept": {test.accept}})
+		if res.StatusCode != test.status || res.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s Accept %q: %d %q %q", test.key, test.accept, res.StatusCode,
+				res.Header.Get("Content-Type"), reply)
+		}
+	}
+
+	res, _ := binaryRequest(t, "HEAD", keyURL, nil, nil)
+	if res.Header.Get("Content-Type") != png {
+		t.Errorf("HEAD Content-Type %q", res.Header.Get("Content-Type"))
+	}
+}
+
+func TestBase64Bodies(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	b64 := base64.StdEncoding.EncodeToString
+
+	blob, _ := json.Marshal(PostBody{
+		Key:         b64(binaryKey),
+		Value:       b64(binaryValue),
+		ContentType: "application/x-test",
+		Encoding:    "base64",
+	})
+	res, _ := binaryRequest(t, "POST", ts.URL+"/v1/insert", blob, nil)
+	if v, _ := db.Get(binaryKey); res.StatusCode != http.StatusOK || !bytes.Equal(v, binaryValue) {
+		t.Errorf("insert %d %q", res.StatusCode, v)
+	}
+	if info, _ := db.Stat(binaryKey); info == nil || info.ContentType != "application/x-test" {
+		t.Errorf("insert kept %+v", info)
+	}
+
+	blob, _ = json.Marshal(BatchBody{
+		Ops:      []BatchOp{{Op: "put", Key: b64([]byte("\x00b")), Value: b64([]byte{0xfe})}},
+		Encoding: "base64",
+	})
+	res, _ = binaryRequest(t, "POST", ts.URL+"/v1/batch", blob, nil)
+	if v, _ := db.Get([]byte("\x00b")); res.StatusCode != http.StatusOK || !bytes.Equal(v, []byte{0xfe}) {
+		t.Errorf("batch %d %q", res.StatusCode, v)
+	}
+
+	blob, _ = json.Marshal(BatchBody{
+		Ops:      []BatchOp{{Op: "put", Key: "not base64!", Value: ""}},
+		Encoding: "base64",
+	})
+	res, reply := binaryRequest(t, "POST", ts.URL+"/v1/batch", blob, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad base64 %d %s", res.StatusCode, reply)
+	}
+
+	// Scans take and return base64 too
+	lines, _ := scanPage(t, ts.URL, url.Values{
+		"prefix":   {b64([]byte{0})},
+		"encoding": {"base64"},
+	})
+	if len(lines) != 1 || lines[0].Key != b64([]byte("\x00b")) || lines[0].Value != b64([]byte{0xfe}) {
+		t.Errorf("scan %v", lines)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain; charset=utf-8", "application/json"}
+	for accept, expect := range map[string]string{
+		"":                                offers[0],
+		"*/*":                             offers[0],
+		"application/*":                   offers[1],
+		"text/plain;q=0.1, */*":           offers[1],
+		"text/*;q=0, application/json":    offers[1],
+		"text/plain, application/json":    offers[0],
+		"image/png":                       "",
+		"text/plain;q=0":                  "",
+		"bogus, application/json;q=0.5":   offers[1],
+		"TEXT/PLAIN;q=0.9, */*;q=0.5":     offers[0],
+		"application/json;q=0.9, */*;q=1": offers[0],
+	} {
+		if got := negotiate(accept, offers); got != expect {
+			t.Errorf("negotiate(%q) = %q != %q", accept, got, expect)
+		}
+	}
+}
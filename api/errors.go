@@ -0,0 +1,46 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/raft"
+	"github.com/jlitzingerdev/simple-kv/shard"
+)
+
+// Body of every error reply
+type ErrorBody struct {
+	Error string `json:"error"`
+}
+
+// Reply with status and an ErrorBody holding msg
+func writeError(w http.ResponseWriter, status int, msg string) {
+	blob, _ := json.Marshal(ErrorBody{msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(blob)
+}
+
+// The status for a write the database refused, 403 on a read-only
+// follower.  In a cluster a write that could not be committed, because
+// leadership changed or a majority is unreachable, is 503 and may be
+// retried.  A batch spanning shards is the client's to split, 400.
+// A missing namespace is 404, one that already exists 409 and one with
+// a bad name or options 400.
+func dbErrorStatus(err error) int {
+	switch err {
+	case kvdb.ErrReadOnly:
+		return http.StatusForbidden
+	case kvdb.ErrClosed, raft.ErrNotLeader, raft.ErrProposalDropped, raft.ErrTimeout, raft.ErrStopped:
+		return http.StatusServiceUnavailable
+	case raft.ErrConfigPending, raft.ErrMemberExists, kvdb.ErrFamilyExists:
+		return http.StatusConflict
+	case raft.ErrNoMember, shard.ErrNoRange, shard.ErrNoShard, kvdb.ErrNoFamily:
+		return http.StatusNotFound
+	case shard.ErrCrossShard, shard.ErrSplitBoundary, kvdb.ErrInvalidFamily, kvdb.ErrDropDefault,
+		kvdb.ErrUnknownComparator, kvdb.ErrInvalidTTL:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
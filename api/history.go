@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// One entry of a history response
+type HistoryEntry struct {
+	Value       string    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Deleted     bool      `json:"deleted,omitempty"`
+	Sequence    uint64    `json:"sequence"`
+}
+
+// Parse the at parameter of GET /v1/{key}, either RFC 3339 or epoch
+// seconds
+func parseAt(at string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(at, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, at)
+}
+
+// Handler for GET /v1/{key}/history.  Returns a JSON array of
+// HistoryEntry, newest first, with values base64 encoded if
+// ?encoding=base64 is given.  How far back it goes depends on the
+// database's history configuration.
+func (s *Server) GetHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		enc, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		history, err := s.reads.History(key)
+		if err != nil {
+			fmt.Println("History failed ", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(history) == 0 {
+			writeError(w, http.StatusNotFound, "key not found")
+			return
+		}
+
+		body := make([]HistoryEntry, 0, len(history))
+		for _, v := range history {
+			body = append(body, HistoryEntry{
+				Value:       enc.encode(v.Value),
+				ContentType: v.ContentType,
+				Timestamp:   v.Timestamp.UTC(),
+				Deleted:     v.Deleted,
+				Sequence:    v.Sequence,
+			})
+		}
+		blob, err := json.Marshal(body)
+		if err != nil {
+			fmt.Println("Failed encoding ", err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
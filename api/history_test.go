@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func configureHistoryServer() (*httptest.Server, *kvdb.Db) {
+	db, err := kvdb.InitDb(&kvdb.DbConfig{HistoryVersions: 10})
+	if err != nil {
+		panic(err)
+	}
+	s := InitServer(db)
+	ts := httptest.NewServer(s.router)
+	return ts, db
+}
+
+func TestGetHistory(t *testing.T) {
+	ts, db := configureHistoryServer()
+	defer ts.Close()
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("a"), []byte("2"))
+	db.Delete([]byte("a"))
+
+	res, err := http.Get(fmt.Sprintf("%s/v1/a/history", ts.URL))
+	if err != nil {
+		t.Errorf("Failed get: %v", err)
+		t.FailNow()
+	}
+	reply, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var history []HistoryEntry
+	if err := json.Unmarshal(reply, &history); err != nil {
+		t.Errorf("Unmarshal Body failed: %v", err)
+		t.FailNow()
+	}
+	if len(history) != 3 || !history[0].Deleted || history[1].Value != "2" ||
+		history[2].Value != "1" || history[2].Sequence >= history[1].Sequence {
+		t.Errorf("history invalid %v", history)
+	}
+
+	res, _ = http.Get(fmt.Sprintf("%s/v1/b/history", ts.URL))
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing key status %d", res.StatusCode)
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	ts, db := configureHistoryServer()
+	defer ts.Close()
+	before := time.Now().Add(-time.Minute)
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("a"), []byte("2"))
+	db.Delete([]byte("b"))
+
+	for _, test := range []struct {
+		path   string
+		status int
+		value  string
+	}{
+		{fmt.Sprintf("/v1/a?at=%d", time.Now().Unix()), http.StatusOK, "2"},
+		{"/v1/a?at=" + time.Now().UTC().Format(time.RFC3339), http.StatusOK, "2"},
+		{fmt.Sprintf("/v1/a?at=%d", before.Unix()), http.StatusNotFound, ""},
+		{fmt.Sprintf("/v1/b?at=%d", time.Now().Unix()), http.StatusNotFound, ""},
+		{"/v1/a?at=yesterday", http.StatusBadRequest, ""},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Errorf("Failed get: %v", err)
+			t.FailNow()
+		}
+		reply, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: status %d != %d", test.path, res.StatusCode, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var data ReplyBody
+		if err := json.Unmarshal(reply, &data); err != nil || data["a"] != test.value {
+			t.Errorf("%s: reply %s", test.path, reply)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v4"
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Namespaces are the Db's column families, see kvdb/family.go.  They live
+// in a single Db and are written around the Raft log, so a sharded or
+// clustered server has none.
+
+var errNoNamespaces = errors.New("namespaces need a single unclustered database")
+
+// Reply 501 on a sharded or clustered server, returning whether it
+// replied
+func (s *Server) noNamespaces(w http.ResponseWriter) bool {
+	if s.shards == nil && s.cluster == nil {
+		return false
+	}
+	writeError(w, http.StatusNotImplemented, errNoNamespaces.Error())
+	return true
+}
+
+// The namespace named in the path of r, replying 404 if there is none
+func (s *Server) namespace(w http.ResponseWriter, r *http.Request) *kvdb.Family {
+	if s.noNamespaces(w) {
+		return nil
+	}
+	f := s.db.Family(chi.URLParam(r, "namespace"))
+	if f == nil {
+		writeError(w, http.StatusNotFound, kvdb.ErrNoFamily.Error())
+	}
+	return f
+}
+
+// A namespace and its options.  TTL is in seconds, Compaction is
+// "leveled" or "tiered" and Comparator "bytewise", "reverse" or one the
+// Db was configured with.  Unset options take their defaults on create.
+type Namespace struct {
+	Name       string `json:"name"`
+	TTL        int64  `json:"ttl,omitempty"`
+	Compaction string `json:"compaction,omitempty"`
+	Comparator string `json:"comparator,omitempty"`
+}
+
+var compactionNames = map[kvdb.CompactionStyle]string{
+	kvdb.CompactionLeveled:    "leveled",
+	kvdb.CompactionSizeTiered: "tiered",
+}
+
+func namespaceOf(f *kvdb.Family) Namespace {
+	opts := f.Options()
+	return Namespace{
+		Name:       f.Name(),
+		TTL:        int64(opts.TTL / time.Second),
+		Compaction: compactionNames[opts.CompactionStyle],
+		Comparator: opts.Comparator,
+	}
+}
+
+func (n *Namespace) options() (kvdb.FamilyOptions, error) {
+	if n.TTL < 0 {
+		return kvdb.FamilyOptions{}, errors.New("ttl must be positive")
+	}
+	opts := kvdb.FamilyOptions{TTL: time.Duration(n.TTL) * time.Second, Comparator: n.Comparator}
+	if n.Compaction == "" {
+		return opts, nil
+	}
+	for style, name := range compactionNames {
+		if name == n.Compaction {
+			opts.CompactionStyle = style
+			return opts, nil
+		}
+	}
+	return opts, fmt.Errorf("unknown compaction %q", n.Compaction)
+}
+
+// Handler for GET /v1/ns.  Replies with every Namespace, the default
+// first and the rest in the order they were created.
+func (s *Server) ListNamespaces() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.noNamespaces(w) {
+			return
+		}
+		namespaces := []Namespace{}
+		for _, f := range s.db.Families() {
+			namespaces = append(namespaces, namespaceOf(f))
+		}
+		replyJSON(w, namespaces)
+	}
+}
+
+// Handler for POST /v1/ns.  Creates the Namespace in the body, replying
+// 201 with it as created.  409 if it already exists, 400 if its name or
+// options are not allowed.
+func (s *Server) CreateNamespace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.noNamespaces(w) {
+			return
+		}
+		var body Namespace
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		opts, err := body.options()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f, err := s.db.CreateFamily(body.Name, opts)
+		if err != nil {
+			fmt.Println("CreateFamily failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		replyJSON(w, namespaceOf(f))
+	}
+}
+
+// Handler for DELETE /v1/ns/{namespace}.  Drops the namespace and every
+// key in it, replying 204.  404 if there is no such namespace, 400 for
+// the default one.
+func (s *Server) DropNamespace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.noNamespaces(w) {
+			return
+		}
+		if err := s.db.DropFamily(chi.URLParam(r, "namespace")); err != nil {
+			fmt.Println("DropFamily failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Handler for GET /v1/ns/{namespace}/{key}.  Replies as GetKey does,
+// without an ETag as versions are kept for the default namespace only.
+func (s *Server) GetNamespaceKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.namespace(w, r)
+		if f == nil {
+			return
+		}
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		enc, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		v, info, err := f.GetWithInfo(key)
+		if err != nil {
+			fmt.Println("Get failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		if v == nil {
+			writeError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		writeValue(w, r, enc, key, v, info.ContentType)
+	}
+}
+
+// Handler for PUT /v1/ns/{namespace}/{key}.  The raw request body is the
+// new value and its Content-Type is kept with it.  With ?ttl= the key
+// expires that many seconds after it is written, otherwise after the
+// namespace's TTL if it has one.  Replies 200.
+func (s *Server) PutNamespaceKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.namespace(w, r)
+		if f == nil {
+			return
+		}
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		opts := kvdb.PutOptions{ContentType: r.Header.Get("Content-Type")}
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			n, err := strconv.ParseInt(ttl, 10, 64)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "ttl must be positive")
+				return
+			}
+			opts.TTL = time.Duration(n) * time.Second
+		}
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Println("Bad data ", err)
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := f.PutWithOptions(key, value, opts); err != nil {
+			fmt.Println("Put failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handler for DELETE /v1/ns/{namespace}/{key}.  Replies 204 once the key
+// is deleted and 404 if it does not exist.
+func (s *Server) DeleteNamespaceKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.namespace(w, r)
+		if f == nil {
+			return
+		}
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		info, err := f.Stat(key)
+		if err == nil && info == nil {
+			writeError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		if err == nil {
+			err = f.Delete(key)
+		}
+		if err != nil {
+			fmt.Println("Delete failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
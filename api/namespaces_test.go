@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/shard"
+)
+
+func TestNamespaces(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	defer db.Close()
+
+	status, reply := txnRequest(t, "POST", ts.URL+"/v1/ns", Namespace{Name: "users", TTL: 60, Compaction: "tiered", Comparator: "reverse"})
+	if status != http.StatusCreated || string(reply) != `{"name":"users","ttl":60,"compaction":"tiered","comparator":"reverse"}` {
+		t.Errorf("create replied %d %s", status, reply)
+	}
+	for _, c := range []struct {
+		body   Namespace
+		status int
+	}{
+		{Namespace{Name: "users"}, http.StatusConflict},
+		{Namespace{Name: "a/b"}, http.StatusBadRequest},
+		{Namespace{Name: "x", Compaction: "none"}, http.StatusBadRequest},
+		{Namespace{Name: "x", Comparator: "none"}, http.StatusBadRequest},
+		{Namespace{Name: "x", TTL: -1}, http.StatusBadRequest},
+	} {
+		if status, reply := txnRequest(t, "POST", ts.URL+"/v1/ns", c.body); status != c.status {
+			t.Errorf("create %+v replied %d %s", c.body, status, reply)
+		}
+	}
+
+	status, reply = txnRequest(t, "GET", ts.URL+"/v1/ns", nil)
+	var namespaces []Namespace
+	json.Unmarshal(reply, &namespaces)
+	if status != http.StatusOK || len(namespaces) != 2 || namespaces[0] != (Namespace{"default", 0, "leveled", "bytewise"}) ||
+		namespaces[1].Name != "users" {
+		t.Errorf("list replied %d %s", status, reply)
+	}
+
+	// Keys in a namespace are apart from those in the default one
+	db.Put([]byte("k"), []byte("default"))
+	req, _ := http.NewRequest("PUT", ts.URL+"/v1/ns/users/k", strings.NewReader("users"))
+	req.Header.Set("Content-Type", "text/plain")
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusOK {
+		t.Errorf("PUT replied %d", res.StatusCode)
+	}
+	if status, reply := txnRequest(t, "GET", ts.URL+"/v1/ns/users/k", nil); status != http.StatusOK || string(reply) != "users" {
+		t.Errorf("GET replied %d %s", status, reply)
+	}
+	if v := db.GetString("k"); string(v) != "default" {
+		t.Errorf("default k = %q", v)
+	}
+	info, _ := db.Family("users").Stat([]byte("k"))
+	if info == nil || info.Expires.Sub(info.Timestamp).Seconds() < 60 {
+		t.Errorf("namespace TTL not applied %+v", info)
+	}
+	if status, _ := txnRequest(t, "PUT", ts.URL+"/v1/ns/users/k?ttl=0", nil); status != http.StatusBadRequest {
+		t.Errorf("PUT with ttl=0 replied %d", status)
+	}
+	if status, _ := txnRequest(t, "PUT", ts.URL+"/v1/ns/nope/k", nil); status != http.StatusNotFound {
+		t.Errorf("PUT to a missing namespace replied %d", status)
+	}
+
+	if status, _ := txnRequest(t, "DELETE", ts.URL+"/v1/ns/users/k", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE replied %d", status)
+	}
+	if status, _ := txnRequest(t, "DELETE", ts.URL+"/v1/ns/users/k", nil); status != http.StatusNotFound {
+		t.Errorf("DELETE twice replied %d", status)
+	}
+	if status, _ := txnRequest(t, "GET", ts.URL+"/v1/ns/users/k", nil); status != http.StatusNotFound {
+		t.Errorf("GET after DELETE replied %d", status)
+	}
+
+	if status, _ := txnRequest(t, "DELETE", ts.URL+"/v1/ns/default", nil); status != http.StatusBadRequest {
+		t.Errorf("dropping the default namespace replied %d", status)
+	}
+	if status, _ := txnRequest(t, "DELETE", ts.URL+"/v1/ns/users", nil); status != http.StatusNoContent {
+		t.Errorf("drop replied %d", status)
+	}
+	if status, _ := txnRequest(t, "DELETE", ts.URL+"/v1/ns/users", nil); status != http.StatusNotFound {
+		t.Errorf("drop twice replied %d", status)
+	}
+	if status, _ := txnRequest(t, "GET", ts.URL+"/v1/ns/users/k", nil); status != http.StatusNotFound {
+		t.Errorf("GET from a dropped namespace replied %d", status)
+	}
+}
+
+func TestNamespacesSharded(t *testing.T) {
+	router, _ := shard.InitRouter(&shard.Config{Shards: 2})
+	defer router.Close()
+	ts := httptest.NewServer(InitShardedServer(router).router)
+	defer ts.Close()
+	if status, _ := txnRequest(t, "GET", ts.URL+"/v1/ns", nil); status != http.StatusNotImplemented {
+		t.Errorf("list when sharded replied %d", status)
+	}
+	if status, _ := txnRequest(t, "GET", ts.URL+"/v1/ns/"+kvdb.DefaultFamily+"/k", nil); status != http.StatusNotImplemented {
+		t.Errorf("GET when sharded replied %d", status)
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jlitzingerdev/simple-kv/replication"
+)
+
+// A leader or follower, either can report its status
+type Replicator interface {
+	Status() replication.Status
+}
+
+// Report r's status from GET /v1/admin/replication
+func (s *Server) SetReplication(r Replicator) {
+	s.replication = r
+}
+
+// Handler for GET /v1/admin/replication.  Replies with a
+// replication.Status: for a follower its sequence, the leader's and the
+// lag between them; for a leader its followers and how far behind each
+// is.  A server doing neither has the role "standalone".
+func (s *Server) GetReplication() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := replication.Status{Role: "standalone"}
+		if s.db != nil {
+			st.Sequence = s.db.LastSequence()
+		}
+		if s.replication != nil {
+			st = s.replication.Status()
+		}
+		blob, err := json.Marshal(st)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/replication"
+)
+
+type fixedStatus replication.Status
+
+func (st fixedStatus) Status() replication.Status {
+	return replication.Status(st)
+}
+
+func getReplication(t *testing.T, url string) replication.Status {
+	res, err := http.Get(url + "/v1/admin/replication")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/admin/replication: %v %v", res, err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	var st replication.Status
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		t.Errorf("decoding status: %v", err)
+	}
+	return st
+}
+
+func TestReplicationStatus(t *testing.T) {
+	db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+	defer db.Close()
+	s := InitServer(db)
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	db.Put([]byte("admin"), []byte("1"))
+	if st := getReplication(t, ts.URL); st.Role != "standalone" || st.Sequence != 1 {
+		t.Errorf("standalone status %+v", st)
+	}
+	// A key named admin is still reachable
+	if res, _ := http.Get(ts.URL + "/v1/admin/history"); res.StatusCode != http.StatusOK {
+		t.Errorf("history of admin replied %d", res.StatusCode)
+	}
+
+	s.SetReplication(fixedStatus{Role: replication.RoleFollower, Sequence: 1, LeaderSequence: 5, Lag: 4})
+	if st := getReplication(t, ts.URL); st.Role != "follower" || st.Lag != 4 {
+		t.Errorf("follower status %+v", st)
+	}
+
+	// Writes to a follower are forbidden, reads are served
+	db.SetReadOnly(true)
+	req, _ := http.NewRequest("PUT", ts.URL+"/v1/k", strings.NewReader("v"))
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT on a follower replied %d", res.StatusCode)
+	}
+	res, _ := http.Post(ts.URL+"/v1/batch", "application/json", strings.NewReader(`{"ops":[{"op":"delete","key":"admin"}]}`))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("batch on a follower replied %d", res.StatusCode)
+	}
+	if res, _ := http.Get(ts.URL + "/v1/admin"); res.StatusCode != http.StatusOK {
+		t.Errorf("GET on a follower replied %d", res.StatusCode)
+	}
+}
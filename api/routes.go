@@ -3,34 +3,103 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v4"
 	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/raft"
+	"github.com/jlitzingerdev/simple-kv/shard"
 )
 
 type Server struct {
 	db     *kvdb.Db
 	router *chi.Mux
+
+	// Open transactions by id, see txn.go
+	txns    map[string]*txnSession
+	txnLock sync.Mutex
+
+	// Set on a leader or follower, see replication.go
+	replication Replicator
+
+	// Where writes go, the Db unless in a cluster, see cluster.go
+	writes  Writer
+	cluster *raft.KV
+
+	// Where keys are read from, the Db unless sharded, see shards.go
+	reads  Reader
+	shards *shard.Router
 }
 
-// Handler for GET /v1/{key}.  Returns a JSON object of the form
-// {"key": "value"}.
+// Handler for GET /v1/{key}.  The reply depends on the Accept header.
+// By default it is a JSON object of the form {"key": "value"}, with key
+// and value base64 encoded if ?encoding=base64 is given.  The raw value
+// is returned instead for application/octet-stream, or for the content
+// type the value was put with, and is the default for a value that has
+// one.  The key's version is the ETag.  With ?at= the value the key had
+// at that time is returned instead, without an ETag, see parseAt.
 func (s *Server) GetKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		k := chi.URLParam(r, "key")
-		v := s.db.GetString(strings.TrimSpace(k))
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		enc, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var v []byte
+		info := &kvdb.KeyInfo{}
+		if at := r.URL.Query().Get("at"); at != "" {
+			t, perr := parseAt(at)
+			if perr != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("bad at %q", at))
+				return
+			}
+			v, err = s.reads.GetAt(key, t)
+		} else {
+			v, info, err = s.reads.GetWithInfo(key)
+			if info != nil {
+				w.Header().Set("ETag", versionETag(info.Version))
+			}
+		}
+		if err != nil {
+			fmt.Println("Get failed ", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 		if v == nil {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, http.StatusNotFound, "key not found")
 			return
 		}
+		writeValue(w, r, enc, key, v, info.ContentType)
+	}
+}
 
-		// This is *not* going to work as desired for non
-		// string data
-		body := map[string]string{}
-		body[k] = string(v)
-		blob, err := json.Marshal(body)
+// Reply with the value of key in the representation the Accept header of
+// r asks for, see GetKey
+func writeValue(w http.ResponseWriter, r *http.Request, enc jsonEncoding, key, v []byte, contentType string) {
+	offers := []string{"application/json", "application/octet-stream"}
+	if contentType != "" {
+		offers = append([]string{contentType}, offers...)
+	}
+	switch negotiate(r.Header.Get("Accept"), offers) {
+	case "":
+		writeError(w, http.StatusNotAcceptable, "no acceptable representation")
+	case contentType:
+		w.Header().Set("Content-Type", contentType)
+		w.Write(v)
+	case "application/octet-stream":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(v)
+	default:
+		blob, err := json.Marshal(map[string]string{enc.encode(key): enc.encode(v)})
 		if err != nil {
 			fmt.Println("Failed encoding ", err)
 			return
@@ -40,13 +109,158 @@ func (s *Server) GetKey() http.HandlerFunc {
 	}
 }
 
+// Handler for PUT /v1/{key}.  The raw request body is the new value, and
+// its Content-Type is kept with it for GET.  Replies 201 if the key was
+// created and 200 if it was replaced, either way with the new version as
+// the ETag.  With If-Match or If-None-Match the write
+// is made only if the key's version still satisfies them, otherwise the
+// reply is 412 Precondition Failed.
+func (s *Server) PutKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Println("Bad data ", err)
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		opts := kvdb.PutOptions{ContentType: r.Header.Get("Content-Type")}
+
+		// The write is made against the version the preconditions
+		// were checked on.  If another write gets in between, a
+		// conditional request fails and any other tries again.
+		for {
+			version, conditional, failed, err := s.precondition(r, key)
+			if err == nil && failed {
+				writeError(w, http.StatusPreconditionFailed, "precondition failed")
+				return
+			}
+			var newVersion uint64
+			if err == nil {
+				newVersion, err = s.writes.PutIfVersionWithOptions(key, value, version, opts)
+			}
+			if err == kvdb.ErrVersionMismatch && conditional {
+				writeError(w, http.StatusPreconditionFailed, "precondition failed")
+				return
+			} else if err == kvdb.ErrVersionMismatch {
+				continue
+			} else if err != nil {
+				fmt.Println("Put failed ", err)
+				writeError(w, dbErrorStatus(err), err.Error())
+				return
+			}
+
+			w.Header().Set("ETag", versionETag(newVersion))
+			if version == 0 {
+				w.WriteHeader(http.StatusCreated)
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+	}
+}
+
+// Handler for DELETE /v1/{key}.  Replies 204 once the key is deleted and
+// 404 if it does not exist.  Takes the same preconditions as PUT.
+func (s *Server) DeleteKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		for {
+			version, conditional, failed, err := s.precondition(r, key)
+			if err == nil && failed {
+				writeError(w, http.StatusPreconditionFailed, "precondition failed")
+				return
+			} else if err == nil && version == 0 {
+				writeError(w, http.StatusNotFound, "key not found")
+				return
+			}
+			if err == nil {
+				err = s.writes.DeleteIfVersion(key, version)
+			}
+			if err == kvdb.ErrVersionMismatch && conditional {
+				writeError(w, http.StatusPreconditionFailed, "precondition failed")
+				return
+			} else if err == kvdb.ErrVersionMismatch {
+				continue
+			} else if err != nil {
+				fmt.Println("Delete failed ", err)
+				writeError(w, dbErrorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
+
+// Handler for HEAD /v1/{key}.  Replies with the key's headers but no
+// body: its version as the ETag, the size of its value in X-Value-Size,
+// when it was written in Last-Modified, the content type it was put with
+// if any and, if it has a TTL, when it expires in Expires.
+func (s *Server) HeadKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := urlKey(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		info, err := s.reads.Stat(key)
+		if err != nil {
+			fmt.Println("Stat failed ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if info == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		h := w.Header()
+		h.Set("ETag", versionETag(info.Version))
+		h.Set("X-Value-Size", strconv.Itoa(info.Size))
+		h.Set("Last-Modified", info.Timestamp.UTC().Format(http.TimeFormat))
+		if !info.Expires.IsZero() {
+			h.Set("Expires", info.Expires.UTC().Format(http.TimeFormat))
+		}
+		if info.ContentType != "" {
+			h.Set("Content-Type", info.ContentType)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Body of POST /v1/insert.  When TTL is set the key expires that many
+// seconds after it is written, and ContentType is kept with the value as
+// if it were put with that Content-Type.  Key and value are base64 when
+// Encoding is "base64".
 type PostBody struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	TTL         int64  `json:"ttl,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
 }
 
 func (s *Server) PostKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
 		dec := json.NewDecoder(r.Body)
 
 		var body PostBody
@@ -54,16 +268,114 @@ func (s *Server) PostKey() http.HandlerFunc {
 		err := dec.Decode(&body)
 		if err != nil {
 			fmt.Println("Bad data ", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if body.TTL < 0 {
+			writeError(w, http.StatusBadRequest, "ttl must be positive")
+			return
+		}
+		key, value, err := decodePair(body.Encoding, body.Key, body.Value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = s.writes.PutWithOptions(key, value, kvdb.PutOptions{
+			TTL:         time.Duration(body.TTL) * time.Second,
+			ContentType: body.ContentType,
+		})
+		if err != nil {
+			fmt.Println("Put failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
 			return
 		}
-		fmt.Printf("%s = %s", body.Key, body.Value)
-		s.db.Put([]byte(body.Key), []byte(body.Value))
 		w.WriteHeader(http.StatusOK)
 	}
 
 }
 
+// Decode a key and value sent in a JSON body with the named encoding
+func decodePair(encoding, k, v string) ([]byte, []byte, error) {
+	enc, err := parseEncoding(encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := enc.decode(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := enc.decode(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+type BatchOp struct {
+	// "put" or "delete"
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Keys and values of the ops are base64 when Encoding is "base64"
+type BatchBody struct {
+	Ops      []BatchOp `json:"ops"`
+	Encoding string    `json:"encoding,omitempty"`
+}
+
+// Check and decode the ops of a batch body into batch
+func (body *BatchBody) decode(batch *kvdb.WriteBatch) error {
+	for _, op := range body.Ops {
+		key, value, err := decodePair(body.Encoding, op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "put":
+			batch.Put(key, value)
+		case "delete":
+			batch.Delete(key)
+		default:
+			return fmt.Errorf("unknown op %q", op.Op)
+		}
+	}
+	return nil
+}
+
+// Handler for POST /v1/batch.  Applies every operation in the body
+// atomically, either all of them take effect or none do.
+func (s *Server) PostBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+
+		var body BatchBody
+		err := dec.Decode(&body)
+		if err != nil {
+			fmt.Println("Bad data ", err)
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		batch := kvdb.NewWriteBatch()
+		if err := body.decode(batch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = s.writes.Write(batch)
+		if err != nil {
+			fmt.Println("Write failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 // Start the server, runs until exit is called or program
 // exits
 func (s *Server) StartServer() {
@@ -71,10 +383,52 @@ func (s *Server) StartServer() {
 }
 
 func InitServer(db *kvdb.Db) *Server {
-	s := &Server{db, chi.NewRouter()}
+	return newServer(&Server{db: db, reads: db, writes: localWriter{db}})
+}
+
+// A server whose keys are spread over r's shards
+func InitShardedServer(r *shard.Router) *Server {
+	return newServer(&Server{reads: r, writes: shardWriter{r}, shards: r})
+}
+
+func newServer(s *Server) *Server {
+	s.router = chi.NewRouter()
+	s.txns = map[string]*txnSession{}
+	s.router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	})
+	s.router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
 	s.router.Route("/v1", func(r chi.Router) {
+		r.Get("/scan", s.ScanKeys())
+		r.Get("/watch", s.WatchKeys())
+		r.Get("/admin/replication", s.GetReplication())
+		r.Get("/admin/cluster", s.GetCluster())
+		r.Post("/admin/cluster/members", s.AddMember())
+		r.Delete("/admin/cluster/members/{id}", s.RemoveMember())
+		r.Get("/admin/shards", s.GetShards())
+		r.Post("/admin/shards/split", s.SplitShard())
+		r.Post("/admin/shards/move", s.MoveRange())
+		r.Post("/admin/shards/rebalance", s.RebalanceShards())
+		r.Get("/ns", s.ListNamespaces())
+		r.Post("/ns", s.CreateNamespace())
+		r.Delete("/ns/{namespace}", s.DropNamespace())
+		r.Get("/ns/{namespace}/{key}", s.GetNamespaceKey())
+		r.Put("/ns/{namespace}/{key}", s.PutNamespaceKey())
+		r.Delete("/ns/{namespace}/{key}", s.DeleteNamespaceKey())
 		r.Get("/{key}", s.GetKey())
+		r.Get("/{key}/history", s.GetHistory())
+		r.Put("/{key}", s.PutKey())
+		r.Delete("/{key}", s.DeleteKey())
+		r.Head("/{key}", s.HeadKey())
 		r.Post("/insert", s.PostKey())
+		r.Post("/batch", s.PostBatch())
+		r.Post("/txn", s.BeginTxn())
+		r.Post("/txn/{id}", s.TxnWrite())
+		r.Get("/txn/{id}/{key}", s.TxnGet())
+		r.Post("/txn/{id}/commit", s.CommitTxn())
+		r.Delete("/txn/{id}", s.RollbackTxn())
 	})
 	return s
 }
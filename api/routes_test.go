@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/jlitzingerdev/simple-kv/kvdb"
 )
@@ -15,7 +16,10 @@ import (
 type ReplyBody map[string]string
 
 func configureServer() (*httptest.Server, *kvdb.Db) {
-	db := kvdb.InitDb(&kvdb.DbConfig{})
+	db, err := kvdb.InitDb(&kvdb.DbConfig{})
+	if err != nil {
+		panic(err)
+	}
 	s := InitServer(db)
 	ts := httptest.NewServer(s.router)
 	return ts, db
@@ -93,3 +97,144 @@ func TestPost(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestPostBatch(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	db.Put([]byte("gone"), []byte("x"))
+
+	url := fmt.Sprintf("%s/v1/batch", ts.URL)
+	body := []byte(`{"ops": [
+		{"op": "put", "key": "a", "value": "1"},
+		{"op": "put", "key": "b", "value": "2"},
+		{"op": "delete", "key": "gone"}
+	]}`)
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Failed post: %v", err)
+		t.FailNow()
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("StatusCode != 200")
+		t.FailNow()
+	}
+	if string(db.GetString("a")) != "1" || string(db.GetString("b")) != "2" ||
+		db.GetString("gone") != nil {
+		t.Errorf("batch not applied")
+		t.FailNow()
+	}
+
+	// A bad op rejects the whole batch
+	body = []byte(`{"ops": [
+		{"op": "put", "key": "c", "value": "3"},
+		{"op": "frob", "key": "a"}
+	]}`)
+	res, err = http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("Failed post: %v", err)
+		t.FailNow()
+	}
+	if res.StatusCode != http.StatusBadRequest || db.GetString("c") != nil {
+		t.Errorf("bad batch applied, StatusCode %d", res.StatusCode)
+	}
+}
+
+func TestPostTTL(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+
+	url := fmt.Sprintf("%s/v1/insert", ts.URL)
+	for _, test := range []struct {
+		body   PostBody
+		status int
+	}{
+		{PostBody{Key: "session", Value: "token", TTL: 3600}, http.StatusOK},
+		{PostBody{Key: "bad", Value: "ttl", TTL: -1}, http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(test.body)
+		res, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("Failed post: %v", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%v: StatusCode %d != %d", test.body, res.StatusCode, test.status)
+		}
+	}
+
+	history, _ := db.History([]byte("session"))
+	if len(history) != 1 || string(history[0].Value) != "token" ||
+		history[0].Expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("ttl not set %v", history)
+	}
+	if db.GetString("bad") != nil {
+		t.Errorf("bad ttl stored")
+	}
+}
+
+func TestPutDeleteHead(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	url := ts.URL + "/v1/k"
+
+	for _, expect := range []int{http.StatusCreated, http.StatusOK} {
+		res := conditionalRequest(t, "PUT", url, "raw value", nil)
+		if res.StatusCode != expect || res.Header.Get("ETag") == "" {
+			t.Errorf("PUT %d != %d", res.StatusCode, expect)
+		}
+	}
+	if v := db.GetString("k"); string(v) != "raw value" {
+		t.Errorf("k = %q", v)
+	}
+
+	res := conditionalRequest(t, "HEAD", url, "", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-Value-Size") != "9" ||
+		res.Header.Get("Last-Modified") == "" || res.Header.Get("ETag") == "" ||
+		res.Header.Get("Expires") != "" {
+		t.Errorf("HEAD %d %v", res.StatusCode, res.Header)
+	}
+
+	res = conditionalRequest(t, "DELETE", url, "", nil)
+	if res.StatusCode != http.StatusNoContent || db.GetString("k") != nil {
+		t.Errorf("DELETE %d", res.StatusCode)
+	}
+	for _, method := range []string{"DELETE", "HEAD", "GET"} {
+		if res := conditionalRequest(t, method, url, "", nil); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s of deleted key %d", method, res.StatusCode)
+		}
+	}
+}
+
+// Errors carry a JSON body
+func TestErrorBody(t *testing.T) {
+	ts, _ := configureServer()
+	defer ts.Close()
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/v1/missing", http.StatusNotFound},
+		{"DELETE", "/v1/missing", http.StatusNotFound},
+		{"POST", "/v1/insert", http.StatusBadRequest},
+		{"GET", "/v1/scan?limit=0", http.StatusBadRequest},
+		{"PATCH", "/v1/missing", http.StatusMethodNotAllowed},
+		{"GET", "/v2/missing", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(test.method, ts.URL+test.path, bytes.NewReader([]byte("{")))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed %s: %v", test.method, err)
+			t.FailNow()
+		}
+		reply, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		var body ErrorBody
+		if res.StatusCode != test.status || json.Unmarshal(reply, &body) != nil ||
+			body.Error == "" || res.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: %d %s", test.method, test.path, res.StatusCode, reply)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+
+	// Flush the response every so many lines so large pages stream
+	scanFlushEvery = 100
+)
+
+// A line of a scan response.  Every line but the last holds a key and
+// its value, the last holds the cursor for the next page if any keys
+// remain, or the error that ended the scan early.
+type ScanLine struct {
+	Key    string `json:"key,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The first key after every key beginning with prefix, nil if there is
+// none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Handler for GET /v1/scan.  Streams the keys in [start, end), or those
+// beginning with prefix, in order as JSON lines of ScanLine, at most limit
+// of them.  With encoding=base64 start, end and prefix are given, and keys
+// and values returned, base64 encoded.  When more keys remain the final line carries a cursor, pass
+// it back as cursor with the same range to fetch the next page.
+//
+// Each page uses its own iterator so no state is held between requests.
+// Keys written between pages may or may not be returned.
+func (s *Server) ScanKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		codec, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var start, end []byte
+		if prefix, ok := q["prefix"]; ok {
+			if q.Get("start") != "" || q.Get("end") != "" {
+				writeError(w, http.StatusBadRequest, "prefix cannot be combined with start or end")
+				return
+			}
+			start, err = codec.decode(prefix[0])
+			end = prefixEnd(start)
+		} else {
+			start, err = codec.decode(q.Get("start"))
+			if e := q.Get("end"); e != "" && err == nil {
+				end, err = codec.decode(e)
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		limit := defaultScanLimit
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxScanLimit {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxScanLimit))
+				return
+			}
+			limit = n
+		}
+
+		if c := q.Get("cursor"); c != "" {
+			resume, err := base64.RawURLEncoding.DecodeString(c)
+			if err != nil || bytes.Compare(resume, start) < 0 {
+				writeError(w, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+			start = resume
+		}
+
+		it := s.reads.NewIterator()
+		defer it.Close()
+
+		w.Header().Add("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		n := 0
+		for it.Seek(start); it.Valid(); it.Next() {
+			if end != nil && bytes.Compare(it.Key(), end) >= 0 {
+				break
+			}
+			if n == limit {
+				cursor := base64.RawURLEncoding.EncodeToString(it.Key())
+				enc.Encode(ScanLine{Cursor: cursor})
+				return
+			}
+
+			line := ScanLine{Key: codec.encode(it.Key()), Value: codec.encode(it.Value())}
+			if err := enc.Encode(line); err != nil {
+				fmt.Println("Scan write failed ", err)
+				return
+			}
+			n++
+			if flusher != nil && n%scanFlushEvery == 0 {
+				flusher.Flush()
+			}
+		}
+
+		if err := it.Err(); err != nil {
+			fmt.Println("Scan failed ", err)
+			enc.Encode(ScanLine{Error: err.Error()})
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Fetch one page of a scan, returning its keys and the cursor, if any
+func scanPage(t *testing.T, base string, params url.Values) ([]ScanLine, string) {
+	res, err := http.Get(fmt.Sprintf("%s/v1/scan?%s", base, params.Encode()))
+	if err != nil {
+		t.Errorf("Failed get: %v", err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("StatusCode %d != 200", res.StatusCode)
+		t.FailNow()
+	}
+
+	var lines []ScanLine
+	cursor := ""
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var line ScanLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Errorf("Unmarshal line failed: %v", err)
+			t.FailNow()
+		}
+		if line.Error != "" {
+			t.Errorf("scan failed: %s", line.Error)
+			t.FailNow()
+		} else if line.Cursor != "" {
+			cursor = line.Cursor
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return lines, cursor
+}
+
+func TestScanPaginates(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	for i := 0; i < 250; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	db.Delete([]byte("key100"))
+
+	params := url.Values{"start": {"key050"}, "end": {"key200"}, "limit": {"40"}}
+	var all []ScanLine
+	pages := 0
+	for {
+		lines, cursor := scanPage(t, ts.URL, params)
+		all = append(all, lines...)
+		pages++
+		if cursor == "" {
+			break
+		}
+		params.Set("cursor", cursor)
+	}
+
+	if pages != 4 || len(all) != 149 {
+		t.Errorf("%d keys in %d pages", len(all), pages)
+		t.FailNow()
+	}
+	i := 50
+	for _, line := range all {
+		if i == 100 {
+			i++
+		}
+		if line.Key != fmt.Sprintf("key%03d", i) || line.Value != fmt.Sprintf("v%d", i) {
+			t.Errorf("unexpected line %v at %d", line, i)
+			t.FailNow()
+		}
+		i++
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	for _, k := range []string{"a", "b", "b/1", "b/2", "b0", "c"} {
+		db.Put([]byte(k), []byte("x"))
+	}
+
+	lines, cursor := scanPage(t, ts.URL, url.Values{"prefix": {"b/"}})
+	if cursor != "" || len(lines) != 2 || lines[0].Key != "b/1" || lines[1].Key != "b/2" {
+		t.Errorf("unexpected scan %v %s", lines, cursor)
+		t.FailNow()
+	}
+}
+
+func TestScanBadRequest(t *testing.T) {
+	ts, _ := configureServer()
+	defer ts.Close()
+
+	for _, q := range []string{"limit=0", "limit=x", "prefix=a&start=b", "cursor=!!"} {
+		res, err := http.Get(fmt.Sprintf("%s/v1/scan?%s", ts.URL, q))
+		if err != nil {
+			t.Errorf("Failed get: %v", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: StatusCode %d != 400", q, res.StatusCode)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{"ab": "ac", "a\xff": "b", "\xff\xff": "", "": ""}
+	for prefix, expect := range cases {
+		if end := prefixEnd([]byte(prefix)); string(end) != expect {
+			t.Errorf("prefixEnd(%q) = %q", prefix, end)
+		}
+	}
+}
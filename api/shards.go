@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/shard"
+)
+
+// Where the handlers read keys from: the Db, or a shard.Router sending
+// each key to the shard holding it
+type Reader interface {
+	GetWithInfo(key []byte) ([]byte, *kvdb.KeyInfo, error)
+	GetVersion(key []byte) ([]byte, uint64, error)
+	GetAt(key []byte, t time.Time) ([]byte, error)
+	Stat(key []byte) (*kvdb.KeyInfo, error)
+	History(key []byte) ([]kvdb.Version, error)
+	NewIterator() kvdb.Iterator
+}
+
+// Writes through a shard.Router, which has no transactions
+type shardWriter struct {
+	*shard.Router
+}
+
+func (w shardWriter) CommitTxn(txn *kvdb.Txn) error {
+	return errNotSharded
+}
+
+var errNotSharded = errors.New("not supported by a sharded server")
+
+// Reply 501 on a sharded server, returning whether it replied
+func (s *Server) notSharded(w http.ResponseWriter) bool {
+	if s.shards == nil {
+		return false
+	}
+	writeError(w, http.StatusNotImplemented, errNotSharded.Error())
+	return true
+}
+
+// Reply with v as JSON
+func replyJSON(w http.ResponseWriter, v interface{}) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
+
+// Handler for GET /v1/admin/shards.  Replies with the shard.Map: the
+// ranges in key order, each with the shard holding it and its start and
+// end keys base64 encoded, null at either end of the keyspace.  404 on a
+// server that is not sharded.
+func (s *Server) GetShards() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shards == nil {
+			writeError(w, http.StatusNotFound, "not sharded")
+			return
+		}
+		replyJSON(w, s.shards.Map())
+	}
+}
+
+// Body of POST /v1/admin/shards/split.  Key is base64 when Encoding is
+// "base64".
+type SplitBody struct {
+	Key      string `json:"key"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Handler for POST /v1/admin/shards/split.  Cuts the range holding the
+// key in two at it and replies with the new map.  400 if the key already
+// starts a range.
+func (s *Server) SplitShard() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shards == nil {
+			writeError(w, http.StatusNotFound, "not sharded")
+			return
+		}
+		var body SplitBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		enc, err := parseEncoding(body.Encoding)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key, err := enc.decode(body.Key)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.shards.Split(key); err != nil {
+			fmt.Println("Split failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		replyJSON(w, s.shards.Map())
+	}
+}
+
+// Body of POST /v1/admin/shards/move
+type MoveBody struct {
+	Range uint64 `json:"range"`
+	Shard int    `json:"shard"`
+}
+
+// Handler for POST /v1/admin/shards/move.  Moves a range to a shard,
+// replying with the new map once it is copied.  Writes to the range
+// wait meanwhile.  404 if there is no such range or shard.
+func (s *Server) MoveRange() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shards == nil {
+			writeError(w, http.StatusNotFound, "not sharded")
+			return
+		}
+		var body MoveBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := s.shards.Move(body.Range, body.Shard); err != nil {
+			fmt.Println("Move failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		replyJSON(w, s.shards.Map())
+	}
+}
+
+type RebalanceReply struct {
+	Moved int        `json:"moved"`
+	Map   *shard.Map `json:"map"`
+}
+
+// Handler for POST /v1/admin/shards/rebalance.  Splits and moves ranges
+// until each shard holds about as many keys, see shard.Router.Rebalance,
+// replying with the number of ranges moved and the new map.
+func (s *Server) RebalanceShards() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shards == nil {
+			writeError(w, http.StatusNotFound, "not sharded")
+			return
+		}
+		moved, err := s.shards.Rebalance()
+		if err != nil {
+			fmt.Println("Rebalance failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		replyJSON(w, RebalanceReply{moved, s.shards.Map()})
+	}
+}
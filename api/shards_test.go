@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/shard"
+)
+
+func getShards(t *testing.T, url string) shard.Map {
+	res, err := http.Get(url + "/v1/admin/shards")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/admin/shards: %v %v", res, err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	var m shard.Map
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		t.Errorf("decoding map: %v", err)
+	}
+	return m
+}
+
+func TestShards(t *testing.T) {
+	db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+	defer db.Close()
+	ts := httptest.NewServer(InitServer(db).router)
+	if res, _ := http.Get(ts.URL + "/v1/admin/shards"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("shard map when not sharded replied %d", res.StatusCode)
+	}
+	ts.Close()
+
+	router, _ := shard.InitRouter(&shard.Config{Shards: 2})
+	defer router.Close()
+	ts = httptest.NewServer(InitShardedServer(router).router)
+	defer ts.Close()
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/v1/k%02d", ts.URL, i), strings.NewReader(fmt.Sprint(i)))
+		if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusCreated {
+			t.Errorf("PUT k%02d replied %d", i, res.StatusCode)
+		}
+	}
+
+	res, _ := http.Post(ts.URL+"/v1/admin/shards/split", "application/json", strings.NewReader(`{"key":"k10"}`))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("split replied %d", res.StatusCode)
+	}
+	res, _ = http.Post(ts.URL+"/v1/admin/shards/split", "application/json", strings.NewReader(`{"key":"k10"}`))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("split at a boundary replied %d", res.StatusCode)
+	}
+	m := getShards(t, ts.URL)
+	if len(m.Ranges) != 2 || string(m.Ranges[1].Start) != "k10" {
+		t.Errorf("map after split %+v", m)
+	}
+	body := fmt.Sprintf(`{"range":%d,"shard":1}`, m.Ranges[1].ID)
+	if res, _ := http.Post(ts.URL+"/v1/admin/shards/move", "application/json", strings.NewReader(body)); res.StatusCode != http.StatusOK {
+		t.Errorf("move replied %d", res.StatusCode)
+	}
+	if res, _ := http.Post(ts.URL+"/v1/admin/shards/move", "application/json", strings.NewReader(`{"range":99,"shard":1}`)); res.StatusCode != http.StatusNotFound {
+		t.Errorf("moving a missing range replied %d", res.StatusCode)
+	}
+	if m := getShards(t, ts.URL); m.Ranges[1].Shard != 1 || m.Shards != 2 {
+		t.Errorf("map after move %+v", m)
+	}
+
+	// Reads find keys on either shard, and scans cross them in order
+	if res, _ := http.Get(ts.URL + "/v1/k15"); res.StatusCode != http.StatusOK {
+		t.Errorf("GET k15 replied %d", res.StatusCode)
+	}
+	res, _ = http.Get(ts.URL + "/v1/scan?start=k05&limit=10")
+	scanner := bufio.NewScanner(res.Body)
+	n := 5
+	for scanner.Scan() {
+		var line ScanLine
+		json.Unmarshal(scanner.Bytes(), &line)
+		if line.Cursor != "" {
+			break
+		}
+		if line.Key != fmt.Sprintf("k%02d", n) {
+			t.Errorf("scan line %d: %+v", n, line)
+		}
+		n++
+	}
+	res.Body.Close()
+	if n != 15 {
+		t.Errorf("scan stopped at %d", n)
+	}
+
+	// A batch must stay on one shard
+	res, _ = http.Post(ts.URL+"/v1/batch", "application/json",
+		strings.NewReader(`{"ops":[{"op":"put","key":"k01","value":"x"},{"op":"delete","key":"k02"}]}`))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("batch on one shard replied %d", res.StatusCode)
+	}
+	res, _ = http.Post(ts.URL+"/v1/batch", "application/json",
+		strings.NewReader(`{"ops":[{"op":"put","key":"k01","value":"y"},{"op":"delete","key":"k12"}]}`))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("batch across shards replied %d", res.StatusCode)
+	}
+
+	// Transactions and watches need a single Db
+	if res, _ := http.Post(ts.URL+"/v1/txn", "application/json", nil); res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("POST /v1/txn replied %d", res.StatusCode)
+	}
+	if res, _ := http.Get(ts.URL + "/v1/watch"); res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("GET /v1/watch replied %d", res.StatusCode)
+	}
+
+	res, _ = http.Post(ts.URL+"/v1/admin/shards/rebalance", "", nil)
+	var reply RebalanceReply
+	json.NewDecoder(res.Body).Decode(&reply)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || reply.Map == nil || reply.Map.Version < m.Version {
+		t.Errorf("rebalance replied %d %+v", res.StatusCode, reply)
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v4"
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Sessions idle for longer are rolled back, releasing their snapshot
+const txnIdleTimeout = time.Minute
+
+// A transaction held open between requests
+type txnSession struct {
+	txn      *kvdb.Txn
+	lastUsed time.Time
+
+	// Held while a request uses txn, which is not safe for concurrent
+	// use.  users counts the requests holding or waiting for it, so the
+	// session is not expired from under them, and is guarded by
+	// Server.txnLock.
+	lock  sync.Mutex
+	users int
+}
+
+type TxnReply struct {
+	ID string `json:"id"`
+}
+
+// Roll back sessions idle too long, s.txnLock must be held
+func (s *Server) expireTxns(now time.Time) {
+	for id, session := range s.txns {
+		if session.users == 0 && now.Sub(session.lastUsed) > txnIdleTimeout {
+			session.txn.Rollback()
+			delete(s.txns, id)
+		}
+	}
+}
+
+// Look up the session named in the request, writing a 404 if there is
+// none.  The session is removed if remove is set.  It is returned locked,
+// pass it to releaseTxn once done with it.
+func (s *Server) txnSession(w http.ResponseWriter, r *http.Request, remove bool) *txnSession {
+	s.txnLock.Lock()
+	now := time.Now()
+	s.expireTxns(now)
+
+	id := chi.URLParam(r, "id")
+	session, ok := s.txns[id]
+	if !ok {
+		s.txnLock.Unlock()
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no transaction %q", id))
+		return nil
+	}
+	session.users++
+	if remove {
+		delete(s.txns, id)
+	}
+	s.txnLock.Unlock()
+
+	session.lock.Lock()
+	return session
+}
+
+// Unlock a session returned by txnSession, its idle time starting now
+func (s *Server) releaseTxn(session *txnSession) {
+	session.lock.Unlock()
+	s.txnLock.Lock()
+	session.users--
+	session.lastUsed = time.Now()
+	s.txnLock.Unlock()
+}
+
+// Handler for POST /v1/txn.  Begins a transaction and returns its id as
+// {"id": id}.  The transaction is rolled back if it is left idle for a
+// minute.  Transactions are not offered by a sharded server.
+func (s *Server) BeginTxn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.notSharded(w) {
+			return
+		}
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			fmt.Println("Failed generating id ", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id := hex.EncodeToString(buf[:])
+
+		s.txnLock.Lock()
+		now := time.Now()
+		s.expireTxns(now)
+		s.txns[id] = &txnSession{txn: s.db.Begin(), lastUsed: now}
+		s.txnLock.Unlock()
+
+		blob, err := json.Marshal(TxnReply{id})
+		if err != nil {
+			fmt.Println("Failed encoding ", err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(blob)
+	}
+}
+
+// Handler for GET /v1/txn/{id}/{key}.  Reads key within the transaction,
+// replying like GET /v1/{key} does in JSON.
+func (s *Server) TxnGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		session := s.txnSession(w, r, false)
+		if session == nil {
+			return
+		}
+		defer s.releaseTxn(session)
+		key, err := urlKey(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid key")
+			return
+		}
+		enc, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		v, err := session.txn.Get(key)
+		if err != nil {
+			fmt.Println("Get failed ", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if v == nil {
+			writeError(w, http.StatusNotFound, "key not found")
+			return
+		}
+
+		blob, err := json.Marshal(map[string]string{enc.encode(key): enc.encode(v)})
+		if err != nil {
+			fmt.Println("Failed encoding ", err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
+
+// Handler for POST /v1/txn/{id}.  Buffers the operations of a BatchBody
+// in the transaction, they take effect when it commits.
+func (s *Server) TxnWrite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		var body BatchBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fmt.Println("Bad data ", err)
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		batch := kvdb.NewWriteBatch()
+		if err := body.decode(batch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		session := s.txnSession(w, r, false)
+		if session == nil {
+			return
+		}
+		defer s.releaseTxn(session)
+		if err := session.txn.Write(batch); err != nil {
+			fmt.Println("Write failed ", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handler for POST /v1/txn/{id}/commit.  Replies 409 Conflict if a key
+// the transaction read has changed, in which case nothing is written.
+// The session ends either way.
+func (s *Server) CommitTxn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		session := s.txnSession(w, r, true)
+		if session == nil {
+			return
+		}
+		defer s.releaseTxn(session)
+		err := s.writes.CommitTxn(session.txn)
+		if err == kvdb.ErrConflict {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			fmt.Println("Commit failed ", err)
+			writeError(w, dbErrorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handler for DELETE /v1/txn/{id}.  Rolls the transaction back.
+func (s *Server) RollbackTxn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		session := s.txnSession(w, r, true)
+		if session == nil {
+			return
+		}
+		defer s.releaseTxn(session)
+		session.txn.Rollback()
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func beginTestTxn(t *testing.T, url string) string {
+	res, err := http.Post(url+"/v1/txn", "application/json", nil)
+	if err != nil {
+		t.Errorf("Failed post: %v", err)
+		t.FailNow()
+	}
+	reply, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var data TxnReply
+	if res.StatusCode != http.StatusCreated || json.Unmarshal(reply, &data) != nil || data.ID == "" {
+		t.Errorf("begin failed %d %s", res.StatusCode, reply)
+		t.FailNow()
+	}
+	return data.ID
+}
+
+func txnRequest(t *testing.T, method, url string, body interface{}) (int, []byte) {
+	var blob []byte
+	if body != nil {
+		blob, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewReader(blob))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed %s: %v", method, err)
+		t.FailNow()
+	}
+	reply, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res.StatusCode, reply
+}
+
+func TestTxnSession(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	id := beginTestTxn(t, ts.URL)
+	base := fmt.Sprintf("%s/v1/txn/%s", ts.URL, id)
+	status, reply := txnRequest(t, "GET", base+"/a", nil)
+	if status != http.StatusOK || string(reply) != `{"a":"1"}` {
+		t.Errorf("txn get %d %s", status, reply)
+	}
+	status, _ = txnRequest(t, "POST", base, BatchBody{Ops: []BatchOp{
+		{Op: "put", Key: "a", Value: "2"},
+		{Op: "put", Key: "b", Value: "3"},
+	}})
+	if status != http.StatusOK {
+		t.Errorf("txn write %d", status)
+	}
+	status, reply = txnRequest(t, "GET", base+"/b", nil)
+	if status != http.StatusOK || string(reply) != `{"b":"3"}` {
+		t.Errorf("txn get own write %d %s", status, reply)
+	}
+	if db.GetString("b") != nil {
+		t.Errorf("write visible before commit")
+	}
+
+	status, _ = txnRequest(t, "POST", base+"/commit", nil)
+	if status != http.StatusOK || string(db.GetString("a")) != "2" ||
+		string(db.GetString("b")) != "3" {
+		t.Errorf("commit %d", status)
+	}
+	status, _ = txnRequest(t, "POST", base+"/commit", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("second commit %d", status)
+	}
+}
+
+func TestTxnSessionConflict(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	base := fmt.Sprintf("%s/v1/txn/%s", ts.URL, beginTestTxn(t, ts.URL))
+	txnRequest(t, "GET", base+"/a", nil)
+	txnRequest(t, "POST", base, BatchBody{Ops: []BatchOp{{Op: "put", Key: "a", Value: "txn"}}})
+	db.Put([]byte("a"), []byte("other"))
+
+	status, _ := txnRequest(t, "POST", base+"/commit", nil)
+	if status != http.StatusConflict || string(db.GetString("a")) != "other" {
+		t.Errorf("conflicting commit %d, a = %s", status, db.GetString("a"))
+	}
+
+	base = fmt.Sprintf("%s/v1/txn/%s", ts.URL, beginTestTxn(t, ts.URL))
+	txnRequest(t, "POST", base, BatchBody{Ops: []BatchOp{{Op: "delete", Key: "a"}}})
+	status, _ = txnRequest(t, "DELETE", base, nil)
+	if status != http.StatusOK || string(db.GetString("a")) != "other" {
+		t.Errorf("rollback %d, a = %s", status, db.GetString("a"))
+	}
+	status, _ = txnRequest(t, "POST", base, BatchBody{Ops: []BatchOp{{Op: "bad", Key: "a"}}})
+	if status != http.StatusBadRequest {
+		t.Errorf("bad op %d", status)
+	}
+	status, _ = txnRequest(t, "GET", base+"/a", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("get after rollback %d", status)
+	}
+}
+
+// Requests on one transaction are run one at a time, the Txn not being
+// safe for concurrent use
+func TestTxnSessionConcurrent(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	base := fmt.Sprintf("%s/v1/txn/%s", ts.URL, beginTestTxn(t, ts.URL))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				res, err := http.Get(base + "/a")
+				if err != nil || res.StatusCode != http.StatusOK {
+					t.Errorf("concurrent get %v %v", res, err)
+					return
+				}
+				res.Body.Close()
+				body := fmt.Sprintf(`{"ops":[{"op":"put","key":"k%d-%d","value":"v"}]}`, i, j)
+				res, err = http.Post(base, "application/json", strings.NewReader(body))
+				if err != nil || res.StatusCode != http.StatusOK {
+					t.Errorf("concurrent write %v %v", res, err)
+					return
+				}
+				res.Body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if status, reply := txnRequest(t, "POST", base+"/commit", nil); status != http.StatusOK {
+		t.Errorf("commit %d %s", status, reply)
+	}
+	for i := 0; i < 8; i++ {
+		if db.GetString(fmt.Sprintf("k%d-19", i)) == nil {
+			t.Errorf("k%d-19 missing after commit", i)
+		}
+	}
+}
+
+// A session in use by a request is not expired however long it has been
+func TestTxnExpirySkipsBusySessions(t *testing.T) {
+	db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+	defer db.Close()
+	s := InitServer(db)
+	old := time.Now().Add(-2 * txnIdleTimeout)
+	s.txns["busy"] = &txnSession{txn: db.Begin(), lastUsed: old, users: 1}
+	s.txns["idle"] = &txnSession{txn: db.Begin(), lastUsed: old}
+
+	s.txnLock.Lock()
+	s.expireTxns(time.Now())
+	s.txnLock.Unlock()
+	if s.txns["busy"] == nil || s.txns["idle"] != nil {
+		t.Errorf("sessions after expiry %v", s.txns)
+	}
+}
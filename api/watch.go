@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// How often a comment is sent on an idle watch so proxies keep it open
+const watchKeepAlive = 15 * time.Second
+
+// The data of a watch event
+type WatchEvent struct {
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// The sequence a watch starts from, the one after Last-Event-ID when an
+// EventSource reconnects, otherwise ?from=
+func watchFrom(r *http.Request) (uint64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		return last + 1, err
+	}
+	if from := r.URL.Query().Get("from"); from != "" {
+		return strconv.ParseUint(from, 10, 64)
+	}
+	return 0, nil
+}
+
+// Handler for GET /v1/watch?prefix=.  Streams every change to a key
+// beginning with prefix as Server-Sent Events, a "put" or "delete" event
+// whose id is the change's sequence and whose data is a WatchEvent, with
+// key and value base64 encoded if ?encoding=base64 is given.  With ?from=
+// the stream starts at that sequence rather than with the next change,
+// and a reconnecting EventSource picks up after its Last-Event-ID.
+//
+// A client that falls too far behind is sent an "error" event and the
+// stream ends, reconnecting resumes it.  If the changes it would resume
+// from are no longer kept the reply is 410 Gone, and the client should
+// read the keys afresh before watching again.  Watches are not offered
+// by a sharded server.
+func (s *Server) WatchKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.notSharded(w) {
+			return
+		}
+		codec, err := queryEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		prefix, err := codec.decode(r.URL.Query().Get("prefix"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		from, err := watchFrom(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid sequence")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+
+		watcher, err := s.db.Watch(prefix, from)
+		if err == kvdb.ErrWatchCompacted {
+			writeError(w, http.StatusGone, err.Error())
+			return
+		} else if err != nil {
+			fmt.Println("Watch failed ", err)
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer watcher.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case e, ok := <-watcher.Events():
+				if !ok {
+					blob, _ := json.Marshal(ErrorBody{watcher.Err().Error()})
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", blob)
+					flusher.Flush()
+					return
+				}
+				blob, err := json.Marshal(WatchEvent{
+					Type:      e.Type.String(),
+					Key:       codec.encode(e.Key),
+					Value:     codec.encode(e.Value),
+					Sequence:  e.Sequence,
+					Timestamp: e.Timestamp.UTC(),
+				})
+				if err != nil {
+					fmt.Println("Failed encoding ", err)
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %v\ndata: %s\n\n", e.Sequence, e.Type, blob)
+			}
+			// Send everything already waiting before flushing
+			if len(watcher.Events()) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
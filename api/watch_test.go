@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// Read events from an event stream, skipping comments
+func readEvents(t *testing.T, r *bufio.Reader, n int) []sseEvent {
+	events := []sseEvent{}
+	var e sseEvent
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Errorf("reading events: %v", err)
+			t.FailNow()
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e != (sseEvent{}) {
+				events = append(events, e)
+			}
+			e = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+	return events
+}
+
+func watchRequest(t *testing.T, url string, header http.Header) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("watch failed: %v", err)
+		t.FailNow()
+	}
+	return res
+}
+
+func TestWatchEvents(t *testing.T) {
+	ts, db := configureServer()
+	defer ts.Close()
+
+	res := watchRequest(t, ts.URL+"/v1/watch?prefix=config/", nil)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("watch replied %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		t.FailNow()
+	}
+
+	db.Put([]byte("config/a"), []byte("1"))
+	db.Put([]byte("other"), []byte("2"))
+	db.Delete([]byte("config/a"))
+
+	events := readEvents(t, bufio.NewReader(res.Body), 2)
+	var put, del WatchEvent
+	json.Unmarshal([]byte(events[0].data), &put)
+	json.Unmarshal([]byte(events[1].data), &del)
+	if events[0].event != "put" || put.Type != "put" || put.Key != "config/a" || put.Value != "1" ||
+		events[0].id != "1" || put.Sequence != 1 || put.Timestamp.IsZero() {
+		t.Errorf("first event %v %v", events[0], put)
+	}
+	if events[1].event != "delete" || del.Key != "config/a" || del.Value != "" || events[1].id != "3" {
+		t.Errorf("second event %v %v", events[1], del)
+	}
+
+	// Reconnecting after the first event replays the second
+	again := watchRequest(t, ts.URL+"/v1/watch?prefix=config/", http.Header{"Last-Event-ID": {"1"}})
+	defer again.Body.Close()
+	if events := readEvents(t, bufio.NewReader(again.Body), 1); events[0].id != "3" {
+		t.Errorf("resumed at %v", events[0])
+	}
+
+	// So does ?from=, here with base64 keys
+	from := watchRequest(t, ts.URL+"/v1/watch?prefix=Y29uZmln&encoding=base64&from=2", nil)
+	defer from.Body.Close()
+	if events := readEvents(t, bufio.NewReader(from.Body), 1); !strings.Contains(events[0].data, `"key":"Y29uZmlnL2E="`) {
+		t.Errorf("base64 watch from 2 got %v", events[0])
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	db, _ := kvdb.InitDb(&kvdb.DbConfig{WatchHistory: 1, WatchBufferSize: 1})
+	defer db.Close()
+	s := InitServer(db)
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("a"), []byte("2"))
+	res := watchRequest(t, ts.URL+"/v1/watch?from=1", nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("watch from a dropped sequence replied %d", res.StatusCode)
+	}
+	for _, query := range []string{"from=x", "encoding=bogus", "prefix=!&encoding=base64"} {
+		res := watchRequest(t, ts.URL+"/v1/watch?"+query, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s replied %d", query, res.StatusCode)
+		}
+	}
+
+	// A watcher that falls behind is told so.  Large values fill the
+	// connection's buffers while the client is not reading.
+	res = watchRequest(t, ts.URL+"/v1/watch?from=2", nil)
+	defer res.Body.Close()
+	value := bytes.Repeat([]byte("v"), 256<<10)
+	for i := 0; i < 200; i++ {
+		db.Put([]byte("a"), value)
+	}
+	r := bufio.NewReader(res.Body)
+	for {
+		e := readEvents(t, r, 1)[0]
+		if e.event == "error" {
+			if !strings.Contains(e.data, kvdb.ErrWatchOverflow.Error()) {
+				t.Errorf("error event %v", e)
+			}
+			break
+		}
+	}
+}
@@ -1,5 +1,17 @@
 module github.com/jlitzingerdev/simple-kv
 
-go 1.13
+go 1.18
 
-require github.com/go-chi/chi/v4 v4.0.0-rc1
+require (
+	github.com/go-chi/chi/v4 v4.0.0-rc1
+	google.golang.org/grpc v1.57.1
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
+)
@@ -0,0 +1,150 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Write batches.  A batch collects puts and deletes that Db.Write logs as
+// a single write-ahead log record and applies under one acquisition of the
+// database lock, so a crash or a concurrent reader sees either all of the
+// batch or none of it.
+//
+// The batch is logged as a record of type walRecordBatch with an empty
+// key, its value holding the operations:
+//
+//   count uvarint
+//   then count times
+//   type   1 byte, walRecordPut or walRecordDelete
+//   family uvarint, only if walRecordFamily is set in type
+//   key    uvarint length, key
+//   value  uvarint length, value, empty for deletes
+//
+// An operation on the default column family has no family.
+
+package kvdb
+
+type WriteBatch struct {
+	ops []walRecord
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Add a put of key to the batch.  key and value are copied, so the caller
+// may reuse them.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.put(0, key, value)
+}
+
+// Add a put of key in family f to the batch
+func (b *WriteBatch) PutIn(f *Family, key, value []byte) {
+	b.put(f.id, key, value)
+}
+
+func (b *WriteBatch) put(family uint64, key, value []byte) {
+	b.ops = append(b.ops, walRecord{
+		walRecordPut,
+		append([]byte{}, key...),
+		append([]byte{}, value...),
+		0,
+		0,
+		"",
+		family,
+	})
+}
+
+// Add a delete of key to the batch
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, walRecord{walRecordDelete, append([]byte{}, key...), nil, 0, 0, "", 0})
+}
+
+// Add a delete of key in family f to the batch
+func (b *WriteBatch) DeleteIn(f *Family, key []byte) {
+	b.ops = append(b.ops, walRecord{walRecordDelete, append([]byte{}, key...), nil, 0, 0, "", f.id})
+}
+
+// The number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// The keys the batch writes, in the order they were added
+func (b *WriteBatch) Keys() [][]byte {
+	keys := make([][]byte, len(b.ops))
+	for i, op := range b.ops {
+		keys[i] = op.key
+	}
+	return keys
+}
+
+// Empty the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+func encodeBatch(ops []walRecord) []byte {
+	buf := appendUvarint(nil, uint64(len(ops)))
+	for _, op := range ops {
+		if op.family != 0 {
+			buf = append(buf, op.kind|walRecordFamily)
+			buf = appendUvarint(buf, op.family)
+		} else {
+			buf = append(buf, op.kind)
+		}
+		buf = appendBytes(buf, op.key)
+		buf = appendBytes(buf, op.value)
+	}
+	return buf
+}
+
+func decodeBatch(payload []byte) ([]walRecord, error) {
+	r := &blockReader{buf: payload}
+	count := r.uvarint()
+	if r.err != nil || count > uint64(len(payload)) {
+		return nil, errCorruptRecord
+	}
+
+	ops := make([]walRecord, 0, count)
+	for i := uint64(0); i < count; i++ {
+		kind := r.bytes(1)
+		if r.err != nil {
+			return nil, errCorruptRecord
+		}
+		var family uint64
+		op := kind[0] &^ walRecordFamily
+		if kind[0]&walRecordFamily != 0 {
+			family = r.uvarint()
+		}
+		key := r.lengthPrefixed()
+		value := r.lengthPrefixed()
+		if r.err != nil || (op != walRecordPut && op != walRecordDelete) {
+			return nil, errCorruptRecord
+		}
+		ops = append(ops, walRecord{op, key, value, 0, 0, "", family})
+	}
+	if !r.done() || r.err != nil {
+		return nil, errCorruptRecord
+	}
+	return ops, nil
+}
+
+// Apply every operation in batch atomically.  Operations are applied in
+// the order they were added, so a later operation on a key wins.
+// Returns ErrNoFamily, writing nothing, if one is to a family since
+// dropped.
+func (db *Db) Write(batch *WriteBatch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if batch.Len() == 0 {
+		if db.closed {
+			return ErrClosed
+		}
+		return nil
+	}
+	for _, op := range batch.ops {
+		if db.families[op.family] == nil {
+			return ErrNoFamily
+		}
+	}
+	return db.write(&walRecord{walRecordBatch, nil, encodeBatch(batch.ops), 0, 0, "", 0})
+}
@@ -0,0 +1,133 @@
+// Whitebox tests for batch.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir}
+
+	db := openCompactionDb(t, config)
+	db.Put([]byte("c"), []byte("old"))
+
+	b := NewWriteBatch()
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Delete([]byte("c"))
+	b.Put([]byte("a"), []byte("3"))
+	if b.Len() != 4 {
+		t.Errorf("b.Len() != 4")
+		t.FailNow()
+	}
+	if keys := b.Keys(); len(keys) != 4 || string(keys[2]) != "c" || string(keys[3]) != "a" {
+		t.Errorf("b.Keys() = %q", keys)
+	}
+	if err := db.Write(b); err != nil {
+		t.Errorf("Write failed: %v", err)
+		t.FailNow()
+	}
+
+	check := func() {
+		if string(db.GetString("a")) != "3" || string(db.GetString("b")) != "2" ||
+			db.GetString("c") != nil {
+			t.Errorf("batch not applied")
+			t.FailNow()
+		}
+	}
+	check()
+	db.Close()
+
+	db = openCompactionDb(t, config)
+	defer db.Close()
+	check()
+
+	b.Reset()
+	if b.Len() != 0 || db.Write(b) != nil {
+		t.Errorf("empty batch failed")
+	}
+}
+
+func TestWriteBatchCopiesKeys(t *testing.T) {
+	db := openCompactionDb(t, &DbConfig{})
+	defer db.Close()
+
+	key := []byte("a")
+	b := NewWriteBatch()
+	b.Put(key, []byte("1"))
+	key[0] = 'z'
+	db.Write(b)
+
+	if string(db.GetString("a")) != "1" || db.GetString("z") != nil {
+		t.Errorf("batch did not copy its key")
+	}
+}
+
+// A reader never sees some of a batch without the rest
+func TestWriteBatchAtomic(t *testing.T) {
+	db := openCompactionDb(t, &DbConfig{})
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := NewWriteBatch()
+		for i := 0; i < 1000; i++ {
+			b.Reset()
+			v := []byte(fmt.Sprintf("%d", i))
+			b.Put([]byte("x"), v)
+			b.Put([]byte("y"), v)
+			db.Write(b)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		db.lock.Lock()
+		x, y := db.defaultFamily().mem.Get([]byte("x")), db.defaultFamily().mem.Get([]byte("y"))
+		db.lock.Unlock()
+		if string(x) != string(y) {
+			t.Errorf("partial batch seen: %s %s", x, y)
+			t.FailNow()
+		}
+	}
+	wg.Wait()
+}
+
+func TestDecodeBatchCorrupt(t *testing.T) {
+	ops := []walRecord{
+		{walRecordPut, []byte("a"), []byte("1"), 0, 0, "", 0},
+		{walRecordDelete, []byte("b"), nil, 0, 0, "", 0},
+	}
+	payload := encodeBatch(ops)
+	decoded, err := decodeBatch(payload)
+	if err != nil || len(decoded) != 2 || string(decoded[0].value) != "1" ||
+		decoded[1].kind != walRecordDelete {
+		t.Errorf("round trip failed: %v %v", decoded, err)
+		t.FailNow()
+	}
+
+	for i := 0; i < len(payload); i++ {
+		if _, err := decodeBatch(payload[:i]); err != errCorruptRecord {
+			t.Errorf("truncated to %d decoded: %v", i, err)
+		}
+	}
+	bad := append([]byte{}, payload...)
+	bad[1] = 7
+	if _, err := decodeBatch(bad); err != errCorruptRecord {
+		t.Errorf("bad kind decoded")
+	}
+	if _, err := decodeWalRecord(walRecordBatch, append(appendBytes(nil, nil), encodeBatch(nil)...)); err != nil {
+		t.Errorf("empty batch record: %v", err)
+	}
+	if _, err := decodeWalRecord(walRecordBatch, append(appendBytes(nil, nil), 5)); err != errCorruptRecord {
+		t.Errorf("corrupt batch record accepted")
+	}
+}
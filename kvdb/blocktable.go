@@ -0,0 +1,547 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Binary block based table format.  A table is laid out as:
+//
+//   data block 0
+//   ...
+//   data block n
+//   index block
+//   meta block
+//   footer
+//
+// Every block is followed by a 4 byte castagnoli crc32 of its contents.
+//
+// Data blocks hold entries in key order, each key stored as the length of
+// the prefix it shares with the previous key in the block and the
+// remaining suffix:
+//
+//   shared uvarint, unshared uvarint, value length uvarint,
+//   timestamp varint, sequence uvarint, flags byte,
+//   expires varint if flags has entryFlagExpires,
+//   content type length uvarint and content type if flags has
+//   entryFlagContentType, key suffix, value
+//
+// Version 1 tables have no sequence, their entries read as sequence 0.
+// Tables before version 3 never set entryFlagExpires, nor before version 4
+// entryFlagContentType.
+// A key with several versions may span blocks, the index points at the
+// first block holding it.
+//
+// The index block holds one entry per data block, the last key in the
+// block and where to find it, so a lookup reads exactly one data block:
+//
+//   key length uvarint, key, offset uvarint, size uvarint
+//
+// The meta block describes the whole table:
+//
+//   entry count uvarint, smallest key length uvarint, smallest key,
+//   largest key length uvarint, largest key, min timestamp varint,
+//   max timestamp varint, level uvarint, newest uvarint,
+//   bloom filter length uvarint, bloom filter
+//
+// The bloom filter is empty when filters are disabled.
+//
+// The footer is fixed size and little endian:
+//
+//   index offset 8, index size 8, meta offset 8, meta size 8,
+//   version 4, magic 8
+
+package kvdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	blockMagic           uint64 = 0x766b656c706d6973 // "simplekv"
+	blockVersion         uint32 = 4
+	blockFooterSize             = 44
+	defaultBlockSize            = 4096
+	entryFlagTombstone   byte   = 1
+	entryFlagExpires     byte   = 2
+	entryFlagContentType byte   = 4
+)
+
+var errCorruptTable = errors.New("kvdb: corrupt table")
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// Sequential decoder for the varint encoded blocks, the first failure
+// is sticky and reported by err.
+type blockReader struct {
+	buf []byte
+	err error
+}
+
+func (r *blockReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errCorruptTable
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *blockReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errCorruptTable
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *blockReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errCorruptTable
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *blockReader) lengthPrefixed() []byte {
+	return r.bytes(r.uvarint())
+}
+
+func (r *blockReader) done() bool {
+	return r.err != nil || len(r.buf) == 0
+}
+
+type blockBuilder struct {
+	w          *bufio.Writer
+	blockSize  int
+	bitsPerKey int
+	offset     uint64
+	block      []byte
+	lastKey    []byte
+	index      []byte
+	hashes     []uint64
+	meta       tableMeta
+}
+
+func newBlockBuilder(w io.Writer, config *DbConfig, level int, newest uint64) *blockBuilder {
+	blockSize := config.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	b := &blockBuilder{
+		w:          bufio.NewWriter(w),
+		blockSize:  blockSize,
+		bitsPerKey: config.BloomBitsPerKey,
+	}
+	b.meta.level = level
+	b.meta.newest = newest
+	return b
+}
+
+func (b *blockBuilder) add(e *tableEntry) error {
+	shared := 0
+	if len(b.block) > 0 {
+		shared = sharedPrefixLen(b.lastKey, e.Key)
+	}
+
+	var flags byte
+	if e.Tombstone {
+		flags |= entryFlagTombstone
+	}
+	if e.Expires > 0 {
+		flags |= entryFlagExpires
+	}
+	if e.ContentType != "" {
+		flags |= entryFlagContentType
+	}
+
+	b.block = appendUvarint(b.block, uint64(shared))
+	b.block = appendUvarint(b.block, uint64(len(e.Key)-shared))
+	b.block = appendUvarint(b.block, uint64(len(e.Value)))
+	b.block = appendVarint(b.block, e.Timestamp)
+	b.block = appendUvarint(b.block, e.Sequence)
+	b.block = append(b.block, flags)
+	if e.Expires > 0 {
+		b.block = appendVarint(b.block, e.Expires)
+	}
+	if e.ContentType != "" {
+		b.block = appendBytes(b.block, []byte(e.ContentType))
+	}
+	b.block = append(b.block, e.Key[shared:]...)
+	b.block = append(b.block, e.Value...)
+	b.lastKey = append(b.lastKey[:0], e.Key...)
+	b.meta.addEntry(e)
+	if b.bitsPerKey > 0 {
+		b.hashes = append(b.hashes, bloomHash(e.Key))
+	}
+
+	if len(b.block) >= b.blockSize {
+		return b.flushBlock()
+	}
+	return nil
+}
+
+func (b *blockBuilder) writeBlock(data []byte) (blockHandle, error) {
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(data, crcTable))
+	h := blockHandle{b.offset, uint64(len(data))}
+	if _, err := b.w.Write(data); err != nil {
+		return h, err
+	}
+	if _, err := b.w.Write(sum[:]); err != nil {
+		return h, err
+	}
+	b.offset += uint64(len(data)) + 4
+	return h, nil
+}
+
+func (b *blockBuilder) flushBlock() error {
+	h, err := b.writeBlock(b.block)
+	if err != nil {
+		return err
+	}
+	b.index = appendBytes(b.index, b.lastKey)
+	b.index = appendUvarint(b.index, h.offset)
+	b.index = appendUvarint(b.index, h.size)
+	b.block = b.block[:0]
+	return nil
+}
+
+func (b *blockBuilder) finish() error {
+	if len(b.block) > 0 {
+		if err := b.flushBlock(); err != nil {
+			return err
+		}
+	}
+	index, err := b.writeBlock(b.index)
+	if err != nil {
+		return err
+	}
+
+	meta := appendUvarint(nil, b.meta.count)
+	meta = appendBytes(meta, b.meta.smallest)
+	meta = appendBytes(meta, b.meta.largest)
+	meta = appendVarint(meta, b.meta.minTimestamp)
+	meta = appendVarint(meta, b.meta.maxTimestamp)
+	meta = appendUvarint(meta, uint64(b.meta.level))
+	meta = appendUvarint(meta, b.meta.newest)
+	if b.bitsPerKey > 0 {
+		b.meta.filter = newBloomFilter(b.hashes, b.bitsPerKey)
+	}
+	meta = appendBytes(meta, b.meta.filter)
+	metaHandle, err := b.writeBlock(meta)
+	if err != nil {
+		return err
+	}
+
+	var footer [blockFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], index.offset)
+	binary.LittleEndian.PutUint64(footer[8:], index.size)
+	binary.LittleEndian.PutUint64(footer[16:], metaHandle.offset)
+	binary.LittleEndian.PutUint64(footer[24:], metaHandle.size)
+	binary.LittleEndian.PutUint32(footer[32:], blockVersion)
+	binary.LittleEndian.PutUint64(footer[36:], blockMagic)
+	if _, err := b.w.Write(footer[:]); err != nil {
+		return err
+	}
+	return b.w.Flush()
+}
+
+type indexEntry struct {
+	lastKey []byte
+	handle  blockHandle
+}
+
+type blockTable struct {
+	number   uint64
+	version  uint32
+	f        *os.File
+	fileSize int64
+	index    []indexEntry
+	info     tableMeta
+}
+
+func readFooter(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < blockFooterSize {
+		return nil, nil
+	}
+
+	footer := make([]byte, blockFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-blockFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[36:]) != blockMagic {
+		return nil, nil
+	}
+	return footer, nil
+}
+
+func hasBlockFooter(f *os.File) (bool, error) {
+	footer, err := readFooter(f)
+	return footer != nil, err
+}
+
+func readBlock(f *os.File, h blockHandle) ([]byte, error) {
+	buf := make([]byte, h.size+4)
+	if _, err := f.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	data := buf[:h.size]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(buf[h.size:]) {
+		return nil, errCorruptTable
+	}
+	return data, nil
+}
+
+// Open a block table, reading its index and meta blocks into memory.
+// The table takes ownership of f.
+func openBlockTable(f *os.File, number uint64) (*blockTable, error) {
+	t, err := loadBlockTable(f, number)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func loadBlockTable(f *os.File, number uint64) (*blockTable, error) {
+	footer, err := readFooter(f)
+	if err != nil {
+		return nil, err
+	}
+	if footer == nil {
+		return nil, errCorruptTable
+	}
+	version := binary.LittleEndian.Uint32(footer[32:])
+	if version < 1 || version > blockVersion {
+		return nil, errCorruptTable
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := &blockTable{number: number, version: version, f: f, fileSize: info.Size()}
+
+	index, err := readBlock(f, blockHandle{
+		binary.LittleEndian.Uint64(footer[0:]),
+		binary.LittleEndian.Uint64(footer[8:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &blockReader{buf: index}
+	for !r.done() {
+		key := r.lengthPrefixed()
+		h := blockHandle{r.uvarint(), r.uvarint()}
+		t.index = append(t.index, indexEntry{key, h})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	meta, err := readBlock(f, blockHandle{
+		binary.LittleEndian.Uint64(footer[16:]),
+		binary.LittleEndian.Uint64(footer[24:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	r = &blockReader{buf: meta}
+	t.info.count = r.uvarint()
+	t.info.smallest = r.lengthPrefixed()
+	t.info.largest = r.lengthPrefixed()
+	t.info.minTimestamp = r.varint()
+	t.info.maxTimestamp = r.varint()
+	t.info.level = int(r.uvarint())
+	t.info.newest = r.uvarint()
+	t.info.filter = r.lengthPrefixed()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return t, nil
+}
+
+func (t *blockTable) fileNumber() uint64 {
+	return t.number
+}
+
+func (t *blockTable) meta() *tableMeta {
+	return &t.info
+}
+
+func (t *blockTable) size() int64 {
+	return t.fileSize
+}
+
+// Decode every entry of data block i
+func (t *blockTable) readEntries(i int) ([]tableEntry, error) {
+	data, err := readBlock(t.f, t.index[i].handle)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []tableEntry{}
+	var key []byte
+	r := &blockReader{buf: data}
+	for !r.done() {
+		shared := r.uvarint()
+		unshared := r.uvarint()
+		vlen := r.uvarint()
+		ts := r.varint()
+		var seq uint64
+		if t.version >= 2 {
+			seq = r.uvarint()
+		}
+		flags := r.bytes(1)
+		var expires int64
+		if r.err == nil && flags[0]&entryFlagExpires != 0 {
+			expires = r.varint()
+		}
+		var contentType []byte
+		if r.err == nil && flags[0]&entryFlagContentType != 0 {
+			contentType = r.lengthPrefixed()
+		}
+		suffix := r.bytes(unshared)
+		value := r.bytes(vlen)
+		if r.err != nil || shared > uint64(len(key)) {
+			return nil, errCorruptTable
+		}
+
+		key = append(key[:shared:shared], suffix...)
+		entries = append(entries, tableEntry{key, value, ts,
+			flags[0]&entryFlagTombstone != 0, seq, expires, string(contentType)})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return entries, nil
+}
+
+func (t *blockTable) get(key []byte, sequence uint64) (*tableEntry, error) {
+	return findVersion(t.iterator(), key, sequence)
+}
+
+func (t *blockTable) iterator() tableIterator {
+	return &blockIterator{t: t}
+}
+
+func (t *blockTable) close() error {
+	return t.f.Close()
+}
+
+// Walks the data blocks, decoding one block at a time
+type blockIterator struct {
+	t       *blockTable
+	block   int
+	entries []tableEntry
+	pos     int
+	e       error
+}
+
+// Decode block i, leaving the iterator invalid if it does not exist
+func (it *blockIterator) load(i int) bool {
+	it.block = i
+	it.entries = nil
+	if i < 0 || i >= len(it.t.index) || it.e != nil {
+		return false
+	}
+	it.entries, it.e = it.t.readEntries(i)
+	return it.e == nil
+}
+
+func (it *blockIterator) seekToFirst() {
+	it.load(0)
+	it.pos = 0
+}
+
+func (it *blockIterator) seekToLast() {
+	it.load(len(it.t.index) - 1)
+	it.pos = len(it.entries) - 1
+}
+
+func (it *blockIterator) seek(key []byte) {
+	i := sort.Search(len(it.t.index), func(i int) bool {
+		return it.t.info.cmp.Compare(it.t.index[i].lastKey, key) >= 0
+	})
+	it.load(i)
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.t.info.cmp.Compare(it.entries[i].Key, key) >= 0
+	})
+}
+
+func (it *blockIterator) next() {
+	it.pos++
+	if it.pos >= len(it.entries) && it.load(it.block+1) {
+		it.pos = 0
+	}
+}
+
+func (it *blockIterator) prev() {
+	it.pos--
+	if it.pos < 0 && it.load(it.block-1) {
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *blockIterator) valid() bool {
+	return it.e == nil && it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *blockIterator) entry() *tableEntry {
+	return &it.entries[it.pos]
+}
+
+func (it *blockIterator) err() error {
+	return it.e
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Bloom filters.  Every table carries a filter over its keys so a lookup
+// for a key the table does not hold can usually skip it without reading
+// a data block.  The filter is a bit array followed by one byte holding
+// the number of probes, k.  Probe positions are derived from a single
+// 64 bit hash by double hashing.
+
+package kvdb
+
+import (
+	"hash/fnv"
+)
+
+const defaultBloomBitsPerKey = 10
+
+type bloomFilter []byte
+
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	// ln(2) * bits per key probes minimizes the false positive rate
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	bits := len(hashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	nbytes := (bits + 7) / 8
+	bits = nbytes * 8
+
+	filter := make(bloomFilter, nbytes+1)
+	filter[nbytes] = byte(k)
+	for _, h := range hashes {
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := 0; i < k; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	return filter
+}
+
+// Whether the filter's set may contain key.  An empty filter may contain
+// anything.
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		pos := (h1 + uint32(i)*h2) % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type BloomStats struct {
+	// Tables whose filter was checked during a lookup
+	Checks int64
+
+	// Lookups the filter ruled out, skipping the table
+	Negatives int64
+
+	// Lookups the filter allowed that the table did not hold
+	FalsePositives int64
+}
+
+// The fraction of lookups for absent keys the filters failed to rule out
+func (s BloomStats) FalsePositiveRate() float64 {
+	absent := s.Negatives + s.FalsePositives
+	if absent == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(absent)
+}
@@ -0,0 +1,143 @@
+// Whitebox tests for bloom.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBloomNoFalseNegatives(t *testing.T) {
+	hashes := []uint64{}
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key%d", i))))
+	}
+	f := newBloomFilter(hashes, 10)
+
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain([]byte(fmt.Sprintf("key%d", i))) {
+			t.Errorf("key%d missing from filter", i)
+			t.FailNow()
+		}
+	}
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	hashes := []uint64{}
+	for i := 0; i < 10000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key%d", i))))
+	}
+	f := newBloomFilter(hashes, 10)
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain([]byte(fmt.Sprintf("absent%d", i))) {
+			positives++
+		}
+	}
+
+	// 10 bits per key should be close to 1%
+	if positives > 300 {
+		t.Errorf("false positive rate too high: %d/10000", positives)
+	}
+}
+
+func TestBloomEmpty(t *testing.T) {
+	var f bloomFilter
+	if !f.mayContain([]byte("a")) {
+		t.Errorf("empty filter must allow every key")
+	}
+}
+
+func testTableFilter(t *testing.T, config *DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	tree := NewTree()
+	for i := 0; i < 100; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%d", i)), []byte("foo"))
+	}
+
+	tbl := writeTestTable(t, dir, config, tree)
+	defer tbl.close()
+
+	f := tbl.meta().filter
+	if len(f) == 0 {
+		t.Errorf("filter not persisted")
+		t.FailNow()
+	}
+
+	for i := 0; i < 100; i++ {
+		if !f.mayContain([]byte(fmt.Sprintf("key%d", i))) {
+			t.Errorf("key%d missing from filter", i)
+			t.FailNow()
+		}
+	}
+}
+
+func TestJSONTableFilter(t *testing.T) {
+	testTableFilter(t, &DbConfig{BloomBitsPerKey: 10})
+}
+
+func TestBlockTableFilter(t *testing.T) {
+	testTableFilter(t, &DbConfig{BloomBitsPerKey: 10, TableFormat: TableFormatBlock})
+}
+
+func TestDbBloomStats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db, err := InitDb(&DbConfig{Dir: dir, TableFormat: TableFormatBlock})
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("foo"))
+	}
+	db.Flush()
+
+	for i := 0; i < 100; i++ {
+		db.Get([]byte(fmt.Sprintf("absent%d", i)))
+	}
+
+	stats := db.BloomStats()
+	if stats.Checks != 100 {
+		t.Errorf("stats.Checks != 100: %d", stats.Checks)
+	}
+
+	if stats.Negatives+stats.FalsePositives != 100 || stats.Negatives < 90 {
+		t.Errorf("filters not used %+v", stats)
+	}
+
+	if stats.FalsePositiveRate() > 0.1 {
+		t.Errorf("false positive rate too high %v", stats.FalsePositiveRate())
+	}
+}
+
+func TestDbBloomDisabled(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db, err := InitDb(&DbConfig{Dir: dir, BloomBitsPerKey: -1})
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("foo"))
+	db.Flush()
+	db.Get([]byte("b"))
+
+	if db.BloomStats().Checks != 0 {
+		t.Errorf("disabled filter was checked")
+	}
+	if v, _ := db.Get([]byte("a")); string(v) != "foo" {
+		t.Errorf("v != foo")
+	}
+}
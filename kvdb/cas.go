@@ -0,0 +1,135 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Conditional writes.  The version of a key is the sequence of the
+// mutation that wrote its current value, 0 when the key does not exist,
+// so any write to the key changes it.  The condition is checked and the
+// write made under one acquisition of the database lock, so no other
+// write can come between them.
+
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrVersionMismatch = errors.New("kvdb: version mismatch")
+
+// Get the value of key and its version, returning nil and 0 if it does
+// not exist
+func (db *Db) GetVersion(key []byte) ([]byte, uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+	e, err := db.getEntry(key, db.lastSequence)
+	if e == nil {
+		return nil, 0, err
+	}
+	return e.Value, e.Sequence, nil
+}
+
+// Make the write in r if check accepts the current version of its key,
+// returning the new version.  db.lock must be held.
+func (db *Db) writeIf(r *walRecord, check func(e *tableEntry) bool) (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	e, err := db.getEntry(r.key, db.lastSequence)
+	if err != nil {
+		return 0, err
+	}
+	if !check(e) {
+		return 0, ErrVersionMismatch
+	}
+	if err := db.write(r); err != nil {
+		return 0, err
+	}
+	return db.lastSequence, nil
+}
+
+func versionOf(e *tableEntry) uint64 {
+	if e == nil {
+		return 0
+	}
+	return e.Sequence
+}
+
+// Put key if its current version is version, a version of 0 meaning the
+// key must not exist.  Returns the new version, or ErrVersionMismatch if
+// the key has changed.
+func (db *Db) PutIfVersion(key, value []byte, version uint64) (uint64, error) {
+	return db.PutIfVersionWithOptions(key, value, version, PutOptions{})
+}
+
+// PutIfVersion with the TTL and content type in opts
+func (db *Db) PutIfVersionWithOptions(key, value []byte, version uint64, opts PutOptions) (uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	r, err := db.putRecord(key, value, opts)
+	if err != nil {
+		return 0, err
+	}
+	return db.writeIf(r, func(e *tableEntry) bool {
+		return versionOf(e) == version
+	})
+}
+
+// PutWithOptions, returning the version it was written at
+func (db *Db) PutAnyVersion(key, value []byte, opts PutOptions) (uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	r, err := db.putRecord(key, value, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.write(r); err != nil {
+		return 0, err
+	}
+	return db.lastSequence, nil
+}
+
+// Delete key if its current version is version, otherwise return
+// ErrVersionMismatch
+func (db *Db) DeleteIfVersion(key []byte, version uint64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.writeIf(&walRecord{walRecordDelete, key, nil, 0, 0, "", 0}, func(e *tableEntry) bool {
+		return versionOf(e) == version
+	})
+	return err
+}
+
+// Delete key if it exists, returning whether it did
+func (db *Db) DeleteAnyVersion(key []byte) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.writeIf(&walRecord{walRecordDelete, key, nil, 0, 0, "", 0}, func(e *tableEntry) bool {
+		return e != nil
+	})
+	if err == ErrVersionMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put value if the current value of key is expected, a nil expected
+// meaning the key must not exist.  Returns whether the value was swapped.
+func (db *Db) CompareAndSwap(key, expected, value []byte) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.writeIf(&walRecord{walRecordPut, key, value, 0, 0, "", 0}, func(e *tableEntry) bool {
+		if e == nil {
+			return expected == nil
+		}
+		return expected != nil && bytes.Equal(e.Value, expected)
+	})
+	if err == ErrVersionMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
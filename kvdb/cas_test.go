@@ -0,0 +1,129 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func TestPutIfVersion(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	defer db.Close()
+
+	if _, v, _ := db.GetVersion([]byte("a")); v != 0 {
+		t.Errorf("missing key has version %d", v)
+	}
+	v1, err := db.PutIfVersion([]byte("a"), []byte("1"), 0)
+	if err != nil || v1 == 0 {
+		t.Errorf("create failed: %d %v", v1, err)
+		t.FailNow()
+	}
+	if _, err := db.PutIfVersion([]byte("a"), []byte("x"), 0); err != kvdb.ErrVersionMismatch {
+		t.Errorf("create over existing key: %v", err)
+	}
+
+	// The version survives a flush
+	db.Flush()
+	value, v, err := db.GetVersion([]byte("a"))
+	if err != nil || v != v1 || string(value) != "1" {
+		t.Errorf("GetVersion = %s %d %v, expected 1 %d", value, v, err, v1)
+	}
+
+	v2, err := db.PutIfVersion([]byte("a"), []byte("2"), v1)
+	if err != nil || v2 <= v1 {
+		t.Errorf("update failed: %d %v", v2, err)
+	}
+	if _, err := db.PutIfVersion([]byte("a"), []byte("x"), v1); err != kvdb.ErrVersionMismatch {
+		t.Errorf("stale update: %v", err)
+	}
+	if err := db.DeleteIfVersion([]byte("a"), v1); err != kvdb.ErrVersionMismatch {
+		t.Errorf("stale delete: %v", err)
+	}
+	if err := db.DeleteIfVersion([]byte("a"), v2); err != nil {
+		t.Errorf("delete failed: %v", err)
+	}
+	if _, v, _ := db.GetVersion([]byte("a")); v != 0 || db.GetString("a") != nil {
+		t.Errorf("deleted key has version %d", v)
+	}
+}
+
+func TestAnyVersion(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	v1, err := db.PutAnyVersion([]byte("a"), []byte("1"), kvdb.PutOptions{})
+	if _, v, _ := db.GetVersion([]byte("a")); err != nil || v1 == 0 || v1 != v {
+		t.Errorf("PutAnyVersion = %d %v, version is %d", v1, err, v)
+	}
+	v2, err := db.PutAnyVersion([]byte("a"), []byte("2"), kvdb.PutOptions{})
+	if err != nil || v2 <= v1 {
+		t.Errorf("PutAnyVersion over existing key = %d %v", v2, err)
+	}
+	if deleted, err := db.DeleteAnyVersion([]byte("a")); err != nil || !deleted {
+		t.Errorf("DeleteAnyVersion = %v %v", deleted, err)
+	}
+	if deleted, err := db.DeleteAnyVersion([]byte("a")); err != nil || deleted {
+		t.Errorf("DeleteAnyVersion of a missing key = %v %v", deleted, err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	for _, test := range []struct {
+		expected, value string
+		nilExpected     bool
+		swapped         bool
+	}{
+		{"", "1", true, true},
+		{"", "x", true, false},
+		{"2", "x", false, false},
+		{"1", "2", false, true},
+	} {
+		var expected []byte
+		if !test.nilExpected {
+			expected = []byte(test.expected)
+		}
+		swapped, err := db.CompareAndSwap([]byte("a"), expected, []byte(test.value))
+		if err != nil || swapped != test.swapped {
+			t.Errorf("%v: swapped %v, %v", test, swapped, err)
+		}
+	}
+	if v := db.GetString("a"); string(v) != "2" {
+		t.Errorf("a = %s", v)
+	}
+
+	// Concurrent increments retried until they swap lose no updates
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for {
+					v := db.GetString("a")
+					n, _ := strconv.Atoi(string(v))
+					swapped, err := db.CompareAndSwap([]byte("a"), v, []byte(fmt.Sprint(n+1)))
+					if err != nil {
+						t.Errorf("CompareAndSwap failed: %v", err)
+						return
+					} else if swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := db.GetString("a"); string(v) != "402" {
+		t.Errorf("a = %s after increments", v)
+	}
+}
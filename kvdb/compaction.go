@@ -0,0 +1,614 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Background compaction.  Flushed tables pile up in level 0 and every
+// read that misses the memtable has to check each of them, so tables
+// are periodically merged, keeping only the newest version of each key,
+// along with any older ones a live snapshot still reads, and dropping
+// tombstones once nothing older could be shadowed by them.  Values whose
+// TTL ran out are purged, leaving a tombstone in their place.
+//
+// Each column family is compacted on its own, with its own strategy.
+// Two strategies are supported:
+//
+// Leveled compaction keeps levels 1 and deeper free of overlapping
+// tables, each level allowed ten times the bytes of the one above.  When
+// level 0 gathers enough tables they are all merged into level 1, and
+// when a deeper level grows too large one of its tables is merged into
+// the next level down.
+//
+// Size-tiered compaction keeps every table in level 0 and merges runs of
+// tables of similar size, adjacent in age, into a single larger table.
+
+package kvdb
+
+import (
+	"bytes"
+	"container/heap"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+type CompactionStyle int
+
+const (
+	CompactionLeveled CompactionStyle = iota
+	CompactionSizeTiered
+)
+
+const (
+	numLevels                  = 7
+	defaultL0CompactionTrigger = 4
+	defaultLevelSizeBase       = 10 << 20
+	defaultTargetTableSize     = 2 << 20
+	defaultTierMinWidth        = 4
+	tierMaxWidth               = 32
+)
+
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+type CompactionStats struct {
+	// Completed compactions and those that failed
+	Compactions int64
+	Failures    int64
+
+	TablesRead    int64
+	TablesWritten int64
+	BytesRead     int64
+	BytesWritten  int64
+
+	// Entries dropped because a newer version of the key exists and
+	// tombstones dropped because nothing older remains to shadow
+	ShadowedDropped   int64
+	TombstonesDropped int64
+
+	Duration time.Duration
+
+	// The tables currently in each level, across every column family
+	Levels []LevelStats
+}
+
+// A compaction merges inputs, ordered newest first, into tables of family
+// written to level.  Tombstones may be dropped unless a table in older
+// might hold a value for the same key.  Versions the oldest snapshot, at
+// sequence smallestSnapshot, or a newer one can still read are kept, as
+// are those still in their key's history as of now.
+type compaction struct {
+	family           *Family
+	level            int
+	inputs           []table
+	older            []table
+	split            bool
+	smallestSnapshot uint64
+	now              int64
+}
+
+func levelBytes(level []table) int64 {
+	var total int64
+	for _, t := range level {
+		total += t.size()
+	}
+	return total
+}
+
+func keyRange(cmp Comparator, tables []table) ([]byte, []byte) {
+	var smallest, largest []byte
+	for _, t := range tables {
+		m := t.meta()
+		if m.count == 0 {
+			continue
+		}
+		if smallest == nil || cmp.Compare(m.smallest, smallest) < 0 {
+			smallest = m.smallest
+		}
+		if largest == nil || cmp.Compare(m.largest, largest) > 0 {
+			largest = m.largest
+		}
+	}
+	return smallest, largest
+}
+
+func overlapping(level []table, smallest, largest []byte) []table {
+	result := []table{}
+	for _, t := range level {
+		if t.meta().overlaps(smallest, largest) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Choose the next compaction to run in any family, or nil if none is
+// needed.  db.lock must be held.
+func (db *Db) pickCompaction() *compaction {
+	for _, f := range db.familyList() {
+		var c *compaction
+		if f.options.CompactionStyle == CompactionSizeTiered {
+			c = db.pickTiered(f)
+		} else {
+			c = db.pickLeveled(f)
+		}
+		if c != nil {
+			c.family = f
+			return c
+		}
+	}
+	return nil
+}
+
+func (db *Db) pickLeveled(f *Family) *compaction {
+	var c *compaction
+	if len(f.levels[0]) >= db.config.L0CompactionTrigger {
+		c = &compaction{level: 1, split: true}
+		c.inputs = append(c.inputs, f.levels[0]...)
+	} else {
+		maxBytes := int64(db.config.LevelSizeBase)
+		for level := 1; level < numLevels-1; level++ {
+			if levelBytes(f.levels[level]) > maxBytes {
+				c = &compaction{level: level + 1, split: true}
+				c.inputs = append(c.inputs, f.nextInLevel(level))
+				break
+			}
+			maxBytes *= 10
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	smallest, largest := keyRange(f.cmp, c.inputs)
+	c.inputs = append(c.inputs, overlapping(f.levels[c.level], smallest, largest)...)
+	for _, level := range f.levels[c.level+1:] {
+		c.older = append(c.older, level...)
+	}
+	return c
+}
+
+// Pick the table in level after the last one compacted so every part of
+// the key space gets its turn
+func (f *Family) nextInLevel(level int) table {
+	tables := f.levels[level]
+	for _, t := range tables {
+		if f.compactPointer[level] == nil ||
+			f.cmp.Compare(t.meta().smallest, f.compactPointer[level]) > 0 {
+			f.compactPointer[level] = t.meta().largest
+			return t
+		}
+	}
+	f.compactPointer[level] = tables[0].meta().largest
+	return tables[0]
+}
+
+func (db *Db) pickTiered(f *Family) *compaction {
+	tables := f.levels[0]
+	for start := 0; start < len(tables); {
+		end := start + 1
+		total := tables[start].size()
+		for end < len(tables) && end-start < tierMaxWidth {
+			avg := total / int64(end-start)
+			size := tables[end].size()
+			if size < avg/2 || size > avg+avg/2 {
+				break
+			}
+			total += size
+			end++
+		}
+
+		if end-start >= db.config.TierMinWidth {
+			c := &compaction{level: 0}
+			c.inputs = append(c.inputs, tables[start:end]...)
+			c.older = append(c.older, tables[end:]...)
+			for _, level := range f.levels[1:] {
+				c.older = append(c.older, level...)
+			}
+			return c
+		}
+		start = end
+	}
+	return nil
+}
+
+// Merges table iterators, yielding entries by key and then newest, highest
+// sequence, first.  Ties, between tables written before sequences were
+// recorded, are broken by rank, the position of the iterator's table in
+// the compaction inputs.
+type mergeItem struct {
+	it   tableIterator
+	rank int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+	cmp   Comparator
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i].it.entry(), h.items[j].it.entry()
+	c := h.cmp.Compare(a.Key, b.Key)
+	if c != 0 {
+		return c < 0
+	}
+	if a.Sequence != b.Sequence {
+		return a.Sequence > b.Sequence
+	}
+	return h.items[i].rank < h.items[j].rank
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// Writes compaction output, starting a new table whenever the current
+// one reaches the target size if split is set.
+type compactionWriter struct {
+	db      *Db
+	c       *compaction
+	newest  uint64
+	pending *pendingFile
+	builder tableBuilder
+	written int
+	lastKey []byte
+	done    []*pendingFile
+	stats   CompactionStats
+}
+
+func (w *compactionWriter) add(e *tableEntry) error {
+	// Versions of one key stay in one table so tables in a level never
+	// share a key
+	if w.c.split && w.written >= w.db.config.TargetTableSize &&
+		!bytes.Equal(e.Key, w.lastKey) {
+		if err := w.finishTable(); err != nil {
+			return err
+		}
+	}
+	w.lastKey = append(w.lastKey[:0], e.Key...)
+
+	if w.pending == nil {
+		w.db.lock.Lock()
+		number := w.db.nextFile
+		w.db.nextFile++
+		w.db.lock.Unlock()
+
+		p, err := createPending(w.db.config.Dir, tableFile, number)
+		if err != nil {
+			return err
+		}
+		w.pending = p
+		w.builder = newTableBuilder(p.File, &w.db.config, w.c.level, w.newest)
+		w.written = 0
+	}
+
+	if err := w.builder.add(e); err != nil {
+		return err
+	}
+	w.written += len(e.Key) + len(e.Value)
+	return nil
+}
+
+func (w *compactionWriter) finishTable() error {
+	if w.pending == nil {
+		return nil
+	}
+	p := w.pending
+	w.pending = nil
+	if err := w.builder.finish(); err != nil {
+		p.abort()
+		return err
+	}
+	if err := p.commit(); err != nil {
+		return err
+	}
+	w.done = append(w.done, p)
+	return nil
+}
+
+// Remove everything written, used when the compaction fails
+func (w *compactionWriter) abort() {
+	if w.pending != nil {
+		w.pending.abort()
+	}
+	for _, p := range w.done {
+		os.Remove(fileName(p.dir, tableFile, p.number))
+	}
+}
+
+// Whether any table in older may contain key
+func (c *compaction) olderMayContain(key []byte) bool {
+	for _, t := range c.older {
+		if t.meta().contains(key) && t.meta().filter.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge the inputs of c into new tables, which are returned opened
+func (db *Db) runCompaction(c *compaction) ([]table, CompactionStats, error) {
+	w := &compactionWriter{db: db, c: c}
+	h := &mergeHeap{cmp: c.family.cmp}
+	for i, t := range c.inputs {
+		if t.meta().newest > w.newest {
+			w.newest = t.meta().newest
+		}
+		w.stats.BytesRead += t.size()
+		it := t.iterator()
+		it.seekToFirst()
+		if it.valid() {
+			heap.Push(h, mergeItem{it, i})
+		} else if it.err() != nil {
+			return nil, w.stats, it.err()
+		}
+	}
+	w.stats.TablesRead = int64(len(c.inputs))
+
+	// A version is only needed if some snapshot reads it rather than
+	// the next newer version of the key, which no snapshot does once
+	// the newer version is at or below the oldest snapshot, or if it is
+	// still in the key's history.  Depth counts the versions of the
+	// current key kept so far.
+	var last []byte
+	var lastSequence uint64
+	var lastTimestamp int64
+	var depth int
+	for h.Len() > 0 {
+		item := h.items[0]
+		// An expired value is purged, leaving a tombstone to shadow
+		// older versions of the key
+		e := *item.it.entry()
+		e.purge(c.now)
+		if last == nil || !bytes.Equal(e.Key, last) {
+			lastSequence = math.MaxUint64
+			depth = 0
+		}
+		last = append(last[:0], e.Key...)
+
+		if lastSequence <= c.smallestSnapshot &&
+			!db.config.historyKeeps(depth+1, lastTimestamp, c.now) {
+			w.stats.ShadowedDropped++
+		} else {
+			// A dropped tombstone still shadows the versions after it
+			depth++
+			lastSequence, lastTimestamp = e.Sequence, e.Timestamp
+			if e.Tombstone && e.Sequence <= c.smallestSnapshot &&
+				!c.olderMayContain(e.Key) &&
+				!db.config.historyKeeps(depth+1, e.Timestamp, c.now) {
+				w.stats.TombstonesDropped++
+			} else if err := w.add(&e); err != nil {
+				w.abort()
+				return nil, w.stats, err
+			}
+		}
+
+		item.it.next()
+		if item.it.valid() {
+			heap.Fix(h, 0)
+		} else if item.it.err() != nil {
+			w.abort()
+			return nil, w.stats, item.it.err()
+		} else {
+			heap.Pop(h)
+		}
+	}
+
+	if err := w.finishTable(); err != nil {
+		w.abort()
+		return nil, w.stats, err
+	}
+	if err := syncDir(db.config.Dir); err != nil {
+		w.abort()
+		return nil, w.stats, err
+	}
+
+	outputs := []table{}
+	for _, p := range w.done {
+		t, err := openTable(db.config.Dir, p.number, c.family.cmp)
+		if err != nil {
+			for _, o := range outputs {
+				o.close()
+			}
+			w.abort()
+			return nil, w.stats, err
+		}
+		w.stats.BytesWritten += t.size()
+		outputs = append(outputs, t)
+	}
+	w.stats.TablesWritten = int64(len(outputs))
+	return outputs, w.stats, nil
+}
+
+func removeTables(level []table, remove map[table]bool) []table {
+	result := []table{}
+	for _, t := range level {
+		if !remove[t] {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// The manifest edit replacing the inputs of c with outputs
+func (c *compaction) edit(outputs []table, nextFile uint64) *versionEdit {
+	e := &versionEdit{nextFile: nextFile}
+	for _, t := range c.inputs {
+		e.removed = append(e.removed, tableRef{c.family.id, t.meta().level, t.fileNumber()})
+	}
+	for _, t := range outputs {
+		e.added = append(e.added, tableRef{c.family.id, c.level, t.fileNumber()})
+	}
+	return e
+}
+
+// Swap the inputs of c for outputs and delete the input files, once the
+// swap is recorded in the manifest.  db.lock must be held.
+func (db *Db) installCompaction(c *compaction, outputs []table) {
+	remove := map[table]bool{}
+	for _, t := range c.inputs {
+		remove[t] = true
+	}
+	f := c.family
+	for level := range f.levels {
+		f.levels[level] = removeTables(f.levels[level], remove)
+	}
+
+	f.levels[c.level] = append(f.levels[c.level], outputs...)
+	f.sortLevel(c.level)
+
+	for _, t := range c.inputs {
+		db.releaseTable(t)
+	}
+}
+
+func (db *Db) removeTable(t table) {
+	t.close()
+	os.Remove(fileName(db.config.Dir, tableFile, t.fileNumber()))
+}
+
+// Level 0 is ordered newest first, deeper levels by key.
+func (f *Family) sortLevel(level int) {
+	tables := f.levels[level]
+	if level == 0 {
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].meta().newest > tables[j].meta().newest
+		})
+	} else {
+		sort.Slice(tables, func(i, j int) bool {
+			return f.cmp.Compare(tables[i].meta().smallest, tables[j].meta().smallest) < 0
+		})
+	}
+}
+
+// Run a single compaction if one is needed, returns whether one ran
+func (db *Db) compactOnce() (bool, error) {
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	db.lock.Lock()
+	if db.bgErr != nil {
+		db.lock.Unlock()
+		return false, db.bgErr
+	}
+	c := db.pickCompaction()
+	if c != nil {
+		c.smallestSnapshot = db.oldestSnapshot()
+		c.now = db.now().Unix()
+	}
+	db.lock.Unlock()
+	if c == nil {
+		return false, nil
+	}
+
+	start := time.Now()
+	outputs, stats, err := db.runCompaction(c)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err == nil {
+		err = db.manifest.apply(c.edit(outputs, db.nextFile))
+		if err != nil {
+			// Left on disk, see manifest.apply
+			for _, t := range outputs {
+				t.close()
+			}
+			db.bgErr = err
+		}
+	}
+	if err != nil {
+		db.stats.Failures++
+		return false, err
+	}
+	db.installCompaction(c, outputs)
+
+	db.stats.Compactions++
+	db.stats.TablesRead += stats.TablesRead
+	db.stats.TablesWritten += stats.TablesWritten
+	db.stats.BytesRead += stats.BytesRead
+	db.stats.BytesWritten += stats.BytesWritten
+	db.stats.ShadowedDropped += stats.ShadowedDropped
+	db.stats.TombstonesDropped += stats.TombstonesDropped
+	db.stats.Duration += time.Since(start)
+	return true, nil
+}
+
+// Wake the background compactor, it runs until nothing is left to do
+func (db *Db) scheduleCompaction() {
+	select {
+	case db.compactWake <- struct{}{}:
+	default:
+	}
+}
+
+func (db *Db) compactLoop() {
+	defer db.compactWg.Done()
+	for {
+		select {
+		case <-db.compactWake:
+		case <-db.compactDone:
+			return
+		}
+
+		for {
+			select {
+			case <-db.compactDone:
+				return
+			default:
+			}
+			ran, err := db.compactOnce()
+			if err != nil || !ran {
+				break
+			}
+		}
+	}
+}
+
+// Run compactions until none are needed.  Compactions normally happen
+// in the background, this is for callers that want to wait for them.
+func (db *Db) Compact() error {
+	for {
+		db.lock.Lock()
+		closed := db.closed
+		db.lock.Unlock()
+		if closed {
+			return ErrClosed
+		}
+
+		ran, err := db.compactOnce()
+		if err != nil || !ran {
+			return err
+		}
+	}
+}
+
+func (db *Db) BloomStats() BloomStats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.bloomStats
+}
+
+func (db *Db) CompactionStats() CompactionStats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	stats := db.stats
+	stats.Levels = make([]LevelStats, numLevels)
+	for _, f := range db.families {
+		for i, level := range f.levels {
+			stats.Levels[i].Tables += len(level)
+			stats.Levels[i].Bytes += levelBytes(level)
+		}
+	}
+	return stats
+}
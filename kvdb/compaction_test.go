@@ -0,0 +1,240 @@
+// Whitebox tests for compaction.go
+
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func openCompactionDb(t *testing.T, config *DbConfig) *Db {
+	db, err := InitDb(config)
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	return db
+}
+
+// Write rounds of overwrites and deletes, flushing after each round so
+// every key ends up in several tables.
+func fillCompactionDb(t *testing.T, db *Db, rounds int) map[string]string {
+	expect := map[string]string{}
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < 200; i++ {
+			k := fmt.Sprintf("key%03d", i)
+			if i%7 == round%7 {
+				db.Delete([]byte(k))
+				delete(expect, k)
+			} else {
+				v := fmt.Sprintf("value%d-%d", i, round)
+				db.Put([]byte(k), []byte(v))
+				expect[k] = v
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Errorf("Flush failed: %v", err)
+			t.FailNow()
+		}
+	}
+	return expect
+}
+
+func checkCompactionDb(t *testing.T, db *Db, expect map[string]string) {
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("key%03d", i)
+		v, err := db.Get([]byte(k))
+		if err != nil {
+			t.Errorf("Get failed: %v", err)
+			t.FailNow()
+		}
+		e, ok := expect[k]
+		if !ok && v != nil {
+			t.Errorf("%s deleted but found %s", k, v)
+			t.FailNow()
+		} else if ok && string(v) != e {
+			t.Errorf("%s: %s != %s", k, v, e)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{
+		Dir:                 dir,
+		TableFormat:         TableFormatBlock,
+		BlockSize:           128,
+		L0CompactionTrigger: 2,
+		LevelSizeBase:       2048,
+		TargetTableSize:     1024,
+	}
+
+	db := openCompactionDb(t, config)
+	expect := fillCompactionDb(t, db, 8)
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+	checkCompactionDb(t, db, expect)
+
+	stats := db.CompactionStats()
+	if stats.Compactions == 0 || stats.ShadowedDropped == 0 {
+		t.Errorf("no compaction recorded %+v", stats)
+	}
+
+	if stats.Levels[0].Tables >= config.L0CompactionTrigger {
+		t.Errorf("level 0 not compacted %+v", stats.Levels)
+	}
+
+	for level := 1; level < numLevels; level++ {
+		tables := db.defaultFamily().levels[level]
+		for i := 1; i < len(tables); i++ {
+			if bytes.Compare(tables[i-1].meta().largest, tables[i].meta().smallest) >= 0 {
+				t.Errorf("level %d tables overlap", level)
+			}
+		}
+	}
+	db.Close()
+
+	db = openCompactionDb(t, config)
+	defer db.Close()
+	checkCompactionDb(t, db, expect)
+}
+
+func TestTieredCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{
+		Dir:             dir,
+		CompactionStyle: CompactionSizeTiered,
+		TierMinWidth:    3,
+	}
+
+	db := openCompactionDb(t, config)
+	defer db.Close()
+	expect := fillCompactionDb(t, db, 5)
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+	checkCompactionDb(t, db, expect)
+
+	stats := db.CompactionStats()
+	if stats.Compactions == 0 {
+		t.Errorf("no compaction recorded %+v", stats)
+	}
+
+	if stats.Levels[0].Tables >= 5 {
+		t.Errorf("tables not merged %+v", stats.Levels)
+	}
+
+	for _, level := range stats.Levels[1:] {
+		if level.Tables != 0 {
+			t.Errorf("size-tiered wrote a deeper level %+v", stats.Levels)
+		}
+	}
+}
+
+// Once nothing older can hold a key its tombstone is dropped
+func TestCompactionDropsTombstones(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir, L0CompactionTrigger: 2}
+
+	db := openCompactionDb(t, config)
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("foo"))
+	db.Put([]byte("b"), []byte("bar"))
+	db.Flush()
+	db.Delete([]byte("a"))
+	db.Delete([]byte("b"))
+	db.Flush()
+
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+
+	stats := db.CompactionStats()
+	if stats.TombstonesDropped != 2 || stats.ShadowedDropped != 2 {
+		t.Errorf("tombstones not dropped %+v", stats)
+	}
+
+	if v, _ := db.Get([]byte("a")); v != nil {
+		t.Errorf("deleted key found")
+	}
+}
+
+// Deletes only leave a tombstone in the memtable when an older table
+// may hold the key
+func TestDeleteTombstoneOnlyWhenShadowing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+
+	db.Put([]byte("flushed"), []byte("v"))
+	if err := db.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+		t.FailNow()
+	}
+	db.Put([]byte("fresh"), []byte("v"))
+	db.Delete([]byte("fresh"))
+	db.Delete([]byte("flushed"))
+
+	if db.defaultFamily().mem.find([]byte("fresh")) != nil {
+		t.Errorf("fresh key left in memtable")
+	}
+	if n := db.defaultFamily().mem.find([]byte("flushed")); n == nil || !n.tombstone {
+		t.Errorf("flushed key has no tombstone")
+	}
+	if db.GetString("flushed") != nil || db.GetString("fresh") != nil {
+		t.Errorf("deleted key found")
+	}
+}
+
+// A compaction whose manifest edit cannot be written stops the database
+// rather than carrying on with a manifest that may not match it, and
+// reopening finds everything as it was before the compaction
+func TestCompactionManifestFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir}
+
+	db := openCompactionDb(t, config)
+	expect := fillCompactionDb(t, db, 3)
+
+	db.lock.Lock()
+	db.config.L0CompactionTrigger = 2
+	db.manifest.f.Close()
+	db.lock.Unlock()
+
+	if err := db.Compact(); err == nil {
+		t.Errorf("Compact succeeded without a manifest")
+		t.FailNow()
+	}
+	if err := db.Put([]byte("after"), []byte("v")); err == nil {
+		t.Errorf("Put succeeded after the manifest failed")
+	}
+	if err := db.Compact(); err == nil {
+		t.Errorf("Compact ran again after the manifest failed")
+	}
+	if stats := db.CompactionStats(); stats.Failures != 1 || stats.Compactions != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	db.Close()
+
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+	if len(db.defaultFamily().levels[0]) != 3 {
+		t.Errorf("level 0 has %d tables", len(db.defaultFamily().levels[0]))
+	}
+	checkCompactionDb(t, db, expect)
+}
@@ -2,35 +2,877 @@ package kvdb
 
 // Main database interface for simple-kv
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+const defaultMemtableSize = 4 << 20
+
+var ErrClosed = errors.New("kvdb: database closed")
+
+var ErrSnapshotReleased = errors.New("kvdb: snapshot released")
+
+var ErrInvalidTTL = errors.New("kvdb: ttl must be positive")
+
 type DbConfig struct {
+	// Directory holding the write-ahead log and tables.  When empty the
+	// database lives only in memory and is lost on exit.
+	Dir string
+
+	// When the write-ahead log is fsynced, see SyncPolicy
+	SyncPolicy SyncPolicy
+
+	// Time between fsyncs when SyncPolicy is SyncPeriodic, defaults
+	// to one second
+	SyncInterval time.Duration
+
+	// Approximate size in bytes the memtable may reach before it is
+	// flushed to a table, defaults to 4MB
+	MemtableSize int
+
+	// Format new tables are written in, existing tables are read in
+	// whichever format they were written
+	TableFormat TableFormat
+
+	// Target size in bytes of a data block in TableFormatBlock tables,
+	// defaults to 4KB
+	BlockSize int
+
+	// Bits per key in the bloom filter written with each table, more
+	// bits means fewer false positives.  Defaults to 10, which gives
+	// roughly 1% false positives, a negative value disables filters.
+	BloomBitsPerKey int
+
+	// How tables are merged in the background, see compaction.go
+	CompactionStyle CompactionStyle
+
+	// Leveled compaction, the number of level 0 tables that triggers a
+	// compaction into level 1, the size in bytes allowed in level 1
+	// (each deeper level allows ten times more), and the size of the
+	// tables compaction writes.  Default to 4, 10MB and 2MB.
+	L0CompactionTrigger int
+	LevelSizeBase       int
+	TargetTableSize     int
+
+	// Size-tiered compaction, the number of similarly sized tables that
+	// are merged together, defaults to 4
+	TierMinWidth int
+
+	// Comparators column families may be created with besides the
+	// built in ones, see family.go
+	Comparators []Comparator
+
+	// How much of each key's history is kept for Db.History and
+	// Db.GetAt, see history.go.  HistoryVersions bounds the number of
+	// versions, counting the current one, and HistoryAge how long a
+	// version is kept after it was replaced.  Either may be zero to
+	// leave that bound off, with both zero no history is kept.
+	HistoryVersions int
+	HistoryAge      time.Duration
+
+	// Change feeds, see watch.go.  WatchBufferSize is how many events a
+	// watcher may fall behind before it is closed, and WatchHistory how
+	// many recent changes are kept for Db.Watch to start from and to ship
+	// to followers.  Default to 256 and 4096, a negative WatchHistory
+	// keeps none.
+	WatchBufferSize int
+	WatchHistory    int
 }
 
 type Db struct {
-	tree *Tree
-	lock sync.Mutex
+	config DbConfig
+
+	// The column families by ID, see family.go.  In each the active
+	// memtable takes all writes, once full it becomes the immutable
+	// memtable until a background flush writes it to a table.  Level 0
+	// tables are ordered newest first, deeper levels by key, see
+	// compaction.go.
+	families   map[uint64]*Family
+	nextFamily uint64
+
+	// The open log and the numbers of all logs holding the contents of
+	// the active and immutable memtables respectively, immLogs being nil
+	// unless a flush is in progress
+	log     *wal
+	memLogs []uint64
+	immLogs []uint64
+
+	// Records the live tables, see manifest.go
+	manifest *manifest
+
+	// Sequence number of the last mutation applied and of the last one
+	// in imm
+	lastSequence uint64
+	immSequence  uint64
+
+	nextFile  uint64
+	bgErr     error
+	closed    bool
+	flushDone *sync.Cond
+	lock      sync.Mutex
+
+	// Compactions run one at a time under compactLock, usually from
+	// the background goroutine woken through compactWake
+	compactLock sync.Mutex
+	compactWake chan struct{}
+	compactDone chan struct{}
+	compactWg   sync.WaitGroup
+	stats       CompactionStats
+
+	bloomStats BloomStats
+
+	// Open iterators per table, and tables compaction has replaced
+	// that are waiting for their last iterator to close
+	tableRefs map[table]int
+	obsolete  map[table]bool
+
+	// Sequence numbers held by live snapshots and iterators, with how
+	// many hold each, see snapshot.go
+	snapshots map[uint64]int
+
+	// Open change feeds and the recent changes they may start from, see
+	// watch.go
+	watchers map[*Watcher]bool
+	changes  changeLog
+
+	// Closed at the next mutation, see WaitLog, and whether writes other
+	// than those shipped from a leader are refused
+	logWait  chan struct{}
+	readOnly bool
+
+	// The clock mutations are stamped with
+	now func() time.Time
+}
+
+// Get the value of key, returning nil if it does not exist
+func (db *Db) Get(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.get(key, db.lastSequence)
 }
 
+// Get the value of key as of sequence, db.lock must be held
+func (db *Db) get(key []byte, sequence uint64) ([]byte, error) {
+	e, err := db.getEntry(key, sequence)
+	if e == nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+// Get the version of key visible at sequence, nil if there is none or it
+// is a delete.  Expired values read as deleted whatever the sequence.
+// db.lock must be held.
+func (db *Db) getEntry(key []byte, sequence uint64) (*tableEntry, error) {
+	return db.getEntryAt(key, sequence, db.now().Unix())
+}
+
+// getEntry with now, in epoch seconds, as the time values expire by
+func (db *Db) getEntryAt(key []byte, sequence uint64, now int64) (*tableEntry, error) {
+	return db.defaultFamily().getEntryAt(key, sequence, now)
+}
+
+// Db.getEntryAt in f
+func (f *Family) getEntryAt(key []byte, sequence uint64, now int64) (*tableEntry, error) {
+	db := f.db
+	for _, tree := range []*Tree{f.mem, f.imm} {
+		if tree == nil {
+			continue
+		}
+		if n := tree.find(key).visible(sequence); n != nil {
+			if n.tombstone || n.expired(now) {
+				return nil, nil
+			}
+			e := n.entry()
+			return &e, nil
+		}
+	}
+
+	for level, tables := range f.levels {
+		for _, t := range tables {
+			if level > 0 && !t.meta().contains(key) {
+				continue
+			}
+
+			filter := t.meta().filter
+			if len(filter) > 0 {
+				db.bloomStats.Checks++
+				if !filter.mayContain(key) {
+					db.bloomStats.Negatives++
+					continue
+				}
+			}
+
+			e, err := t.get(key, sequence)
+			if err != nil {
+				return nil, err
+			} else if e == nil && len(filter) > 0 && sequence == db.lastSequence {
+				// An older read may miss a key the table holds
+				db.bloomStats.FalsePositives++
+			} else if e != nil {
+				if e.Tombstone || e.expired(now) {
+					return nil, nil
+				}
+				return e, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Get the value of key, returning nil if it does not exist or could not
+// be read
 func (db *Db) GetString(key string) []byte {
+	v, _ := db.Get([]byte(key))
+	return v
+}
+
+// Describes the current value of a key, see Db.Stat.  Expires is zero
+// if the value has no TTL and ContentType empty if it was put without
+// one.
+type KeyInfo struct {
+	Size        int
+	Timestamp   time.Time
+	Expires     time.Time
+	ContentType string
+	Version     uint64
+}
+
+func keyInfo(e *tableEntry) *KeyInfo {
+	info := &KeyInfo{
+		Size:        len(e.Value),
+		Timestamp:   time.Unix(e.Timestamp, 0),
+		ContentType: e.ContentType,
+		Version:     e.Sequence,
+	}
+	if e.Expires > 0 {
+		info.Expires = time.Unix(e.Expires, 0)
+	}
+	return info
+}
+
+// Get the value of key along with its description, returning nil for
+// both if it does not exist
+func (db *Db) GetWithInfo(key []byte) ([]byte, *KeyInfo, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
+	e, err := db.getEntry(key, db.lastSequence)
+	if e == nil {
+		return nil, nil, err
+	}
+	return e.Value, keyInfo(e), nil
+}
+
+// Describe the current value of key without returning it, nil if the
+// key does not exist
+func (db *Db) Stat(key []byte) (*KeyInfo, error) {
+	_, info, err := db.GetWithInfo(key)
+	return info, err
+}
+
+func (db *Db) Put(key, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.write(&walRecord{walRecordPut, key, value, 0, 0, "", 0})
+}
+
+// Put key with a value that expires once ttl has passed, to the second,
+// after which it reads as deleted
+func (db *Db) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.PutWithOptions(key, value, PutOptions{TTL: ttl})
+}
+
+// Options for a put.  The value expires once TTL has passed or at
+// ExpiresAt, at most one of which may be set, and never if neither is.
+// ContentType, the media type of the value, is kept with it for readers
+// to find in KeyInfo.
+type PutOptions struct {
+	TTL         time.Duration
+	ExpiresAt   time.Time
+	ContentType string
+}
+
+// Build the log record for a put with opts, db.lock must be held
+func (db *Db) putRecord(key, value []byte, opts PutOptions) (*walRecord, error) {
+	return newPutRecord(key, value, opts, db.now())
+}
+
+// A put record with a TTL in opts counted from now
+func newPutRecord(key, value []byte, opts PutOptions, now time.Time) (*walRecord, error) {
+	if opts.TTL < 0 || opts.TTL > 0 && !opts.ExpiresAt.IsZero() {
+		return nil, ErrInvalidTTL
+	}
+	r := &walRecord{walRecordPut, key, value, 0, 0, opts.ContentType, 0}
+	if opts.TTL > 0 {
+		r.expires = expiryTime(now, opts.TTL)
+	} else if !opts.ExpiresAt.IsZero() {
+		r.expires = expiryTime(opts.ExpiresAt, 0)
+	}
+	return r, nil
+}
+
+func (db *Db) PutWithOptions(key, value []byte, opts PutOptions) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	r, err := db.putRecord(key, value, opts)
+	if err != nil {
+		return err
+	}
+	return db.write(r)
+}
+
+// Epoch seconds ttl after now, rounded up so a value lives at least ttl
+func expiryTime(now time.Time, ttl time.Duration) int64 {
+	expires := now.Add(ttl)
+	seconds := expires.Unix()
+	if expires.Nanosecond() > 0 {
+		seconds++
+	}
+	return seconds
+}
+
+func (db *Db) Delete(key []byte) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	return db.tree.Get([]byte(key))
+	return db.write(&walRecord{walRecordDelete, key, nil, 0, 0, "", 0})
+}
+
+// Stamp a mutation with the time, log it and then apply it to the
+// memtable, db.lock must be held
+func (db *Db) write(r *walRecord) error {
+	if db.readOnly && !db.closed {
+		return ErrReadOnly
+	}
+	r.timestamp = db.now().Unix()
+	return db.writeRecord(r)
+}
+
+// Log a mutation and then apply it to the memtable, db.lock must be held
+func (db *Db) writeRecord(r *walRecord) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	if db.log == nil {
+		db.apply(r)
+		return nil
+	}
+
+	if db.memSize() >= db.config.MemtableSize {
+		if err := db.freeze(); err != nil {
+			return err
+		}
+	}
+	if err := db.log.append(r); err != nil {
+		return err
+	}
+	db.apply(r)
+	return nil
 }
 
-func (db *Db) Put(key, value []byte) {
+// Apply a logged record to the memtable, db.lock must be held
+func (db *Db) apply(r *walRecord) {
+	ops := []walRecord{*r}
+	if r.kind == walRecordBatch {
+		// Checked when the record was built or read from the log
+		ops, _ = decodeBatch(r.value)
+		for i := range ops {
+			ops[i].timestamp = r.timestamp
+		}
+	}
+	db.changes.add(db.lastSequence+1, r, len(ops))
+	for i := range ops {
+		db.applyOne(&ops[i])
+	}
+	db.wakeLogWaiters()
+}
+
+func (db *Db) applyOne(r *walRecord) {
+	db.lastSequence++
+	f := db.families[r.family]
+	if f == nil {
+		// A family since dropped, or on a follower one it does not have
+		return
+	}
+	n := NewNode(r.key, r.value)
+	n.sequence = db.lastSequence
+	if r.timestamp > 0 {
+		n.timestamp = r.timestamp
+	}
+	n.expires = r.expires
+	n.contentType = r.contentType
+	switch r.kind {
+	case walRecordPut:
+		if n.expires == 0 && f.options.TTL > 0 && r.timestamp > 0 {
+			n.expires = expiryTime(time.Unix(r.timestamp, 0), f.options.TTL)
+		}
+		f.mem.insertVersion(n, db.retainVersion)
+		if f.id == 0 {
+			db.notify(EventPut, n)
+		}
+	case walRecordDelete:
+		if f.id == 0 {
+			db.notify(EventDelete, n)
+		}
+		// A snapshot or the key's history may need a tombstone even
+		// when nothing older holds the key
+		if len(db.snapshots) == 0 && !db.config.keepsHistory() &&
+			!f.olderMayContain(r.key) {
+			f.mem.Delete(r.key)
+		} else {
+			n.value = nil
+			n.tombstone = true
+			f.mem.insertVersion(n, db.retainVersion)
+		}
+	}
+}
+
+// Whether anything older than the active memtable of f may hold key, in
+// which case deleting it needs a tombstone to shadow the old copy.
+// db.lock must be held.
+func (f *Family) olderMayContain(key []byte) bool {
+	if f.imm != nil && f.imm.find(key) != nil {
+		return true
+	}
+	for _, tables := range f.levels {
+		for _, t := range tables {
+			if t.meta().contains(key) && t.meta().filter.mayContain(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wait until no flush is in progress, db.lock must be held
+func (db *Db) waitForFlush() {
+	for db.immLogs != nil && db.bgErr == nil {
+		db.flushDone.Wait()
+	}
+}
+
+// Make the active memtable of every family immutable, start new ones with
+// their own log and flush the old ones in the background.  db.lock must
+// be held.
+func (db *Db) freeze() error {
+	db.waitForFlush()
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	number := db.nextFile
+	log, err := openWal(fileName(db.config.Dir, logFile, number),
+		db.config.SyncPolicy, db.config.SyncInterval)
+	if err != nil {
+		return err
+	}
+	db.nextFile++
+
+	old := db.log
+	db.log = log
+	families := db.familyList()
+	for _, f := range families {
+		f.imm, f.mem = f.mem, newTree(f.cmp)
+	}
+	db.immLogs, db.memLogs = db.memLogs, []uint64{number}
+	db.immSequence = db.lastSequence
+
+	// One table number for each family
+	go db.flush(families, db.nextFile, db.now().Unix())
+	db.nextFile += uint64(len(families))
+	return old.close()
+}
+
+// Write the immutable memtable of each family that has anything in it to
+// a table, the i'th family's to table first+i, purging values expired by
+// now.  Record them in the manifest, then drop the logs they covered.
+func (db *Db) flush(families []*Family, first uint64, now int64) {
+	tables := make([]table, len(families))
+	var err error
+	for i, f := range families {
+		if f.imm.root == nil {
+			continue
+		}
+		number := first + uint64(i)
+		err = writeTable(db.config.Dir, number, &db.config, f.imm, now)
+		if err == nil {
+			tables[i], err = openTable(db.config.Dir, number, f.cmp)
+		}
+		if err != nil {
+			break
+		}
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	db.tree.Insert(key, value)
+	defer db.flushDone.Broadcast()
+
+	if err == nil {
+		edit := &versionEdit{
+			logNumber:    db.memLogs[0],
+			nextFile:     db.nextFile,
+			lastSequence: db.immSequence,
+		}
+		for i, t := range tables {
+			if t != nil {
+				edit.added = append(edit.added, tableRef{families[i].id, 0, t.fileNumber()})
+			}
+		}
+		if err = db.manifest.apply(edit); err != nil {
+			// Left on disk, see manifest.apply
+			for _, t := range tables {
+				if t != nil {
+					t.close()
+				}
+			}
+			db.bgErr = err
+			return
+		}
+	}
+	if err != nil {
+		for _, t := range tables {
+			if t != nil {
+				db.removeTable(t)
+			}
+		}
+		db.bgErr = err
+		return
+	}
+
+	for i, f := range families {
+		if tables[i] != nil {
+			f.levels[0] = append([]table{tables[i]}, f.levels[0]...)
+		}
+		f.imm = nil
+	}
+	for _, n := range db.immLogs {
+		os.Remove(fileName(db.config.Dir, logFile, n))
+	}
+	db.immLogs = nil
+	db.scheduleCompaction()
 }
 
-func (db *Db) Delete(key []byte) {
+// Write the active memtables to tables and wait for it to finish
+func (db *Db) Flush() error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	db.tree.Delete(key)
+	if db.closed {
+		return ErrClosed
+	}
+	if db.log == nil || db.memSize() == 0 {
+		return db.bgErr
+	}
+
+	if err := db.freeze(); err != nil {
+		return err
+	}
+	db.waitForFlush()
+	return db.bgErr
+}
+
+// Wait for any flush or compaction to finish and close the write-ahead
+// log.  The Db must not be used afterwards.
+func (db *Db) Close() error {
+	db.lock.Lock()
+	for w := range db.watchers {
+		db.stopWatcher(w, ErrClosed)
+	}
+	if db.closed || db.log == nil {
+		db.closed = true
+		db.lock.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.waitForFlush()
+	db.lock.Unlock()
+
+	close(db.compactDone)
+	db.compactWg.Wait()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.log.close()
+	db.log = nil
+	if cerr := db.manifest.close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = db.bgErr
+	}
+	if cerr := db.closeTables(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (db *Db) closeTables() error {
+	var err error
+	for _, f := range db.families {
+		for _, level := range f.levels {
+			for _, t := range level {
+				if cerr := t.close(); err == nil {
+					err = cerr
+				}
+			}
+		}
+		f.levels = make([][]table, numLevels)
+	}
+	for t := range db.obsolete {
+		if cerr := t.close(); err == nil {
+			err = cerr
+		}
+	}
+	db.obsolete = map[table]bool{}
+	return err
+}
+
+// Open the database described by config, loading its tables and
+// rebuilding the memtable from any logs that were not yet flushed.
+func InitDb(config *DbConfig) (*Db, error) {
+	db := &Db{
+		config:      *config,
+		families:    map[uint64]*Family{},
+		nextFamily:  1,
+		tableRefs:   map[table]int{},
+		obsolete:    map[table]bool{},
+		snapshots:   map[uint64]int{},
+		watchers:    map[*Watcher]bool{},
+		nextFile:    1,
+		compactWake: make(chan struct{}, 1),
+		compactDone: make(chan struct{}),
+		now:         time.Now,
+	}
+	db.flushDone = sync.NewCond(&db.lock)
+	db.config.setDefaults()
+	db.changes = newChangeLog(db.config.WatchHistory)
+	// The default family takes its options from config
+	def, err := db.newFamily(0, DefaultFamily, FamilyOptions{CompactionStyle: config.CompactionStyle})
+	if err != nil {
+		return nil, err
+	}
+	db.families[0] = def
+	if config.Dir == "" {
+		return db, nil
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := db.recover(); err != nil {
+		return nil, err
+	}
+
+	number := db.nextFile
+	log, err := openWal(fileName(config.Dir, logFile, number),
+		config.SyncPolicy, config.SyncInterval)
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	db.nextFile++
+	db.log = log
+	db.memLogs = append(db.memLogs, number)
+
+	if err := db.startManifest(); err != nil {
+		db.log.close()
+		db.closeTables()
+		return nil, err
+	}
+
+	db.compactWg.Add(1)
+	go db.compactLoop()
+	db.scheduleCompaction()
+	return db, nil
+}
+
+func (config *DbConfig) setDefaults() {
+	if config.MemtableSize <= 0 {
+		config.MemtableSize = defaultMemtableSize
+	}
+	if config.L0CompactionTrigger <= 0 {
+		config.L0CompactionTrigger = defaultL0CompactionTrigger
+	}
+	if config.LevelSizeBase <= 0 {
+		config.LevelSizeBase = defaultLevelSizeBase
+	}
+	if config.TargetTableSize <= 0 {
+		config.TargetTableSize = defaultTargetTableSize
+	}
+	if config.TierMinWidth < 2 {
+		config.TierMinWidth = defaultTierMinWidth
+	}
+	if config.BloomBitsPerKey == 0 {
+		config.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	if config.WatchBufferSize <= 0 {
+		config.WatchBufferSize = defaultWatchBufferSize
+	}
+	if config.WatchHistory == 0 {
+		config.WatchHistory = defaultWatchHistory
+	}
+}
+
+// Load the tables of the current version and rebuild the memtable from
+// the logs that have not been flushed
+func (db *Db) recover() error {
+	dir := db.config.Dir
+	v, err := readVersion(dir)
+	if err != nil {
+		return err
+	}
+
+	for id, fv := range v.families {
+		f := db.families[id]
+		if f == nil {
+			f, err = db.newFamily(id, fv.name, fv.options)
+			if err != nil {
+				db.closeTables()
+				return err
+			}
+			db.families[id] = f
+		}
+		for level, numbers := range fv.levels {
+			for n := range numbers {
+				t, err := openTable(dir, n, f.cmp)
+				if err != nil {
+					db.closeTables()
+					return err
+				}
+				t.meta().level = level
+				f.levels[level] = append(f.levels[level], t)
+				db.useFile(n)
+			}
+			f.sortLevel(level)
+		}
+	}
+	db.lastSequence = v.lastSequence
+	if v.nextFile > db.nextFile {
+		db.nextFile = v.nextFile
+	}
+	if v.nextFamily > db.nextFamily {
+		db.nextFamily = v.nextFamily
+	}
+
+	logs, err := listFiles(dir, logFile)
+	if err != nil {
+		db.closeTables()
+		return err
+	}
+	for _, n := range logs {
+		db.useFile(n)
+		if n < v.logNumber {
+			continue
+		}
+		if err := replayWal(fileName(dir, logFile, n), db.apply); err != nil {
+			db.closeTables()
+			return err
+		}
+		db.memLogs = append(db.memLogs, n)
+	}
+	return nil
+}
+
+// Load the version named by CURRENT.  Directories written before the
+// manifest existed have no CURRENT, every table in them is live at the
+// level recorded in the table itself.
+func readVersion(dir string) (*version, error) {
+	current, err := readCurrent(dir)
+	if err == nil {
+		return replayManifest(dir, current)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	v := newVersion()
+	tables, err := listFiles(dir, tableFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range tables {
+		t, err := openTable(dir, n, BytewiseComparator)
+		if err != nil {
+			return nil, err
+		}
+		level := t.meta().level
+		t.close()
+		if level >= numLevels {
+			level = numLevels - 1
+		}
+		v.families[0].levels[level][n] = true
+	}
+	return v, nil
+}
+
+// Start a new manifest describing the current version, then remove every
+// file it does not reference.  Only called while opening the database.
+func (db *Db) startManifest() error {
+	dir := db.config.Dir
+	number := db.nextFile
+	db.nextFile++
+
+	snapshot := &versionEdit{
+		logNumber:    db.memLogs[0],
+		nextFile:     db.nextFile,
+		lastSequence: db.lastSequence,
+		nextFamily:   db.nextFamily,
+	}
+	for _, f := range db.familyList() {
+		if f.id != 0 {
+			snapshot.created = append(snapshot.created, familyDef{f.id, f.name, f.options})
+		}
+		for level, tables := range f.levels {
+			for _, t := range tables {
+				snapshot.added = append(snapshot.added, tableRef{f.id, level, t.fileNumber()})
+			}
+		}
+	}
+
+	m, err := createManifest(dir, number, snapshot)
+	if err != nil {
+		return err
+	}
+	db.manifest = m
+
+	live := map[uint64]bool{}
+	for _, t := range snapshot.added {
+		live[t.number] = true
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		kind, n, ok := parseFileName(info.Name())
+		if !ok {
+			continue
+		}
+		if (kind == tableFile && !live[n]) ||
+			(kind == logFile && n < db.memLogs[0]) ||
+			(kind == manifestFile && n != number) ||
+			kind == tempFile {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+	return nil
 }
 
-func InitDb(_ *DbConfig) *Db {
-	return &Db{tree: NewTree()}
+// Note that file number is taken so it is never handed out again
+func (db *Db) useFile(number uint64) {
+	if number >= db.nextFile {
+		db.nextFile = number + 1
+	}
 }
@@ -0,0 +1,189 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func openTestDb(t *testing.T, config *kvdb.DbConfig) *kvdb.Db {
+	db, err := kvdb.InitDb(config)
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	return db
+}
+
+func TestDbReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &kvdb.DbConfig{Dir: dir}
+
+	db := openTestDb(t, config)
+	db.Put([]byte("a"), []byte("foo"))
+	db.Put([]byte("b"), []byte("bar"))
+	db.Put([]byte("a"), []byte("baz"))
+	db.Delete([]byte("b"))
+	db.Close()
+
+	db = openTestDb(t, config)
+	defer db.Close()
+
+	v := db.GetString("a")
+	if string(v) != "baz" {
+		t.Errorf("v != baz")
+		t.FailNow()
+	}
+
+	v = db.GetString("b")
+	if v != nil {
+		t.Errorf("v != nil")
+		t.FailNow()
+	}
+}
+
+func TestDbPeriodicSync(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &kvdb.DbConfig{Dir: dir, SyncPolicy: kvdb.SyncPeriodic}
+
+	db := openTestDb(t, config)
+	db.Put([]byte("a"), []byte("foo"))
+	db.Close()
+
+	db = openTestDb(t, config)
+	defer db.Close()
+
+	v := db.GetString("a")
+	if string(v) != "foo" {
+		t.Errorf("v != foo")
+		t.FailNow()
+	}
+}
+
+func TestDbInMemory(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("foo"))
+	v := db.GetString("a")
+	if string(v) != "foo" {
+		t.Errorf("v != foo")
+		t.FailNow()
+	}
+}
+
+func testDbFlush(t *testing.T, config *kvdb.DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+
+	db := openTestDb(t, config)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key%03d", i)
+		db.Put([]byte(k), []byte(fmt.Sprintf("value%d", i)))
+	}
+	db.Delete([]byte("key010"))
+	db.Put([]byte("key020"), []byte("new"))
+
+	check := func() {
+		for i := 0; i < 100; i++ {
+			v := db.GetString(fmt.Sprintf("key%03d", i))
+			expect := fmt.Sprintf("value%d", i)
+			if i == 10 && v != nil {
+				t.Errorf("deleted key found %s", v)
+				t.FailNow()
+			} else if i == 20 && string(v) != "new" {
+				t.Errorf("%s != new", v)
+				t.FailNow()
+			} else if i != 10 && i != 20 && string(v) != expect {
+				t.Errorf("%s != %s", v, expect)
+				t.FailNow()
+			}
+		}
+	}
+
+	check()
+	if err := db.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+		t.FailNow()
+	}
+	check()
+	db.Close()
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(tables) == 0 {
+		t.Errorf("no tables written")
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(logs) != 1 {
+		t.Errorf("flushed logs not removed %v", logs)
+	}
+
+	db = openTestDb(t, config)
+	defer db.Close()
+	check()
+}
+
+func TestDbFlushJSON(t *testing.T) {
+	testDbFlush(t, &kvdb.DbConfig{MemtableSize: 64})
+}
+
+func TestDbFlushBlock(t *testing.T) {
+	testDbFlush(t, &kvdb.DbConfig{
+		MemtableSize: 64,
+		TableFormat:  kvdb.TableFormatBlock,
+		BlockSize:    32,
+	})
+}
+
+// Binary keys and values, and the content type put with them, survive a
+// restart from the log and a flush to either table format
+func testDbContentType(t *testing.T, config *kvdb.DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+
+	key := []byte("k\x00\xff")
+	value := []byte("\x00\xfe\xff\x00")
+	db := openTestDb(t, config)
+	db.PutWithOptions(key, value, kvdb.PutOptions{ContentType: "image/png"})
+	db.Put([]byte("plain"), []byte("1"))
+	db.Close()
+
+	db = openTestDb(t, config)
+	defer db.Close()
+	for _, where := range []string{"log", "table"} {
+		if where == "table" {
+			db.Flush()
+		}
+		v, info, err := db.GetWithInfo(key)
+		if err != nil || string(v) != string(value) || info == nil ||
+			info.ContentType != "image/png" || info.Size != len(value) {
+			t.Errorf("%s: %q %+v %v", where, v, info, err)
+		}
+		if info, _ := db.Stat([]byte("plain")); info == nil || info.ContentType != "" {
+			t.Errorf("%s: plain %+v", where, info)
+		}
+	}
+
+	// A put without a content type clears it
+	db.Put(key, value)
+	if info, _ := db.Stat(key); info.ContentType != "" {
+		t.Errorf("content type %q kept", info.ContentType)
+	}
+}
+
+func TestDbContentTypeJSON(t *testing.T) {
+	testDbContentType(t, &kvdb.DbConfig{})
+}
+
+func TestDbContentTypeBlock(t *testing.T) {
+	testDbContentType(t, &kvdb.DbConfig{TableFormat: kvdb.TableFormatBlock})
+}
@@ -0,0 +1,382 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Column families.  A database holds one or more named families, each a
+// key space of its own with its own memtable and tables, compacted on its
+// own and ordered by its own comparator.  Every family shares the one
+// write-ahead log, so a batch writing to several of them is applied
+// atomically, and the one sequence, so a snapshot's sequence or the last
+// sequence means the same in each.
+//
+// The default family always exists, has ID 0 and is the one the Db's own
+// methods read and write.  Others are created and dropped while the
+// database is open and recorded in the manifest.  Log records for them
+// carry their ID, see wal.go.  IDs are never reused, so records for a
+// dropped family still in the log are skipped when it is replayed.
+//
+// The memtables of every family are frozen together once between them
+// they reach DbConfig.MemtableSize, each non-empty one being flushed to a
+// table of its family, so a log can be dropped once that flush is done.
+//
+// History, transactions, compare-and-swap, change feeds and replication
+// snapshots cover the default family only.  Records for other families
+// are shipped to followers like any other, a follower skips those for
+// families it does not have.
+
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Name of the family the Db's own methods use
+const DefaultFamily = "default"
+
+const maxFamilyName = 64
+
+var ErrNoFamily = errors.New("kvdb: no such column family")
+
+var ErrFamilyExists = errors.New("kvdb: column family already exists")
+
+var ErrInvalidFamily = errors.New("kvdb: invalid column family name")
+
+var ErrDropDefault = errors.New("kvdb: the default column family cannot be dropped")
+
+var ErrUnknownComparator = errors.New("kvdb: unknown comparator")
+
+// Orders the keys of a family.  Compare returns a negative number, zero
+// or a positive number as a sorts before, is equal to or sorts after b,
+// and must only return zero for identical keys.  A family records the
+// name of its comparator, and a comparator by that name must be given
+// whenever the database is opened again.
+type Comparator interface {
+	Name() string
+	Compare(a, b []byte) int
+}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string { return "bytewise" }
+
+func (bytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string { return "reverse" }
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+// The built in comparators, keys in lexicographic byte order and the
+// reverse of it
+var (
+	BytewiseComparator Comparator = bytewiseComparator{}
+	ReverseComparator  Comparator = reverseComparator{}
+)
+
+// Find the comparator named name, among those built in and those in
+// DbConfig.Comparators.  An empty name is bytewise.
+func (config *DbConfig) comparator(name string) (Comparator, error) {
+	if name == "" {
+		return BytewiseComparator, nil
+	}
+	for _, c := range config.Comparators {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	for _, c := range []Comparator{BytewiseComparator, ReverseComparator} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, ErrUnknownComparator
+}
+
+// Options a family is created with, fixed for its lifetime
+type FamilyOptions struct {
+	// Values put without a TTL or expiry time of their own expire this
+	// long after they are written, never if zero
+	TTL time.Duration
+
+	// How the family's tables are merged, see compaction.go
+	CompactionStyle CompactionStyle
+
+	// Name of the comparator ordering the family's keys: bytewise, the
+	// default, reverse or one given in DbConfig.Comparators
+	Comparator string
+}
+
+// A column family, see Db.CreateFamily.  Handles stay valid until the
+// family is dropped, after which their methods return ErrNoFamily.
+type Family struct {
+	db      *Db
+	id      uint64
+	name    string
+	options FamilyOptions
+	cmp     Comparator
+
+	// As for the whole database before families, see Db
+	mem            *Tree
+	imm            *Tree
+	levels         [][]table
+	compactPointer [numLevels][]byte
+
+	dropped bool
+}
+
+// Names are 1 to 64 letters, digits, '-', '_' or '.'
+func validFamilyName(name string) bool {
+	if len(name) == 0 || len(name) > maxFamilyName {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *Db) newFamily(id uint64, name string, opts FamilyOptions) (*Family, error) {
+	if opts.TTL < 0 {
+		return nil, ErrInvalidTTL
+	}
+	cmp, err := db.config.comparator(opts.Comparator)
+	if err != nil {
+		return nil, err
+	}
+	opts.Comparator = cmp.Name()
+	return &Family{
+		db:      db,
+		id:      id,
+		name:    name,
+		options: opts,
+		cmp:     cmp,
+		mem:     newTree(cmp),
+		levels:  make([][]table, numLevels),
+	}, nil
+}
+
+// db.lock must be held for the following
+
+func (db *Db) defaultFamily() *Family {
+	return db.families[0]
+}
+
+func (db *Db) familyNamed(name string) *Family {
+	for _, f := range db.families {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Every family, in the order they were created
+func (db *Db) familyList() []*Family {
+	families := make([]*Family, 0, len(db.families))
+	for _, f := range db.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+// Approximate size in bytes of every family's active memtable
+func (db *Db) memSize() int {
+	size := 0
+	for _, f := range db.families {
+		size += f.mem.Size()
+	}
+	return size
+}
+
+// Create a family called name.  Returns ErrFamilyExists if there already
+// is one, ErrInvalidFamily if the name is not allowed and
+// ErrUnknownComparator if the comparator in opts is not known.
+func (db *Db) CreateFamily(name string, opts FamilyOptions) (*Family, error) {
+	if !validFamilyName(name) {
+		return nil, ErrInvalidFamily
+	}
+	if opts.CompactionStyle != CompactionLeveled && opts.CompactionStyle != CompactionSizeTiered {
+		return nil, errors.New("kvdb: unknown compaction style")
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if db.familyNamed(name) != nil {
+		return nil, ErrFamilyExists
+	}
+	f, err := db.newFamily(db.nextFamily, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if db.manifest != nil {
+		err := db.manifest.apply(&versionEdit{
+			nextFamily: f.id + 1,
+			created:    []familyDef{{f.id, f.name, f.options}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	db.nextFamily++
+	db.families[f.id] = f
+	return f, nil
+}
+
+// Drop the family called name along with everything in it.  Iterators
+// already open on it keep reading what it held.
+func (db *Db) DropFamily(name string) error {
+	// No compaction may install tables in the family
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.waitForFlush()
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	f := db.familyNamed(name)
+	if f == nil {
+		return ErrNoFamily
+	} else if f.id == 0 {
+		return ErrDropDefault
+	}
+
+	if db.manifest != nil {
+		if err := db.manifest.apply(&versionEdit{dropped: []uint64{f.id}}); err != nil {
+			return err
+		}
+	}
+	delete(db.families, f.id)
+	f.dropped = true
+	for _, tables := range f.levels {
+		for _, t := range tables {
+			db.releaseTable(t)
+		}
+	}
+	f.mem, f.levels = newTree(f.cmp), make([][]table, numLevels)
+	return nil
+}
+
+// The family called name, nil if there is none
+func (db *Db) Family(name string) *Family {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.familyNamed(name)
+}
+
+// Every family, the default first and the rest in the order they were
+// created
+func (db *Db) Families() []*Family {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.familyList()
+}
+
+func (f *Family) Name() string {
+	return f.name
+}
+
+func (f *Family) Options() FamilyOptions {
+	return f.options
+}
+
+// ErrClosed or ErrNoFamily if the family can no longer be used, db.lock
+// must be held
+func (f *Family) check() error {
+	if f.db.closed {
+		return ErrClosed
+	}
+	if f.dropped {
+		return ErrNoFamily
+	}
+	return nil
+}
+
+// Get the value of key, returning nil if it does not exist
+func (f *Family) Get(key []byte) ([]byte, error) {
+	v, _, err := f.GetWithInfo(key)
+	return v, err
+}
+
+// Get the value of key along with its description, returning nil for
+// both if it does not exist
+func (f *Family) GetWithInfo(key []byte) ([]byte, *KeyInfo, error) {
+	f.db.lock.Lock()
+	defer f.db.lock.Unlock()
+	if err := f.check(); err != nil {
+		return nil, nil, err
+	}
+	e, err := f.getEntryAt(key, f.db.lastSequence, f.db.now().Unix())
+	if e == nil {
+		return nil, nil, err
+	}
+	return e.Value, keyInfo(e), nil
+}
+
+// Describe the current value of key without returning it, nil if the
+// key does not exist
+func (f *Family) Stat(key []byte) (*KeyInfo, error) {
+	_, info, err := f.GetWithInfo(key)
+	return info, err
+}
+
+func (f *Family) Put(key, value []byte) error {
+	return f.PutWithOptions(key, value, PutOptions{})
+}
+
+// Put key with opts, see Db.PutWithOptions.  Without a TTL or expiry
+// time in opts the family's TTL applies.
+func (f *Family) PutWithOptions(key, value []byte, opts PutOptions) error {
+	f.db.lock.Lock()
+	defer f.db.lock.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	r, err := f.db.putRecord(key, value, opts)
+	if err != nil {
+		return err
+	}
+	r.family = f.id
+	return f.db.write(r)
+}
+
+func (f *Family) Delete(key []byte) error {
+	f.db.lock.Lock()
+	defer f.db.lock.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.db.write(&walRecord{walRecordDelete, key, nil, 0, 0, "", f.id})
+}
+
+// Create an iterator over the family as it is now, see Iterator.  Keys
+// are visited in the order of the family's comparator.
+func (f *Family) NewIterator() Iterator {
+	f.db.lock.Lock()
+	defer f.db.lock.Unlock()
+	if f.dropped {
+		return &dbIterator{db: f.db, merge: &mergingIterator{}, e: ErrNoFamily}
+	}
+	return f.db.newIterator(f, f.db.lastSequence)
+}
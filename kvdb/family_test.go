@@ -0,0 +1,311 @@
+// Whitebox tests for family.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func createTestFamily(t *testing.T, db *Db, name string, opts FamilyOptions) *Family {
+	f, err := db.CreateFamily(name, opts)
+	if err != nil {
+		t.Errorf("CreateFamily %s failed: %v", name, err)
+		t.FailNow()
+	}
+	return f
+}
+
+// Check the keys an iterator over f visits in both directions
+func checkFamilyKeys(t *testing.T, f *Family, expect []string, msg string) {
+	it := f.NewIterator()
+	defer it.Close()
+	got := []string{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	back := []string{}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		back = append([]string{string(it.Key())}, back...)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) || fmt.Sprint(back) != fmt.Sprint(expect) {
+		t.Errorf("%s: iterated %v %v != %v", msg, got, back, expect)
+		t.FailNow()
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	db := openCompactionDb(t, &DbConfig{})
+	defer db.Close()
+	users := createTestFamily(t, db, "users", FamilyOptions{})
+	orders := createTestFamily(t, db, "orders", FamilyOptions{})
+
+	db.Put([]byte("k"), []byte("default"))
+	users.Put([]byte("k"), []byte("users"))
+	orders.Put([]byte("k"), []byte("orders"))
+	orders.Delete([]byte("k"))
+	if v := db.GetString("k"); string(v) != "default" {
+		t.Errorf("default k = %q", v)
+	}
+	if v, _ := users.Get([]byte("k")); string(v) != "users" {
+		t.Errorf("users k = %q", v)
+	}
+	if v, _ := orders.Get([]byte("k")); v != nil {
+		t.Errorf("orders k = %q after delete", v)
+	}
+	checkIteratorKeys(t, db, []string{"k"}, "default")
+	checkFamilyKeys(t, orders, []string{}, "orders")
+
+	if _, err := db.CreateFamily("users", FamilyOptions{}); err != ErrFamilyExists {
+		t.Errorf("creating users twice: %v", err)
+	}
+	if _, err := db.CreateFamily(DefaultFamily, FamilyOptions{}); err != ErrFamilyExists {
+		t.Errorf("creating the default family: %v", err)
+	}
+	if _, err := db.CreateFamily("a/b", FamilyOptions{}); err != ErrInvalidFamily {
+		t.Errorf("creating a/b: %v", err)
+	}
+	if _, err := db.CreateFamily("x", FamilyOptions{Comparator: "nope"}); err != ErrUnknownComparator {
+		t.Errorf("creating with an unknown comparator: %v", err)
+	}
+
+	names := []string{}
+	for _, f := range db.Families() {
+		names = append(names, f.Name())
+	}
+	if fmt.Sprint(names) != "[default users orders]" {
+		t.Errorf("families %v", names)
+	}
+
+	if err := db.DropFamily(DefaultFamily); err != ErrDropDefault {
+		t.Errorf("dropping the default family: %v", err)
+	}
+	if err := db.DropFamily("users"); err != nil {
+		t.Errorf("DropFamily failed: %v", err)
+	}
+	if err := db.DropFamily("users"); err != ErrNoFamily {
+		t.Errorf("dropping users twice: %v", err)
+	}
+	if _, err := users.Get([]byte("k")); err != ErrNoFamily {
+		t.Errorf("Get from a dropped family: %v", err)
+	}
+	if err := users.Put([]byte("k"), nil); err != ErrNoFamily {
+		t.Errorf("Put to a dropped family: %v", err)
+	}
+	if db.Family("users") != nil || db.Family("orders") != orders {
+		t.Errorf("Family lookup after drop")
+	}
+
+	// A new family of the same name starts empty
+	users = createTestFamily(t, db, "users", FamilyOptions{})
+	if v, _ := users.Get([]byte("k")); v != nil {
+		t.Errorf("recreated users k = %q", v)
+	}
+}
+
+// A batch across families is applied whole or not at all
+func TestFamilyBatch(t *testing.T) {
+	db := openCompactionDb(t, &DbConfig{})
+	defer db.Close()
+	a := createTestFamily(t, db, "a", FamilyOptions{})
+	b := createTestFamily(t, db, "b", FamilyOptions{})
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("k"), []byte("0"))
+	batch.PutIn(a, []byte("k"), []byte("1"))
+	batch.PutIn(b, []byte("k"), []byte("2"))
+	batch.DeleteIn(a, []byte("gone"))
+	if err := db.Write(batch); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	for f, expect := range map[*Family]string{db.Family(DefaultFamily): "0", a: "1", b: "2"} {
+		if v, _ := f.Get([]byte("k")); string(v) != expect {
+			t.Errorf("%s k = %q", f.Name(), v)
+		}
+	}
+
+	db.DropFamily("b")
+	sequence := db.LastSequence()
+	batch.Reset()
+	batch.PutIn(a, []byte("k"), []byte("x"))
+	batch.PutIn(b, []byte("k"), []byte("x"))
+	if err := db.Write(batch); err != ErrNoFamily {
+		t.Errorf("Write to a dropped family: %v", err)
+	}
+	if v, _ := a.Get([]byte("k")); string(v) != "1" || db.LastSequence() != sequence {
+		t.Errorf("part of a refused batch was written")
+	}
+
+	txn := db.Begin()
+	if err := txn.Write(batch); err != ErrTxnFamily {
+		t.Errorf("Txn.Write to a family: %v", err)
+	}
+	txn.Rollback()
+}
+
+// Families, their options and their contents, in tables and in the log,
+// survive reopening.  Records for a dropped family left in the log are
+// skipped.
+func TestFamilyReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	opts := FamilyOptions{TTL: time.Hour, CompactionStyle: CompactionSizeTiered, Comparator: "reverse"}
+	a := createTestFamily(t, db, "a", opts)
+	b := createTestFamily(t, db, "b", FamilyOptions{})
+	a.Put([]byte("flushed"), []byte("1"))
+	db.Put([]byte("flushed"), []byte("0"))
+	db.Flush()
+	a.Put([]byte("logged"), []byte("2"))
+	b.Put([]byte("logged"), []byte("3"))
+	db.DropFamily("b")
+	db.Close()
+
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	a = db.Family("a")
+	if a == nil || a.Options() != opts || db.Family("b") != nil {
+		t.Errorf("families after reopening %v", db.Families())
+		t.FailNow()
+	}
+	checkFamilyKeys(t, a, []string{"logged", "flushed"}, "a")
+	if info, _ := a.Stat([]byte("logged")); info == nil || info.Expires.IsZero() {
+		t.Errorf("family TTL lost %+v", info)
+	}
+	if v := db.GetString("flushed"); string(v) != "0" {
+		t.Errorf("default flushed = %q", v)
+	}
+
+	// b's ID is not reused, so its records still in the log stay skipped
+	b = createTestFamily(t, db, "b", FamilyOptions{})
+	db.Close()
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+	if v, _ := db.Family("b").Get([]byte("logged")); v != nil || b.id != 3 {
+		t.Errorf("b's ID %d, logged = %q", b.id, v)
+	}
+}
+
+// Keys in a family with the reverse comparator come in descending order
+// from memtables, tables and compacted tables alike
+func TestFamilyComparator(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openCompactionDb(t, &DbConfig{Dir: dir, L0CompactionTrigger: 2})
+	defer db.Close()
+	f := createTestFamily(t, db, "rev", FamilyOptions{Comparator: "reverse"})
+
+	expect := []string{}
+	for i := 9; i >= 0; i-- {
+		expect = append(expect, fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		f.Put([]byte(fmt.Sprintf("key%d", i)), []byte{byte(i)})
+		if i%3 == 2 {
+			db.Flush()
+		}
+	}
+	checkFamilyKeys(t, f, expect, "before compacting")
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+	}
+	if len(f.levels[1]) == 0 {
+		t.Errorf("no tables compacted to level 1")
+	}
+	checkFamilyKeys(t, f, expect, "after compacting")
+
+	it := f.NewIterator()
+	defer it.Close()
+	if it.Seek([]byte("key45")); !it.Valid() || string(it.Key()) != "key4" {
+		t.Errorf("Seek found %q", it.Key())
+	}
+	for i := 0; i < 10; i++ {
+		if v, _ := f.Get([]byte(fmt.Sprintf("key%d", i))); len(v) != 1 || v[0] != byte(i) {
+			t.Errorf("key%d = %v", i, v)
+		}
+	}
+}
+
+// Values put to a family with a TTL expire unless they have their own
+func TestFamilyTTL(t *testing.T) {
+	db, clock := openHistoryDb(t, &DbConfig{})
+	defer db.Close()
+	f := createTestFamily(t, db, "short", FamilyOptions{TTL: time.Minute})
+	f.Put([]byte("a"), []byte("1"))
+	f.PutWithOptions([]byte("b"), []byte("2"), PutOptions{TTL: time.Hour})
+	batch := NewWriteBatch()
+	batch.PutIn(f, []byte("c"), []byte("3"))
+	batch.Put([]byte("c"), []byte("3"))
+	db.Write(batch)
+
+	clock.advance(time.Minute)
+	checkFamilyKeys(t, f, []string{"b"}, "after a minute")
+	if v := db.GetString("c"); string(v) != "3" {
+		t.Errorf("the default family's c expired")
+	}
+}
+
+// Each family is compacted with its own style
+func TestFamilyCompactionStyle(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+	f := createTestFamily(t, db, "tiered", FamilyOptions{CompactionStyle: CompactionSizeTiered})
+	for i := 0; i < 4; i++ {
+		db.Put([]byte("k"), []byte(fmt.Sprint(i)))
+		f.Put([]byte("k"), []byte(fmt.Sprint(i)))
+		db.Flush()
+	}
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+	}
+
+	def := db.Family(DefaultFamily)
+	if len(def.levels[0]) != 0 || len(def.levels[1]) != 1 {
+		t.Errorf("leveled family has %d %d tables", len(def.levels[0]), len(def.levels[1]))
+	}
+	if len(f.levels[0]) != 1 || len(f.levels[1]) != 0 {
+		t.Errorf("tiered family has %d %d tables", len(f.levels[0]), len(f.levels[1]))
+	}
+	if stats := db.CompactionStats(); stats.Compactions != 2 || stats.Levels[0].Tables != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	if v, _ := f.Get([]byte("k")); string(v) != "3" {
+		t.Errorf("tiered k = %q", v)
+	}
+}
+
+// Iterators on a dropped family keep reading what it held, and its tables
+// are removed once they close
+func TestDropFamilyWithIterator(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+	f := createTestFamily(t, db, "f", FamilyOptions{})
+	f.Put([]byte("a"), []byte("1"))
+	db.Flush()
+	f.Put([]byte("b"), []byte("2"))
+	number := f.levels[0][0].fileNumber()
+
+	it := f.NewIterator()
+	db.DropFamily("f")
+	checkFamilyKeys(t, f, []string{}, "dropped")
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 2 || it.Err() != nil {
+		t.Errorf("iterator saw %d keys, %v", n, it.Err())
+	}
+	if _, err := os.Stat(fileName(dir, tableFile, number)); err != nil {
+		t.Errorf("table removed while in use: %v", err)
+	}
+	it.Close()
+	if _, err := os.Stat(fileName(dir, tableFile, number)); !os.IsNotExist(err) {
+		t.Errorf("table kept after drop: %v", err)
+	}
+}
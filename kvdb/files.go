@@ -0,0 +1,130 @@
+package kvdb
+
+// Naming and bookkeeping for the files in a database directory.  Logs
+// and tables share one sequence of file numbers so their names also
+// record the order they were created in.
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type fileKind int
+
+const (
+	logFile fileKind = iota
+	tableFile
+	tempFile
+	manifestFile
+)
+
+var fileSuffixes = map[fileKind]string{
+	logFile:      ".log",
+	tableFile:    ".sst",
+	tempFile:     ".tmp",
+	manifestFile: ".manifest",
+}
+
+func fileName(dir string, kind fileKind, number uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", number, fileSuffixes[kind]))
+}
+
+func parseFileName(name string) (fileKind, uint64, bool) {
+	for kind, suffix := range fileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			number, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			return kind, number, true
+		}
+	}
+	return 0, 0, false
+}
+
+// List the numbers of every file of kind in dir, oldest first
+func listFiles(dir string, kind fileKind) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := []uint64{}
+	for _, info := range infos {
+		k, number, ok := parseFileName(info.Name())
+		if ok && k == kind {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// fsync a directory so that renames and removals within it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// A file being written under a temporary name, it only appears under
+// its real name once committed so readers never see partial contents.
+type pendingFile struct {
+	*os.File
+	dir    string
+	kind   fileKind
+	number uint64
+}
+
+func createPending(dir string, kind fileKind, number uint64) (*pendingFile, error) {
+	f, err := os.Create(fileName(dir, tempFile, number))
+	if err != nil {
+		return nil, err
+	}
+	return &pendingFile{f, dir, kind, number}, nil
+}
+
+// Sync, close and rename the file to its real name.  The directory is
+// not synced, see syncDir.
+func (p *pendingFile) commit() error {
+	err := p.Sync()
+	if cerr := p.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p.Name(), fileName(p.dir, p.kind, p.number))
+	}
+	if err != nil {
+		os.Remove(p.Name())
+	}
+	return err
+}
+
+func (p *pendingFile) abort() {
+	p.Close()
+	os.Remove(p.Name())
+}
+
+// Write a file by way of a temporary file and a rename so that readers
+// only ever see the complete contents.
+func writeFileAtomic(dir string, number uint64, kind fileKind, write func(f *os.File) error) error {
+	p, err := createPending(dir, kind, number)
+	if err != nil {
+		return err
+	}
+	if err := write(p.File); err != nil {
+		p.abort()
+		return err
+	}
+	if err := p.commit(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Key history.  Every put or delete writes a new version of its key
+// stamped with the time it was made, in epoch seconds.  With
+// DbConfig.HistoryVersions or DbConfig.HistoryAge set, replaced versions
+// are kept alongside the current one in the memtable and through
+// compaction instead of being discarded, so History can list how a key
+// changed and GetAt can read it as it was at an earlier time.
+//
+// A key's history is its newest versions up to the first one the
+// retention bounds exclude, the depth'th newest being excluded when depth
+// is above HistoryVersions or when the version after it was written
+// HistoryAge or more ago.  Versions outside the history are discarded
+// lazily, when the memtable next writes the key or compaction next merges
+// it, and are not returned in the meantime.  Deletes are kept as
+// tombstones for as long as they are in the history, as are values with
+// a TTL once they expire and are purged by a flush or compaction.
+
+package kvdb
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// One version of a key.  Expires is zero unless the value was put with a
+// TTL, and ContentType empty unless it was put with one.
+type Version struct {
+	Value       []byte
+	Timestamp   time.Time
+	Expires     time.Time
+	ContentType string
+	Deleted     bool
+	Sequence    uint64
+}
+
+// Whether the configuration keeps any history beyond the current version
+func (config *DbConfig) keepsHistory() bool {
+	if config.HistoryVersions > 0 {
+		return config.HistoryVersions > 1
+	}
+	return config.HistoryAge > 0
+}
+
+// Whether the depth'th newest version of a key, the newest being 1, is in
+// its history when the version after it was written at replaced and the
+// time is now
+func (config *DbConfig) historyKeeps(depth int, replaced, now int64) bool {
+	if depth <= 1 {
+		return true
+	}
+	if !config.keepsHistory() {
+		return false
+	}
+	if config.HistoryVersions > 0 && depth > config.HistoryVersions {
+		return false
+	}
+	if config.HistoryAge > 0 && now-replaced >= int64(config.HistoryAge/time.Second) {
+		return false
+	}
+	return true
+}
+
+// Whether the memtable keeps v, the depth'th newest version of its key,
+// now that newer replaced it.  db.lock must be held.
+func (db *Db) retainVersion(v, newer *Node, depth int) bool {
+	return db.snapshotReads(v.sequence, newer.sequence) ||
+		db.config.historyKeeps(depth, newer.timestamp, db.now().Unix())
+}
+
+// Every version of key in the default family, newest first, including
+// those outside its history.  db.lock must be held.
+func (db *Db) versions(key []byte) ([]tableEntry, error) {
+	f := db.defaultFamily()
+	entries := []tableEntry{}
+	for _, tree := range []*Tree{f.mem, f.imm} {
+		if tree == nil {
+			continue
+		}
+		for n := tree.find(key); n != nil; n = n.older {
+			entries = append(entries, n.entry())
+		}
+	}
+
+	for _, tables := range f.levels {
+		for _, t := range tables {
+			if !t.meta().contains(key) || !t.meta().filter.mayContain(key) {
+				continue
+			}
+			it := t.iterator()
+			for it.seek(key); it.valid() && bytes.Equal(it.entry().Key, key); it.next() {
+				entries = append(entries, *it.entry())
+			}
+			if it.err() != nil {
+				return nil, it.err()
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sequence > entries[j].Sequence
+	})
+	return entries, nil
+}
+
+// The history of key, newest version first.  A key that was never written,
+// or whose only remaining version is a delete that was discarded, has
+// none.
+func (db *Db) History(key []byte) ([]Version, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	entries, err := db.versions(key)
+	if err != nil {
+		return nil, err
+	}
+	now := db.now().Unix()
+	history := []Version{}
+	for i, e := range entries {
+		if i > 0 && !db.config.historyKeeps(i+1, entries[i-1].Timestamp, now) {
+			break
+		}
+		v := Version{
+			Value:       e.Value,
+			Timestamp:   time.Unix(e.Timestamp, 0),
+			ContentType: e.ContentType,
+			Deleted:     e.Tombstone,
+			Sequence:    e.Sequence,
+		}
+		if e.Expires > 0 {
+			v.Expires = time.Unix(e.Expires, 0)
+		}
+		history = append(history, v)
+	}
+	return history, nil
+}
+
+// Get the value key had at time t, returning nil if it did not exist or
+// had expired then, or if the versions from then are no longer in its
+// history
+func (db *Db) GetAt(key []byte, t time.Time) ([]byte, error) {
+	history, err := db.History(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range history {
+		if !v.Timestamp.After(t) {
+			if v.Deleted || !v.Expires.IsZero() && !t.Before(v.Expires) {
+				return nil, nil
+			}
+			return v.Value, nil
+		}
+	}
+	return nil, nil
+}
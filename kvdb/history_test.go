@@ -0,0 +1,218 @@
+// Whitebox tests for history.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A clock tests advance by hand
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func openHistoryDb(t *testing.T, config *DbConfig) (*Db, *testClock) {
+	db := openCompactionDb(t, config)
+	clock := &testClock{time.Unix(1600000000, 0)}
+	db.lock.Lock()
+	db.now = clock.now
+	db.lock.Unlock()
+	return db, clock
+}
+
+// Check the values of key's history, newest first, with "" for a delete
+func checkHistory(t *testing.T, db *Db, key string, expect []string, msg string) {
+	history, err := db.History([]byte(key))
+	if err != nil {
+		t.Errorf("%s: History failed: %v", msg, err)
+		t.FailNow()
+	}
+	got := []string{}
+	for _, v := range history {
+		if v.Deleted {
+			got = append(got, "")
+		} else {
+			got = append(got, string(v.Value))
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("%s: history %q != %q", msg, got, expect)
+		t.FailNow()
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].Timestamp.After(history[i-1].Timestamp) ||
+			history[i].Sequence >= history[i-1].Sequence {
+			t.Errorf("%s: history out of order %v", msg, history)
+			t.FailNow()
+		}
+	}
+}
+
+func tableEntries(db *Db) uint64 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var count uint64
+	for _, level := range db.defaultFamily().levels {
+		for _, tbl := range level {
+			count += tbl.meta().count
+		}
+	}
+	return count
+}
+
+// The same history is read from the memtable, from flushed tables and
+// after compaction
+func testHistoryVersions(t *testing.T, config *DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+	config.HistoryVersions = 3
+	config.L0CompactionTrigger = 1
+
+	db, clock := openHistoryDb(t, config)
+	defer db.Close()
+
+	start := clock.t
+	for i := 1; i <= 5; i++ {
+		db.Put([]byte("a"), []byte(fmt.Sprint(i)))
+		db.Put([]byte("b"), []byte(fmt.Sprint(i)))
+		clock.advance(time.Minute)
+	}
+	db.Delete([]byte("b"))
+	checkHistory(t, db, "a", []string{"5", "4", "3"}, "memtable")
+	checkHistory(t, db, "b", []string{"", "5", "4"}, "memtable")
+	checkHistory(t, db, "c", []string{}, "memtable")
+
+	db.Flush()
+	checkHistory(t, db, "a", []string{"5", "4", "3"}, "flushed")
+	db.Put([]byte("a"), []byte("6"))
+	db.Flush()
+	db.Put([]byte("a"), []byte("7"))
+	checkHistory(t, db, "a", []string{"7", "6", "5"}, "spread")
+
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+	checkHistory(t, db, "a", []string{"7", "6", "5"}, "compacted")
+	checkHistory(t, db, "b", []string{"", "5", "4"}, "compacted")
+	if n := tableEntries(db); n != 6 {
+		t.Errorf("%d entries kept for 3 versions of 2 keys", n)
+	}
+
+	for i, expect := range []string{"", "", "", "4", "5"} {
+		at := start.Add(time.Duration(i)*time.Minute + time.Second)
+		v, err := db.GetAt([]byte("b"), at)
+		if err != nil || string(v) != expect || expect == "" && v != nil {
+			t.Errorf("b at %d = %q, %v", i, v, err)
+		}
+	}
+	if v, _ := db.GetAt([]byte("b"), clock.t); v != nil {
+		t.Errorf("deleted b = %q", v)
+	}
+	if v, _ := db.GetAt([]byte("a"), start.Add(-time.Second)); v != nil {
+		t.Errorf("a before it was written = %q", v)
+	}
+}
+
+func TestHistoryVersionsJSON(t *testing.T) {
+	testHistoryVersions(t, &DbConfig{})
+}
+
+func TestHistoryVersionsBlock(t *testing.T) {
+	testHistoryVersions(t, &DbConfig{TableFormat: TableFormatBlock, BlockSize: 64})
+}
+
+// Replaced versions expire HistoryAge after they were replaced
+func TestHistoryAge(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db, clock := openHistoryDb(t, &DbConfig{Dir: dir, HistoryAge: time.Hour,
+		L0CompactionTrigger: 1})
+	defer db.Close()
+
+	// z widens the table so a later put of m compacts with it
+	db.Put([]byte("z"), []byte("1"))
+	for i := 1; i <= 4; i++ {
+		db.Put([]byte("a"), []byte(fmt.Sprint(i)))
+		clock.advance(15 * time.Minute)
+	}
+	checkHistory(t, db, "a", []string{"4", "3", "2", "1"}, "young")
+	clock.advance(30 * time.Minute)
+	checkHistory(t, db, "a", []string{"4", "3"}, "aged")
+
+	db.Flush()
+	db.Delete([]byte("a"))
+	db.Flush()
+	db.Compact()
+	checkHistory(t, db, "a", []string{"", "4", "3"}, "deleted")
+	if n := tableEntries(db); n != 4 {
+		t.Errorf("%d entries kept for 4 versions", n)
+	}
+
+	// Once the value it replaced expires the delete goes too
+	clock.advance(2 * time.Hour)
+	checkHistory(t, db, "a", []string{""}, "expired")
+	db.Put([]byte("m"), []byte("1"))
+	db.Flush()
+	db.Compact()
+	checkHistory(t, db, "a", []string{}, "dropped")
+	if n := tableEntries(db); n != 2 {
+		t.Errorf("%d entries kept for 2 versions", n)
+	}
+}
+
+// Without history only the current version is kept
+func TestHistoryDisabled(t *testing.T) {
+	db, _ := openHistoryDb(t, &DbConfig{})
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("a"), []byte("2"))
+	checkHistory(t, db, "a", []string{"2"}, "put")
+	if n := db.defaultFamily().mem.find([]byte("a")); n.older != nil {
+		t.Errorf("old version kept")
+	}
+	db.Delete([]byte("a"))
+	checkHistory(t, db, "a", []string{}, "deleted")
+}
+
+// Timestamps are logged, so replay keeps the times mutations were made
+func TestHistoryReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir, HistoryVersions: 10}
+
+	db, clock := openHistoryDb(t, config)
+	start := clock.t
+	db.Put([]byte("a"), []byte("1"))
+	clock.advance(time.Minute)
+	batch := NewWriteBatch()
+	batch.Put([]byte("a"), []byte("2"))
+	batch.Delete([]byte("b"))
+	db.Write(batch)
+	db.Close()
+
+	db, _ = openHistoryDb(t, config)
+	defer db.Close()
+	checkHistory(t, db, "a", []string{"2", "1"}, "replayed")
+	history, _ := db.History([]byte("a"))
+	if !history[0].Timestamp.Equal(start.Add(time.Minute)) ||
+		!history[1].Timestamp.Equal(start) {
+		t.Errorf("timestamps not replayed %v", history)
+	}
+	checkHistory(t, db, "b", []string{""}, "replayed delete")
+}
@@ -0,0 +1,489 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Ordered iteration over the whole database.  A database iterator merges
+// an iterator for each memtable and table, newest first, keeping only the
+// newest version of each key visible at the iterator's sequence and hiding
+// tombstones and expired values.
+//
+// The merge keeps every child positioned relative to the current key.
+// Moving forward, each child sits on its first entry at or after the
+// current key, so stepping advances just the children on the current key.
+// Moving backward is the mirror image, and changing direction re-seeks
+// every child.
+
+package kvdb
+
+import (
+	"bytes"
+)
+
+// Walks the keys of a Db in order.  Key and Value return slices that are
+// only valid until the iterator is moved and must not be modified.
+//
+// The iterator reads a consistent snapshot of the database taken when it
+// was created, writes made afterwards are not seen.  Close must be called
+// once the iterator is no longer needed so the versions it reads can be
+// discarded.
+type Iterator interface {
+	// Position at the first key greater than or equal to key
+	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
+
+	Next()
+	Prev()
+
+	// Whether the iterator is positioned at a key, false once it moves
+	// past either end or hits an error
+	Valid() bool
+	Key() []byte
+	Value() []byte
+
+	Err() error
+	Close() error
+}
+
+// Iterates over the versions of a memtable visible at sequence, at most
+// one per key.  The tree may change between calls, so the current entry
+// is copied out while the caller holds db.lock, and if a node has been
+// removed since, the iterator finds its place again by key.
+type memIterator struct {
+	tree       *Tree
+	sequence   uint64
+	node       *Node
+	generation uint64
+	current    tableEntry
+}
+
+func newMemIterator(tree *Tree, sequence uint64) *memIterator {
+	return &memIterator{tree: tree, sequence: sequence}
+}
+
+// Position at n, or if none of its versions are visible, the nearest
+// node in the direction of step that has one
+func (it *memIterator) setNode(n *Node, step func(*Node) *Node) {
+	for n != nil && n.visible(it.sequence) == nil {
+		n = step(n)
+	}
+	it.node = n
+	it.generation = it.tree.generation
+	if n != nil {
+		it.current = n.visible(it.sequence).entry()
+	}
+}
+
+func (it *memIterator) seekToFirst() {
+	it.setNode(it.tree.first(), successor)
+}
+
+func (it *memIterator) seekToLast() {
+	it.setNode(it.tree.last(), predecessor)
+}
+
+func (it *memIterator) seek(key []byte) {
+	it.setNode(it.tree.ceiling(key), successor)
+}
+
+func (it *memIterator) next() {
+	if it.generation == it.tree.generation {
+		it.setNode(successor(it.node), successor)
+		return
+	}
+	n := it.tree.ceiling(it.current.Key)
+	if n != nil && bytes.Equal(n.key, it.current.Key) {
+		n = successor(n)
+	}
+	it.setNode(n, successor)
+}
+
+func (it *memIterator) prev() {
+	if it.generation == it.tree.generation {
+		it.setNode(predecessor(it.node), predecessor)
+		return
+	}
+	n := it.tree.floor(it.current.Key)
+	if n != nil && bytes.Equal(n.key, it.current.Key) {
+		n = predecessor(n)
+	}
+	it.setNode(n, predecessor)
+}
+
+func (it *memIterator) valid() bool {
+	return it.node != nil
+}
+
+func (it *memIterator) entry() *tableEntry {
+	return &it.current
+}
+
+func (it *memIterator) err() error {
+	return nil
+}
+
+// Filters a table iterator, which holds every version of each key newest
+// first, down to the newest version of each key visible at sequence
+type versionIterator struct {
+	it       tableIterator
+	sequence uint64
+}
+
+// Move forward from the current entry to the first visible one
+func (v *versionIterator) settleForward() {
+	for v.it.valid() && v.it.entry().Sequence > v.sequence {
+		v.it.next()
+	}
+}
+
+// From the oldest version of some key, move back to the newest visible
+// version of that key or of an earlier one
+func (v *versionIterator) settleBackward() {
+	for v.it.valid() {
+		key := append([]byte{}, v.it.entry().Key...)
+		if v.it.entry().Sequence > v.sequence {
+			// The oldest version is invisible, so are the rest
+			for v.it.valid() && bytes.Equal(v.it.entry().Key, key) {
+				v.it.prev()
+			}
+			continue
+		}
+
+		// Walk back over newer visible versions, then step forward
+		// onto the newest of them
+		for {
+			v.it.prev()
+			if !v.it.valid() || !bytes.Equal(v.it.entry().Key, key) ||
+				v.it.entry().Sequence > v.sequence {
+				break
+			}
+		}
+		if v.it.valid() {
+			v.it.next()
+		} else if v.it.err() == nil {
+			v.it.seek(key)
+		}
+		return
+	}
+}
+
+func (v *versionIterator) seekToFirst() {
+	v.it.seekToFirst()
+	v.settleForward()
+}
+
+func (v *versionIterator) seekToLast() {
+	v.it.seekToLast()
+	v.settleBackward()
+}
+
+func (v *versionIterator) seek(key []byte) {
+	v.it.seek(key)
+	v.settleForward()
+}
+
+func (v *versionIterator) next() {
+	key := append([]byte{}, v.it.entry().Key...)
+	for v.it.valid() && bytes.Equal(v.it.entry().Key, key) {
+		v.it.next()
+	}
+	v.settleForward()
+}
+
+func (v *versionIterator) prev() {
+	key := append([]byte{}, v.it.entry().Key...)
+	for v.it.valid() && bytes.Equal(v.it.entry().Key, key) {
+		v.it.prev()
+	}
+	v.settleBackward()
+}
+
+func (v *versionIterator) valid() bool {
+	return v.it.valid()
+}
+
+func (v *versionIterator) entry() *tableEntry {
+	return v.it.entry()
+}
+
+func (v *versionIterator) err() error {
+	return v.it.err()
+}
+
+// Merges children, ordered newest first, yielding each key once with the
+// entry from the newest child holding it.  Tombstones are included.
+type mergingIterator struct {
+	children []tableIterator
+	current  tableIterator
+	forward  bool
+	e        error
+	cmp      Comparator
+}
+
+func (m *mergingIterator) checkErrors() {
+	for _, c := range m.children {
+		if err := c.err(); err != nil && m.e == nil {
+			m.e = err
+		}
+	}
+}
+
+// Choose the smallest or, moving backward, largest key among the
+// children.  On a tie the version with the highest sequence wins, or
+// for tables written before sequences were recorded, the earlier child.
+func (m *mergingIterator) pick() {
+	m.checkErrors()
+	m.current = nil
+	if m.e != nil {
+		return
+	}
+	for _, c := range m.children {
+		if !c.valid() {
+			continue
+		}
+		if m.current == nil {
+			m.current = c
+			continue
+		}
+		cmp := m.cmp.Compare(c.entry().Key, m.current.entry().Key)
+		if (m.forward && cmp < 0) || (!m.forward && cmp > 0) ||
+			(cmp == 0 && c.entry().Sequence > m.current.entry().Sequence) {
+			m.current = c
+		}
+	}
+}
+
+func (m *mergingIterator) seekToFirst() {
+	for _, c := range m.children {
+		c.seekToFirst()
+	}
+	m.forward = true
+	m.pick()
+}
+
+func (m *mergingIterator) seekToLast() {
+	for _, c := range m.children {
+		c.seekToLast()
+	}
+	m.forward = false
+	m.pick()
+}
+
+func (m *mergingIterator) seek(key []byte) {
+	for _, c := range m.children {
+		c.seek(key)
+	}
+	m.forward = true
+	m.pick()
+}
+
+func (m *mergingIterator) next() {
+	key := append([]byte{}, m.current.entry().Key...)
+	if !m.forward {
+		// Every child is at or before key, move them all past it
+		for _, c := range m.children {
+			c.seek(key)
+		}
+		m.forward = true
+	}
+	for _, c := range m.children {
+		if c.valid() && bytes.Equal(c.entry().Key, key) {
+			c.next()
+		}
+	}
+	m.pick()
+}
+
+func (m *mergingIterator) prev() {
+	key := append([]byte{}, m.current.entry().Key...)
+	if m.forward {
+		// Every child is at or after key, move them all before it
+		for _, c := range m.children {
+			c.seek(key)
+			if c.valid() {
+				c.prev()
+			} else if c.err() == nil {
+				c.seekToLast()
+			}
+		}
+		m.forward = false
+	} else {
+		for _, c := range m.children {
+			if c.valid() && bytes.Equal(c.entry().Key, key) {
+				c.prev()
+			}
+		}
+	}
+	m.pick()
+}
+
+func (m *mergingIterator) valid() bool {
+	return m.current != nil
+}
+
+func (m *mergingIterator) entry() *tableEntry {
+	return m.current.entry()
+}
+
+func (m *mergingIterator) err() error {
+	return m.e
+}
+
+type dbIterator struct {
+	db       *Db
+	sequence uint64
+	merge    *mergingIterator
+	tables   []table
+	pinned   bool
+	e        error
+	closed   bool
+}
+
+// Create an iterator over the whole of the default family as it is now,
+// see Iterator
+func (db *Db) NewIterator() Iterator {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.newIterator(db.defaultFamily(), db.lastSequence)
+}
+
+// Create an iterator over the versions in f visible at sequence.  The
+// iterator holds its own reference to sequence so the versions it reads
+// are kept until it is closed.  db.lock must be held.
+func (db *Db) newIterator(f *Family, sequence uint64) *dbIterator {
+	it := &dbIterator{db: db, sequence: sequence, merge: &mergingIterator{cmp: f.cmp}}
+	if db.closed {
+		it.e = ErrClosed
+		return it
+	}
+
+	it.merge.children = append(it.merge.children, newMemIterator(f.mem, sequence))
+	if f.imm != nil {
+		it.merge.children = append(it.merge.children, newMemIterator(f.imm, sequence))
+	}
+	for _, level := range f.levels {
+		for _, t := range level {
+			it.tables = append(it.tables, t)
+			it.merge.children = append(it.merge.children,
+				&versionIterator{t.iterator(), sequence})
+		}
+	}
+	db.refTables(it.tables)
+	db.refSequence(sequence)
+	it.pinned = true
+	return it
+}
+
+// Run a movement under db.lock, then step past tombstones and expired
+// values in the same direction
+func (it *dbIterator) move(op func()) {
+	it.db.lock.Lock()
+	defer it.db.lock.Unlock()
+	if it.closed || it.e != nil {
+		return
+	}
+	if it.db.closed {
+		it.e = ErrClosed
+		return
+	}
+
+	op()
+	now := it.db.now().Unix()
+	for it.merge.valid() && (it.merge.entry().Tombstone || it.merge.entry().expired(now)) {
+		if it.merge.forward {
+			it.merge.next()
+		} else {
+			it.merge.prev()
+		}
+	}
+	it.e = it.merge.err()
+}
+
+func (it *dbIterator) Seek(key []byte) {
+	it.move(func() { it.merge.seek(key) })
+}
+
+func (it *dbIterator) SeekToFirst() {
+	it.move(it.merge.seekToFirst)
+}
+
+func (it *dbIterator) SeekToLast() {
+	it.move(it.merge.seekToLast)
+}
+
+func (it *dbIterator) Next() {
+	if it.Valid() {
+		it.move(it.merge.next)
+	}
+}
+
+func (it *dbIterator) Prev() {
+	if it.Valid() {
+		it.move(it.merge.prev)
+	}
+}
+
+func (it *dbIterator) Valid() bool {
+	return !it.closed && it.e == nil && it.merge.valid()
+}
+
+func (it *dbIterator) Key() []byte {
+	return it.merge.entry().Key
+}
+
+func (it *dbIterator) Value() []byte {
+	return it.merge.entry().Value
+}
+
+func (it *dbIterator) Err() error {
+	return it.e
+}
+
+func (it *dbIterator) Close() error {
+	it.db.lock.Lock()
+	defer it.db.lock.Unlock()
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	if it.pinned {
+		it.db.unrefTables(it.tables)
+		it.db.unrefSequence(it.sequence)
+	}
+	it.tables = nil
+	return nil
+}
+
+// Tables in use by iterators are kept open, and on disk, until the last
+// iterator using them is closed, even once compaction has replaced them.
+// db.lock must be held.
+func (db *Db) refTables(tables []table) {
+	for _, t := range tables {
+		db.tableRefs[t]++
+	}
+}
+
+func (db *Db) unrefTables(tables []table) {
+	for _, t := range tables {
+		db.tableRefs[t]--
+		if db.tableRefs[t] > 0 {
+			continue
+		}
+		delete(db.tableRefs, t)
+		if db.obsolete[t] {
+			delete(db.obsolete, t)
+			db.removeTable(t)
+		}
+	}
+}
+
+// Close and delete a table that is no longer live, deferring it if an
+// iterator is still using it.  db.lock must be held.
+func (db *Db) releaseTable(t table) {
+	if db.tableRefs[t] > 0 {
+		db.obsolete[t] = true
+		return
+	}
+	db.removeTable(t)
+}
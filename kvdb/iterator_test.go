@@ -0,0 +1,258 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Spread writes across several tables and the memtable, returning the
+// expected contents in key order
+func fillIteratorDb(t *testing.T, db *kvdb.Db) ([]string, map[string]string) {
+	expect := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 200; i++ {
+			k := fmt.Sprintf("key%03d", r.Intn(300))
+			if r.Intn(5) == 0 {
+				db.Delete([]byte(k))
+				delete(expect, k)
+				continue
+			}
+			v := fmt.Sprintf("value%d-%d", round, i)
+			db.Put([]byte(k), []byte(v))
+			expect[k] = v
+		}
+		if round < 3 {
+			if err := db.Flush(); err != nil {
+				t.Errorf("Flush failed: %v", err)
+				t.FailNow()
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(expect))
+	for k := range expect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, expect
+}
+
+func checkForward(t *testing.T, it kvdb.Iterator, keys []string, expect map[string]string) {
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if i >= len(keys) || string(it.Key()) != keys[i] {
+			t.Errorf("key %d is %s", i, it.Key())
+			t.FailNow()
+		}
+		if string(it.Value()) != expect[keys[i]] {
+			t.Errorf("%s: %s != %s", keys[i], it.Value(), expect[keys[i]])
+			t.FailNow()
+		}
+		i++
+	}
+	if it.Err() != nil || i != len(keys) {
+		t.Errorf("iterated %d of %d keys: %v", i, len(keys), it.Err())
+		t.FailNow()
+	}
+}
+
+func checkBackward(t *testing.T, it kvdb.Iterator, keys []string) {
+	i := len(keys) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if i < 0 || string(it.Key()) != keys[i] {
+			t.Errorf("key %d is %s", i, it.Key())
+			t.FailNow()
+		}
+		i--
+	}
+	if it.Err() != nil || i != -1 {
+		t.Errorf("stopped at %d: %v", i, it.Err())
+		t.FailNow()
+	}
+}
+
+func testIterator(t *testing.T, config *kvdb.DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+
+	db := openTestDb(t, config)
+	defer db.Close()
+	keys, expect := fillIteratorDb(t, db)
+
+	it := db.NewIterator()
+	defer it.Close()
+	checkForward(t, it, keys, expect)
+	checkBackward(t, it, keys)
+
+	// Seek to every key and to the gaps between them
+	for i := 0; i < 300; i++ {
+		k := fmt.Sprintf("key%03d", i)
+		j := sort.SearchStrings(keys, k)
+		it.Seek([]byte(k))
+		if j == len(keys) {
+			if it.Valid() {
+				t.Errorf("Seek(%s) found %s", k, it.Key())
+				t.FailNow()
+			}
+			continue
+		}
+		if !it.Valid() || string(it.Key()) != keys[j] {
+			t.Errorf("Seek(%s) != %s", k, keys[j])
+			t.FailNow()
+		}
+
+		// Step back and forth across the seek position
+		if j > 0 {
+			it.Prev()
+			if !it.Valid() || string(it.Key()) != keys[j-1] {
+				t.Errorf("Prev from %s != %s", keys[j], keys[j-1])
+				t.FailNow()
+			}
+			it.Next()
+			if !it.Valid() || string(it.Key()) != keys[j] {
+				t.Errorf("Next from %s != %s", keys[j-1], keys[j])
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestIteratorJSON(t *testing.T) {
+	testIterator(t, &kvdb.DbConfig{})
+}
+
+func TestIteratorBlock(t *testing.T) {
+	testIterator(t, &kvdb.DbConfig{
+		TableFormat: kvdb.TableFormatBlock,
+		BlockSize:   256,
+	})
+}
+
+func TestIteratorInMemory(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	db.Put([]byte("b"), []byte("2"))
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("c"), []byte("3"))
+	db.Delete([]byte("b"))
+
+	it := db.NewIterator()
+	defer it.Close()
+	checkForward(t, it, []string{"a", "c"}, map[string]string{"a": "1", "c": "3"})
+}
+
+func TestIteratorSurvivesCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openTestDb(t, &kvdb.DbConfig{Dir: dir, L0CompactionTrigger: 100})
+	defer db.Close()
+	keys, expect := fillIteratorDb(t, db)
+
+	it := db.NewIterator()
+	it.SeekToFirst()
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+
+	// Writes after the iterator was created must not break ordering
+	db.Put([]byte("key000"), []byte("late"))
+	db.Put([]byte("key999"), []byte("late"))
+
+	last := ""
+	n := 0
+	for ; it.Valid(); it.Next() {
+		if string(it.Key()) <= last {
+			t.Errorf("%s after %s", it.Key(), last)
+			t.FailNow()
+		}
+		last = string(it.Key())
+		if v, ok := expect[last]; ok && string(it.Value()) != v {
+			t.Errorf("%s: %s != %s", last, it.Value(), v)
+			t.FailNow()
+		}
+		n++
+	}
+	if it.Err() != nil || n < len(keys) {
+		t.Errorf("iterated %d of %d keys: %v", n, len(keys), it.Err())
+		t.FailNow()
+	}
+	it.Close()
+
+	it = db.NewIterator()
+	defer it.Close()
+	expect["key000"] = "late"
+	expect["key999"] = "late"
+	keys = append([]string{}, keys...)
+	if keys[0] != "key000" {
+		keys = append([]string{"key000"}, keys...)
+	}
+	keys = append(keys, "key999")
+	checkForward(t, it, keys, expect)
+}
+
+func TestIteratorAfterClose(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	db.Put([]byte("a"), []byte("1"))
+	it := db.NewIterator()
+	db.Close()
+
+	it.SeekToFirst()
+	if it.Valid() || it.Err() != kvdb.ErrClosed {
+		t.Errorf("iterator usable after close: %v", it.Err())
+		t.FailNow()
+	}
+	it.Close()
+}
+
+// Writes made while iterating are not seen
+func TestIteratorIsolation(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v"))
+	}
+
+	it := db.NewIterator()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		k := string(it.Key())
+		if k != fmt.Sprintf("key%03d", n) || string(it.Value()) != "v" {
+			t.Errorf("key %d is %s = %s", n, k, it.Value())
+			t.FailNow()
+		}
+		db.Delete([]byte(k))
+		db.Put([]byte(fmt.Sprintf("key%03d", n+1)), []byte("new"))
+		db.Put([]byte(k+"x"), []byte("new"))
+		n++
+	}
+	if it.Err() != nil || n != 100 {
+		t.Errorf("saw %d keys: %v", n, it.Err())
+		t.FailNow()
+	}
+	it.Close()
+
+	// A new iterator sees the writes
+	it = db.NewIterator()
+	defer it.Close()
+	n = 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 101 {
+		t.Errorf("saw %d keys != 101", n)
+	}
+}
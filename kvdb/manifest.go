@@ -0,0 +1,375 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// The manifest records which tables are live in each level.  It is a log
+// of version edits, framed like the write-ahead log, each edit adding and
+// removing tables and advancing the file and sequence counters.  A flush
+// or compaction only takes effect once its edit is durable in the
+// manifest, so a crash part way through leaves the previous set of tables
+// in place and the half-written files unreferenced.
+//
+// Each open starts a new manifest holding a single edit that describes the
+// whole current version.  The CURRENT file names the manifest in use and
+// is replaced by an atomic rename once the new manifest is durable.
+//
+// An edit is a sequence of tagged fields:
+//
+//   tag uvarint, then for
+//   log number       number uvarint
+//   next file        number uvarint
+//   last sequence    sequence uvarint
+//   add table        level uvarint, number uvarint
+//   remove table     level uvarint, number uvarint
+//   next family      id uvarint
+//   create family    id uvarint, name uvarint length and name, TTL
+//                    uvarint nanoseconds, compaction style uvarint,
+//                    comparator uvarint length and name
+//   drop family      id uvarint
+//   add family table     family uvarint, level uvarint, number uvarint
+//   remove family table  family uvarint, level uvarint, number uvarint
+//
+// Tables of the default column family use add and remove table, so
+// manifests written before there were families read as they always did.
+
+package kvdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	currentName              = "CURRENT"
+	manifestRecordEdit       = 1
+	editTagLogNumber         = 1
+	editTagNextFile          = 2
+	editTagLastSequence      = 3
+	editTagAddTable          = 4
+	editTagRemoveTable       = 5
+	editTagNextFamily        = 6
+	editTagCreateFamily      = 7
+	editTagDropFamily        = 8
+	editTagAddFamilyTable    = 9
+	editTagRemoveFamilyTable = 10
+)
+
+type tableRef struct {
+	family uint64
+	level  int
+	number uint64
+}
+
+// A column family as created
+type familyDef struct {
+	id      uint64
+	name    string
+	options FamilyOptions
+}
+
+// A change to the set of live tables and column families.  Zero counters
+// are left unchanged when the edit is applied.
+type versionEdit struct {
+	logNumber    uint64
+	nextFile     uint64
+	lastSequence uint64
+	nextFamily   uint64
+	created      []familyDef
+	dropped      []uint64
+	added        []tableRef
+	removed      []tableRef
+}
+
+func appendTableRef(buf []byte, tag, familyTag uint64, t tableRef) []byte {
+	if t.family != 0 {
+		buf = appendUvarint(buf, familyTag)
+		buf = appendUvarint(buf, t.family)
+	} else {
+		buf = appendUvarint(buf, tag)
+	}
+	buf = appendUvarint(buf, uint64(t.level))
+	return appendUvarint(buf, t.number)
+}
+
+func (e *versionEdit) encode() []byte {
+	var buf []byte
+	if e.logNumber != 0 {
+		buf = appendUvarint(buf, editTagLogNumber)
+		buf = appendUvarint(buf, e.logNumber)
+	}
+	if e.nextFile != 0 {
+		buf = appendUvarint(buf, editTagNextFile)
+		buf = appendUvarint(buf, e.nextFile)
+	}
+	if e.lastSequence != 0 {
+		buf = appendUvarint(buf, editTagLastSequence)
+		buf = appendUvarint(buf, e.lastSequence)
+	}
+	if e.nextFamily != 0 {
+		buf = appendUvarint(buf, editTagNextFamily)
+		buf = appendUvarint(buf, e.nextFamily)
+	}
+	for _, f := range e.created {
+		buf = appendUvarint(buf, editTagCreateFamily)
+		buf = appendUvarint(buf, f.id)
+		buf = appendBytes(buf, []byte(f.name))
+		buf = appendUvarint(buf, uint64(f.options.TTL))
+		buf = appendUvarint(buf, uint64(f.options.CompactionStyle))
+		buf = appendBytes(buf, []byte(f.options.Comparator))
+	}
+	for _, id := range e.dropped {
+		buf = appendUvarint(buf, editTagDropFamily)
+		buf = appendUvarint(buf, id)
+	}
+	for _, t := range e.removed {
+		buf = appendTableRef(buf, editTagRemoveTable, editTagRemoveFamilyTable, t)
+	}
+	for _, t := range e.added {
+		buf = appendTableRef(buf, editTagAddTable, editTagAddFamilyTable, t)
+	}
+	return buf
+}
+
+func decodeVersionEdit(payload []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	r := &blockReader{buf: payload}
+	for !r.done() {
+		switch r.uvarint() {
+		case editTagLogNumber:
+			e.logNumber = r.uvarint()
+		case editTagNextFile:
+			e.nextFile = r.uvarint()
+		case editTagLastSequence:
+			e.lastSequence = r.uvarint()
+		case editTagAddTable:
+			e.added = append(e.added, tableRef{0, int(r.uvarint()), r.uvarint()})
+		case editTagRemoveTable:
+			e.removed = append(e.removed, tableRef{0, int(r.uvarint()), r.uvarint()})
+		case editTagNextFamily:
+			e.nextFamily = r.uvarint()
+		case editTagCreateFamily:
+			f := familyDef{id: r.uvarint(), name: string(r.lengthPrefixed())}
+			f.options.TTL = time.Duration(r.uvarint())
+			f.options.CompactionStyle = CompactionStyle(r.uvarint())
+			f.options.Comparator = string(r.lengthPrefixed())
+			e.created = append(e.created, f)
+		case editTagDropFamily:
+			e.dropped = append(e.dropped, r.uvarint())
+		case editTagAddFamilyTable:
+			e.added = append(e.added, tableRef{r.uvarint(), int(r.uvarint()), r.uvarint()})
+		case editTagRemoveFamilyTable:
+			e.removed = append(e.removed, tableRef{r.uvarint(), int(r.uvarint()), r.uvarint()})
+		default:
+			return nil, errCorruptRecord
+		}
+	}
+	if r.err != nil {
+		return nil, errCorruptRecord
+	}
+	for _, t := range append(e.added, e.removed...) {
+		if t.level < 0 || t.level >= numLevels {
+			return nil, errCorruptRecord
+		}
+	}
+	return e, nil
+}
+
+// The state rebuilt by replaying a manifest
+type version struct {
+	logNumber    uint64
+	nextFile     uint64
+	lastSequence uint64
+	nextFamily   uint64
+	families     map[uint64]*familyVersion
+}
+
+// A column family and the tables in each of its levels
+type familyVersion struct {
+	name    string
+	options FamilyOptions
+	levels  []map[uint64]bool
+}
+
+func newFamilyVersion(name string, options FamilyOptions) *familyVersion {
+	fv := &familyVersion{name, options, make([]map[uint64]bool, numLevels)}
+	for i := range fv.levels {
+		fv.levels[i] = map[uint64]bool{}
+	}
+	return fv
+}
+
+func newVersion() *version {
+	return &version{families: map[uint64]*familyVersion{
+		0: newFamilyVersion(DefaultFamily, FamilyOptions{}),
+	}}
+}
+
+// Tables of a family that has been dropped are ignored
+func (v *version) apply(e *versionEdit) {
+	if e.logNumber != 0 {
+		v.logNumber = e.logNumber
+	}
+	if e.nextFile != 0 {
+		v.nextFile = e.nextFile
+	}
+	if e.lastSequence != 0 {
+		v.lastSequence = e.lastSequence
+	}
+	if e.nextFamily != 0 {
+		v.nextFamily = e.nextFamily
+	}
+	for _, f := range e.created {
+		v.families[f.id] = newFamilyVersion(f.name, f.options)
+	}
+	for _, t := range e.removed {
+		if fv := v.families[t.family]; fv != nil {
+			delete(fv.levels[t.level], t.number)
+		}
+	}
+	for _, t := range e.added {
+		if fv := v.families[t.family]; fv != nil {
+			fv.levels[t.level][t.number] = true
+		}
+	}
+	for _, id := range e.dropped {
+		if id != 0 {
+			delete(v.families, id)
+		}
+	}
+}
+
+func (v *version) live(number uint64) bool {
+	for _, fv := range v.families {
+		for _, level := range fv.levels {
+			if level[number] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read CURRENT, returning the number of the manifest it names
+func readCurrent(dir string) (uint64, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, currentName))
+	if err != nil {
+		return 0, err
+	}
+	kind, number, ok := parseFileName(strings.TrimSpace(string(blob)))
+	if !ok || kind != manifestFile {
+		return 0, fmt.Errorf("kvdb: CURRENT names invalid manifest %q", blob)
+	}
+	return number, nil
+}
+
+// Atomically point CURRENT at manifest number
+func setCurrent(dir string, number uint64) error {
+	tmp := filepath.Join(dir, currentName+fileSuffixes[tempFile])
+	name := filepath.Base(fileName(dir, manifestFile, number)) + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(name), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmp)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, currentName))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Rebuild the version recorded in manifest number.  A torn edit at the
+// end was never synced, and so never acted on, and is ignored.
+func replayManifest(dir string, number uint64) (*version, error) {
+	f, err := os.Open(fileName(dir, manifestFile, number))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	v := newVersion()
+	r := bufio.NewReader(f)
+	for {
+		kind, payload, _, err := readRecord(r)
+		if err == io.EOF || err == errCorruptRecord {
+			return v, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if kind != manifestRecordEdit {
+			return nil, errCorruptRecord
+		}
+
+		e, err := decodeVersionEdit(payload)
+		if err != nil {
+			return nil, err
+		}
+		v.apply(e)
+	}
+}
+
+type manifest struct {
+	f      *os.File
+	number uint64
+
+	// Set once an edit fails to be written or synced, after which
+	// nothing more is appended
+	err error
+}
+
+// Write a new manifest starting from snapshot, then make it current
+func createManifest(dir string, number uint64, snapshot *versionEdit) (*manifest, error) {
+	path := fileName(dir, manifestFile, number)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{f: f, number: number}
+	if err := m.apply(snapshot); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := setCurrent(dir, number); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Durably record an edit.  When writing or syncing it fails the edit may
+// or may not be on disk, possibly torn, so the manifest is not written
+// again and the error is returned from then on.  Tables the edit adds
+// must then be left in place: recovery keeps them if the edit survived
+// and removes them as unreferenced if not.
+func (m *manifest) apply(e *versionEdit) error {
+	if m.err != nil {
+		return m.err
+	}
+	if _, err := m.f.Write(encodeRecord(manifestRecordEdit, e.encode())); err != nil {
+		m.err = err
+		return err
+	}
+	m.err = m.f.Sync()
+	return m.err
+}
+
+func (m *manifest) close() error {
+	return m.f.Close()
+}
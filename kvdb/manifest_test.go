@@ -0,0 +1,174 @@
+// Whitebox tests for manifest.go
+
+package kvdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersionEditRoundTrip(t *testing.T) {
+	e := &versionEdit{
+		logNumber:    7,
+		nextFile:     12,
+		lastSequence: 1000,
+		nextFamily:   3,
+		added:        []tableRef{{0, 0, 9}, {0, 2, 10}, {2, 0, 11}},
+		removed:      []tableRef{{0, 1, 3}, {1, 0, 4}},
+		created:      []familyDef{{2, "users", FamilyOptions{time.Minute, CompactionSizeTiered, "reverse"}}},
+		dropped:      []uint64{1},
+	}
+
+	d, err := decodeVersionEdit(e.encode())
+	if err != nil {
+		t.Errorf("decodeVersionEdit failed: %v", err)
+		t.FailNow()
+	}
+
+	if d.logNumber != 7 || d.nextFile != 12 || d.lastSequence != 1000 {
+		t.Errorf("counters invalid %+v", d)
+	}
+
+	if len(d.added) != 3 || d.added[1] != (tableRef{0, 2, 10}) || d.added[2] != (tableRef{2, 0, 11}) {
+		t.Errorf("added invalid %+v", d.added)
+	}
+
+	if len(d.removed) != 2 || d.removed[0] != (tableRef{0, 1, 3}) || d.removed[1] != (tableRef{1, 0, 4}) {
+		t.Errorf("removed invalid %+v", d.removed)
+	}
+
+	if d.nextFamily != 3 || len(d.created) != 1 || d.created[0] != e.created[0] ||
+		len(d.dropped) != 1 || d.dropped[0] != 1 {
+		t.Errorf("families invalid %+v", d)
+	}
+}
+
+func TestVersionApply(t *testing.T) {
+	v := newVersion()
+	v.apply(&versionEdit{nextFile: 5, added: []tableRef{{0, 0, 3}, {0, 0, 4}}})
+	v.apply(&versionEdit{logNumber: 6, removed: []tableRef{{0, 0, 3}, {0, 0, 4}},
+		added: []tableRef{{0, 1, 5}}})
+
+	if v.nextFile != 5 || v.logNumber != 6 {
+		t.Errorf("counters invalid %+v", v)
+	}
+
+	if v.live(3) || v.live(4) || !v.live(5) || !v.families[0].levels[1][5] {
+		t.Errorf("tables invalid %+v", v.families[0].levels)
+	}
+}
+
+// A table that never made it into the manifest, as left by a crash during
+// a flush or compaction, is ignored and removed.
+func TestManifestIgnoresUnreferencedTables(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	db.Put([]byte("a"), []byte("foo"))
+	db.Flush()
+	db.Close()
+
+	stale := NewTree()
+	stale.Insert([]byte("a"), []byte("stale"))
+	if err := writeTable(dir, 1000, &DbConfig{}, stale, 0); err != nil {
+		t.Errorf("writeTable failed: %v", err)
+		t.FailNow()
+	}
+
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+
+	if v, _ := db.Get([]byte("a")); string(v) != "foo" {
+		t.Errorf("%s != foo", v)
+	}
+
+	if _, err := os.Stat(fileName(dir, tableFile, 1000)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced table not removed")
+	}
+}
+
+func TestManifestRestoresState(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	db.Put([]byte("a"), []byte("foo"))
+	db.Put([]byte("b"), []byte("bar"))
+	db.Flush()
+	db.Put([]byte("c"), []byte("baz"))
+	db.Close()
+
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+
+	if db.lastSequence != 3 {
+		t.Errorf("db.lastSequence != 3: %d", db.lastSequence)
+	}
+
+	if len(db.defaultFamily().levels[0]) != 1 {
+		t.Errorf("len(db.defaultFamily().levels[0]) != 1: %d", len(db.defaultFamily().levels[0]))
+	}
+
+	current, err := readCurrent(dir)
+	if err != nil || current != db.manifest.number {
+		t.Errorf("CURRENT does not name the open manifest %d %v", current, err)
+	}
+
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest"))
+	if len(manifests) != 1 {
+		t.Errorf("old manifests not removed %v", manifests)
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if v, _ := db.Get([]byte(k)); v == nil {
+			t.Errorf("%s missing", k)
+		}
+	}
+}
+
+func TestManifestTornEdit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	db.Put([]byte("a"), []byte("foo"))
+	db.Flush()
+	number := db.manifest.number
+	db.Close()
+
+	f, _ := os.OpenFile(fileName(dir, manifestFile, number), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	db = openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+	if v, _ := db.Get([]byte("a")); string(v) != "foo" {
+		t.Errorf("%s != foo", v)
+	}
+}
+
+// Directories written before the manifest existed are read by scanning
+// for tables
+func TestManifestUpgrade(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	tree := NewTree()
+	tree.Insert([]byte("a"), []byte("foo"))
+	writeTable(dir, 1, &DbConfig{}, tree, 0)
+
+	db := openCompactionDb(t, &DbConfig{Dir: dir})
+	defer db.Close()
+
+	if v, _ := db.Get([]byte("a")); string(v) != "foo" {
+		t.Errorf("%s != foo", v)
+	}
+
+	if _, err := readCurrent(dir); err != nil {
+		t.Errorf("manifest not created: %v", err)
+	}
+}
@@ -6,26 +6,36 @@ import (
 )
 
 // Simple node for an arbitrary key/value pair.  Timestamps are epoch
-// time.
+// time, as is expires, the time a value with a TTL vanishes, 0 if it
+// never does.  contentType is the media type the value was put with, if
+// any.
 type Node struct {
-	key       []byte
-	value     []byte
-	color     Color
-	left      *Node
-	right     *Node
-	parent    *Node
-	timestamp int64
-	tombstone bool
+	key         []byte
+	value       []byte
+	color       Color
+	left        *Node
+	right       *Node
+	parent      *Node
+	timestamp   int64
+	tombstone   bool
+	expires     int64
+	contentType string
+
+	// Sequence number of the mutation that wrote this version, and the
+	// previous version of the key if a snapshot may still read it.
+	// Older versions are not linked into the tree.
+	sequence uint64
+	older    *Node
 }
 
 func NewNode(key, value []byte) *Node {
-	n := &Node{key, value, Red, nil, nil, nil, -1, false}
+	n := &Node{key, value, Red, nil, nil, nil, -1, false, 0, "", 0, nil}
 	n.timestamp = time.Now().Unix()
 	return n
 }
 
 func NewStringNode(key, value string) *Node {
-	n := &Node{[]byte(key), []byte(value), Red, nil, nil, nil, -1, false}
+	n := &Node{[]byte(key), []byte(value), Red, nil, nil, nil, -1, false, 0, "", 0, nil}
 	n.timestamp = time.Now().Unix()
 	return n
 }
@@ -42,6 +52,41 @@ func (n *Node) Timestamp() int64 {
 	return n.timestamp
 }
 
+func (n *Node) Tombstone() bool {
+	return n.tombstone
+}
+
+func (n *Node) Expires() int64 {
+	return n.expires
+}
+
+func (n *Node) ContentType() string {
+	return n.contentType
+}
+
+func (n *Node) Sequence() uint64 {
+	return n.sequence
+}
+
+// Whether n has a TTL that ran out at or before now
+func (n *Node) expired(now int64) bool {
+	return n.expires > 0 && now >= n.expires
+}
+
+// The newest version of n's key with a sequence number at or below
+// sequence, or nil if every version is newer
+func (n *Node) visible(sequence uint64) *Node {
+	for n != nil && n.sequence > sequence {
+		n = n.older
+	}
+	return n
+}
+
+func (n *Node) entry() tableEntry {
+	return tableEntry{n.key, n.value, n.timestamp, n.tombstone, n.sequence, n.expires,
+		n.contentType}
+}
+
 // Returns -1, 0, or 1 depending on whether lhs.key is less than, equal to,
 // or greater than rhs.key
 func (lhs *Node) Compare(rhs *Node) int {
@@ -0,0 +1,395 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Replication support.  A leader ships the records of its write-ahead
+// log to followers, which log and apply them exactly as the leader did,
+// so every mutation has the same sequence, and so the same version, on
+// both.  A follower's last sequence is therefore the point to resume
+// from after a reconnect or restart.
+//
+// The leader ships from the records kept for watchers, see watch.go.
+// Once those no longer reach back to where a follower is, because it was
+// away too long or the leader restarted, the leader sends a snapshot
+// instead: a table holding the current version of every key, which the
+// follower installs in place of everything it had before carrying on
+// with the records after it.
+//
+// A follower is marked read-only so only shipped records change it.
+//
+// Records can also be built without a database, with PutLogRecord and the
+// like, and applied with ApplyLogRecord under conditions on the versions
+// of keys.  A consensus log carries writes that way, every replica
+// applying the same records in the same order.
+
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// How many records ReadLog returns when no limit is given
+const defaultReadLogMax = 1024
+
+var ErrReadOnly = errors.New("kvdb: database is read-only")
+
+var ErrLogTruncated = errors.New("kvdb: log no longer holds the sequence requested")
+
+var ErrSequenceGap = errors.New("kvdb: log record out of sequence")
+
+// A write-ahead log record as shipped to followers, Data being the record
+// as it is framed in the log and Sequence that of its first mutation
+type LogRecord struct {
+	Sequence uint64
+	Data     []byte
+}
+
+// The sequence of the last mutation applied
+func (db *Db) LastSequence() uint64 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.lastSequence
+}
+
+// Refuse, or once again allow, every write but those made by ApplyLog
+// and RestoreSnapshotTable.  Refused writes fail with ErrReadOnly.
+func (db *Db) SetReadOnly(readOnly bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.readOnly = readOnly
+}
+
+// Read up to max log records, 0 meaning a default, starting with the one
+// whose first mutation is from.  Returns the records and the sequence to
+// read from next, which is from if there are none yet.  Returns
+// ErrLogTruncated if the records from there are no longer kept, or from
+// is not the start of a record or lies beyond the end of the log.
+func (db *Db) ReadLog(from uint64, max int) ([]LogRecord, uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, from, ErrClosed
+	}
+	if from > db.lastSequence+1 {
+		return nil, from, ErrLogTruncated
+	}
+	records, ok := db.changes.since(from, db.lastSequence)
+	if !ok || len(records) > 0 && records[0].sequence != from {
+		return nil, from, ErrLogTruncated
+	}
+	if max <= 0 {
+		max = defaultReadLogMax
+	}
+	if len(records) > max {
+		records = records[:max]
+	}
+
+	shipped := make([]LogRecord, 0, len(records))
+	next := from
+	for _, lr := range records {
+		shipped = append(shipped, LogRecord{lr.sequence, lr.r.encode()})
+		next = lr.sequence + uint64(lr.count)
+	}
+	return shipped, next, nil
+}
+
+// A channel closed once a mutation after sequence after is applied, or
+// the database is closed
+func (db *Db) WaitLog(after uint64) <-chan struct{} {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.lastSequence > after || db.closed {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if db.logWait == nil {
+		db.logWait = make(chan struct{})
+	}
+	return db.logWait
+}
+
+// db.lock must be held
+func (db *Db) wakeLogWaiters() {
+	if db.logWait != nil {
+		close(db.logWait)
+		db.logWait = nil
+	}
+}
+
+// Log and apply records shipped from a leader, keeping the time each
+// mutation was made.  Each must begin at the sequence after the last one
+// applied, otherwise ErrSequenceGap is returned and the records from the
+// out of sequence one on are not applied.
+func (db *Db) ApplyLog(records []LogRecord) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, lr := range records {
+		if lr.Sequence != db.lastSequence+1 {
+			return ErrSequenceGap
+		}
+		kind, payload, _, err := readRecord(bytes.NewReader(lr.Data))
+		if err != nil {
+			return err
+		}
+		r, err := decodeWalRecord(kind, payload)
+		if err != nil {
+			return err
+		}
+		if err := db.writeRecord(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A condition on a write made by ApplyLogRecord, that the version of Key
+// is Version, 0 meaning it must not exist
+type LogCondition struct {
+	Key     []byte
+	Version uint64
+}
+
+// A log record of a put with opts made at now, for ApplyLogRecord
+func PutLogRecord(key, value []byte, opts PutOptions, now time.Time) ([]byte, error) {
+	r, err := newPutRecord(key, value, opts, now)
+	if err != nil {
+		return nil, err
+	}
+	r.timestamp = now.Unix()
+	return r.encode(), nil
+}
+
+// A log record of a delete of key made at now, for ApplyLogRecord
+func DeleteLogRecord(key []byte, now time.Time) []byte {
+	return (&walRecord{walRecordDelete, key, nil, now.Unix(), 0, "", 0}).encode()
+}
+
+// A log record of batch made at now, for ApplyLogRecord
+func BatchLogRecord(batch *WriteBatch, now time.Time) []byte {
+	return (&walRecord{walRecordBatch, nil, encodeBatch(batch.ops), now.Unix(), 0, "", 0}).encode()
+}
+
+// Log and apply a record, made by PutLogRecord and the like or read by
+// ReadLog, as the next mutation if every condition holds, otherwise
+// return ErrVersionMismatch.  Returns the sequence of the record's last
+// mutation.  Like ApplyLog this ignores SetReadOnly.
+//
+// Conditions are checked as of the time in the record, not the clock, so
+// that every database applying the same records reaches the same result.
+func (db *Db) ApplyLogRecord(data []byte, conditions []LogCondition) (uint64, error) {
+	kind, payload, _, err := readRecord(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	r, err := decodeWalRecord(kind, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	for _, c := range conditions {
+		e, err := db.getEntryAt(c.Key, db.lastSequence, r.timestamp)
+		if err != nil {
+			return 0, err
+		} else if versionOf(e) != c.Version {
+			return 0, ErrVersionMismatch
+		}
+	}
+	if r.kind == walRecordBatch {
+		// An empty batch, from a transaction that only read, changes
+		// nothing
+		if ops, err := decodeBatch(r.value); err != nil {
+			return 0, err
+		} else if len(ops) == 0 {
+			return db.lastSequence, nil
+		}
+	}
+	if err := db.writeRecord(r); err != nil {
+		return 0, err
+	}
+	return db.lastSequence, nil
+}
+
+// Write a snapshot of the database to w as a table holding the current
+// version of every key in the default family, returning the sequence it
+// was taken at.  The table is always in TableFormatBlock.
+func (db *Db) WriteSnapshotTable(w io.Writer) (uint64, error) {
+	db.lock.Lock()
+	it := db.newIterator(db.defaultFamily(), db.lastSequence)
+	db.lock.Unlock()
+	defer it.Close()
+
+	b := newBlockBuilder(w, &db.config, numLevels-1, 0)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		e := *it.merge.entry()
+		if err := b.add(&e); err != nil {
+			return 0, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return it.sequence, b.finish()
+}
+
+// Replace the whole contents of the database with a table written by
+// WriteSnapshotTable at sequence, which becomes the last sequence.
+// Watchers are closed with ErrWatchCompacted, and snapshots taken before
+// read the new contents.  The table holds the default family only, every
+// other family is dropped.
+func (db *Db) RestoreSnapshotTable(r io.Reader, sequence uint64) error {
+	if db.config.Dir == "" {
+		return db.restoreToMemory(r, sequence)
+	}
+
+	// No compaction may install tables built from the old contents
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.waitForFlush()
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	dir := db.config.Dir
+	number, logNumber := db.nextFile, db.nextFile+1
+	db.nextFile += 2
+	err := writeFileAtomic(dir, number, tableFile, func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t, err := openTable(dir, number, BytewiseComparator)
+	if err != nil {
+		os.Remove(fileName(dir, tableFile, number))
+		return err
+	}
+	t.meta().level = numLevels - 1
+	log, err := openWal(fileName(dir, logFile, logNumber),
+		db.config.SyncPolicy, db.config.SyncInterval)
+	if err != nil {
+		db.removeTable(t)
+		return err
+	}
+
+	edit := &versionEdit{
+		logNumber:    logNumber,
+		nextFile:     db.nextFile,
+		lastSequence: sequence,
+		added:        []tableRef{{0, numLevels - 1, number}},
+	}
+	for _, f := range db.families {
+		for level, tables := range f.levels {
+			for _, old := range tables {
+				edit.removed = append(edit.removed, tableRef{f.id, level, old.fileNumber()})
+			}
+		}
+		if f.id != 0 {
+			edit.dropped = append(edit.dropped, f.id)
+		}
+	}
+	if err := db.manifest.apply(edit); err != nil {
+		log.close()
+		os.Remove(fileName(dir, logFile, logNumber))
+		db.removeTable(t)
+		return err
+	}
+
+	for _, f := range db.families {
+		for _, tables := range f.levels {
+			for _, old := range tables {
+				db.releaseTable(old)
+			}
+		}
+		f.levels = make([][]table, numLevels)
+	}
+	db.defaultFamily().levels[numLevels-1] = []table{t}
+
+	err = db.log.close()
+	for _, n := range db.memLogs {
+		os.Remove(fileName(dir, logFile, n))
+	}
+	db.log, db.memLogs = log, []uint64{logNumber}
+	db.reset(NewTree(), sequence)
+	return err
+}
+
+// Restore a database without a directory by loading the table into a new
+// memtable
+func (db *Db) restoreToMemory(r io.Reader, sequence uint64) error {
+	dir, err := ioutil.TempDir("", "kvdb-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	err = writeFileAtomic(dir, 1, tableFile, func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t, err := openTable(dir, 1, BytewiseComparator)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	mem := NewTree()
+	it := t.iterator()
+	for it.seekToFirst(); it.valid(); it.next() {
+		e := it.entry()
+		n := NewNode(e.Key, e.Value)
+		n.timestamp, n.sequence = e.Timestamp, e.Sequence
+		n.expires, n.contentType = e.Expires, e.ContentType
+		// The table holds one version of each key
+		mem.insertVersion(n, func(v, newer *Node, depth int) bool { return false })
+	}
+	if err := it.err(); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.reset(mem, sequence)
+	return nil
+}
+
+// Start over with mem as the memtable of the default family and sequence
+// as the last sequence, forgetting the old changes and every other
+// family.  db.lock must be held.
+func (db *Db) reset(mem *Tree, sequence uint64) {
+	for id, f := range db.families {
+		if id != 0 {
+			f.dropped = true
+			delete(db.families, id)
+		}
+	}
+	db.defaultFamily().mem = mem
+	db.lastSequence = sequence
+	db.changes.reset()
+	for w := range db.watchers {
+		db.stopWatcher(w, ErrWatchCompacted)
+	}
+	db.wakeLogWaiters()
+}
@@ -0,0 +1,240 @@
+package kvdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Ship every record from leader to follower
+func shipLog(t *testing.T, leader, follower *kvdb.Db) {
+	from := follower.LastSequence() + 1
+	for {
+		records, next, err := leader.ReadLog(from, 2)
+		if err != nil {
+			t.Errorf("ReadLog(%d) failed: %v", from, err)
+			t.FailNow()
+		}
+		if len(records) == 0 {
+			return
+		}
+		if err := follower.ApplyLog(records); err != nil {
+			t.Errorf("ApplyLog failed: %v", err)
+			t.FailNow()
+		}
+		from = next
+	}
+}
+
+// Check every key reads the same, with the same info, from both
+func expectReplicated(t *testing.T, leader, follower *kvdb.Db, keys ...string) {
+	if l, f := leader.LastSequence(), follower.LastSequence(); l != f {
+		t.Errorf("leader at %d, follower at %d", l, f)
+	}
+	for _, key := range keys {
+		lv, linfo, _ := leader.GetWithInfo([]byte(key))
+		fv, finfo, err := follower.GetWithInfo([]byte(key))
+		if err != nil || !bytes.Equal(lv, fv) || fmt.Sprint(linfo) != fmt.Sprint(finfo) {
+			t.Errorf("%s: leader %q %v, follower %q %v %v", key, lv, linfo, fv, finfo, err)
+		}
+	}
+}
+
+func TestShipLog(t *testing.T) {
+	leader := openTestDb(t, &kvdb.DbConfig{})
+	defer leader.Close()
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	follower := openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	defer follower.Close()
+	follower.SetReadOnly(true)
+
+	leader.Put([]byte("a"), []byte("1"))
+	leader.PutWithOptions([]byte("b"), []byte("2"), kvdb.PutOptions{TTL: time.Hour, ContentType: "text/plain"})
+	batch := kvdb.NewWriteBatch()
+	batch.Put([]byte("c"), []byte("3"))
+	batch.Delete([]byte("a"))
+	batch.Put([]byte("d"), []byte("4"))
+	leader.Write(batch)
+	leader.Put([]byte("c"), []byte("5"))
+
+	shipLog(t, leader, follower)
+	expectReplicated(t, leader, follower, "a", "b", "c", "d")
+
+	if err := follower.Put([]byte("x"), []byte("y")); err != kvdb.ErrReadOnly {
+		t.Errorf("Put on a follower: %v", err)
+	}
+	if _, err := follower.PutIfVersion([]byte("x"), []byte("y"), 0); err != kvdb.ErrReadOnly {
+		t.Errorf("PutIfVersion on a follower: %v", err)
+	}
+
+	// Records that do not follow on are refused
+	records, _, _ := leader.ReadLog(1, 1)
+	if err := follower.ApplyLog(records); err != kvdb.ErrSequenceGap {
+		t.Errorf("applying an old record: %v", err)
+	}
+
+	// Starting inside the batch or past the end is refused too
+	if _, _, err := leader.ReadLog(4, 0); err != kvdb.ErrLogTruncated {
+		t.Errorf("ReadLog from inside a batch: %v", err)
+	}
+	if _, _, err := leader.ReadLog(100, 0); err != kvdb.ErrLogTruncated {
+		t.Errorf("ReadLog past the end: %v", err)
+	}
+
+	// The follower resumes where it left off after a restart
+	follower.Close()
+	follower = openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	follower.SetReadOnly(true)
+	leader.Delete([]byte("d"))
+	shipLog(t, leader, follower)
+	expectReplicated(t, leader, follower, "a", "b", "c", "d")
+}
+
+func TestWaitLog(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	wait := db.WaitLog(0)
+	select {
+	case <-wait:
+		t.Errorf("WaitLog returned before a write")
+	default:
+	}
+	db.Put([]byte("a"), []byte("1"))
+	select {
+	case <-wait:
+	case <-time.After(time.Second):
+		t.Errorf("WaitLog not woken by a write")
+	}
+	select {
+	case <-db.WaitLog(0):
+	default:
+		t.Errorf("WaitLog for a past sequence blocked")
+	}
+}
+
+func TestSnapshotTable(t *testing.T) {
+	leader := openTestDb(t, &kvdb.DbConfig{WatchHistory: 4})
+	defer leader.Close()
+	for i := 0; i < 100; i++ {
+		leader.Put([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	leader.PutWithOptions([]byte("k000"), []byte("new"), kvdb.PutOptions{ContentType: "text/plain"})
+	leader.Delete([]byte("k001"))
+	if _, _, err := leader.ReadLog(1, 0); err != kvdb.ErrLogTruncated {
+		t.Errorf("ReadLog of dropped records: %v", err)
+	}
+
+	for i, config := range []kvdb.DbConfig{{}, {Dir: "dir"}} {
+		var table bytes.Buffer
+		sequence, err := leader.WriteSnapshotTable(&table)
+		if err != nil || sequence != uint64(102+2*i) {
+			t.Errorf("WriteSnapshotTable = %d, %v", sequence, err)
+			t.FailNow()
+		}
+
+		if config.Dir != "" {
+			dir, _ := ioutil.TempDir("", "kvdb")
+			defer os.RemoveAll(dir)
+			config.Dir = dir
+		}
+		follower := openTestDb(t, &config)
+		follower.SetReadOnly(true)
+
+		// What the follower had before is replaced
+		follower.SetReadOnly(false)
+		follower.Put([]byte("stale"), []byte("x"))
+		follower.Flush()
+		follower.Put([]byte("stale2"), []byte("x"))
+		follower.SetReadOnly(true)
+		watcher, _ := follower.Watch(nil, 0)
+
+		if err := follower.RestoreSnapshotTable(bytes.NewReader(table.Bytes()), sequence); err != nil {
+			t.Errorf("RestoreSnapshotTable failed: %v", err)
+			t.FailNow()
+		}
+		if _, ok := <-watcher.Events(); ok || watcher.Err() != kvdb.ErrWatchCompacted {
+			t.Errorf("watcher after restore: %v", watcher.Err())
+		}
+		expectReplicated(t, leader, follower, "k000", "k001", "k050", "k099", "stale", "stale2")
+
+		leader.Put([]byte("k050"), []byte("after"))
+		shipLog(t, leader, follower)
+		expectReplicated(t, leader, follower, "k050")
+
+		if config.Dir != "" {
+			follower.Close()
+			follower = openTestDb(t, &config)
+			expectReplicated(t, leader, follower, "k000", "k001", "k050", "k099", "stale", "stale2")
+		}
+		follower.Close()
+		leader.Delete([]byte("k050"))
+	}
+}
+
+func TestApplyLogRecord(t *testing.T) {
+	dbs := []*kvdb.Db{openTestDb(t, &kvdb.DbConfig{}), openTestDb(t, &kvdb.DbConfig{})}
+	for _, db := range dbs {
+		defer db.Close()
+		db.SetReadOnly(true)
+	}
+	now := time.Now()
+	put, _ := kvdb.PutLogRecord([]byte("a"), []byte("1"), kvdb.PutOptions{TTL: time.Hour, ContentType: "text/plain"}, now)
+	if _, err := kvdb.PutLogRecord([]byte("a"), nil, kvdb.PutOptions{TTL: -1}, now); err != kvdb.ErrInvalidTTL {
+		t.Errorf("PutLogRecord with a bad TTL: %v", err)
+	}
+	batch := kvdb.NewWriteBatch()
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Delete([]byte("a"))
+
+	// Every database applying the same records agrees on the outcome
+	for _, db := range dbs {
+		if version, err := db.ApplyLogRecord(put, []kvdb.LogCondition{{Key: []byte("a")}}); err != nil || version != 1 {
+			t.Errorf("conditional put = %d, %v", version, err)
+		}
+		if _, err := db.ApplyLogRecord(put, []kvdb.LogCondition{{Key: []byte("a")}}); err != kvdb.ErrVersionMismatch {
+			t.Errorf("put over an existing key: %v", err)
+		}
+		version, err := db.ApplyLogRecord(kvdb.BatchLogRecord(batch, now), []kvdb.LogCondition{{Key: []byte("a"), Version: 1}})
+		if err != nil || version != 3 {
+			t.Errorf("batch = %d, %v", version, err)
+		}
+		if version, err := db.ApplyLogRecord(kvdb.BatchLogRecord(kvdb.NewWriteBatch(), now), nil); err != nil || version != 3 {
+			t.Errorf("empty batch = %d, %v", version, err)
+		}
+		db.ApplyLogRecord(kvdb.DeleteLogRecord([]byte("b"), now), nil)
+	}
+	expectReplicated(t, dbs[0], dbs[1], "a", "b")
+	if v, _ := dbs[0].Get([]byte("b")); v != nil || dbs[0].LastSequence() != 4 {
+		t.Errorf("b = %q at %d", v, dbs[0].LastSequence())
+	}
+}
+
+func TestTxnPrepare(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	txn := db.Begin()
+	txn.Get([]byte("a"))
+	txn.Get([]byte("missing"))
+	txn.Put([]byte("b"), []byte("2"))
+	conditions, batch, err := txn.Prepare()
+	if err != nil || fmt.Sprint(conditions) != "[{[97] 1} {[109 105 115 115 105 110 103] 0}]" || batch.Len() != 1 {
+		t.Errorf("Prepare = %v %v %v", conditions, batch, err)
+	}
+	if err := txn.Commit(); err != kvdb.ErrTxnDone {
+		t.Errorf("Commit after Prepare: %v", err)
+	}
+
+	db.Put([]byte("a"), []byte("changed"))
+	if _, err := db.ApplyLogRecord(kvdb.BatchLogRecord(batch, time.Now()), conditions); err != kvdb.ErrVersionMismatch {
+		t.Errorf("applying a conflicting transaction: %v", err)
+	}
+}
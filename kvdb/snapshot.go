@@ -0,0 +1,110 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Point in time snapshots.  Every mutation is numbered by a sequence that
+// increases by one with each put or delete, stored with the version it
+// writes in the memtable and in tables.  A snapshot remembers the
+// sequence of the last mutation when it was taken and reads, for each
+// key, the newest version at or below it.
+//
+// Older versions are normally discarded as soon as they are replaced.
+// While a snapshot is live, the memtable keeps the versions it can read
+// and compaction keeps every version newer than the one the oldest
+// snapshot reads, see runCompaction.
+
+package kvdb
+
+// A consistent, read-only view of a Db.  Release must be called once the
+// snapshot is no longer needed.
+type Snapshot struct {
+	db       *Db
+	sequence uint64
+	released bool
+}
+
+// Take a snapshot of the database as it is now
+func (db *Db) NewSnapshot() *Snapshot {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.refSequence(db.lastSequence)
+	return &Snapshot{db: db, sequence: db.lastSequence}
+}
+
+// The sequence number of the last mutation the snapshot sees
+func (s *Snapshot) Sequence() uint64 {
+	return s.sequence
+}
+
+// Get the value key had when the snapshot was taken, returning nil if it
+// did not exist
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	if s.db.closed {
+		return nil, ErrClosed
+	}
+	return s.db.get(key, s.sequence)
+}
+
+// Create an iterator over the database as it was when the snapshot was
+// taken.  The iterator remains usable after the snapshot is released.
+func (s *Snapshot) NewIterator() Iterator {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	if s.released {
+		return &dbIterator{db: s.db, merge: &mergingIterator{}, e: ErrSnapshotReleased}
+	}
+	return s.db.newIterator(s.db.defaultFamily(), s.sequence)
+}
+
+// Release the snapshot, allowing the versions only it reads to be
+// discarded.  Releasing a snapshot more than once has no effect.
+func (s *Snapshot) Release() {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	if !s.released {
+		s.released = true
+		s.db.unrefSequence(s.sequence)
+	}
+}
+
+// db.lock must be held for the following
+
+func (db *Db) refSequence(sequence uint64) {
+	db.snapshots[sequence]++
+}
+
+func (db *Db) unrefSequence(sequence uint64) {
+	db.snapshots[sequence]--
+	if db.snapshots[sequence] <= 0 {
+		delete(db.snapshots, sequence)
+	}
+}
+
+// Whether a live snapshot reads the version of a key written at sequence
+// rather than the version written after it at newer
+func (db *Db) snapshotReads(sequence, newer uint64) bool {
+	for s := range db.snapshots {
+		if sequence <= s && s < newer {
+			return true
+		}
+	}
+	return false
+}
+
+// The sequence of the oldest live snapshot, the last sequence if there
+// are none
+func (db *Db) oldestSnapshot() uint64 {
+	oldest := db.lastSequence
+	for sequence := range db.snapshots {
+		if sequence < oldest {
+			oldest = sequence
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,287 @@
+// Whitebox tests for snapshot.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func checkSnapshotGet(t *testing.T, s *Snapshot, expect map[string]string, msg string) {
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("key%02d", i)
+		v, err := s.Get([]byte(k))
+		if err != nil {
+			t.Errorf("%s: Get failed: %v", msg, err)
+			t.FailNow()
+		}
+		want, ok := expect[k]
+		if ok && string(v) != want || !ok && v != nil {
+			t.Errorf("%s: %s = %q, expected %q", msg, k, v, want)
+			t.FailNow()
+		}
+	}
+}
+
+func checkSnapshotIterator(t *testing.T, s *Snapshot, expect map[string]string, msg string) {
+	keys := []string{}
+	for k := range expect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	it := s.NewIterator()
+	defer it.Close()
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if i >= len(keys) || string(it.Key()) != keys[i] || string(it.Value()) != expect[keys[i]] {
+			t.Errorf("%s: entry %d is %s = %s", msg, i, it.Key(), it.Value())
+			t.FailNow()
+		}
+		i++
+	}
+	if it.Err() != nil || i != len(keys) {
+		t.Errorf("%s: iterated %d of %d: %v", msg, i, len(keys), it.Err())
+		t.FailNow()
+	}
+
+	i = len(keys) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if i < 0 || string(it.Key()) != keys[i] || string(it.Value()) != expect[keys[i]] {
+			t.Errorf("%s: backward entry %d is %s = %s", msg, i, it.Key(), it.Value())
+			t.FailNow()
+		}
+		i--
+	}
+	if it.Err() != nil || i != -1 {
+		t.Errorf("%s: backward stopped at %d: %v", msg, i, it.Err())
+		t.FailNow()
+	}
+}
+
+func copyExpect(expect map[string]string) map[string]string {
+	c := map[string]string{}
+	for k, v := range expect {
+		c[k] = v
+	}
+	return c
+}
+
+// Take snapshots between rounds of writes, checking each still reads
+// the same after later writes, flushes and compactions
+func testSnapshots(t *testing.T, config *DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+	config.L0CompactionTrigger = 2
+
+	db := openCompactionDb(t, config)
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(1))
+	expect := map[string]string{}
+	var snapshots []*Snapshot
+	var expects []map[string]string
+	for round := 0; round < 8; round++ {
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key%02d", r.Intn(50))
+			if r.Intn(4) == 0 {
+				db.Delete([]byte(k))
+				delete(expect, k)
+			} else {
+				v := fmt.Sprintf("%d-%d", round, i)
+				db.Put([]byte(k), []byte(v))
+				expect[k] = v
+			}
+		}
+		snapshots = append(snapshots, db.NewSnapshot())
+		expects = append(expects, copyExpect(expect))
+
+		if round%2 == 1 {
+			if err := db.Flush(); err != nil {
+				t.Errorf("Flush failed: %v", err)
+				t.FailNow()
+			}
+		}
+		if round%4 == 3 {
+			if err := db.Compact(); err != nil {
+				t.Errorf("Compact failed: %v", err)
+				t.FailNow()
+			}
+		}
+
+		for i, s := range snapshots {
+			msg := fmt.Sprintf("round %d snapshot %d", round, i)
+			checkSnapshotGet(t, s, expects[i], msg)
+			checkSnapshotIterator(t, s, expects[i], msg)
+		}
+	}
+
+	for _, s := range snapshots {
+		s.Release()
+	}
+	if len(db.snapshots) != 0 {
+		t.Errorf("snapshots not released: %v", db.snapshots)
+	}
+	if _, err := snapshots[0].Get([]byte("key00")); err != ErrSnapshotReleased {
+		t.Errorf("released snapshot readable: %v", err)
+	}
+
+	// Once released, the next compaction through the old versions drops
+	// them.  Rewrite every key so leveled compaction merges every table.
+	if config.CompactionStyle != CompactionLeveled {
+		return
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("last"))
+		}
+		db.Flush()
+	}
+	db.Compact()
+	db.lock.Lock()
+	var count uint64
+	for _, level := range db.defaultFamily().levels {
+		for _, tbl := range level {
+			count += tbl.meta().count
+		}
+	}
+	db.lock.Unlock()
+	if count != 50 {
+		t.Errorf("%d entries kept for 50 keys", count)
+	}
+}
+
+func TestSnapshotsJSON(t *testing.T) {
+	testSnapshots(t, &DbConfig{})
+}
+
+func TestSnapshotsBlock(t *testing.T) {
+	testSnapshots(t, &DbConfig{TableFormat: TableFormatBlock, BlockSize: 64})
+}
+
+func TestSnapshotsTiered(t *testing.T) {
+	testSnapshots(t, &DbConfig{CompactionStyle: CompactionSizeTiered, TierMinWidth: 2})
+}
+
+// The memtable keeps old versions only while a snapshot needs them
+func TestSnapshotMemtableVersions(t *testing.T) {
+	db := openCompactionDb(t, &DbConfig{})
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	s := db.NewSnapshot()
+	db.Put([]byte("a"), []byte("2"))
+	db.Put([]byte("a"), []byte("3"))
+	db.Delete([]byte("a"))
+
+	n := db.defaultFamily().mem.find([]byte("a"))
+	// Only the version the snapshot reads is kept
+	if n == nil || !n.tombstone || n.older == nil || string(n.older.value) != "1" ||
+		n.older.older != nil {
+		t.Errorf("versions not kept")
+		t.FailNow()
+	}
+	if v, _ := s.Get([]byte("a")); string(v) != "1" {
+		t.Errorf("snapshot read %q != 1", v)
+	}
+	if db.GetString("a") != nil {
+		t.Errorf("deleted key found")
+	}
+
+	s.Release()
+	db.Put([]byte("a"), []byte("4"))
+	if n.older != nil {
+		t.Errorf("versions kept after release")
+	}
+	if db.defaultFamily().mem.Size() != len("a")+len("4") {
+		t.Errorf("size %d after release", db.defaultFamily().mem.Size())
+	}
+}
+
+// Sequences continue across a restart so new writes shadow old ones
+func TestSnapshotSequenceRecovered(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir}
+
+	db := openCompactionDb(t, config)
+	db.Put([]byte("a"), []byte("1"))
+	db.Flush()
+	db.Put([]byte("b"), []byte("1"))
+	last := db.lastSequence
+	db.Close()
+
+	db = openCompactionDb(t, config)
+	defer db.Close()
+	if db.lastSequence != last {
+		t.Errorf("lastSequence %d != %d", db.lastSequence, last)
+	}
+	db.Put([]byte("a"), []byte("2"))
+	s := db.NewSnapshot()
+	defer s.Release()
+	checkSnapshotIterator(t, s, map[string]string{"a": "2", "b": "1"}, "reopened")
+}
+
+// Many versions of a key spread over several blocks
+func TestVersionIteratorAcrossBlocks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{TableFormat: TableFormatBlock, BlockSize: 32}
+	config.setDefaults()
+
+	tree := NewTree()
+	var sequence uint64
+	for _, k := range []string{"a", "b", "c"} {
+		for i := 0; i < 20; i++ {
+			sequence++
+			n := NewNode([]byte(k), []byte(fmt.Sprintf("%s%d", k, sequence)))
+			n.sequence = sequence
+			tree.insertVersion(n, func(v, newer *Node, depth int) bool { return true })
+		}
+	}
+	tbl := writeTestTable(t, dir, config, tree)
+	defer tbl.close()
+	if tbl.meta().count != 60 {
+		t.Errorf("count %d != 60", tbl.meta().count)
+	}
+
+	// b was written at sequences 21 to 40
+	for _, seq := range []uint64{0, 5, 20, 21, 30, 40, 41, 60} {
+		expect := []string{}
+		for i, k := range []string{"a", "b", "c"} {
+			first := uint64(i*20 + 1)
+			if seq >= first {
+				v := seq
+				if v > first+19 {
+					v = first + 19
+				}
+				expect = append(expect, fmt.Sprintf("%s%d", k, v))
+			}
+		}
+
+		it := &versionIterator{tbl.iterator(), seq}
+		got := []string{}
+		for it.seekToFirst(); it.valid(); it.next() {
+			got = append(got, string(it.entry().Value))
+		}
+		back := []string{}
+		for it.seekToLast(); it.valid(); it.prev() {
+			back = append([]string{string(it.entry().Value)}, back...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expect) || fmt.Sprint(back) != fmt.Sprint(expect) {
+			t.Errorf("sequence %d: %v %v != %v", seq, got, back, expect)
+		}
+
+		e, err := tbl.get([]byte("b"), seq)
+		if err != nil {
+			t.Errorf("get failed: %v", err)
+		} else if seq < 21 && e != nil || seq >= 21 && (e == nil || string(e.Value) != expect[1]) {
+			t.Errorf("sequence %d: get b = %v", seq, e)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Sorted string tables.  When a memtable fills up it is frozen and its
+// contents written, in key order, to an immutable table on disk.  Deleted
+// keys are written as tombstones so they keep shadowing older tables.
+//
+// Two formats are supported.  The JSON format described in the README
+// favors readability and is read into memory whole, the block format in
+// blocktable.go is compact and reads a single block per lookup.  Both
+// use the .sst suffix, the block format is recognized by its footer.
+
+package kvdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+type TableFormat int
+
+const (
+	TableFormatJSON TableFormat = iota
+	TableFormatBlock
+)
+
+// A version of a key.  Tables hold every version a snapshot may still
+// read, ordered by key and then newest, highest sequence, first.
+type tableEntry struct {
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	Tombstone bool   `json:"tombstone,omitempty"`
+	Sequence  uint64 `json:"sequence,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+
+	// Media type the value was put with, empty if none was given
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Whether the entry has a TTL that ran out at or before now, an expired
+// entry reads as deleted
+func (e *tableEntry) expired(now int64) bool {
+	return e.Expires > 0 && now >= e.Expires
+}
+
+// Turn an expired entry into a tombstone, dropping its value
+func (e *tableEntry) purge(now int64) {
+	if e.expired(now) {
+		e.Value = nil
+		e.Tombstone = true
+		e.Expires = 0
+		e.ContentType = ""
+	}
+}
+
+// Describes a whole table.  level is the compaction level the table
+// belongs to and newest the file number of the most recent flush whose
+// data the table holds, which orders tables that may share keys.
+type tableMeta struct {
+	count        uint64
+	smallest     []byte
+	largest      []byte
+	minTimestamp int64
+	maxTimestamp int64
+	level        int
+	newest       uint64
+	filter       bloomFilter
+
+	// Orders the keys of the family the table belongs to, given when
+	// it is opened
+	cmp Comparator
+}
+
+// Whether key falls within the table's key range
+func (m *tableMeta) contains(key []byte) bool {
+	return m.count > 0 && m.cmp.Compare(key, m.smallest) >= 0 &&
+		m.cmp.Compare(key, m.largest) <= 0
+}
+
+// Whether the table's key range intersects [smallest, largest]
+func (m *tableMeta) overlaps(smallest, largest []byte) bool {
+	return m.count > 0 && m.cmp.Compare(m.largest, smallest) >= 0 &&
+		m.cmp.Compare(m.smallest, largest) <= 0
+}
+
+func (m *tableMeta) addEntry(e *tableEntry) {
+	if m.count == 0 {
+		m.smallest = append([]byte{}, e.Key...)
+		m.minTimestamp = e.Timestamp
+		m.maxTimestamp = e.Timestamp
+	}
+	m.count++
+	m.largest = append(m.largest[:0], e.Key...)
+	if e.Timestamp < m.minTimestamp {
+		m.minTimestamp = e.Timestamp
+	}
+	if e.Timestamp > m.maxTimestamp {
+		m.maxTimestamp = e.Timestamp
+	}
+}
+
+type table interface {
+	fileNumber() uint64
+	meta() *tableMeta
+
+	// Size of the table file in bytes
+	size() int64
+
+	// Find the newest version of key with a sequence number at or below
+	// sequence, which may be a tombstone, or nil if the table has none.
+	get(key []byte, sequence uint64) (*tableEntry, error)
+
+	// Iterate over every version in key order
+	iterator() tableIterator
+
+	close() error
+}
+
+// Iterates over the entries of a table or memtable.  A new iterator is
+// not positioned, one of the seek methods must be called first.
+type tableIterator interface {
+	seekToFirst()
+	seekToLast()
+
+	// Position at the first entry with a key greater than or equal to key
+	seek(key []byte)
+
+	next()
+	prev()
+	valid() bool
+	entry() *tableEntry
+	err() error
+}
+
+// Find the newest version of key at or below sequence using it
+func findVersion(it tableIterator, key []byte, sequence uint64) (*tableEntry, error) {
+	for it.seek(key); it.valid() && bytes.Equal(it.entry().Key, key); it.next() {
+		if it.entry().Sequence <= sequence {
+			e := *it.entry()
+			return &e, nil
+		}
+	}
+	return nil, it.err()
+}
+
+// Accepts entries in key order and writes them out as a table
+type tableBuilder interface {
+	add(e *tableEntry) error
+	finish() error
+}
+
+func newTableBuilder(f *os.File, config *DbConfig, level int, newest uint64) tableBuilder {
+	if config.TableFormat == TableFormatBlock {
+		return newBlockBuilder(f, config, level, newest)
+	}
+	return &jsonBuilder{w: f, bitsPerKey: config.BloomBitsPerKey,
+		contents: tableContents{
+			Level:   level,
+			Newest:  newest,
+			Entries: []tableEntry{},
+		}}
+}
+
+// Write every node of tree and its older versions, including tombstones,
+// to level 0 table number in dir, purging values that expired by now
+func writeTable(dir string, number uint64, config *DbConfig, tree *Tree, now int64) error {
+	return writeFileAtomic(dir, number, tableFile, func(f *os.File) error {
+		b := newTableBuilder(f, config, 0, number)
+		var err error
+		tree.InOrder(func(n *Node) {
+			for v := n; v != nil && err == nil; v = v.older {
+				e := v.entry()
+				e.purge(now)
+				err = b.add(&e)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return b.finish()
+	})
+}
+
+// Open table number in dir, whose keys are ordered by cmp
+func openTable(dir string, number uint64, cmp Comparator) (table, error) {
+	path := fileName(dir, tableFile, number)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	isBlock, err := hasBlockFooter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if isBlock {
+		t, err := openBlockTable(f, number)
+		if err != nil {
+			return nil, err
+		}
+		t.info.cmp = cmp
+		return t, nil
+	}
+
+	defer f.Close()
+	blob, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents tableContents
+	if err := json.Unmarshal(blob, &contents); err != nil {
+		return nil, err
+	}
+
+	t := &jsonTable{number: number, fileSize: int64(len(blob)), entries: contents.Entries}
+	for i := range t.entries {
+		t.info.addEntry(&t.entries[i])
+	}
+	t.info.level = contents.Level
+	t.info.newest = contents.Newest
+	t.info.filter = contents.Bloom
+	t.info.cmp = cmp
+	if t.info.newest == 0 {
+		t.info.newest = number
+	}
+	return t, nil
+}
+
+type tableContents struct {
+	Level   int          `json:"level"`
+	Newest  uint64       `json:"newest"`
+	Bloom   []byte       `json:"bloom,omitempty"`
+	Entries []tableEntry `json:"entries"`
+}
+
+type jsonBuilder struct {
+	w          *os.File
+	bitsPerKey int
+	contents   tableContents
+}
+
+func (b *jsonBuilder) add(e *tableEntry) error {
+	b.contents.Entries = append(b.contents.Entries, *e)
+	return nil
+}
+
+func (b *jsonBuilder) finish() error {
+	if b.bitsPerKey > 0 {
+		hashes := make([]uint64, len(b.contents.Entries))
+		for i := range b.contents.Entries {
+			hashes[i] = bloomHash(b.contents.Entries[i].Key)
+		}
+		b.contents.Bloom = newBloomFilter(hashes, b.bitsPerKey)
+	}
+
+	w := bufio.NewWriter(b.w)
+	if err := json.NewEncoder(w).Encode(&b.contents); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type jsonTable struct {
+	number   uint64
+	fileSize int64
+	info     tableMeta
+	entries  []tableEntry
+}
+
+func (t *jsonTable) fileNumber() uint64 {
+	return t.number
+}
+
+func (t *jsonTable) meta() *tableMeta {
+	return &t.info
+}
+
+func (t *jsonTable) size() int64 {
+	return t.fileSize
+}
+
+func (t *jsonTable) get(key []byte, sequence uint64) (*tableEntry, error) {
+	return findVersion(t.iterator(), key, sequence)
+}
+
+func (t *jsonTable) iterator() tableIterator {
+	return &sliceIterator{entries: t.entries, pos: -1, cmp: t.info.cmp}
+}
+
+func (t *jsonTable) close() error {
+	return nil
+}
+
+type sliceIterator struct {
+	entries []tableEntry
+	pos     int
+	cmp     Comparator
+}
+
+func (it *sliceIterator) seekToFirst() {
+	it.pos = 0
+}
+
+func (it *sliceIterator) seekToLast() {
+	it.pos = len(it.entries) - 1
+}
+
+func (it *sliceIterator) seek(key []byte) {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.cmp.Compare(it.entries[i].Key, key) >= 0
+	})
+}
+
+func (it *sliceIterator) next() {
+	it.pos++
+}
+
+func (it *sliceIterator) prev() {
+	it.pos--
+}
+
+func (it *sliceIterator) valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) entry() *tableEntry {
+	return &it.entries[it.pos]
+}
+
+func (it *sliceIterator) err() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+// Whitebox tests for sstable.go and blocktable.go
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func writeTestTable(t *testing.T, dir string, config *DbConfig, tree *Tree) table {
+	if err := writeTable(dir, 3, config, tree, 0); err != nil {
+		t.Errorf("writeTable failed: %v", err)
+		t.FailNow()
+	}
+
+	tbl, err := openTable(dir, 3, BytewiseComparator)
+	if err != nil {
+		t.Errorf("openTable failed: %v", err)
+		t.FailNow()
+	}
+	return tbl
+}
+
+func getTestEntry(t *testing.T, tbl table, key string) *tableEntry {
+	e, err := tbl.get([]byte(key), math.MaxUint64)
+	if err != nil {
+		t.Errorf("get failed: %v", err)
+		t.FailNow()
+	}
+	return e
+}
+
+func testTableRoundTrip(t *testing.T, config *DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	tree := NewTree()
+	tree.Insert([]byte("c"), []byte("baz"))
+	tree.Insert([]byte("a"), []byte("foo"))
+	tree.Insert([]byte("b"), []byte("bar"))
+	tree.InsertTombstone([]byte("b"))
+	tree.InsertTombstone([]byte("d"))
+
+	tbl := writeTestTable(t, dir, config, tree)
+	defer tbl.close()
+
+	e := getTestEntry(t, tbl, "a")
+	if e == nil || string(e.Value) != "foo" || e.Tombstone {
+		t.Errorf("a invalid %v", e)
+	}
+
+	e = getTestEntry(t, tbl, "b")
+	if e == nil || !e.Tombstone {
+		t.Errorf("b not a tombstone %v", e)
+	}
+
+	e = getTestEntry(t, tbl, "d")
+	if e == nil || !e.Tombstone {
+		t.Errorf("d not a tombstone %v", e)
+	}
+
+	e = getTestEntry(t, tbl, "bb")
+	if e != nil {
+		t.Errorf("bb != nil")
+	}
+
+	e = getTestEntry(t, tbl, "z")
+	if e != nil {
+		t.Errorf("z != nil")
+	}
+}
+
+func TestJSONTableRoundTrip(t *testing.T) {
+	testTableRoundTrip(t, &DbConfig{})
+}
+
+func TestBlockTableRoundTrip(t *testing.T) {
+	testTableRoundTrip(t, &DbConfig{TableFormat: TableFormatBlock})
+}
+
+// Small blocks force many index entries and shared key prefixes
+func TestBlockTableManyBlocks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	tree := NewTree()
+	for i := 0; i < 500; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+
+	config := &DbConfig{TableFormat: TableFormatBlock, BlockSize: 64}
+	tbl := writeTestTable(t, dir, config, tree)
+	defer tbl.close()
+
+	bt, ok := tbl.(*blockTable)
+	if !ok {
+		t.Errorf("table is not a block table")
+		t.FailNow()
+	}
+
+	if len(bt.index) < 10 {
+		t.Errorf("expected many blocks, got %d", len(bt.index))
+	}
+
+	if bt.info.count != 500 {
+		t.Errorf("meta.count != 500: %d", bt.info.count)
+	}
+
+	if string(bt.info.smallest) != "key0000" || string(bt.info.largest) != "key0499" {
+		t.Errorf("key range invalid %s %s", bt.info.smallest, bt.info.largest)
+	}
+
+	if bt.info.minTimestamp > bt.info.maxTimestamp || bt.info.minTimestamp <= 0 {
+		t.Errorf("timestamps invalid %d %d", bt.info.minTimestamp, bt.info.maxTimestamp)
+	}
+
+	for i := 0; i < 500; i++ {
+		e := getTestEntry(t, tbl, fmt.Sprintf("key%04d", i))
+		if e == nil || string(e.Value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("key%04d invalid %v", i, e)
+			t.FailNow()
+		}
+	}
+
+	if e := getTestEntry(t, tbl, "key0100a"); e != nil {
+		t.Errorf("key0100a != nil")
+	}
+}
+
+func TestBlockTableCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	tree := NewTree()
+	tree.Insert([]byte("a"), []byte("foo"))
+	tbl := writeTestTable(t, dir, &DbConfig{TableFormat: TableFormatBlock}, tree)
+	tbl.close()
+
+	path := fileName(dir, tableFile, 3)
+	data, _ := ioutil.ReadFile(path)
+	data[0] ^= 0xff
+	ioutil.WriteFile(path, data, 0644)
+
+	tbl, err := openTable(dir, 3, BytewiseComparator)
+	if err != nil {
+		t.Errorf("openTable failed: %v", err)
+		t.FailNow()
+	}
+	defer tbl.close()
+
+	_, err = tbl.get([]byte("a"), math.MaxUint64)
+	if err != errCorruptTable {
+		t.Errorf("err != errCorruptTable: %v", err)
+	}
+}
@@ -16,7 +16,6 @@
 package kvdb
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -38,19 +37,37 @@ const (
 
 type Tree struct {
 	root *Node
+	size int
+
+	// Incremented whenever a node is removed, so code holding a node
+	// across changes to the tree knows to find its place again
+	generation uint64
+
+	// Orders the keys, see Comparator
+	cmp Comparator
 }
 
 func NewTree() *Tree {
-	return &Tree{}
+	return newTree(BytewiseComparator)
 }
 
-func (tree *Tree) getNode(key []byte) *Node {
+func newTree(cmp Comparator) *Tree {
+	return &Tree{cmp: cmp}
+}
+
+// Approximate size in bytes of the keys and values held in the tree
+func (tree *Tree) Size() int {
+	return tree.size
+}
+
+// Find the node for key whether or not it is tombstoned
+func (tree *Tree) find(key []byte) *Node {
 	target := tree.root
 	for target != nil {
-		c := bytes.Compare(key, target.key)
-		if c == -1 {
+		c := tree.cmp.Compare(key, target.key)
+		if c < 0 {
 			target = target.left
-		} else if c == 0 && !target.tombstone {
+		} else if c == 0 {
 			return target
 		} else {
 			target = target.right
@@ -59,17 +76,26 @@ func (tree *Tree) getNode(key []byte) *Node {
 	return nil
 }
 
+// Find the node for key, ignoring tombstones
+func (tree *Tree) getNode(key []byte) *Node {
+	n := tree.find(key)
+	if n != nil && n.tombstone {
+		return nil
+	}
+	return n
+}
+
 func (tree *Tree) doInsert(n *Node) *Node {
 	target := &tree.root
 	parent := tree.root
 	for *target != nil {
 		parent = *target
-		c := n.Compare(*target)
-		if c == -1 {
+		c := tree.cmp.Compare(n.key, (*target).key)
+		if c < 0 {
 			target = &((*target).left)
 		} else if c == 0 {
+			tree.size += len(n.value) - len((*target).value)
 			(*target).SetValue(n.value)
-			fmt.Println("existing")
 			return *target
 		} else {
 			target = &((*target).right)
@@ -77,6 +103,7 @@ func (tree *Tree) doInsert(n *Node) *Node {
 	}
 	n.parent = parent
 	*target = n
+	tree.size += len(n.key) + len(n.value)
 	return *target
 }
 
@@ -94,6 +121,9 @@ func (tree *Tree) rightRotate(oldRoot *Node) {
 	leftChild.right = oldRoot
 
 	oldRoot.left = tmp
+	if tmp != nil {
+		tmp.parent = oldRoot
+	}
 
 	if oldRoot.parent == nil {
 		tree.root = leftChild
@@ -115,6 +145,9 @@ func (tree *Tree) leftRotate(oldRoot *Node) {
 	tmp := rightChild.left
 	rightChild.left = oldRoot
 	oldRoot.right = tmp
+	if tmp != nil {
+		tmp.parent = oldRoot
+	}
 	if oldRoot.parent == nil {
 		tree.root = rightChild
 	} else if oldRoot.parent.left == oldRoot {
@@ -125,15 +158,15 @@ func (tree *Tree) leftRotate(oldRoot *Node) {
 	oldRoot.parent = rightChild
 }
 
-func getRotateCase(newNode, parent, grandparent *Node) RotateCase {
-	if parent.Less(grandparent) {
-		if newNode.Less(parent) {
+func getRotateCase(cmp Comparator, newNode, parent, grandparent *Node) RotateCase {
+	if cmp.Compare(parent.key, grandparent.key) < 0 {
+		if cmp.Compare(newNode.key, parent.key) < 0 {
 			return LeftLeft
 		} else {
 			return LeftRight
 		}
 	} else {
-		if parent.Less(newNode) {
+		if cmp.Compare(parent.key, newNode.key) < 0 {
 			return RightRight
 		} else {
 			return RightLeft
@@ -146,9 +179,7 @@ func (tree *Tree) reColor(newNode *Node) {
 
 	for target != nil {
 		if target.parent == nil {
-			if target.color != Black {
-				newNode.color = Black
-			}
+			target.color = Black
 			return
 		}
 
@@ -168,9 +199,10 @@ func (tree *Tree) reColor(newNode *Node) {
 		if uncle != nil && uncle.color == Red {
 			parent.color = Black
 			uncle.color = Black
+			grandparent.color = Red
 			target = grandparent
 		} else {
-			rotateCase := getRotateCase(newNode, parent, grandparent)
+			rotateCase := getRotateCase(tree.cmp, target, parent, grandparent)
 			switch rotateCase {
 			case LeftLeft:
 				tree.rightRotate(grandparent)
@@ -196,15 +228,196 @@ func (tree *Tree) reColor(newNode *Node) {
 }
 
 func (tree *Tree) Insert(key, value []byte) {
-	n := NewNode(key, value)
-	n = tree.doInsert(n)
-	tree.reColor(n)
+	tree.insertVersion(NewNode(key, value), nil)
 }
 
+// Remove key, and any older versions of it, from the tree.  Use
+// InsertTombstone instead when the deletion must shadow copies of the key
+// held outside the tree.
 func (tree *Tree) Delete(key []byte) {
-	n := tree.getNode(key)
+	n := tree.find(key)
 	if n != nil {
-		n.Delete()
+		for v := n; v != nil; v = v.older {
+			tree.size -= len(v.key) + len(v.value)
+		}
+		tree.remove(n)
+	}
+}
+
+// Mark key deleted, inserting a tombstone if the key is not in the tree
+// so the deletion shadows older copies of the key held outside of it.
+func (tree *Tree) InsertTombstone(key []byte) {
+	n := NewNode(key, nil)
+	n.tombstone = true
+	tree.insertVersion(n, nil)
+}
+
+// Decides whether an older version of a key is kept, v being the depth'th
+// newest version (the newest is 1) and newer the version written after it
+type retainFunc func(v, newer *Node, depth int) bool
+
+// Make n the newest version of its key.  The node already holding the key
+// keeps its place in the tree and takes n's contents, its previous
+// version joins the older versions and those retain rejects are
+// discarded.  A nil retain discards every older version.
+func (tree *Tree) insertVersion(n *Node, retain retainFunc) {
+	existing := tree.find(n.key)
+	if existing == nil {
+		tree.doInsert(n)
+		tree.reColor(n)
+		return
+	}
+
+	existing.older = &Node{
+		key:         existing.key,
+		value:       existing.value,
+		timestamp:   existing.timestamp,
+		tombstone:   existing.tombstone,
+		expires:     existing.expires,
+		contentType: existing.contentType,
+		sequence:    existing.sequence,
+		older:       existing.older,
+	}
+	tree.size += len(existing.key) + len(n.value)
+	existing.value = n.value
+	existing.timestamp = n.timestamp
+	existing.tombstone = n.tombstone
+	existing.expires = n.expires
+	existing.contentType = n.contentType
+	existing.sequence = n.sequence
+
+	newer, depth := existing, 2
+	for v := existing.older; v != nil; v = v.older {
+		if retain != nil && retain(v, newer, depth) {
+			newer.older = v
+			newer = v
+			depth++
+		} else {
+			tree.size -= len(v.key) + len(v.value)
+		}
+	}
+	newer.older = nil
+}
+
+func colorOf(n *Node) Color {
+	if n == nil {
+		return Black
+	}
+	return n.color
+}
+
+// Put v in u's place under u's parent
+func (tree *Tree) transplant(u, v *Node) {
+	if u.parent == nil {
+		tree.root = v
+	} else if u == u.parent.left {
+		u.parent.left = v
+	} else {
+		u.parent.right = v
+	}
+	if v != nil {
+		v.parent = u.parent
+	}
+}
+
+// Unlink n from the tree.  A node with two children is replaced by its
+// successor, moved rather than copied so every other node keeps its key.
+// Removing a black node leaves one path a black node short, which
+// removeFixup repairs.
+func (tree *Tree) remove(n *Node) {
+	var child, parent *Node
+	removedColor := n.color
+
+	if n.left == nil {
+		child, parent = n.right, n.parent
+		tree.transplant(n, n.right)
+	} else if n.right == nil {
+		child, parent = n.left, n.parent
+		tree.transplant(n, n.left)
+	} else {
+		next := n.right
+		for next.left != nil {
+			next = next.left
+		}
+		removedColor = next.color
+		child = next.right
+		if next.parent == n {
+			parent = next
+		} else {
+			parent = next.parent
+			tree.transplant(next, next.right)
+			next.right = n.right
+			next.right.parent = next
+		}
+		tree.transplant(n, next)
+		next.left = n.left
+		next.left.parent = next
+		next.color = n.color
+	}
+
+	if removedColor == Black {
+		tree.removeFixup(child, parent)
+	}
+	n.left, n.right, n.parent = nil, nil, nil
+	tree.generation++
+}
+
+// Restore the red-black properties after removing a black node.  n, which
+// may be nil, carries an extra black that is pushed up the tree until it
+// can be absorbed by a red node or by rotating a sibling's subtree.
+func (tree *Tree) removeFixup(n, parent *Node) {
+	for n != tree.root && colorOf(n) == Black {
+		if n == parent.left {
+			sibling := parent.right
+			if colorOf(sibling) == Red {
+				sibling.color = Black
+				parent.color = Red
+				tree.leftRotate(parent)
+				sibling = parent.right
+			}
+			if colorOf(sibling.left) == Black && colorOf(sibling.right) == Black {
+				sibling.color = Red
+				n, parent = parent, parent.parent
+				continue
+			}
+			if colorOf(sibling.right) == Black {
+				sibling.left.color = Black
+				sibling.color = Red
+				tree.rightRotate(sibling)
+				sibling = parent.right
+			}
+			sibling.color = parent.color
+			parent.color = Black
+			sibling.right.color = Black
+			tree.leftRotate(parent)
+		} else {
+			sibling := parent.left
+			if colorOf(sibling) == Red {
+				sibling.color = Black
+				parent.color = Red
+				tree.rightRotate(parent)
+				sibling = parent.left
+			}
+			if colorOf(sibling.left) == Black && colorOf(sibling.right) == Black {
+				sibling.color = Red
+				n, parent = parent, parent.parent
+				continue
+			}
+			if colorOf(sibling.left) == Black {
+				sibling.right.color = Black
+				sibling.color = Red
+				tree.leftRotate(sibling)
+				sibling = parent.left
+			}
+			sibling.color = parent.color
+			parent.color = Black
+			sibling.left.color = Black
+			tree.rightRotate(parent)
+		}
+		n = tree.root
+	}
+	if n != nil {
+		n.color = Black
 	}
 }
 
@@ -216,6 +429,60 @@ func (tree *Tree) Get(key []byte) []byte {
 	return nil
 }
 
+// Check the tree is a valid red-black tree: keys are in order, parent
+// pointers match, the root is black, no red node has a red child and
+// every path to a leaf has the same number of black nodes.  Returns an
+// error describing the first violation found.  Meant for tests.
+func (tree *Tree) Verify() error {
+	if colorOf(tree.root) != Black {
+		return fmt.Errorf("root %q is red", tree.root.key)
+	}
+	if tree.root != nil && tree.root.parent != nil {
+		return fmt.Errorf("root %q has a parent", tree.root.key)
+	}
+	_, err := verifySubtree(tree.cmp, tree.root, nil, nil)
+	return err
+}
+
+// Verify the subtree rooted at n, whose keys must all lie strictly
+// between low and high where they are not nil.  Returns the black height.
+func verifySubtree(cmp Comparator, n *Node, low, high []byte) (int, error) {
+	if n == nil {
+		return 1, nil
+	}
+	if low != nil && cmp.Compare(n.key, low) <= 0 ||
+		high != nil && cmp.Compare(n.key, high) >= 0 {
+		return 0, fmt.Errorf("%q out of order", n.key)
+	}
+	for _, child := range []*Node{n.left, n.right} {
+		if child == nil {
+			continue
+		}
+		if child.parent != n {
+			return 0, fmt.Errorf("%q has wrong parent", child.key)
+		}
+		if n.color == Red && child.color == Red {
+			return 0, fmt.Errorf("red %q has red child %q", n.key, child.key)
+		}
+	}
+
+	left, err := verifySubtree(cmp, n.left, low, n.key)
+	if err != nil {
+		return 0, err
+	}
+	right, err := verifySubtree(cmp, n.right, n.key, high)
+	if err != nil {
+		return 0, err
+	}
+	if left != right {
+		return 0, fmt.Errorf("%q black heights %d != %d", n.key, left, right)
+	}
+	if n.color == Black {
+		left++
+	}
+	return left, nil
+}
+
 type TraversalOperation func(node *Node)
 
 func (tree *Tree) InOrder(op TraversalOperation) {
@@ -232,3 +499,81 @@ func (tree *Tree) InOrder(op TraversalOperation) {
 		n = n.right
 	}
 }
+
+// The node with the smallest key, or nil if the tree is empty
+func (tree *Tree) first() *Node {
+	n := tree.root
+	for n != nil && n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+// The node with the largest key, or nil if the tree is empty
+func (tree *Tree) last() *Node {
+	n := tree.root
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+	return n
+}
+
+// The node with the smallest key greater than or equal to key
+func (tree *Tree) ceiling(key []byte) *Node {
+	var result *Node
+	n := tree.root
+	for n != nil {
+		if tree.cmp.Compare(n.key, key) >= 0 {
+			result = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return result
+}
+
+// The node with the largest key less than or equal to key
+func (tree *Tree) floor(key []byte) *Node {
+	var result *Node
+	n := tree.root
+	for n != nil {
+		if tree.cmp.Compare(n.key, key) <= 0 {
+			result = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return result
+}
+
+// The node following n in key order
+func successor(n *Node) *Node {
+	if n.right != nil {
+		n = n.right
+		for n.left != nil {
+			n = n.left
+		}
+		return n
+	}
+	for n.parent != nil && n == n.parent.right {
+		n = n.parent
+	}
+	return n.parent
+}
+
+// The node preceding n in key order
+func predecessor(n *Node) *Node {
+	if n.left != nil {
+		n = n.left
+		for n.right != nil {
+			n = n.right
+		}
+		return n
+	}
+	for n.parent != nil && n == n.parent.left {
+		n = n.parent
+	}
+	return n.parent
+}
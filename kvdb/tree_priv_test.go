@@ -4,6 +4,8 @@
 package kvdb
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -214,25 +216,25 @@ func TestGetRotateCase(t *testing.T) {
 	n2 := NewStringNode("h", "baz")
 	n3 := NewStringNode("a", "foo")
 
-	rcase := getRotateCase(n3, n2, n1)
+	rcase := getRotateCase(BytewiseComparator, n3, n2, n1)
 	if rcase != LeftLeft {
 		t.Errorf("rcase != LeftLeft")
 		t.FailNow()
 	}
 
-	rcase = getRotateCase(n2, n3, n1)
+	rcase = getRotateCase(BytewiseComparator, n2, n3, n1)
 	if rcase != LeftRight {
 		t.Errorf("rcase != LeftRight")
 		t.FailNow()
 	}
 
-	rcase = getRotateCase(n1, n2, n3)
+	rcase = getRotateCase(BytewiseComparator, n1, n2, n3)
 	if rcase != RightRight {
 		t.Errorf("rcase != RightRight")
 		t.FailNow()
 	}
 
-	rcase = getRotateCase(n2, n1, n3)
+	rcase = getRotateCase(BytewiseComparator, n2, n1, n3)
 	if rcase != RightLeft {
 		t.Errorf("rcase != RightRight")
 		t.FailNow()
@@ -522,3 +524,177 @@ func TestRightLeftRoot(t *testing.T) {
 		t.Errorf("n4.right != n3")
 	}
 }
+
+func checkInvariants(t *testing.T, tree *Tree, msg string) {
+	if err := tree.Verify(); err != nil {
+		t.Errorf("%s: %v", msg, err)
+		t.FailNow()
+	}
+}
+
+func countNodes(tree *Tree) int {
+	count := 0
+	tree.InOrder(func(*Node) { count++ })
+	return count
+}
+
+func TestInsertInvariants(t *testing.T) {
+	tree := NewTree()
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("%03d", (i*37)%200)
+		tree.Insert([]byte(k), []byte("v"))
+		checkInvariants(t, tree, "insert "+k)
+	}
+
+	// Updating existing keys must leave the shape alone
+	for i := 0; i < 200; i += 3 {
+		tree.Insert([]byte(fmt.Sprintf("%03d", i)), []byte("w"))
+		checkInvariants(t, tree, "update")
+	}
+}
+
+func TestDeleteLeaf(t *testing.T) {
+	tree := NewTree()
+	n1 := tree.doInsert(NewStringNode("l", "bar"))
+	tree.reColor(n1)
+	n2 := tree.doInsert(NewStringNode("d", "baz"))
+	tree.reColor(n2)
+
+	tree.Delete([]byte("d"))
+	checkInvariants(t, tree, "red leaf")
+	if tree.root != n1 || n1.left != nil || n2.parent != nil {
+		t.Errorf("red leaf not unlinked")
+	}
+
+	tree.Delete([]byte("l"))
+	if tree.root != nil || tree.Size() != 0 {
+		t.Errorf("tree not empty")
+	}
+}
+
+// Removing a black leaf whose sibling is black with a red child needs
+// a rotation
+func TestDeleteBlackLeafRotates(t *testing.T) {
+	tree := NewTree()
+	for _, k := range []string{"l", "d", "r", "t"} {
+		tree.Insert([]byte(k), []byte("v"))
+	}
+	if colorOf(tree.find([]byte("d"))) != Black {
+		t.Errorf("d is not black")
+		t.FailNow()
+	}
+
+	tree.Delete([]byte("d"))
+	checkInvariants(t, tree, "black leaf")
+	if string(tree.root.key) != "r" {
+		t.Errorf("tree.root %s != r", tree.root.key)
+	}
+}
+
+func TestDeleteTwoChildren(t *testing.T) {
+	tree := NewTree()
+	for _, k := range []string{"h", "d", "p", "b", "f", "n", "t", "e"} {
+		tree.Insert([]byte(k), []byte("v"))
+	}
+	e := tree.find([]byte("e"))
+	f := tree.find([]byte("f"))
+
+	// d is replaced by its successor node, e, not by a copy of it
+	tree.Delete([]byte("d"))
+	checkInvariants(t, tree, "two children")
+	if tree.find([]byte("d")) != nil || tree.find([]byte("e")) != e || tree.find([]byte("f")) != f {
+		t.Errorf("successor not moved into place")
+	}
+	if countNodes(tree) != 7 {
+		t.Errorf("%d nodes != 7", countNodes(tree))
+	}
+}
+
+func TestDeleteAllOrders(t *testing.T) {
+	const n = 300
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 10; round++ {
+		tree := NewTree()
+		for _, i := range r.Perm(n) {
+			tree.Insert([]byte(fmt.Sprintf("%03d", i)), []byte("value"))
+		}
+
+		for count, i := range r.Perm(n) {
+			k := fmt.Sprintf("%03d", i)
+			tree.Delete([]byte(k))
+			checkInvariants(t, tree, "delete "+k)
+			if tree.find([]byte(k)) != nil {
+				t.Errorf("%s still present", k)
+				t.FailNow()
+			}
+			if countNodes(tree) != n-count-1 {
+				t.Errorf("%d nodes after %d deletes", countNodes(tree), count+1)
+				t.FailNow()
+			}
+		}
+		if tree.root != nil || tree.Size() != 0 {
+			t.Errorf("tree not empty, size %d", tree.Size())
+			t.FailNow()
+		}
+	}
+}
+
+func TestDeleteReinsertDoesNotGrow(t *testing.T) {
+	tree := NewTree()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%03d", i%10))
+		tree.Insert(k, []byte("value"))
+		tree.Delete(k)
+		checkInvariants(t, tree, "churn")
+	}
+	if tree.root != nil || tree.Size() != 0 {
+		t.Errorf("tree grew to %d bytes", tree.Size())
+	}
+}
+
+func TestDeleteTombstoned(t *testing.T) {
+	tree := NewTree()
+	tree.Insert([]byte("a"), []byte("1"))
+	tree.InsertTombstone([]byte("b"))
+	if tree.Get([]byte("b")) != nil || tree.find([]byte("b")) == nil {
+		t.Errorf("tombstone missing")
+		t.FailNow()
+	}
+
+	tree.Delete([]byte("b"))
+	checkInvariants(t, tree, "tombstone")
+	if tree.find([]byte("b")) != nil || string(tree.Get([]byte("a"))) != "1" {
+		t.Errorf("tombstone not removed")
+	}
+}
+
+func TestVerifyCatchesViolations(t *testing.T) {
+	build := func() *Tree {
+		tree := NewTree()
+		for _, k := range []string{"h", "d", "p", "b", "f", "n", "t", "a"} {
+			tree.Insert([]byte(k), []byte("v"))
+		}
+		checkInvariants(t, tree, "build")
+		return tree
+	}
+
+	breakages := map[string]func(*Tree){
+		"red root": func(tree *Tree) { tree.root.color = Red },
+		"red red": func(tree *Tree) {
+			a := tree.find([]byte("a"))
+			a.parent.color = Red
+		},
+		"black height": func(tree *Tree) { tree.find([]byte("t")).color = Black },
+		"order":        func(tree *Tree) { tree.find([]byte("f")).key = []byte("z") },
+		"parent": func(tree *Tree) {
+			tree.find([]byte("f")).parent = tree.root
+		},
+	}
+	for name, breakTree := range breakages {
+		tree := build()
+		breakTree(tree)
+		if tree.Verify() == nil {
+			t.Errorf("%s not detected", name)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package kvdb_test
 
 import (
 	"fmt"
-	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"math/rand"
+	"sort"
 	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
 )
 
 func TestInOrder(t *testing.T) {
@@ -106,3 +109,77 @@ func TestPutGet(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// Apply a sequence of operations to a tree and a reference map, checking
+// the tree after each one.  Every two bytes of ops are an operation and a
+// key: insert, delete or tombstone.
+func checkTreeOps(t *testing.T, ops []byte) {
+	tr := kvdb.NewTree()
+	ref := map[string]string{}
+	for i := 0; i+1 < len(ops); i += 2 {
+		k := []byte{ops[i+1]}
+		switch ops[i] % 3 {
+		case 0:
+			v := fmt.Sprintf("v%d", i)
+			tr.Insert(k, []byte(v))
+			ref[string(k)] = v
+		case 1:
+			tr.Delete(k)
+			delete(ref, string(k))
+		case 2:
+			tr.InsertTombstone(k)
+			delete(ref, string(k))
+		}
+		if err := tr.Verify(); err != nil {
+			t.Errorf("op %d: %v", i/2, err)
+			t.FailNow()
+		}
+	}
+
+	expect := make([]string, 0, len(ref))
+	for k := range ref {
+		expect = append(expect, k)
+	}
+	sort.Strings(expect)
+
+	var keys []string
+	tr.InOrder(func(node *kvdb.Node) {
+		if !node.Tombstone() {
+			keys = append(keys, string(node.Key()))
+		}
+	})
+	if len(keys) != len(expect) {
+		t.Errorf("%d keys != %d", len(keys), len(expect))
+		t.FailNow()
+	}
+	for i, k := range keys {
+		if k != expect[i] || string(tr.Get([]byte(k))) != ref[k] {
+			t.Errorf("key %d is %q", i, k)
+			t.FailNow()
+		}
+	}
+}
+
+func TestRandomOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 100; round++ {
+		ops := make([]byte, 2000)
+		r.Read(ops)
+
+		// Narrow the key space in some rounds so keys are reused
+		if round%2 == 0 {
+			for i := 1; i < len(ops); i += 2 {
+				ops[i] %= 16
+			}
+		}
+		checkTreeOps(t, ops)
+	}
+}
+
+func FuzzTreeOps(f *testing.F) {
+	f.Add([]byte{0, 'a', 0, 'b', 0, 'c', 1, 'b'})
+	f.Add([]byte{0, 'a', 2, 'a', 0, 'a', 1, 'a'})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		checkTreeOps(t, ops)
+	})
+}
@@ -0,0 +1,192 @@
+// Whitebox tests for values with a TTL
+
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func checkIteratorKeys(t *testing.T, db *Db, expect []string, msg string) {
+	it := db.NewIterator()
+	defer it.Close()
+	got := []string{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	back := []string{}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		back = append([]string{string(it.Key())}, back...)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) || fmt.Sprint(back) != fmt.Sprint(expect) {
+		t.Errorf("%s: iterated %v %v != %v", msg, got, back, expect)
+		t.FailNow()
+	}
+}
+
+// Expired values vanish from reads at once wherever they are stored
+func testTTL(t *testing.T, config *DbConfig) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+	config.L0CompactionTrigger = 1
+
+	db, clock := openHistoryDb(t, config)
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("old"))
+	db.Flush()
+	db.PutWithTTL([]byte("a"), []byte("1"), time.Minute)
+	db.PutWithTTL([]byte("b"), []byte("2"), time.Hour)
+	db.Put([]byte("c"), []byte("3"))
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	for _, where := range []string{"memtable", "table"} {
+		if where == "table" {
+			db.Flush()
+		}
+		if v := db.GetString("a"); string(v) != "1" {
+			t.Errorf("%s: a = %q before expiry", where, v)
+		}
+		checkIteratorKeys(t, db, []string{"a", "b", "c"}, where)
+
+		clock.advance(time.Minute)
+		if v := db.GetString("a"); v != nil {
+			t.Errorf("%s: a = %q after expiry", where, v)
+		}
+		if v, _ := snapshot.Get([]byte("a")); v != nil {
+			t.Errorf("%s: snapshot read expired a = %q", where, v)
+		}
+		checkIteratorKeys(t, db, []string{"b", "c"}, where)
+		clock.advance(-time.Minute)
+	}
+
+	// A put without a TTL clears it
+	clock.advance(time.Minute)
+	db.Put([]byte("b"), []byte("4"))
+	clock.advance(2 * time.Hour)
+	if v := db.GetString("b"); string(v) != "4" {
+		t.Errorf("b = %q after clearing ttl", v)
+	}
+
+	snapshot.Release()
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Errorf("Compact failed: %v", err)
+		t.FailNow()
+	}
+	checkIteratorKeys(t, db, []string{"b", "c"}, "compacted")
+	history, _ := db.History([]byte("a"))
+	if len(history) != 0 {
+		t.Errorf("expired a kept %v", history)
+	}
+	if n := tableEntries(db); n != 2 {
+		t.Errorf("%d entries kept for 2 keys", n)
+	}
+}
+
+func TestTTLJSON(t *testing.T) {
+	testTTL(t, &DbConfig{})
+}
+
+func TestTTLBlock(t *testing.T) {
+	testTTL(t, &DbConfig{TableFormat: TableFormatBlock, BlockSize: 64})
+}
+
+// A flush purges expired values, leaving a tombstone to shadow older
+// versions
+func TestTTLPurgedByFlush(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db, clock := openHistoryDb(t, &DbConfig{Dir: dir, L0CompactionTrigger: 100})
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("old"))
+	db.Flush()
+	db.PutWithTTL([]byte("a"), []byte("new"), time.Second)
+	clock.advance(time.Second)
+	db.Flush()
+
+	db.lock.Lock()
+	e, err := db.defaultFamily().levels[0][0].get([]byte("a"), db.lastSequence)
+	db.lock.Unlock()
+	if err != nil || e == nil || !e.Tombstone || e.Value != nil {
+		t.Errorf("expired value not purged %v %v", e, err)
+	}
+	if v := db.GetString("a"); v != nil {
+		t.Errorf("a = %q", v)
+	}
+}
+
+// Expiry times are logged, so a value expires on time after a restart
+func TestTTLReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &DbConfig{Dir: dir}
+
+	db, clock := openHistoryDb(t, config)
+	if err := db.PutWithTTL([]byte("a"), []byte("1"), 0); err != ErrInvalidTTL {
+		t.Errorf("zero ttl accepted: %v", err)
+	}
+	db.PutWithTTL([]byte("a"), []byte("1"), 1500*time.Millisecond)
+	db.Close()
+
+	db, clock2 := openHistoryDb(t, config)
+	defer db.Close()
+	clock2.t = clock.t.Add(time.Second)
+	if v := db.GetString("a"); string(v) != "1" {
+		t.Errorf("a = %q before expiry", v)
+	}
+	clock2.advance(time.Second)
+	if v := db.GetString("a"); v != nil {
+		t.Errorf("a = %q after expiry", v)
+	}
+}
+
+func TestStat(t *testing.T) {
+	db, clock := openHistoryDb(t, &DbConfig{})
+	defer db.Close()
+
+	if info, err := db.Stat([]byte("a")); info != nil || err != nil {
+		t.Errorf("Stat of missing key %v %v", info, err)
+	}
+	db.PutWithTTL([]byte("a"), []byte("value"), time.Minute)
+	info, err := db.Stat([]byte("a"))
+	if err != nil || info == nil {
+		t.Errorf("Stat failed %v", err)
+		t.FailNow()
+	}
+	_, version, _ := db.GetVersion([]byte("a"))
+	if info.Size != 5 || info.Version != version || info.Timestamp.Unix() != clock.t.Unix() ||
+		!info.Expires.Equal(time.Unix(clock.t.Add(time.Minute).Unix(), 0)) {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	db.Put([]byte("a"), nil)
+	if info, _ := db.Stat([]byte("a")); info == nil || info.Size != 0 || !info.Expires.IsZero() {
+		t.Errorf("Stat after put = %+v", info)
+	}
+}
+
+func TestTTLExpiresAt(t *testing.T) {
+	db, clock := openHistoryDb(t, &DbConfig{})
+	defer db.Close()
+
+	at := clock.t.Add(90 * time.Second)
+	err := db.PutWithOptions([]byte("a"), []byte("1"), PutOptions{TTL: time.Second, ExpiresAt: at})
+	if err != ErrInvalidTTL {
+		t.Errorf("TTL and ExpiresAt accepted: %v", err)
+	}
+	db.PutWithOptions([]byte("a"), []byte("1"), PutOptions{ExpiresAt: at})
+	if info, _ := db.Stat([]byte("a")); info == nil || info.Expires.Unix() != at.Unix() {
+		t.Errorf("Stat = %+v", info)
+	}
+	clock.advance(90 * time.Second)
+	if v := db.GetString("a"); v != nil {
+		t.Errorf("a = %q after expiry", v)
+	}
+}
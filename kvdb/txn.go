@@ -0,0 +1,283 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Optimistic transactions.  A transaction reads from a snapshot taken when
+// it begins and buffers its writes, which its own reads see.  Commit
+// checks, under the database lock, that no key the transaction read has
+// been written since its snapshot, then logs and applies the buffered
+// writes as a single batch.  If a key did change the transaction fails
+// with ErrConflict and nothing is written; the caller may retry it.
+//
+// Only keys actually read, with Get or by an iterator stopping on them,
+// are checked.  A key an iterator skipped over because it did not exist
+// is not, so a key inserted into a scanned range does not conflict.
+
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrConflict = errors.New("kvdb: transaction conflict")
+
+var ErrTxnDone = errors.New("kvdb: transaction already committed or rolled back")
+
+var ErrTxnFamily = errors.New("kvdb: transactions only write the default column family")
+
+// A transaction, see Db.Begin.  A Txn must not be used from more than one
+// goroutine at a time.
+type Txn struct {
+	db       *Db
+	snapshot *Snapshot
+
+	// Buffered writes, both in the order they were made for the commit
+	// and in a tree so reads see them
+	batch   *WriteBatch
+	pending *Tree
+
+	reads map[string]bool
+	done  bool
+}
+
+// Begin a transaction reading the database as it is now.  Commit or
+// Rollback must be called to release its snapshot.
+func (db *Db) Begin() *Txn {
+	return &Txn{
+		db:       db,
+		snapshot: db.NewSnapshot(),
+		batch:    NewWriteBatch(),
+		pending:  NewTree(),
+		reads:    map[string]bool{},
+	}
+}
+
+// Get the value of key as the transaction sees it, returning nil if it
+// does not exist
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if n := txn.pending.find(key); n != nil {
+		if n.tombstone {
+			return nil, nil
+		}
+		return n.value, nil
+	}
+	txn.reads[string(key)] = true
+	return txn.snapshot.Get(key)
+}
+
+// Buffer a put of key, key and value are copied
+func (txn *Txn) Put(key, value []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.batch.Put(key, value)
+	op := txn.batch.ops[len(txn.batch.ops)-1]
+	n := NewNode(op.key, op.value)
+	n.sequence = math.MaxUint64
+	txn.pending.insertVersion(n, nil)
+	return nil
+}
+
+// Buffer a delete of key
+func (txn *Txn) Delete(key []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.batch.Delete(key)
+	n := NewNode(txn.batch.ops[len(txn.batch.ops)-1].key, nil)
+	n.tombstone = true
+	n.sequence = math.MaxUint64
+	txn.pending.insertVersion(n, nil)
+	return nil
+}
+
+// Buffer every operation of batch in order.  Transactions only cover the
+// default family, ErrTxnFamily is returned, buffering nothing, for a
+// batch that writes any other.
+func (txn *Txn) Write(batch *WriteBatch) error {
+	for _, op := range batch.ops {
+		if op.family != 0 {
+			return ErrTxnFamily
+		}
+	}
+	for _, op := range batch.ops {
+		var err error
+		if op.kind == walRecordPut {
+			err = txn.Put(op.key, op.value)
+		} else {
+			err = txn.Delete(op.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records every key the iterator stops on in the transaction's read set
+type txnIterator struct {
+	*dbIterator
+	txn *Txn
+}
+
+func (it *txnIterator) record() {
+	if it.Valid() && it.txn.pending.find(it.Key()) == nil {
+		it.txn.reads[string(it.Key())] = true
+	}
+}
+
+func (it *txnIterator) Seek(key []byte) {
+	it.dbIterator.Seek(key)
+	it.record()
+}
+
+func (it *txnIterator) SeekToFirst() {
+	it.dbIterator.SeekToFirst()
+	it.record()
+}
+
+func (it *txnIterator) SeekToLast() {
+	it.dbIterator.SeekToLast()
+	it.record()
+}
+
+func (it *txnIterator) Next() {
+	it.dbIterator.Next()
+	it.record()
+}
+
+func (it *txnIterator) Prev() {
+	it.dbIterator.Prev()
+	it.record()
+}
+
+// Create an iterator over the transaction's snapshot with its buffered
+// writes applied.  Writes buffered after the iterator is created may not
+// be seen by it.
+func (txn *Txn) Iterator() Iterator {
+	db := txn.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if txn.done {
+		return &dbIterator{db: db, merge: &mergingIterator{}, e: ErrTxnDone}
+	}
+
+	it := db.newIterator(db.defaultFamily(), txn.snapshot.sequence)
+	// Buffered writes are newer than anything in the snapshot
+	it.merge.children = append([]tableIterator{newMemIterator(txn.pending, math.MaxUint64)},
+		it.merge.children...)
+	return &txnIterator{it, txn}
+}
+
+// Whether key has a version newer than sequence in the default family,
+// db.lock must be held
+func (db *Db) changedSince(key []byte, sequence uint64) (bool, error) {
+	f := db.defaultFamily()
+	for _, tree := range []*Tree{f.mem, f.imm} {
+		if tree == nil {
+			continue
+		}
+		if n := tree.find(key); n != nil {
+			return n.sequence > sequence, nil
+		}
+	}
+
+	for level, tables := range f.levels {
+		for _, t := range tables {
+			if level > 0 && !t.meta().contains(key) {
+				continue
+			}
+			if filter := t.meta().filter; len(filter) > 0 && !filter.mayContain(key) {
+				continue
+			}
+			e, err := t.get(key, math.MaxUint64)
+			if err != nil {
+				return false, err
+			} else if e != nil {
+				return e.Sequence > sequence, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Apply the transaction's writes if no key it read has changed, otherwise
+// return ErrConflict and discard them.  The transaction is finished
+// either way.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	db := txn.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	for key := range txn.reads {
+		changed, err := db.changedSince([]byte(key), txn.snapshot.sequence)
+		if err != nil {
+			return err
+		} else if changed {
+			return ErrConflict
+		}
+	}
+	if txn.batch.Len() == 0 {
+		return nil
+	}
+	return db.write(&walRecord{walRecordBatch, nil, encodeBatch(txn.batch.ops), 0, 0, "", 0})
+}
+
+// The keys the transaction read, each with its version as of its
+// snapshot, and its buffered writes.  Applying the writes under those
+// conditions with ApplyLogRecord commits the transaction elsewhere, for
+// instance through a consensus log.  Unlike Commit a key that changed
+// and then changed back, such as one created and deleted again, does not
+// conflict.  The transaction is finished either way.
+func (txn *Txn) Prepare() ([]LogCondition, *WriteBatch, error) {
+	if txn.done {
+		return nil, nil, ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	db := txn.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
+	conditions := make([]LogCondition, 0, len(txn.reads))
+	for key := range txn.reads {
+		e, err := db.getEntry([]byte(key), txn.snapshot.sequence)
+		if err != nil {
+			return nil, nil, err
+		}
+		conditions = append(conditions, LogCondition{[]byte(key), versionOf(e)})
+	}
+	sort.Slice(conditions, func(i, j int) bool {
+		return bytes.Compare(conditions[i].Key, conditions[j].Key) < 0
+	})
+	// Rollback empties the transaction's own batch
+	return conditions, &WriteBatch{append([]walRecord{}, txn.batch.ops...)}, nil
+}
+
+// Discard the transaction's writes and release its snapshot.  Rolling
+// back a finished transaction has no effect.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snapshot.Release()
+	txn.pending = NewTree()
+	txn.batch.Reset()
+}
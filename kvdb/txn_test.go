@@ -0,0 +1,159 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func TestTxnReadYourWrites(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("2"))
+
+	txn := db.Begin()
+	txn.Put([]byte("c"), []byte("3"))
+	txn.Delete([]byte("a"))
+	txn.Put([]byte("b"), []byte("4"))
+	// Not read by the transaction, so no conflict
+	db.Put([]byte("d"), []byte("late"))
+
+	for k, expect := range map[string]string{"a": "", "b": "4", "c": "3"} {
+		v, err := txn.Get([]byte(k))
+		if err != nil || string(v) != expect || expect == "" && v != nil {
+			t.Errorf("txn %s = %q, %v", k, v, err)
+		}
+	}
+	it := txn.Iterator()
+	checkForward(t, it, []string{"b", "c"}, map[string]string{"b": "4", "c": "3"})
+	checkBackward(t, it, []string{"b", "c"})
+	it.Close()
+
+	// Nothing is visible outside the transaction until it commits
+	if v := db.GetString("c"); v != nil {
+		t.Errorf("uncommitted c = %q", v)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("Commit failed: %v", err)
+		t.FailNow()
+	}
+	for k, expect := range map[string]string{"a": "", "b": "4", "c": "3", "d": "late"} {
+		if v := db.GetString(k); string(v) != expect {
+			t.Errorf("%s = %q after commit", k, v)
+		}
+	}
+
+	if _, err := txn.Get([]byte("a")); err != kvdb.ErrTxnDone {
+		t.Errorf("Get after commit: %v", err)
+	}
+	if err := txn.Commit(); err != kvdb.ErrTxnDone {
+		t.Errorf("second Commit: %v", err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("1"))
+
+	for _, test := range []struct {
+		name     string
+		read     func(*kvdb.Txn)
+		conflict bool
+	}{
+		{"get", func(txn *kvdb.Txn) { txn.Get([]byte("a")) }, true},
+		{"get other", func(txn *kvdb.Txn) { txn.Get([]byte("b")) }, false},
+		{"iterator", func(txn *kvdb.Txn) {
+			it := txn.Iterator()
+			it.Seek([]byte("a"))
+			it.Close()
+		}, true},
+		{"blind write", func(txn *kvdb.Txn) {}, false},
+	} {
+		for _, flush := range []bool{false, true} {
+			txn := db.Begin()
+			test.read(txn)
+			txn.Put([]byte("c"), []byte(test.name))
+			db.Put([]byte("a"), []byte(test.name))
+			if flush {
+				db.Flush()
+			}
+
+			err := txn.Commit()
+			if test.conflict && err != kvdb.ErrConflict || !test.conflict && err != nil {
+				t.Errorf("%s, flush %v: Commit returned %v", test.name, flush, err)
+			}
+			committed := string(db.GetString("c")) == test.name
+			if committed == test.conflict {
+				t.Errorf("%s, flush %v: c = %q", test.name, flush, db.GetString("c"))
+			}
+			db.Delete([]byte("c"))
+		}
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+
+	txn := db.Begin()
+	txn.Put([]byte("a"), []byte("1"))
+	txn.Rollback()
+	txn.Rollback()
+	if err := txn.Commit(); err != kvdb.ErrTxnDone {
+		t.Errorf("Commit after Rollback: %v", err)
+	}
+	if v := db.GetString("a"); v != nil {
+		t.Errorf("rolled back a = %q", v)
+	}
+	it := txn.Iterator()
+	it.SeekToFirst()
+	if it.Valid() || it.Err() != kvdb.ErrTxnDone {
+		t.Errorf("iterator after Rollback: %v", it.Err())
+	}
+	it.Close()
+}
+
+// Concurrent read-modify-write increments, retried on conflict, lose no
+// updates
+func TestTxnCounter(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	db.Put([]byte("counter"), []byte("0"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for {
+					txn := db.Begin()
+					v, _ := txn.Get([]byte("counter"))
+					n, _ := strconv.Atoi(string(v))
+					txn.Put([]byte("counter"), []byte(fmt.Sprint(n+1)))
+					err := txn.Commit()
+					if err == nil {
+						break
+					} else if err != kvdb.ErrConflict {
+						t.Errorf("Commit failed: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := db.GetString("counter"); string(v) != "400" {
+		t.Errorf("counter = %s", v)
+	}
+}
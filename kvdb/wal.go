@@ -0,0 +1,349 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Write-ahead log.  Every mutation is appended to the log before it is
+// applied to the memtable so the tree can be rebuilt after a crash.
+//
+// The log is a sequence of records, each laid out as:
+//
+//   crc32   4 bytes, castagnoli checksum of type and payload
+//   length  4 bytes, length of the payload
+//   type    1 byte
+//   payload uvarint key length, key, value
+//
+// A batch record carries several mutations in its value, see batch.go.
+// When the type has walRecordTimestamped set the payload is preceded by
+// a uvarint holding the time of the mutation in epoch seconds.  Logs
+// written before timestamps were recorded have none, their mutations are
+// stamped with the time they are replayed.  A put with a TTL has
+// walRecordExpires set and the time its value expires, in epoch seconds,
+// follows as another uvarint.  A put with a content type has
+// walRecordContentType set and the content type follows, prefixed by its
+// uvarint length.  A put or delete in a column family other than the
+// default has walRecordFamily set and the family's ID follows as another
+// uvarint, see family.go.
+//
+// All integers are little endian.  A record that is short or fails its
+// checksum marks the end of the log; anything after it was never
+// acknowledged and is discarded on replay.  The manifest uses the same
+// record framing with its own payload.
+
+package kvdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// fsync the log after every write before acknowledging it
+	SyncAlways SyncPolicy = iota
+	// fsync the log every DbConfig.SyncInterval, a crash may lose the
+	// writes made since the last sync
+	SyncPeriodic
+	// Never fsync, leave flushing to the operating system
+	SyncNever
+)
+
+const (
+	walRecordPut byte = iota + 1
+	walRecordDelete
+	// Several puts and deletes applied together, see batch.go
+	walRecordBatch
+
+	// Flags on the type of a record that carries a timestamp, an expiry
+	// time, a content type or a column family
+	walRecordTimestamped byte = 0x80
+	walRecordExpires     byte = 0x40
+	walRecordContentType byte = 0x20
+	walRecordFamily      byte = 0x10
+)
+
+const (
+	walHeaderSize    = 9
+	walMaxRecordSize = 1 << 30
+	defaultSyncEvery = time.Second
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("kvdb: corrupt log record")
+
+type walRecord struct {
+	kind  byte
+	key   []byte
+	value []byte
+
+	// Epoch seconds the mutation was made, 0 if unknown, and when a put
+	// expires, 0 if never
+	timestamp int64
+	expires   int64
+
+	// Media type of a put's value, empty if none was given
+	contentType string
+
+	// ID of the column family written, 0 for the default
+	family uint64
+}
+
+// Frame a payload with the record header
+func encodeRecord(kind byte, payload []byte) []byte {
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	buf[8] = kind
+	buf = append(buf, payload...)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(buf[8:], crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return buf
+}
+
+// Read a single record, returns io.EOF at a clean end of the log and
+// errCorruptRecord for a torn or damaged record.
+func readRecord(r io.Reader) (byte, []byte, int, error) {
+	var header [walHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return 0, nil, 0, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return 0, nil, 0, errCorruptRecord
+	} else if err != nil {
+		return 0, nil, 0, err
+	}
+
+	sum := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length > walMaxRecordSize {
+		return 0, nil, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil, 0, errCorruptRecord
+	} else if err != nil {
+		return 0, nil, 0, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, payload)
+	if crc != sum {
+		return 0, nil, 0, errCorruptRecord
+	}
+	return header[8], payload, walHeaderSize + int(length), nil
+}
+
+func (r *walRecord) encode() []byte {
+	kind := r.kind
+	var payload []byte
+	if r.timestamp > 0 {
+		kind |= walRecordTimestamped
+		payload = appendUvarint(payload, uint64(r.timestamp))
+	}
+	if r.expires > 0 {
+		kind |= walRecordExpires
+		payload = appendUvarint(payload, uint64(r.expires))
+	}
+	if r.contentType != "" {
+		kind |= walRecordContentType
+		payload = appendBytes(payload, []byte(r.contentType))
+	}
+	if r.family != 0 {
+		kind |= walRecordFamily
+		payload = appendUvarint(payload, r.family)
+	}
+	payload = appendBytes(payload, r.key)
+	payload = append(payload, r.value...)
+	return encodeRecord(kind, payload)
+}
+
+// Read a uvarint time from the front of payload if flag is set in kind
+func decodeRecordTime(kind, flag byte, payload []byte) (int64, []byte, error) {
+	if kind&flag == 0 {
+		return 0, payload, nil
+	}
+	t, n := binary.Uvarint(payload)
+	if n <= 0 || t > math.MaxInt64 {
+		return 0, nil, errCorruptRecord
+	}
+	return int64(t), payload[n:], nil
+}
+
+func decodeWalRecord(kind byte, payload []byte) (*walRecord, error) {
+	timestamp, payload, err := decodeRecordTime(kind, walRecordTimestamped, payload)
+	if err != nil {
+		return nil, err
+	}
+	expires, payload, err := decodeRecordTime(kind, walRecordExpires, payload)
+	if err != nil {
+		return nil, err
+	}
+	var contentType []byte
+	if kind&walRecordContentType != 0 {
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || length > uint64(len(payload)-n) {
+			return nil, errCorruptRecord
+		}
+		contentType = payload[n : n+int(length)]
+		payload = payload[n+int(length):]
+	}
+	var family uint64
+	if kind&walRecordFamily != 0 {
+		id, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, errCorruptRecord
+		}
+		family, payload = id, payload[n:]
+	}
+	kind &^= walRecordTimestamped
+	if kind&(walRecordExpires|walRecordContentType) != 0 &&
+		kind&^(walRecordExpires|walRecordContentType|walRecordFamily) != walRecordPut {
+		// Only puts expire or have a content type
+		return nil, errCorruptRecord
+	}
+	kind &^= walRecordExpires | walRecordContentType
+	if kind&walRecordFamily != 0 && kind&^walRecordFamily == walRecordBatch {
+		// Each operation of a batch names its own family
+		return nil, errCorruptRecord
+	}
+	kind &^= walRecordFamily
+	if kind != walRecordPut && kind != walRecordDelete && kind != walRecordBatch {
+		return nil, errCorruptRecord
+	}
+	klen, n := binary.Uvarint(payload)
+	if n <= 0 || klen > uint64(len(payload)-n) {
+		return nil, errCorruptRecord
+	}
+	payload = payload[n:]
+	if kind == walRecordBatch {
+		if _, err := decodeBatch(payload[klen:]); err != nil {
+			return nil, err
+		}
+	}
+	return &walRecord{kind, payload[:klen], payload[klen:], timestamp, expires,
+		string(contentType), family}, nil
+}
+
+func readWalRecord(r io.Reader) (*walRecord, int, error) {
+	kind, payload, n, err := readRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec, err := decodeWalRecord(kind, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, n, nil
+}
+
+// Call apply for every intact record in the log at path, in the order
+// they were written.  A damaged tail is truncated so new records are
+// appended after the last good one.  A missing log is not an error.
+func replayWal(path string, apply func(*walRecord)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readWalRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err == errCorruptRecord {
+			return os.Truncate(path, offset)
+		} else if err != nil {
+			return err
+		}
+		apply(rec)
+		offset += int64(n)
+	}
+}
+
+type wal struct {
+	f      *os.File
+	policy SyncPolicy
+	lock   sync.Mutex
+	dirty  bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func openWal(path string, policy SyncPolicy, interval time.Duration) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{f: f, policy: policy, done: make(chan struct{})}
+	if policy == SyncPeriodic {
+		if interval <= 0 {
+			interval = defaultSyncEvery
+		}
+		w.wg.Add(1)
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+func (w *wal) syncLoop(interval time.Duration) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.sync()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Append a record, returning once it is durable according to the
+// configured SyncPolicy.
+func (w *wal) append(r *walRecord) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := w.f.Write(r.encode()); err != nil {
+		return err
+	}
+	if w.policy == SyncAlways {
+		return w.f.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+func (w *wal) sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	close(w.done)
+	w.wg.Wait()
+	if err := w.sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,139 @@
+// Whitebox tests for wal.go
+
+package kvdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTestWal(t *testing.T, path string, records []*walRecord) {
+	w, err := openWal(path, SyncAlways, 0)
+	if err != nil {
+		t.Errorf("openWal failed: %v", err)
+		t.FailNow()
+	}
+	for _, r := range records {
+		if err := w.append(r); err != nil {
+			t.Errorf("append failed: %v", err)
+			t.FailNow()
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Errorf("close failed: %v", err)
+		t.FailNow()
+	}
+}
+
+func readTestWal(t *testing.T, path string) []*walRecord {
+	records := []*walRecord{}
+	err := replayWal(path, func(r *walRecord) {
+		records = append(records, r)
+	})
+	if err != nil {
+		t.Errorf("replayWal failed: %v", err)
+		t.FailNow()
+	}
+	return records
+}
+
+func TestWalRoundTrip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	path := fileName(dir, logFile, 1)
+
+	writeTestWal(t, path, []*walRecord{
+		{walRecordPut, []byte("a"), []byte("foo"), 1600000000, 0, "", 0},
+		{walRecordDelete, []byte("a"), nil, 0, 0, "", 0},
+		{walRecordPut, []byte("b"), []byte{}, 1600000000, 1600000060, "text/plain", 0},
+		{walRecordDelete, []byte("c"), nil, 0, 0, "", 300},
+	})
+
+	records := readTestWal(t, path)
+	if len(records) != 4 {
+		t.Errorf("len(records) != 4: %d", len(records))
+		t.FailNow()
+	}
+
+	if records[0].kind != walRecordPut || string(records[0].key) != "a" ||
+		string(records[0].value) != "foo" || records[0].timestamp != 1600000000 {
+		t.Errorf("records[0] invalid %v", records[0])
+	}
+
+	if records[1].kind != walRecordDelete || string(records[1].key) != "a" ||
+		records[1].timestamp != 0 {
+		t.Errorf("records[1] invalid %v", records[1])
+	}
+
+	if records[2].kind != walRecordPut || string(records[2].key) != "b" ||
+		len(records[2].value) != 0 || records[2].expires != 1600000060 ||
+		records[2].contentType != "text/plain" {
+		t.Errorf("records[2] invalid %v", records[2])
+	}
+
+	if records[2].family != 0 || records[3].family != 300 || string(records[3].key) != "c" {
+		t.Errorf("families invalid %v %v", records[2], records[3])
+	}
+}
+
+func TestWalMissing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+
+	records := readTestWal(t, fileName(dir, logFile, 1))
+	if len(records) != 0 {
+		t.Errorf("len(records) != 0")
+	}
+}
+
+// A partially written record is dropped and truncated so the next
+// append follows the last good record.
+func TestWalTornTail(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	path := fileName(dir, logFile, 1)
+
+	writeTestWal(t, path, []*walRecord{
+		{walRecordPut, []byte("a"), []byte("foo"), 0, 0, "", 0},
+		{walRecordPut, []byte("b"), []byte("bar"), 0, 0, "", 0},
+	})
+
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-2)
+
+	records := readTestWal(t, path)
+	if len(records) != 1 || string(records[0].key) != "a" {
+		t.Errorf("torn record not dropped %v", records)
+		t.FailNow()
+	}
+
+	writeTestWal(t, path, []*walRecord{
+		{walRecordPut, []byte("c"), []byte("baz"), 0, 0, "", 0},
+	})
+
+	records = readTestWal(t, path)
+	if len(records) != 2 || string(records[1].key) != "c" {
+		t.Errorf("append after truncate failed %v", records)
+	}
+}
+
+func TestWalBadChecksum(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	path := fileName(dir, logFile, 1)
+
+	writeTestWal(t, path, []*walRecord{
+		{walRecordPut, []byte("a"), []byte("foo"), 0, 0, "", 0},
+		{walRecordPut, []byte("b"), []byte("bar"), 0, 0, "", 0},
+	})
+
+	data, _ := ioutil.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(path, data, 0644)
+
+	records := readTestWal(t, path)
+	if len(records) != 1 || string(records[0].key) != "a" {
+		t.Errorf("corrupt record not dropped %v", records)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Change feeds.  Every put and delete becomes an event, numbered by its
+// sequence, sent from the write path while db.lock is held to each
+// watcher whose prefix the key begins with.
+//
+// The log records holding the last DbConfig.WatchHistory mutations are
+// kept in memory, so a watcher can start from a sequence a little in the
+// past, such as the one after the last event it saw before reconnecting.
+// Starting any further back fails with ErrWatchCompacted and the caller
+// must read the current values instead.  Nothing is kept across a restart
+// beyond what replaying the unflushed logs puts back.  The same records
+// are shipped to followers, see replication.go.
+//
+// Writes never wait on a watcher.  Each has a buffer of
+// DbConfig.WatchBufferSize events and one that falls that far behind is
+// closed with ErrWatchOverflow, the slow consumer policy.  It can then
+// watch again from the sequence after its last event, which succeeds as
+// long as it has not fallen behind by more than WatchHistory.
+
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	defaultWatchBufferSize = 256
+	defaultWatchHistory    = 4096
+)
+
+var ErrWatchOverflow = errors.New("kvdb: watcher fell behind")
+
+var ErrWatchClosed = errors.New("kvdb: watcher closed")
+
+var ErrWatchCompacted = errors.New("kvdb: watch sequence no longer available")
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "delete"
+	}
+	return "put"
+}
+
+// A mutation seen by a watcher.  Value is nil for a delete.
+type Event struct {
+	Type      EventType
+	Key       []byte
+	Value     []byte
+	Sequence  uint64
+	Timestamp time.Time
+}
+
+// A subscription to the changes under a prefix
+type Watcher struct {
+	db     *Db
+	prefix []byte
+	events chan Event
+
+	// The first sequence the watcher sees
+	from uint64
+
+	// Why the watcher closed, set under db.lock
+	err error
+}
+
+// A record kept in the change log, with the sequence of its first
+// mutation and how many it holds
+type loggedRecord struct {
+	sequence uint64
+	r        *walRecord
+	count    int
+}
+
+// The most recent log records, oldest first, holding at most size
+// mutations.  Sequences have no gaps as every mutation is logged.
+type changeLog struct {
+	records   []loggedRecord
+	mutations int
+	size      int
+}
+
+func newChangeLog(size int) changeLog {
+	if size < 0 {
+		size = 0
+	}
+	return changeLog{size: size}
+}
+
+func (l *changeLog) add(sequence uint64, r *walRecord, count int) {
+	if l.size == 0 {
+		return
+	}
+	l.records = append(l.records, loggedRecord{sequence, r, count})
+	l.mutations += count
+	for l.mutations > l.size {
+		l.mutations -= l.records[0].count
+		l.records[0] = loggedRecord{}
+		l.records = l.records[1:]
+	}
+}
+
+// The records holding the mutations from sequence through last, the last
+// sequence logged, false if some of them have been dropped.  The first
+// record may begin before sequence.
+func (l *changeLog) since(sequence, last uint64) ([]loggedRecord, bool) {
+	if sequence > last {
+		return nil, true
+	}
+	if len(l.records) == 0 || l.records[0].sequence > sequence {
+		return nil, false
+	}
+	i := sort.Search(len(l.records), func(i int) bool {
+		lr := l.records[i]
+		return lr.sequence+uint64(lr.count) > sequence
+	})
+	return l.records[i:], true
+}
+
+func (l *changeLog) reset() {
+	l.records = nil
+	l.mutations = 0
+}
+
+// The events for the mutations in lr
+func (lr *loggedRecord) events() []Event {
+	ops := []walRecord{*lr.r}
+	if lr.r.kind == walRecordBatch {
+		ops, _ = decodeBatch(lr.r.value)
+	}
+	events := make([]Event, 0, len(ops))
+	for i, op := range ops {
+		if op.family != 0 {
+			// Feeds only watch the default family
+			continue
+		}
+		e := Event{
+			Key:       op.key,
+			Value:     op.value,
+			Sequence:  lr.sequence + uint64(i),
+			Timestamp: time.Unix(lr.r.timestamp, 0),
+		}
+		if op.kind == walRecordDelete {
+			e.Type = EventDelete
+			e.Value = nil
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// Watch the keys beginning with prefix, an empty prefix watching every
+// key.  The watcher sees every change from fromSequence on, 0 meaning
+// only changes made after Watch returns.  Returns ErrWatchCompacted if
+// changes from fromSequence are no longer kept.
+func (db *Db) Watch(prefix []byte, fromSequence uint64) (*Watcher, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if fromSequence == 0 {
+		fromSequence = db.lastSequence + 1
+	}
+	past, ok := db.changes.since(fromSequence, db.lastSequence)
+	if !ok {
+		return nil, ErrWatchCompacted
+	}
+
+	w := &Watcher{db: db, prefix: append([]byte{}, prefix...), from: fromSequence}
+	matching := []Event{}
+	for i := range past {
+		for _, e := range past[i].events() {
+			if e.Sequence >= fromSequence && bytes.HasPrefix(e.Key, w.prefix) {
+				matching = append(matching, e)
+			}
+		}
+	}
+	// The past events count against the buffer only once they are read
+	w.events = make(chan Event, len(matching)+db.config.WatchBufferSize)
+	for _, e := range matching {
+		w.events <- e
+	}
+	db.watchers[w] = true
+	return w, nil
+}
+
+// The events, closed when the watcher is, after which Err says why
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Why the watcher closed, nil while it is open
+func (w *Watcher) Err() error {
+	w.db.lock.Lock()
+	defer w.db.lock.Unlock()
+	return w.err
+}
+
+// Stop watching, events still buffered may be read after
+func (w *Watcher) Close() {
+	w.db.lock.Lock()
+	defer w.db.lock.Unlock()
+	w.db.stopWatcher(w, ErrWatchClosed)
+}
+
+// Close w with err, db.lock must be held
+func (db *Db) stopWatcher(w *Watcher, err error) {
+	if !db.watchers[w] {
+		return
+	}
+	delete(db.watchers, w)
+	w.err = err
+	close(w.events)
+}
+
+// Send the mutation in n to the watchers of its key, closing any whose
+// buffer is full.  db.lock must be held.
+func (db *Db) notify(t EventType, n *Node) {
+	if len(db.watchers) == 0 {
+		return
+	}
+	e := Event{
+		Type:      t,
+		Key:       n.key,
+		Value:     n.value,
+		Sequence:  n.sequence,
+		Timestamp: time.Unix(n.timestamp, 0),
+	}
+	if t == EventDelete {
+		e.Value = nil
+	}
+	for w := range db.watchers {
+		if !bytes.HasPrefix(e.Key, w.prefix) || e.Sequence < w.from {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			db.stopWatcher(w, ErrWatchOverflow)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func formatEvent(e kvdb.Event) string {
+	return fmt.Sprintf("%v %s=%s", e.Type, e.Key, e.Value)
+}
+
+func openWatch(t *testing.T, db *kvdb.Db, prefix string, from uint64) *kvdb.Watcher {
+	w, err := db.Watch([]byte(prefix), from)
+	if err != nil {
+		t.Errorf("Watch(%q, %d) failed: %v", prefix, from, err)
+		t.FailNow()
+	}
+	return w
+}
+
+// Read the events buffered in w, which must be closed
+func drain(w *kvdb.Watcher) []string {
+	events := []string{}
+	for e := range w.Events() {
+		events = append(events, formatEvent(e))
+	}
+	return events
+}
+
+func TestWatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	db := openTestDb(t, &kvdb.DbConfig{Dir: dir})
+	defer db.Close()
+
+	db.Put([]byte("config/before"), []byte("x"))
+	w := openWatch(t, db, "config/", 0)
+	all := openWatch(t, db, "", 0)
+
+	db.Put([]byte("config/a"), []byte("1"))
+	db.Put([]byte("other"), []byte("2"))
+	batch := kvdb.NewWriteBatch()
+	batch.Put([]byte("config/b"), []byte("3"))
+	batch.Delete([]byte("config/a"))
+	db.Write(batch)
+
+	w.Close()
+	db.Put([]byte("config/c"), []byte("4"))
+
+	expect := []string{"put config/a=1", "put config/b=3", "delete config/a="}
+	last := uint64(0)
+	for e := range w.Events() {
+		if len(expect) == 0 || formatEvent(e) != expect[0] {
+			t.Errorf("unexpected event %s, expected %v", formatEvent(e), expect)
+			t.FailNow()
+		}
+		if e.Sequence <= last || e.Timestamp.IsZero() {
+			t.Errorf("event %s at sequence %d after %d", formatEvent(e), e.Sequence, last)
+		}
+		last = e.Sequence
+		expect = expect[1:]
+	}
+	if len(expect) != 0 {
+		t.Errorf("missed events %v", expect)
+	}
+	if w.Err() != kvdb.ErrWatchClosed {
+		t.Errorf("closed watcher err %v", w.Err())
+	}
+
+	if n := len(all.Events()); n != 5 {
+		t.Errorf("watching every key buffered %d events", n)
+	}
+	db.Close()
+	if _, ok := <-all.Events(); !ok || all.Err() != kvdb.ErrClosed {
+		t.Errorf("watcher not closed with the db: %v", all.Err())
+	}
+	if _, err := db.Watch(nil, 0); err != kvdb.ErrClosed {
+		t.Errorf("Watch on a closed db: %v", err)
+	}
+}
+
+func TestWatchFromSequence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	config := &kvdb.DbConfig{Dir: dir, WatchHistory: 4}
+	db := openTestDb(t, config)
+
+	for i := 1; i <= 6; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	// Sequences 3 through 6 are kept
+	if _, err := db.Watch(nil, 2); err != kvdb.ErrWatchCompacted {
+		t.Errorf("Watch from a dropped sequence: %v", err)
+	}
+	w := openWatch(t, db, "", 4)
+	future := openWatch(t, db, "", 8)
+	db.Delete([]byte("k1"))
+	db.Put([]byte("k7"), []byte("v"))
+	w.Close()
+	future.Close()
+	if got := fmt.Sprint(drain(w)); got != "[put k4=v put k5=v put k6=v delete k1= put k7=v]" {
+		t.Errorf("watch from 4 saw %s", got)
+	}
+	if got := fmt.Sprint(drain(future)); got != "[put k7=v]" {
+		t.Errorf("watch from 8 saw %s", got)
+	}
+
+	// Changes replayed from the log on startup are kept too
+	db.Close()
+	db = openTestDb(t, config)
+	defer db.Close()
+	w = openWatch(t, db, "k7", 5)
+	w.Close()
+	if got := fmt.Sprint(drain(w)); got != "[put k7=v]" {
+		t.Errorf("watch after reopening saw %s", got)
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	db := openTestDb(t, &kvdb.DbConfig{WatchBufferSize: 10})
+	defer db.Close()
+
+	w := openWatch(t, db, "k", 0)
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("v")); err != nil {
+			t.Errorf("Put blocked on a slow watcher: %v", err)
+			t.FailNow()
+		}
+	}
+	events := drain(w)
+	if len(events) != 10 || w.Err() != kvdb.ErrWatchOverflow {
+		t.Errorf("slow watcher received %d events, err %v", len(events), w.Err())
+	}
+
+	// Resuming after the last event seen picks up where it left off
+	w = openWatch(t, db, "k", 11)
+	w.Close()
+	if events := drain(w); len(events) != 90 || events[0] != "put k10=v" {
+		t.Errorf("resumed watcher received %d events from %v", len(events), events[:1])
+	}
+}
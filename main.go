@@ -1,12 +1,126 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
 	"github.com/jlitzingerdev/simple-kv/api"
 	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/raft"
+	"github.com/jlitzingerdev/simple-kv/replication"
+	"github.com/jlitzingerdev/simple-kv/resp"
+	"github.com/jlitzingerdev/simple-kv/rpc"
+	"github.com/jlitzingerdev/simple-kv/shard"
 )
 
 func main() {
-	db := kvdb.InitDb(&kvdb.DbConfig{})
+	dir := flag.String("dir", "data", "directory for the write-ahead log")
+	respAddr := flag.String("resp", ":6379", "address for the Redis protocol listener, empty to disable")
+	grpcAddr := flag.String("grpc", ":10001", "address for the gRPC listener, empty to disable")
+	replAddr := flag.String("replication", "", "address to ship the log to followers from, empty to disable")
+	follow := flag.String("follow", "", "address of a leader to follow, serving reads only")
+	raftID := flag.String("raft-id", "", "this member's ID in a Raft cluster, empty to run standalone")
+	raftAddr := flag.String("raft-addr", ":10003", "address for Raft messages between members")
+	raftPeers := flag.String("raft-peers", "", "members a new cluster starts with as id=raftaddr/apiaddr,..., empty to join one")
+	raftDir := flag.String("raft-dir", "raft", "directory for the Raft log and snapshots")
+	shards := flag.Int("shards", 0, "number of shards to spread keys over, 0 for a single database")
+	flag.Parse()
+
+	if *shards > 0 {
+		if *replAddr != "" || *follow != "" || *raftID != "" {
+			fmt.Println("-shards cannot be combined with replication or a Raft cluster")
+			os.Exit(1)
+		}
+		serveShards(*dir, *shards)
+		return
+	}
+
+	db, err := kvdb.InitDb(&kvdb.DbConfig{Dir: *dir})
+	if err != nil {
+		fmt.Println("Failed opening database ", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if *respAddr != "" {
+		rs := resp.InitServer(db)
+		go func() {
+			if err := rs.StartServer(*respAddr); err != nil {
+				fmt.Println("Redis protocol listener failed ", err)
+			}
+		}()
+	}
+
+	if *grpcAddr != "" {
+		gs := rpc.InitServer(db)
+		go func() {
+			if err := gs.StartServer(*grpcAddr); err != nil {
+				fmt.Println("gRPC listener failed ", err)
+			}
+		}()
+	}
+
 	s := api.InitServer(db)
+	if *raftID != "" {
+		kv, transport := startCluster(db, *raftID, *raftAddr, *raftPeers, *raftDir)
+		defer transport.Close()
+		defer kv.Node().Stop()
+		s.SetCluster(kv)
+	} else if *follow != "" {
+		f := replication.InitFollower(db, *follow)
+		f.Start()
+		defer f.Close()
+		s.SetReplication(f)
+	} else if *replAddr != "" {
+		l := replication.InitLeader(db)
+		go func() {
+			if err := l.StartServer(*replAddr); err != nil {
+				fmt.Println("Replication listener failed ", err)
+			}
+		}()
+		s.SetReplication(l)
+	}
 	s.StartServer()
 }
+
+// Replicate db as the member id of a Raft cluster, exiting on failure
+func startCluster(db *kvdb.Db, id, addr, peers, dir string) (*raft.KV, *raft.TCPTransport) {
+	members, err := raft.ParseMembers(peers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	storage, err := raft.OpenFileStorage(dir)
+	if err != nil {
+		fmt.Println("Failed opening Raft storage ", err)
+		os.Exit(1)
+	}
+	transport := raft.NewTCPTransport()
+	kv, err := raft.NewKV(db, raft.Config{ID: id, Members: members, Storage: storage, Transport: transport})
+	if err != nil {
+		fmt.Println("Failed starting Raft ", err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Raft listener failed ", err)
+		os.Exit(1)
+	}
+	go transport.Serve(l, kv.Node())
+	kv.Node().Start(100 * time.Millisecond)
+	return kv, transport
+}
+
+// Serve HTTP only, with keys spread over shards in dir
+func serveShards(dir string, shards int) {
+	r, err := shard.InitRouter(&shard.Config{Dir: dir, Shards: shards})
+	if err != nil {
+		fmt.Println("Failed opening shards ", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+	api.InitShardedServer(r).StartServer()
+}
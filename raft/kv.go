@@ -0,0 +1,215 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+var ErrTimeout = errors.New("raft: timed out waiting for the write to commit")
+
+// How long a write waits to be committed by default
+const defaultWriteTimeout = 5 * time.Second
+
+// A write proposed to the log: a kvdb log record, stamped with the time
+// on the leader, made if every condition holds when it is applied
+type command struct {
+	Record     []byte              `json:"record"`
+	Conditions []kvdb.LogCondition `json:"conditions,omitempty"`
+}
+
+// What applying a command returned
+type applyResult struct {
+	version uint64
+	err     error
+}
+
+// Replicates a kvdb.Db.  The database is read-only except for applying
+// the log, and every member applies the same records in the same order,
+// so every mutation has the same sequence, and version, everywhere.
+type dbMachine struct {
+	db *kvdb.Db
+}
+
+func (m *dbMachine) Apply(data []byte) interface{} {
+	var c command
+	if err := json.Unmarshal(data, &c); err != nil {
+		return applyResult{err: err}
+	}
+	version, err := m.db.ApplyLogRecord(c.Record, c.Conditions)
+	return applyResult{version, err}
+}
+
+// A snapshot is the database's sequence, 8 bytes big endian, followed by
+// its snapshot table
+func (m *dbMachine) Snapshot(w io.Writer) error {
+	var table bytes.Buffer
+	sequence, err := m.db.WriteSnapshotTable(&table)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], sequence)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = table.WriteTo(w)
+	return err
+}
+
+func (m *dbMachine) Restore(data []byte) error {
+	if data == nil {
+		// An empty database's snapshot
+		empty, err := kvdb.InitDb(&kvdb.DbConfig{})
+		if err != nil {
+			return err
+		}
+		defer empty.Close()
+		var buf bytes.Buffer
+		if err := (&dbMachine{empty}).Snapshot(&buf); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if len(data) < 8 {
+		return errors.New("raft: snapshot too short")
+	}
+	return m.db.RestoreSnapshotTable(bytes.NewReader(data[8:]), binary.BigEndian.Uint64(data))
+}
+
+// A kvdb.Db replicated by Raft.  Writes are proposed to the leader's log
+// and return once committed and applied here, failing with ErrNotLeader
+// on any other member.  Reads go straight to the local Db, which on a
+// follower may not yet have every committed write.
+type KV struct {
+	db   *kvdb.Db
+	node *Node
+
+	// How long a write waits to be committed
+	timeout time.Duration
+}
+
+// Replicate db with a node made from config, whose Machine is set to it.
+// The database is made read-only and restored from what config.Storage
+// holds, so starts out empty for a new node.
+func NewKV(db *kvdb.Db, config Config) (*KV, error) {
+	db.SetReadOnly(true)
+	config.Machine = &dbMachine{db}
+	node, err := NewNode(config)
+	if err != nil {
+		return nil, err
+	}
+	return &KV{db: db, node: node, timeout: defaultWriteTimeout}, nil
+}
+
+func (kv *KV) Node() *Node {
+	return kv.node
+}
+
+func (kv *KV) Db() *kvdb.Db {
+	return kv.db
+}
+
+// Wait for the result of a proposal
+func (kv *KV) wait(ch <-chan Result, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(kv.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.Value, r.Err
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (kv *KV) propose(c command) (uint64, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+	value, err := kv.wait(kv.node.Propose(data))
+	if err != nil {
+		return 0, err
+	}
+	r := value.(applyResult)
+	return r.version, r.err
+}
+
+func (kv *KV) Put(key, value []byte) error {
+	return kv.PutWithOptions(key, value, kvdb.PutOptions{})
+}
+
+func (kv *KV) PutWithOptions(key, value []byte, opts kvdb.PutOptions) error {
+	record, err := kvdb.PutLogRecord(key, value, opts, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = kv.propose(command{Record: record})
+	return err
+}
+
+// Put key if its current version is version, see kvdb.Db.PutIfVersion
+func (kv *KV) PutIfVersionWithOptions(key, value []byte, version uint64, opts kvdb.PutOptions) (uint64, error) {
+	record, err := kvdb.PutLogRecord(key, value, opts, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return kv.propose(command{record, []kvdb.LogCondition{{Key: key, Version: version}}})
+}
+
+func (kv *KV) Delete(key []byte) error {
+	_, err := kv.propose(command{Record: kvdb.DeleteLogRecord(key, time.Now())})
+	return err
+}
+
+// Delete key if its current version is version
+func (kv *KV) DeleteIfVersion(key []byte, version uint64) error {
+	_, err := kv.propose(command{kvdb.DeleteLogRecord(key, time.Now()),
+		[]kvdb.LogCondition{{Key: key, Version: version}}})
+	return err
+}
+
+func (kv *KV) Write(batch *kvdb.WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	_, err := kv.propose(command{Record: kvdb.BatchLogRecord(batch, time.Now())})
+	return err
+}
+
+// Commit a transaction begun on the local Db through the log, failing
+// with kvdb.ErrConflict if a key it read has changed
+func (kv *KV) CommitTxn(txn *kvdb.Txn) error {
+	conditions, batch, err := txn.Prepare()
+	if err != nil {
+		return err
+	}
+	_, err = kv.propose(command{kvdb.BatchLogRecord(batch, time.Now()), conditions})
+	if err == kvdb.ErrVersionMismatch {
+		return kvdb.ErrConflict
+	}
+	return err
+}
+
+func (kv *KV) wrote(ch <-chan Result, err error) error {
+	_, err = kv.wait(ch, err)
+	return err
+}
+
+// Add a member and wait for the change to commit
+func (kv *KV) AddMember(m Member) error {
+	return kv.wrote(kv.node.AddMember(m))
+}
+
+// Remove a member and wait for the change to commit
+func (kv *KV) RemoveMember(id string) error {
+	return kv.wrote(kv.node.RemoveMember(id))
+}
@@ -0,0 +1,252 @@
+package raft
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+type testKV struct {
+	t    *testing.T
+	nw   *Network
+	kvs  map[string]*KV
+	done chan struct{}
+}
+
+// KVs on a Network ticked from a goroutine, as writes block until they
+// commit
+func newTestKV(t *testing.T, config Config, ids ...string) *testKV {
+	c := &testKV{t: t, nw: NewNetwork(1), kvs: map[string]*KV{}, done: make(chan struct{})}
+	for _, id := range ids {
+		c.start(id, config, testMembers(ids...))
+	}
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(time.Millisecond):
+				c.nw.Tick()
+			}
+		}
+	}()
+	return c
+}
+
+func (c *testKV) start(id string, config Config, members Membership) *KV {
+	db, err := kvdb.InitDb(&kvdb.DbConfig{})
+	if err != nil {
+		c.t.Errorf("InitDb failed: %v", err)
+		c.t.FailNow()
+	}
+	config.ID, config.Members = id, members
+	config.Storage, config.Transport = NewMemoryStorage(), c.nw
+	kv, err := NewKV(db, config)
+	if err != nil {
+		c.t.Errorf("NewKV failed: %v", err)
+		c.t.FailNow()
+	}
+	c.kvs[id] = kv
+	c.nw.Attach(kv.Node())
+	return kv
+}
+
+func (c *testKV) close() {
+	close(c.done)
+	for _, kv := range c.kvs {
+		kv.Node().Stop()
+		kv.Db().Close()
+	}
+}
+
+func (c *testKV) leader() *KV {
+	for i := 0; i < 1000; i++ {
+		for _, kv := range c.kvs {
+			if kv.Node().Status().State == StateLeader.String() {
+				return kv
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.t.Errorf("no leader elected")
+	c.t.FailNow()
+	return nil
+}
+
+// Wait for every KV to hold value for key
+func (c *testKV) converge(key, value string) {
+	for i := 0; i < 1000; i++ {
+		same := true
+		for _, kv := range c.kvs {
+			if v, _ := kv.Db().Get([]byte(key)); string(v) != value {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for id, kv := range c.kvs {
+		v, _ := kv.Db().Get([]byte(key))
+		c.t.Errorf("%s: %s=%q, expected %q", id, key, v, value)
+	}
+	c.t.FailNow()
+}
+
+func TestKV(t *testing.T) {
+	c := newTestKV(t, Config{SnapshotEntries: 8}, "a", "b", "c")
+	defer c.close()
+	leader := c.leader()
+
+	if err := leader.Put([]byte("k"), []byte("v1")); err != nil {
+		t.Errorf("Put failed: %v", err)
+	}
+	c.converge("k", "v1")
+	for _, kv := range c.kvs {
+		if kv != leader {
+			if err := kv.Put([]byte("k"), []byte("x")); err != ErrNotLeader {
+				t.Errorf("Put on a follower: %v", err)
+			}
+		}
+		// The log is the only way in
+		if err := kv.Db().Put([]byte("k"), []byte("x")); err != kvdb.ErrReadOnly {
+			t.Errorf("Put on the Db: %v", err)
+		}
+	}
+
+	// Versions agree everywhere, so conditions hold or fail alike
+	_, version, _ := leader.Db().GetVersion([]byte("k"))
+	for _, kv := range c.kvs {
+		if _, v, _ := kv.Db().GetVersion([]byte("k")); v != version {
+			t.Errorf("version %d, leader's %d", v, version)
+		}
+	}
+	if _, err := leader.PutIfVersionWithOptions([]byte("k"), []byte("v2"), version+1, kvdb.PutOptions{}); err != kvdb.ErrVersionMismatch {
+		t.Errorf("PutIfVersion with the wrong version: %v", err)
+	}
+	next, err := leader.PutIfVersionWithOptions([]byte("k"), []byte("v2"), version, kvdb.PutOptions{})
+	if err != nil || next <= version {
+		t.Errorf("PutIfVersion = %d, %v", next, err)
+	}
+	c.converge("k", "v2")
+	if err := leader.DeleteIfVersion([]byte("k"), version); err != kvdb.ErrVersionMismatch {
+		t.Errorf("DeleteIfVersion with the wrong version: %v", err)
+	}
+	if err := leader.DeleteIfVersion([]byte("k"), next); err != nil {
+		t.Errorf("DeleteIfVersion failed: %v", err)
+	}
+	c.converge("k", "")
+
+	batch := kvdb.NewWriteBatch()
+	batch.Put([]byte("b1"), []byte("1"))
+	batch.Put([]byte("b2"), []byte("2"))
+	if err := leader.Write(batch); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	c.converge("b2", "2")
+
+	// A transaction commits unless what it read changed first
+	txn := leader.Db().Begin()
+	txn.Get([]byte("b1"))
+	txn.Put([]byte("t"), []byte("txn"))
+	conflicting := leader.Db().Begin()
+	conflicting.Get([]byte("b1"))
+	conflicting.Put([]byte("b1"), []byte("changed"))
+	if err := leader.CommitTxn(txn); err != nil {
+		t.Errorf("CommitTxn failed: %v", err)
+	}
+	c.converge("t", "txn")
+	if err := leader.CommitTxn(conflicting); err != nil {
+		t.Errorf("CommitTxn of a transaction that read nothing changed: %v", err)
+	}
+	stale := leader.Db().Begin()
+	stale.Get([]byte("b1"))
+	stale.Put([]byte("b1"), []byte("stale"))
+	if err := leader.Delete([]byte("b1")); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err := leader.CommitTxn(stale); err != kvdb.ErrConflict {
+		t.Errorf("CommitTxn after a conflicting write: %v", err)
+	}
+	c.converge("b1", "")
+
+	// A member added later is sent a snapshot of the database
+	for i := 0; i < 10; i++ {
+		leader.Put([]byte("fill"), []byte{byte('0' + i)})
+	}
+	joined := c.start("d", Config{}, nil)
+	if err := leader.AddMember(testMembers("d")[0]); err != nil {
+		t.Errorf("AddMember failed: %v", err)
+	}
+	c.converge("fill", "9")
+	c.converge("t", "txn")
+	if joined.Node().Status().SnapshotIndex == 0 {
+		t.Errorf("new member was not sent a snapshot")
+	}
+	if joined.Db().LastSequence() != leader.Db().LastSequence() {
+		t.Errorf("sequence %d, leader's %d", joined.Db().LastSequence(), leader.Db().LastSequence())
+	}
+}
+
+func TestKVOverTCP(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	listeners := map[string]net.Listener{}
+	members := Membership{}
+	for _, id := range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("Listen failed: %v", err)
+			t.FailNow()
+		}
+		listeners[id] = l
+		members = append(members, Member{ID: id, Addr: l.Addr().String()})
+	}
+
+	kvs := []*KV{}
+	for _, id := range ids {
+		db, _ := kvdb.InitDb(&kvdb.DbConfig{})
+		defer db.Close()
+		transport := NewTCPTransport()
+		defer transport.Close()
+		kv, err := NewKV(db, Config{ID: id, Members: members, Storage: NewMemoryStorage(), Transport: transport})
+		if err != nil {
+			t.Errorf("NewKV failed: %v", err)
+			t.FailNow()
+		}
+		go transport.Serve(listeners[id], kv.Node())
+		kv.Node().Start(5 * time.Millisecond)
+		defer kv.Node().Stop()
+		kvs = append(kvs, kv)
+	}
+
+	var err error
+	for i := 0; i < 200; i++ {
+		for _, kv := range kvs {
+			if err = kv.Put([]byte("k"), []byte("v")); err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("Put never succeeded: %v", err)
+		t.FailNow()
+	}
+	for _, kv := range kvs {
+		for i := 0; i < 200; i++ {
+			if v, _ := kv.Db().Get([]byte("k")); string(v) == "v" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if v, _ := kv.Db().Get([]byte("k")); string(v) != "v" {
+			t.Errorf("%s has k=%q", kv.Node().ID(), v)
+		}
+	}
+}
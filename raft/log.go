@@ -0,0 +1,62 @@
+package raft
+
+// The log in memory, entries after the last snapshot
+type raftLog struct {
+	snapIndex, snapTerm uint64
+	entries             []Entry
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	t, _ := l.term(l.lastIndex())
+	return t
+}
+
+// The term of the entry at i, false if it is not held
+func (l *raftLog) term(i uint64) (uint64, bool) {
+	if i == l.snapIndex {
+		return l.snapTerm, true
+	} else if i < l.snapIndex || i > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[i-l.snapIndex-1].Term, true
+}
+
+func (l *raftLog) entry(i uint64) Entry {
+	return l.entries[i-l.snapIndex-1]
+}
+
+// A copy of the entries from lo up to but not including hi
+func (l *raftLog) slice(lo, hi uint64) []Entry {
+	return append([]Entry{}, l.entries[lo-l.snapIndex-1:hi-l.snapIndex-1]...)
+}
+
+// Append es, replacing any entries from es[0].Index on
+func (l *raftLog) append(es ...Entry) {
+	if len(es) == 0 {
+		return
+	}
+	l.entries = append(l.entries[:es[0].Index-l.snapIndex-1], es...)
+}
+
+// Drop the entries up to index, which a snapshot now covers
+func (l *raftLog) compact(index, term uint64) {
+	l.entries = append([]Entry{}, l.entries[index-l.snapIndex:]...)
+	l.snapIndex, l.snapTerm = index, term
+}
+
+// Drop every entry, starting over after a snapshot
+func (l *raftLog) reset(index, term uint64) {
+	l.entries = nil
+	l.snapIndex, l.snapTerm = index, term
+}
+
+// Whether a log ending at index and term is at least as up to date as
+// this one, so its owner may have a vote
+func (l *raftLog) upToDate(index, term uint64) bool {
+	last := l.lastTerm()
+	return term > last || term == last && index >= l.lastIndex()
+}
@@ -0,0 +1,155 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type MessageType uint8
+
+const (
+	// Asks whether an election would be won, without changing terms
+	MsgPreVote MessageType = iota + 1
+	MsgPreVoteResp
+	MsgVote
+	MsgVoteResp
+	// Entries and the commit index from the leader, with none a heartbeat
+	MsgAppend
+	MsgAppendResp
+	// A snapshot for a follower the leader's log no longer reaches back to,
+	// answered with MsgAppendResp
+	MsgSnapshot
+)
+
+var messageTypeNames = map[MessageType]string{
+	MsgPreVote:     "PreVote",
+	MsgPreVoteResp: "PreVoteResp",
+	MsgVote:        "Vote",
+	MsgVoteResp:    "VoteResp",
+	MsgAppend:      "Append",
+	MsgAppendResp:  "AppendResp",
+	MsgSnapshot:    "Snapshot",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", t)
+}
+
+// A message between members.  Which fields are set depends on Type.
+type Message struct {
+	Type     MessageType
+	From, To string
+	Term     uint64
+	// The sender's address, so a node not yet told of its members can
+	// reply to the leader adding it
+	FromAddr string
+
+	// For votes the candidate's last entry, for appends the one before
+	// Entries
+	LogIndex, LogTerm uint64
+	Entries           []Entry
+	Commit            uint64
+
+	// For responses whether the request was refused and, for appends,
+	// the last index the follower now matches, or on refusal its last
+	// index as a hint where to try from
+	Reject bool
+	Index  uint64
+
+	Snapshot *Snapshot
+}
+
+type EntryType uint8
+
+const (
+	// A command for the state machine
+	EntryNormal EntryType = iota
+	// Appended by a new leader to commit the entries of earlier terms
+	EntryNoop
+	// Data is the new Membership, as JSON
+	EntryConfig
+)
+
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// The state machine as of Index, whose entry was in Term, and the
+// membership then
+type Snapshot struct {
+	Index   uint64     `json:"index"`
+	Term    uint64     `json:"term"`
+	Members Membership `json:"members"`
+	Data    []byte     `json:"data"`
+}
+
+// A member of the cluster.  Addr is where it takes Raft messages and
+// APIAddr where it serves clients, for redirecting them to the leader.
+type Member struct {
+	ID      string `json:"id"`
+	Addr    string `json:"addr"`
+	APIAddr string `json:"api_addr,omitempty"`
+}
+
+type Membership []Member
+
+func (ms Membership) find(id string) (Member, bool) {
+	for _, m := range ms {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+func (ms Membership) without(id string) Membership {
+	out := Membership{}
+	for _, m := range ms {
+		if m.ID != id {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Parse members written id=addr/apiaddr and separated by commas, the API
+// address being optional
+func ParseMembers(s string) (Membership, error) {
+	ms := Membership{}
+	if s == "" {
+		return ms, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		eq := strings.Index(field, "=")
+		if eq <= 0 || eq == len(field)-1 {
+			return nil, fmt.Errorf("raft: invalid member %q, expected id=addr/apiaddr", field)
+		}
+		m := Member{ID: field[:eq], Addr: field[eq+1:]}
+		if slash := strings.Index(m.Addr, "/"); slash >= 0 {
+			m.Addr, m.APIAddr = m.Addr[:slash], m.Addr[slash+1:]
+		}
+		if _, dup := ms.find(m.ID); dup {
+			return nil, fmt.Errorf("raft: member %q given twice", m.ID)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func encodeMembership(ms Membership) []byte {
+	blob, _ := json.Marshal(ms)
+	return blob
+}
+
+func decodeMembership(data []byte) (Membership, error) {
+	var ms Membership
+	err := json.Unmarshal(data, &ms)
+	return ms, err
+}
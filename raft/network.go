@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// An in-memory Transport joining nodes in one process.  Nothing moves
+// until Deliver or Tick is called, and messages are lost by a seeded
+// random source, so a test driving it from one goroutine sees the same
+// run every time.  Links can be cut to partition the cluster.
+type Network struct {
+	lock  sync.Mutex
+	rand  *rand.Rand
+	nodes map[string]*Node
+	queue []Message
+	drop  float64
+	// Directed links that lose every message
+	cut map[[2]string]bool
+}
+
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:  rand.New(rand.NewSource(seed)),
+		nodes: map[string]*Node{},
+		cut:   map[[2]string]bool{},
+	}
+}
+
+// Queue m for delivery
+func (nw *Network) Send(to Member, m Message) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.queue = append(nw.queue, m)
+}
+
+// Deliver messages to n, replacing any node with the same ID
+func (nw *Network) Attach(n *Node) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.nodes[n.ID()] = n
+}
+
+// Stop delivering to the node with id, as if it crashed
+func (nw *Network) Detach(id string) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	delete(nw.nodes, id)
+}
+
+// Lose each message with probability rate
+func (nw *Network) SetDropRate(rate float64) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.drop = rate
+}
+
+// Split the nodes into groups that only reach nodes in their own group.
+// A node in no group is cut off from every other.
+func (nw *Network) Partition(groups ...[]string) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	group := map[string]int{}
+	for i, g := range groups {
+		for _, id := range g {
+			group[id] = i + 1
+		}
+	}
+	nw.cut = map[[2]string]bool{}
+	for a := range nw.nodes {
+		for b := range nw.nodes {
+			if a != b && (group[a] == 0 || group[a] != group[b]) {
+				nw.cut[[2]string{a, b}] = true
+			}
+		}
+	}
+}
+
+// Cut the link from one node to another, in that direction only
+func (nw *Network) Cut(from, to string) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.cut[[2]string{from, to}] = true
+}
+
+// Restore every link
+func (nw *Network) Heal() {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.cut = map[[2]string]bool{}
+}
+
+// Deliver queued messages, and those sent in response, until none are
+// left.  Returns how many were delivered.
+func (nw *Network) Deliver() int {
+	delivered := 0
+	for {
+		nw.lock.Lock()
+		if len(nw.queue) == 0 {
+			nw.lock.Unlock()
+			return delivered
+		}
+		m := nw.queue[0]
+		nw.queue = nw.queue[1:]
+		n := nw.nodes[m.To]
+		lost := n == nil || nw.cut[[2]string{m.From, m.To}] || nw.drop > 0 && nw.rand.Float64() < nw.drop
+		nw.lock.Unlock()
+
+		if !lost {
+			n.Step(m)
+			delivered++
+		}
+	}
+}
+
+// Tick every node, in order of ID, then deliver what they send
+func (nw *Network) Tick() {
+	nw.lock.Lock()
+	ids := make([]string, 0, len(nw.nodes))
+	for id := range nw.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nodes := make([]*Node, len(ids))
+	for i, id := range ids {
+		nodes[i] = nw.nodes[id]
+	}
+	nw.lock.Unlock()
+
+	for _, n := range nodes {
+		n.Tick()
+	}
+	nw.Deliver()
+}
@@ -0,0 +1,961 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Raft consensus, as described in "In Search of an Understandable
+// Consensus Algorithm" and Diego Ongaro's dissertation.  Members elect a
+// leader, which appends commands to a log replicated to the others; an
+// entry held by a majority is committed and applied, in log order, to a
+// StateMachine on every member.
+//
+// A Node does nothing by itself.  Time passes when Tick is called and
+// messages arrive when Step is called, so the same node runs under a
+// real clock and network, see Start and TCPTransport, or one driven step
+// by step, see Network, which makes tests with partitions and lost
+// messages repeatable.
+//
+// Beyond the basic algorithm:
+//
+//   - Candidates first ask for a pre-vote, so a member cut off from the
+//     rest does not drive terms up and unseat the leader when it returns.
+//     Members that have heard from a leader within an election timeout
+//     ignore votes altogether, and a leader that has not heard from a
+//     majority for as long steps down.
+//   - Once SnapshotEntries entries have been applied the state machine
+//     is snapshotted and the log before it dropped.  Followers the log no
+//     longer reaches back to are sent the snapshot.
+//   - Membership changes one member at a time, by a config entry that
+//     takes effect as soon as it is appended.  Only one may be
+//     uncommitted at a time.
+
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotLeader = errors.New("raft: not the leader")
+
+var ErrProposalDropped = errors.New("raft: proposal lost to a change of leader")
+
+var ErrStopped = errors.New("raft: node stopped")
+
+var ErrConfigPending = errors.New("raft: a membership change is in progress")
+
+var ErrMemberExists = errors.New("raft: already a member")
+
+var ErrNoMember = errors.New("raft: no such member")
+
+// What members replicate.  Apply is called with each committed command in
+// log order, and the same commands must leave every member in the same
+// state, so Apply must not depend on anything else, such as the clock.
+type StateMachine interface {
+	// Apply a committed command, returning the result for its proposer
+	Apply(data []byte) interface{}
+	// Write the state, as of the last command applied, to w
+	Snapshot(w io.Writer) error
+	// Replace the state with one written by Snapshot, or with nil the
+	// empty state a node starts from
+	Restore(data []byte) error
+}
+
+// Carries messages between members
+type Transport interface {
+	// Send m to the member without waiting, it may be lost
+	Send(to Member, m Message)
+}
+
+type Config struct {
+	ID string
+
+	// The members a new cluster starts with, ignored once Storage holds
+	// state.  A node joining a running cluster starts with none and waits
+	// to be added.
+	Members Membership
+
+	Storage   Storage
+	Machine   StateMachine
+	Transport Transport
+
+	// Ticks without hearing from a leader before a follower campaigns,
+	// randomised up to twice this, default 10.  A leader sends
+	// heartbeats every HeartbeatTicks, default 1.
+	ElectionTicks  int
+	HeartbeatTicks int
+
+	// Applied entries after which the state machine is snapshotted and
+	// the log compacted, default 1024
+	SnapshotEntries int
+
+	// Most entries sent in one append, default 64
+	MaxAppendEntries int
+
+	// Seeds the randomised election timeouts, by default taken from ID
+	Seed int64
+}
+
+func (c *Config) setDefaults() {
+	if c.ElectionTicks <= 0 {
+		c.ElectionTicks = 10
+	}
+	if c.HeartbeatTicks <= 0 {
+		c.HeartbeatTicks = 1
+	}
+	if c.SnapshotEntries <= 0 {
+		c.SnapshotEntries = 1024
+	}
+	if c.MaxAppendEntries <= 0 {
+		c.MaxAppendEntries = 64
+	}
+	if c.Seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(c.ID))
+		c.Seed = int64(h.Sum64())
+	}
+}
+
+type State int
+
+const (
+	StateFollower State = iota
+	StatePreCandidate
+	StateCandidate
+	StateLeader
+)
+
+func (s State) String() string {
+	switch s {
+	case StateFollower:
+		return "follower"
+	case StatePreCandidate:
+		return "pre-candidate"
+	case StateCandidate:
+		return "candidate"
+	case StateLeader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// The outcome of a proposal, Value being what the state machine's Apply
+// returned
+type Result struct {
+	Value interface{}
+	Err   error
+}
+
+// A proposal waiting to be applied
+type waiter struct {
+	term uint64
+	ch   chan Result
+}
+
+// What the leader knows of a follower
+type progress struct {
+	// The last entry known to match, and the next to send
+	match, next uint64
+	// Heard from since the last quorum check
+	active bool
+}
+
+type Node struct {
+	config    Config
+	id        string
+	storage   Storage
+	machine   StateMachine
+	transport Transport
+	rand      *rand.Rand
+
+	lock   sync.Mutex
+	state  State
+	term   uint64
+	vote   string
+	leader string
+
+	log      raftLog
+	snapshot *Snapshot
+	commit   uint64
+	applied  uint64
+
+	// The membership before the log, from the snapshot or the config,
+	// and the one in effect, from the last config entry in the log
+	base    Membership
+	members Membership
+	// Every member ever seen, to reply to those since removed
+	known map[string]Member
+
+	electionElapsed  int
+	heartbeatElapsed int
+	timeout          int
+
+	votes    map[string]bool
+	progress map[string]*progress
+	waiters  map[uint64]waiter
+
+	stopped bool
+	done    chan struct{}
+}
+
+// Create a node, restoring its state machine from what Storage holds
+func NewNode(config Config) (*Node, error) {
+	config.setDefaults()
+	state, snapshot, entries, err := config.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:    config,
+		id:        config.ID,
+		storage:   config.Storage,
+		machine:   config.Machine,
+		transport: config.Transport,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		term:      state.Term,
+		vote:      state.Vote,
+		base:      config.Members,
+		known:     map[string]Member{},
+		waiters:   map[uint64]waiter{},
+	}
+
+	if snapshot != nil {
+		if err := n.machine.Restore(snapshot.Data); err != nil {
+			return nil, err
+		}
+		n.snapshot, n.base = snapshot, snapshot.Members
+		n.log.reset(snapshot.Index, snapshot.Term)
+		n.commit, n.applied = snapshot.Index, snapshot.Index
+	} else if err := n.machine.Restore(nil); err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.Index != n.log.snapIndex+uint64(i)+1 {
+			return nil, fmt.Errorf("raft: stored log has entry %d where %d was expected",
+				e.Index, n.log.snapIndex+uint64(i)+1)
+		}
+	}
+	n.log.entries = entries
+	n.refreshMembers()
+	n.becomeFollower(n.term, "")
+	return n, nil
+}
+
+// Tick every interval until Stop is called
+func (n *Node) Start(interval time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.done != nil || n.stopped {
+		return
+	}
+	n.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n.Tick()
+			}
+		}
+	}(n.done)
+}
+
+// Stop the node, failing any proposals still waiting with ErrStopped
+func (n *Node) Stop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	if n.done != nil {
+		close(n.done)
+	}
+	for index, w := range n.waiters {
+		w.ch <- Result{Err: ErrStopped}
+		delete(n.waiters, index)
+	}
+}
+
+// A storage failure leaves the node's state unknown, so it stops
+func (n *Node) fail(err error) {
+	fmt.Println("Raft node ", n.id, " stopping after storage failure ", err)
+	n.stopped = true
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
+	for index, w := range n.waiters {
+		w.ch <- Result{Err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// Advance the node's clock by one tick
+func (n *Node) Tick() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return
+	}
+	n.electionElapsed++
+	if n.state == StateLeader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.config.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcast()
+		}
+		if n.electionElapsed >= n.config.ElectionTicks {
+			n.electionElapsed = 0
+			n.checkQuorum()
+		}
+		return
+	}
+	if n.electionElapsed >= n.timeout && n.isMember() {
+		n.campaign(true)
+	}
+}
+
+// Handle a message from another member
+func (n *Node) Step(m Message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return
+	}
+	n.step(m)
+}
+
+func (n *Node) step(m Message) {
+	if _, ok := n.known[m.From]; !ok && m.FromAddr != "" {
+		n.known[m.From] = Member{ID: m.From, Addr: m.FromAddr}
+	}
+	switch {
+	case m.Term > n.term:
+		if (m.Type == MsgPreVote || m.Type == MsgVote) && n.inLease() {
+			return
+		}
+		switch {
+		case m.Type == MsgPreVote:
+			// A pre-vote does not change the term
+		case m.Type == MsgPreVoteResp && !m.Reject:
+			// Granted for the term the pre-vote asked about
+		case m.Type == MsgAppend || m.Type == MsgSnapshot:
+			n.becomeFollower(m.Term, m.From)
+		default:
+			n.becomeFollower(m.Term, "")
+		}
+		if n.stopped {
+			return
+		}
+	case m.Term < n.term:
+		switch m.Type {
+		case MsgAppend, MsgSnapshot:
+			// Let a stale leader learn of the new term
+			n.send(Message{Type: MsgAppendResp, To: m.From, Reject: true})
+		case MsgPreVote:
+			n.send(Message{Type: MsgPreVoteResp, To: m.From, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgPreVote, MsgVote:
+		n.handleVote(m)
+	case MsgPreVoteResp:
+		if n.state == StatePreCandidate && (m.Reject || m.Term == n.term+1) {
+			n.tally(m)
+		}
+	case MsgVoteResp:
+		if n.state == StateCandidate {
+			n.tally(m)
+		}
+	case MsgAppend, MsgSnapshot:
+		if n.state != StateFollower {
+			n.becomeFollower(n.term, m.From)
+		}
+		n.leader = m.From
+		n.electionElapsed = 0
+		if m.Type == MsgAppend {
+			n.handleAppend(m)
+		} else {
+			n.handleSnapshot(m)
+		}
+	case MsgAppendResp:
+		if n.state == StateLeader {
+			n.handleAppendResp(m)
+		}
+	}
+}
+
+// Whether a leader has been heard from within an election timeout, in
+// which case votes are ignored
+func (n *Node) inLease() bool {
+	return n.leader != "" && n.electionElapsed < n.config.ElectionTicks
+}
+
+func (n *Node) isMember() bool {
+	_, ok := n.members.find(n.id)
+	return ok
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) send(m Message) {
+	m.From = n.id
+	m.FromAddr = n.known[n.id].Addr
+	if m.Term == 0 {
+		m.Term = n.term
+	}
+	to, ok := n.members.find(m.To)
+	if !ok {
+		if to, ok = n.known[m.To]; !ok {
+			return
+		}
+	}
+	n.transport.Send(to, m)
+}
+
+func (n *Node) saveHardState() {
+	if err := n.storage.SaveHardState(HardState{n.term, n.vote}); err != nil {
+		n.fail(err)
+	}
+}
+
+func (n *Node) resetTimeout() {
+	n.electionElapsed = 0
+	n.timeout = n.config.ElectionTicks + n.rand.Intn(n.config.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term != n.term {
+		n.term, n.vote = term, ""
+		n.saveHardState()
+	}
+	n.state = StateFollower
+	n.leader = leader
+	n.votes, n.progress = nil, nil
+	n.resetTimeout()
+}
+
+// Ask for pre-votes, or with pre false real ones in a new term
+func (n *Node) campaign(pre bool) {
+	kind, term := MsgPreVote, n.term+1
+	if pre {
+		n.state = StatePreCandidate
+	} else {
+		kind = MsgVote
+		n.state = StateCandidate
+		n.term++
+		n.vote = n.id
+		if n.saveHardState(); n.stopped {
+			return
+		}
+		term = n.term
+	}
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.resetTimeout()
+	if n.checkVotes() {
+		return
+	}
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.send(Message{Type: kind, To: m.ID, Term: term,
+				LogIndex: n.log.lastIndex(), LogTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+func (n *Node) handleVote(m Message) {
+	pre := m.Type == MsgPreVote
+	resp := MsgVoteResp
+	if pre {
+		resp = MsgPreVoteResp
+	}
+	canVote := n.vote == m.From || n.vote == "" && n.leader == "" || pre && m.Term > n.term
+	if !canVote || !n.log.upToDate(m.LogIndex, m.LogTerm) {
+		n.send(Message{Type: resp, To: m.From, Reject: true})
+		return
+	}
+	if !pre {
+		n.vote = m.From
+		n.electionElapsed = 0
+		// A vote is only granted once it will survive a restart
+		if n.saveHardState(); n.stopped {
+			return
+		}
+	}
+	n.send(Message{Type: resp, To: m.From, Term: m.Term})
+}
+
+func (n *Node) tally(m Message) {
+	n.votes[m.From] = !m.Reject
+	n.checkVotes()
+}
+
+// Move on if enough votes are in, returning whether the node did
+func (n *Node) checkVotes() bool {
+	granted, rejected := 0, 0
+	for _, m := range n.members {
+		if v, ok := n.votes[m.ID]; ok && v {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum() && n.state == StatePreCandidate:
+		n.campaign(false)
+	case granted >= n.quorum():
+		n.becomeLeader()
+	case rejected >= n.quorum():
+		n.becomeFollower(n.term, "")
+	default:
+		return false
+	}
+	return true
+}
+
+func (n *Node) becomeLeader() {
+	n.state = StateLeader
+	n.leader = n.id
+	n.votes = nil
+	n.electionElapsed, n.heartbeatElapsed = 0, 0
+	n.progress = map[string]*progress{}
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.progress[m.ID] = &progress{next: n.log.lastIndex() + 1}
+		}
+	}
+	// Entries of earlier terms are only committed along with one of this
+	n.appendEntries(Entry{Type: EntryNoop})
+	n.maybeCommit()
+	n.broadcast()
+}
+
+// Append entries to the leader's log in its term
+func (n *Node) appendEntries(es ...Entry) {
+	config := false
+	for i := range es {
+		es[i].Index = n.log.lastIndex() + 1 + uint64(i)
+		es[i].Term = n.term
+		config = config || es[i].Type == EntryConfig
+	}
+	n.log.append(es...)
+	if err := n.storage.Append(es); err != nil {
+		n.fail(err)
+		return
+	}
+	if config {
+		n.refreshMembers()
+	}
+}
+
+// Take the membership from the last config entry in the log, updating
+// the leader's followers to match
+func (n *Node) refreshMembers() {
+	n.members = n.membersAt(n.log.lastIndex())
+	for _, m := range n.members {
+		n.known[m.ID] = m
+	}
+	if n.state != StateLeader {
+		return
+	}
+	for _, m := range n.members {
+		if _, ok := n.progress[m.ID]; !ok && m.ID != n.id {
+			n.progress[m.ID] = &progress{next: n.log.lastIndex() + 1, active: true}
+		}
+	}
+	for id := range n.progress {
+		if _, ok := n.members.find(id); !ok {
+			delete(n.progress, id)
+		}
+	}
+}
+
+// The membership as of the entry at index
+func (n *Node) membersAt(index uint64) Membership {
+	for i := index; i > n.log.snapIndex; i-- {
+		if e := n.log.entry(i); e.Type == EntryConfig {
+			ms, err := decodeMembership(e.Data)
+			if err == nil {
+				return ms
+			}
+			fmt.Println("Bad membership in entry ", e.Index, " ", err)
+		}
+	}
+	return n.base
+}
+
+func (n *Node) broadcast() {
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.sendAppend(m.ID)
+		}
+	}
+}
+
+// Send a follower the entries from the next it needs, or the snapshot
+// if the log no longer holds them.  With nothing to send this is a
+// heartbeat.
+func (n *Node) sendAppend(to string) {
+	pr := n.progress[to]
+	if pr == nil {
+		return
+	}
+	prev := pr.next - 1
+	prevTerm, ok := n.log.term(prev)
+	if !ok {
+		if n.snapshot != nil {
+			n.send(Message{Type: MsgSnapshot, To: to, Snapshot: n.snapshot})
+		}
+		return
+	}
+	hi := n.log.lastIndex() + 1
+	if max := pr.next + uint64(n.config.MaxAppendEntries); hi > max {
+		hi = max
+	}
+	n.send(Message{Type: MsgAppend, To: to, LogIndex: prev, LogTerm: prevTerm,
+		Entries: n.log.slice(pr.next, hi), Commit: n.commit})
+}
+
+func (n *Node) handleAppend(m Message) {
+	if m.LogIndex < n.commit {
+		// Already committed here, the leader will carry on from there
+		n.send(Message{Type: MsgAppendResp, To: m.From, Index: n.commit})
+		return
+	}
+	if t, ok := n.log.term(m.LogIndex); !ok || t != m.LogTerm {
+		hint := n.log.lastIndex()
+		if m.LogIndex-1 < hint {
+			hint = m.LogIndex - 1
+		}
+		n.send(Message{Type: MsgAppendResp, To: m.From, Reject: true, Index: hint})
+		return
+	}
+
+	// Skip what is already held, replacing from the first entry that
+	// differs
+	for i, e := range m.Entries {
+		if t, ok := n.log.term(e.Index); ok && t == e.Term {
+			continue
+		}
+		if e.Index <= n.commit {
+			panic(fmt.Sprintf("raft: %s asked to replace committed entry %d", n.id, e.Index))
+		}
+		es := append([]Entry{}, m.Entries[i:]...)
+		n.log.append(es...)
+		if err := n.storage.Append(es); err != nil {
+			n.fail(err)
+			return
+		}
+		n.refreshMembers()
+		break
+	}
+
+	last := m.LogIndex + uint64(len(m.Entries))
+	if commit := m.Commit; commit > n.commit {
+		if commit > last {
+			commit = last
+		}
+		n.commit = commit
+		n.applyCommitted()
+	}
+	n.send(Message{Type: MsgAppendResp, To: m.From, Index: last})
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	s := m.Snapshot
+	if s.Index <= n.commit {
+		n.send(Message{Type: MsgAppendResp, To: m.From, Index: n.commit})
+		return
+	}
+	if err := n.machine.Restore(s.Data); err != nil {
+		fmt.Println("Failed restoring snapshot ", err)
+		return
+	}
+	if err := n.storage.SaveSnapshot(s); err != nil {
+		n.fail(err)
+		return
+	}
+	if t, ok := n.log.term(s.Index); ok && t == s.Term {
+		n.log.compact(s.Index, s.Term)
+	} else {
+		n.log.reset(s.Index, s.Term)
+	}
+	n.snapshot, n.base = s, s.Members
+	n.commit, n.applied = s.Index, s.Index
+	for index, w := range n.waiters {
+		if index <= s.Index {
+			w.ch <- Result{Err: ErrProposalDropped}
+			delete(n.waiters, index)
+		}
+	}
+	n.refreshMembers()
+	n.send(Message{Type: MsgAppendResp, To: m.From, Index: s.Index})
+}
+
+func (n *Node) handleAppendResp(m Message) {
+	pr := n.progress[m.From]
+	if pr == nil {
+		return
+	}
+	pr.active = true
+	if m.Reject {
+		// Try from after the follower's last entry, or one earlier
+		next := pr.next - 1
+		if m.Index+1 < next {
+			next = m.Index + 1
+		}
+		if next <= pr.match {
+			next = pr.match + 1
+		}
+		if next != pr.next {
+			pr.next = next
+			n.sendAppend(m.From)
+		}
+		return
+	}
+
+	if m.Index > pr.match {
+		pr.match = m.Index
+	}
+	if m.Index+1 > pr.next {
+		pr.next = m.Index + 1
+	}
+	if n.maybeCommit() {
+		n.broadcast()
+	} else if pr.next <= n.log.lastIndex() {
+		n.sendAppend(m.From)
+	}
+}
+
+// Commit what a majority holds, returning whether the commit index moved
+func (n *Node) maybeCommit() bool {
+	matches := []uint64{}
+	for _, m := range n.members {
+		if m.ID == n.id {
+			matches = append(matches, n.log.lastIndex())
+		} else if pr := n.progress[m.ID]; pr != nil {
+			matches = append(matches, pr.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	// Only entries of the leader's own term are committed by counting
+	if t, _ := n.log.term(index); index <= n.commit || t != n.term {
+		return false
+	}
+	n.commit = index
+	n.applyCommitted()
+	return true
+}
+
+// Step down if a majority has not been heard from for an election timeout
+func (n *Node) checkQuorum() {
+	active := 0
+	for _, m := range n.members {
+		if m.ID == n.id {
+			active++
+		} else if pr := n.progress[m.ID]; pr != nil && pr.active {
+			active++
+		}
+	}
+	for _, pr := range n.progress {
+		pr.active = false
+	}
+	if active < n.quorum() {
+		fmt.Println("Raft leader ", n.id, " lost contact with a majority, stepping down")
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) applyCommitted() {
+	removed := false
+	for n.applied < n.commit {
+		e := n.log.entry(n.applied + 1)
+		var result Result
+		switch e.Type {
+		case EntryNormal:
+			result.Value = n.machine.Apply(e.Data)
+		case EntryConfig:
+			removed = !n.isMember()
+		}
+		n.applied++
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				result = Result{Err: ErrProposalDropped}
+			}
+			w.ch <- result
+		}
+	}
+	n.maybeSnapshot()
+	if removed && n.state == StateLeader {
+		// Its removal is committed, the rest elect a new leader
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) maybeSnapshot() {
+	if n.applied-n.log.snapIndex < uint64(n.config.SnapshotEntries) {
+		return
+	}
+	var buf bytes.Buffer
+	if err := n.machine.Snapshot(&buf); err != nil {
+		fmt.Println("Failed taking snapshot ", err)
+		return
+	}
+	term, _ := n.log.term(n.applied)
+	s := &Snapshot{Index: n.applied, Term: term, Members: n.membersAt(n.applied), Data: buf.Bytes()}
+	if err := n.storage.SaveSnapshot(s); err != nil {
+		n.fail(err)
+		return
+	}
+	n.log.compact(s.Index, s.Term)
+	n.snapshot, n.base = s, s.Members
+}
+
+// Append data to the log, the channel receiving the result of applying
+// it once it is committed.  Only the leader takes proposals, any other
+// node returns ErrNotLeader.
+func (n *Node) Propose(data []byte) (<-chan Result, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.propose(Entry{Type: EntryNormal, Data: data})
+}
+
+func (n *Node) propose(e Entry) (<-chan Result, error) {
+	if n.stopped {
+		return nil, ErrStopped
+	} else if n.state != StateLeader {
+		return nil, ErrNotLeader
+	}
+	ch := make(chan Result, 1)
+	n.waiters[n.log.lastIndex()+1] = waiter{n.term, ch}
+	n.appendEntries(e)
+	if n.stopped {
+		return ch, nil
+	}
+	n.maybeCommit()
+	n.broadcast()
+	return ch, nil
+}
+
+// Propose a new membership, once any earlier change is committed and the
+// leader has committed an entry of its own term
+func (n *Node) changeMembers(ms Membership) (<-chan Result, error) {
+	if n.state != StateLeader {
+		return nil, ErrNotLeader
+	}
+	for i := n.log.lastIndex(); i > n.commit; i-- {
+		if n.log.entry(i).Type == EntryConfig {
+			return nil, ErrConfigPending
+		}
+	}
+	if t, _ := n.log.term(n.commit); t != n.term {
+		return nil, ErrConfigPending
+	}
+	return n.propose(Entry{Type: EntryConfig, Data: encodeMembership(ms)})
+}
+
+// Add a member to the cluster.  It should be started with no members,
+// and catches up from the leader once the change is appended.
+func (n *Node) AddMember(m Member) (<-chan Result, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.members.find(m.ID); ok {
+		return nil, ErrMemberExists
+	}
+	return n.changeMembers(append(append(Membership{}, n.members...), m))
+}
+
+// Remove a member from the cluster, which may be the leader itself
+func (n *Node) RemoveMember(id string) (<-chan Result, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.members.find(id); !ok {
+		return nil, ErrNoMember
+	}
+	return n.changeMembers(n.members.without(id))
+}
+
+// The leader as far as this node knows, false if it knows of none
+func (n *Node) Leader() (Member, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.leader == "" {
+		return Member{}, false
+	}
+	if m, ok := n.members.find(n.leader); ok {
+		return m, true
+	}
+	m, ok := n.known[n.leader]
+	return m, ok
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+type Progress struct {
+	Match uint64 `json:"match"`
+	Next  uint64 `json:"next"`
+}
+
+type Status struct {
+	ID            string              `json:"id"`
+	State         string              `json:"state"`
+	Term          uint64              `json:"term"`
+	Leader        string              `json:"leader,omitempty"`
+	Commit        uint64              `json:"commit"`
+	Applied       uint64              `json:"applied"`
+	LastIndex     uint64              `json:"last_index"`
+	SnapshotIndex uint64              `json:"snapshot_index"`
+	Members       Membership          `json:"members"`
+	Progress      map[string]Progress `json:"progress,omitempty"`
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	st := Status{
+		ID:            n.id,
+		State:         n.state.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		Commit:        n.commit,
+		Applied:       n.applied,
+		LastIndex:     n.log.lastIndex(),
+		SnapshotIndex: n.log.snapIndex,
+		Members:       append(Membership{}, n.members...),
+	}
+	if n.stopped {
+		st.State = "stopped"
+	}
+	if n.state == StateLeader {
+		st.Progress = map[string]Progress{}
+		for id, pr := range n.progress {
+			st.Progress[id] = Progress{pr.match, pr.next}
+		}
+	}
+	return st
+}
@@ -0,0 +1,586 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records the commands applied to it
+type testMachine struct {
+	applied []string
+}
+
+func (m *testMachine) Apply(data []byte) interface{} {
+	m.applied = append(m.applied, string(data))
+	return len(m.applied)
+}
+
+func (m *testMachine) Snapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m.applied)
+}
+
+func (m *testMachine) Restore(data []byte) error {
+	m.applied = nil
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &m.applied)
+}
+
+// Nodes on a Network, each with its own storage and state machine that
+// outlive the node so it can be restarted
+type testCluster struct {
+	t        *testing.T
+	nw       *Network
+	config   Config
+	nodes    map[string]*Node
+	storage  map[string]*MemoryStorage
+	machines map[string]*testMachine
+}
+
+func testMembers(ids ...string) Membership {
+	ms := Membership{}
+	for _, id := range ids {
+		ms = append(ms, Member{ID: id, Addr: id + ":1", APIAddr: id + ":2"})
+	}
+	return ms
+}
+
+func newTestCluster(t *testing.T, seed int64, config Config, ids ...string) *testCluster {
+	c := &testCluster{
+		t:        t,
+		nw:       NewNetwork(seed),
+		config:   config,
+		nodes:    map[string]*Node{},
+		storage:  map[string]*MemoryStorage{},
+		machines: map[string]*testMachine{},
+	}
+	for _, id := range ids {
+		c.start(id, testMembers(ids...))
+	}
+	return c
+}
+
+// Start, or restart, the node with id
+func (c *testCluster) start(id string, members Membership) *Node {
+	if c.storage[id] == nil {
+		c.storage[id] = NewMemoryStorage()
+	}
+	config := c.config
+	config.ID, config.Members = id, members
+	config.Storage, config.Transport = c.storage[id], c.nw
+	c.machines[id] = &testMachine{}
+	config.Machine = c.machines[id]
+	n, err := NewNode(config)
+	if err != nil {
+		c.t.Errorf("NewNode(%s) failed: %v", id, err)
+		c.t.FailNow()
+	}
+	c.nodes[id] = n
+	c.nw.Attach(n)
+	return n
+}
+
+func (c *testCluster) crash(id string) {
+	c.nw.Detach(id)
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) tick(n int) {
+	for i := 0; i < n; i++ {
+		c.nw.Tick()
+	}
+}
+
+// The leader with the highest term among nodes in ids, or any node
+func (c *testCluster) leader(ids ...string) *Node {
+	var leader *Node
+	var term uint64
+	for id, n := range c.nodes {
+		if len(ids) > 0 && !contains(ids, id) {
+			continue
+		}
+		if st := n.Status(); st.State == "leader" && st.Term >= term {
+			leader, term = n, st.Term
+		}
+	}
+	return leader
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *testCluster) waitLeader(ids ...string) *Node {
+	for i := 0; i < 500; i++ {
+		if leader := c.leader(ids...); leader != nil {
+			return leader
+		}
+		c.nw.Tick()
+	}
+	c.t.Errorf("no leader elected")
+	c.t.FailNow()
+	return nil
+}
+
+// Commit data through whichever node is leader, retrying if a change of
+// leader loses it
+func (c *testCluster) commit(data string) {
+	for attempt := 0; attempt < 20; attempt++ {
+		ch, err := c.waitLeader().Propose([]byte(data))
+		if err != nil {
+			continue
+		}
+		for i := 0; i < 200; i++ {
+			select {
+			case r := <-ch:
+				if r.Err == nil {
+					return
+				}
+				i = 200
+			default:
+				c.nw.Tick()
+			}
+		}
+	}
+	c.t.Errorf("could not commit %s", data)
+	c.t.FailNow()
+}
+
+// Tick until every running node has applied the same commands
+func (c *testCluster) converge(expect []string) {
+	for i := 0; i < 500; i++ {
+		same := true
+		for id := range c.nodes {
+			if !reflect.DeepEqual(c.machines[id].applied, expect) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		c.nw.Tick()
+	}
+	for id := range c.nodes {
+		c.t.Errorf("%s applied %v, expected %v", id, c.machines[id].applied, expect)
+	}
+	c.t.FailNow()
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 1, Config{}, "a", "b", "c")
+	leader := c.waitLeader()
+	c.tick(20)
+	if c.leader() != leader {
+		t.Errorf("leader changed without failures")
+	}
+	term := leader.Status().Term
+	for id, n := range c.nodes {
+		st := n.Status()
+		if st.Term != term || st.Leader != leader.ID() {
+			t.Errorf("%s: %+v, leader %s in term %d", id, st, leader.ID(), term)
+		}
+		if n != leader && st.State != "follower" {
+			t.Errorf("%s is %s", id, st.State)
+		}
+	}
+	if m, ok := c.nodes["a"].Leader(); !ok || m.ID != leader.ID() || m.APIAddr != leader.ID()+":2" {
+		t.Errorf("Leader() = %v %v", m, ok)
+	}
+
+	// Only the leader takes proposals
+	for _, n := range c.nodes {
+		if _, err := n.Propose([]byte("x")); n != leader && err != ErrNotLeader {
+			t.Errorf("Propose on a follower: %v", err)
+		}
+	}
+
+	// A single node elects itself
+	single := newTestCluster(t, 1, Config{}, "solo")
+	if single.waitLeader().ID() != "solo" {
+		t.Errorf("single node not leader")
+	}
+	single.commit("x")
+	single.converge([]string{"x"})
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 2, Config{MaxAppendEntries: 3}, "a", "b", "c")
+	expect := []string{}
+	for i := 0; i < 10; i++ {
+		expect = append(expect, fmt.Sprint(i))
+		c.commit(expect[i])
+	}
+	c.converge(expect)
+
+	// A proposal's result is what the state machine returned
+	ch, _ := c.waitLeader().Propose([]byte("last"))
+	c.tick(2)
+	if r := <-ch; r.Err != nil || r.Value != 11 {
+		t.Errorf("result %v", r)
+	}
+
+	// A follower that missed entries catches up
+	follower := "a"
+	if c.leader().ID() == "a" {
+		follower = "b"
+	}
+	c.crash(follower)
+	c.commit("while down")
+	c.start(follower, nil)
+	c.converge(append(expect, "last", "while down"))
+}
+
+func TestPartition(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	c := newTestCluster(t, 3, Config{}, ids...)
+	c.commit("before")
+	old := c.waitLeader()
+
+	// The old leader and one follower in the minority
+	minority := []string{old.ID()}
+	majority := []string{}
+	for _, id := range ids {
+		if id != old.ID() && len(minority) < 2 {
+			minority = append(minority, id)
+		} else if id != old.ID() {
+			majority = append(majority, id)
+		}
+	}
+	c.nw.Partition(minority, majority)
+	lost, err := old.Propose([]byte("lost"))
+	if err != nil {
+		t.Errorf("Propose on the old leader: %v", err)
+	}
+
+	leader := c.waitLeader(majority...)
+	if leader == old {
+		t.Errorf("old leader kept leading")
+	}
+	c.commit("after")
+	c.tick(30)
+	if st := old.Status(); st.State == "leader" {
+		t.Errorf("old leader did not step down: %+v", st)
+	}
+	select {
+	case r := <-lost:
+		t.Errorf("proposal in the minority returned %v", r)
+	default:
+	}
+
+	// Once healed the minority takes the majority's log
+	c.nw.Heal()
+	c.converge([]string{"before", "after"})
+	if r := <-lost; r.Err != ErrProposalDropped {
+		t.Errorf("lost proposal returned %v", r)
+	}
+}
+
+func TestMessageDrops(t *testing.T) {
+	c := newTestCluster(t, 4, Config{}, "a", "b", "c")
+	c.nw.SetDropRate(0.3)
+	for i := 0; i < 20; i++ {
+		c.commit(fmt.Sprint(i))
+	}
+	c.nw.SetDropRate(0)
+	c.tick(50)
+
+	// Retried proposals may be applied twice, but everywhere alike
+	var expect []string
+	for _, m := range c.machines {
+		expect = m.applied
+	}
+	for i := 0; i < 20; i++ {
+		if !contains(expect, fmt.Sprint(i)) {
+			t.Errorf("%d not applied: %v", i, expect)
+		}
+	}
+	c.converge(expect)
+}
+
+// The same seed gives the same run
+func TestDeterministic(t *testing.T) {
+	run := func() []Status {
+		c := newTestCluster(t, 5, Config{}, "a", "b", "c")
+		c.nw.SetDropRate(0.2)
+		statuses := []Status{}
+		for i := 0; i < 5; i++ {
+			c.commit(fmt.Sprint(i))
+			c.nw.Partition([]string{"a", "b"}, []string{"c"})
+			c.tick(15)
+			c.nw.Heal()
+			for _, id := range []string{"a", "b", "c"} {
+				statuses = append(statuses, c.nodes[id].Status())
+			}
+		}
+		return statuses
+	}
+	if first, second := run(), run(); !reflect.DeepEqual(first, second) {
+		t.Errorf("runs differ:\n%v\n%v", first, second)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCluster(t, 6, Config{SnapshotEntries: 5}, "a", "b", "c")
+	c.commit("0")
+	follower := "a"
+	if c.leader().ID() == "a" {
+		follower = "b"
+	}
+	c.crash(follower)
+
+	expect := []string{"0"}
+	for i := 1; i < 20; i++ {
+		expect = append(expect, fmt.Sprint(i))
+		c.commit(expect[i])
+	}
+	leader := c.leader()
+	if st := leader.Status(); st.SnapshotIndex < 15 {
+		t.Errorf("leader did not compact its log: %+v", st)
+	}
+
+	// The follower is sent the snapshot, then the entries after it
+	c.start(follower, nil)
+	c.converge(expect)
+	if st := c.nodes[follower].Status(); st.SnapshotIndex == 0 || st.Applied != leader.Status().Applied {
+		t.Errorf("follower after snapshot %+v", st)
+	}
+
+	// Restarting from the snapshot and log replays the rest
+	for _, id := range []string{"a", "b", "c"} {
+		c.crash(id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.start(id, nil)
+	}
+	c.commit("after restart")
+	c.converge(append(expect, "after restart"))
+}
+
+func TestMembership(t *testing.T) {
+	c := newTestCluster(t, 7, Config{SnapshotEntries: 4}, "a", "b", "c")
+	for i := 0; i < 6; i++ {
+		c.commit(fmt.Sprint(i))
+	}
+
+	// A new node starts with no members and waits to be added
+	c.start("d", nil)
+	c.tick(50)
+	if st := c.nodes["d"].Status(); st.State != "follower" || st.Term != 0 {
+		t.Errorf("new node before being added %+v", st)
+	}
+	leader := c.waitLeader()
+	ch, err := leader.AddMember(testMembers("d")[0])
+	if err != nil {
+		t.Errorf("AddMember failed: %v", err)
+		t.FailNow()
+	}
+	if _, err := leader.AddMember(testMembers("e")[0]); err != ErrConfigPending {
+		t.Errorf("second change while the first is pending: %v", err)
+	}
+	if _, err := leader.AddMember(testMembers("d")[0]); err != ErrMemberExists {
+		t.Errorf("adding an existing member: %v", err)
+	}
+	c.tick(5)
+	if r := <-ch; r.Err != nil {
+		t.Errorf("adding d: %v", r.Err)
+	}
+	c.commit("with d")
+	expect := []string{"0", "1", "2", "3", "4", "5", "with d"}
+	c.converge(expect)
+	if st := c.nodes["d"].Status(); len(st.Members) != 4 {
+		t.Errorf("d's members %v", st.Members)
+	}
+
+	// Removing the leader hands over to the rest
+	if _, err := leader.RemoveMember("x"); err != ErrNoMember {
+		t.Errorf("removing a non-member: %v", err)
+	}
+	ch, _ = leader.RemoveMember(leader.ID())
+	c.tick(5)
+	if r := <-ch; r.Err != nil {
+		t.Errorf("removing the leader: %v", r.Err)
+	}
+	c.tick(50)
+	next := c.leader()
+	if next == nil || next == leader {
+		t.Errorf("leader after removing %s: %v", leader.ID(), next)
+		t.FailNow()
+	}
+	c.commit("without " + leader.ID())
+	expect = append(expect, "without "+leader.ID())
+
+	// The removed node stays quiet and no longer hears of new entries
+	term := next.Status().Term
+	c.tick(100)
+	if c.leader() != next || next.Status().Term != term {
+		t.Errorf("removed node disrupted the cluster")
+	}
+	removed := leader.ID()
+	c.crash(removed)
+	c.converge(expect)
+}
+
+func TestParseMembers(t *testing.T) {
+	ms, err := ParseMembers("a=h1:1/h1:2,b=h2:1")
+	if err != nil || !reflect.DeepEqual(ms, Membership{{"a", "h1:1", "h1:2"}, {"b", "h2:1", ""}}) {
+		t.Errorf("ParseMembers = %v, %v", ms, err)
+	}
+	for _, bad := range []string{"a", "=x", "a=", "a=x,a=y"} {
+		if _, err := ParseMembers(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+	s, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Errorf("OpenFileStorage failed: %v", err)
+		t.FailNow()
+	}
+	s.SaveHardState(HardState{Term: 3, Vote: "b"})
+	s.Append([]Entry{{1, 1, EntryNormal, []byte("a")}, {2, 1, EntryNormal, []byte("b")}, {3, 1, EntryNoop, nil}})
+	// Replaces 3 on
+	s.Append([]Entry{{3, 2, EntryNormal, []byte("c")}, {4, 2, EntryNormal, []byte("d")}})
+	s.Close()
+
+	reopen := func() (HardState, *Snapshot, []Entry) {
+		s, err = OpenFileStorage(dir)
+		if err != nil {
+			t.Errorf("reopening failed: %v", err)
+			t.FailNow()
+		}
+		state, snapshot, entries, _ := s.Load()
+		return state, snapshot, entries
+	}
+	state, snapshot, entries := reopen()
+	if state != (HardState{3, "b"}) || snapshot != nil || len(entries) != 4 || string(entries[3].Data) != "d" {
+		t.Errorf("reopened %v %v %v", state, snapshot, entries)
+	}
+
+	s.SaveSnapshot(&Snapshot{Index: 2, Term: 1, Members: testMembers("a"), Data: []byte("state")})
+	s.Close()
+	// A torn last line is dropped
+	f, _ := os.OpenFile(dir+"/"+logFile, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"index":5,"te`)
+	f.Close()
+	_, snapshot, entries = reopen()
+	if snapshot == nil || string(snapshot.Data) != "state" || len(entries) != 2 || entries[0].Index != 3 {
+		t.Errorf("after snapshot %v %v", snapshot, entries)
+	}
+	s.Append([]Entry{{5, 2, EntryNormal, []byte("e")}})
+	s.Close()
+	if _, _, entries = reopen(); len(entries) != 3 || entries[2].Index != 5 {
+		t.Errorf("appending after a torn line: %v", entries)
+	}
+
+	// A snapshot from a different history drops the whole log
+	s.SaveSnapshot(&Snapshot{Index: 4, Term: 3, Data: []byte("other")})
+	s.Close()
+	if _, _, entries = reopen(); len(entries) != 0 {
+		t.Errorf("entries kept after a conflicting snapshot: %v", entries)
+	}
+	s.Close()
+	if blob, _ := os.ReadFile(dir + "/" + stateFile); !strings.Contains(string(blob), `"vote":"b"`) {
+		t.Errorf("state file %s", blob)
+	}
+}
+
+// Storage whose SaveHardState fails once fail is set
+type failingStorage struct {
+	*MemoryStorage
+	fail bool
+}
+
+func (s *failingStorage) SaveHardState(state HardState) error {
+	if s.fail {
+		return errors.New("disk gone")
+	}
+	return s.MemoryStorage.SaveHardState(state)
+}
+
+// Transport keeping every message sent
+type recordingTransport struct {
+	lock sync.Mutex
+	sent []Message
+}
+
+func (rt *recordingTransport) Send(to Member, m Message) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.sent = append(rt.sent, m)
+}
+
+func (rt *recordingTransport) take() []Message {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	sent := rt.sent
+	rt.sent = nil
+	return sent
+}
+
+// A vote that could not be saved is neither granted nor asked for
+func TestVoteNotSavedNotSent(t *testing.T) {
+	newNode := func() (*Node, *failingStorage, *recordingTransport) {
+		storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+		transport := &recordingTransport{}
+		n, err := NewNode(Config{ID: "a", Members: testMembers("a", "b", "c"),
+			Storage: storage, Transport: transport, Machine: &testMachine{}})
+		if err != nil {
+			t.Errorf("NewNode failed: %v", err)
+			t.FailNow()
+		}
+		return n, storage, transport
+	}
+
+	// Once in the candidate's term, so only the vote itself is saved
+	n, storage, transport := newNode()
+	n.Step(Message{Type: MsgVoteResp, From: "c", To: "a", Term: 5, Reject: true})
+	storage.fail = true
+	n.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 5, LogIndex: 10, LogTerm: 5})
+	if sent := transport.take(); len(sent) != 0 {
+		t.Errorf("sent %+v without saving the vote", sent)
+	}
+
+	// A vote in a newer term is not granted when the term is not saved
+	n, storage, transport = newNode()
+	storage.fail = true
+	n.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 5, LogIndex: 10, LogTerm: 5})
+	if sent := transport.take(); len(sent) != 0 {
+		t.Errorf("sent %+v without saving the term", sent)
+	}
+
+	n, storage, transport = newNode()
+	for i := 0; i < 100 && len(transport.sent) == 0; i++ {
+		n.Tick()
+	}
+	if sent := transport.take(); len(sent) == 0 || sent[0].Type != MsgPreVote {
+		t.Errorf("no pre-vote sent %+v", sent)
+		t.FailNow()
+	}
+	storage.fail = true
+	n.Step(Message{Type: MsgPreVoteResp, From: "b", To: "a", Term: 1})
+	if sent := transport.take(); len(sent) != 0 {
+		t.Errorf("sent %+v without saving the vote", sent)
+	}
+	if _, err := n.Propose([]byte("x")); err == nil {
+		t.Errorf("node still running after a storage failure")
+	}
+}
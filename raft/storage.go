@@ -0,0 +1,309 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// What a member must remember across restarts besides its log
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Where a node keeps its state.  Every call must have made the state
+// durable by the time it returns, since the node acts on it at once.
+type Storage interface {
+	// What was saved before a restart, nothing for a new node
+	Load() (HardState, *Snapshot, []Entry, error)
+	SaveHardState(state HardState) error
+	// Save entries, replacing any saved from entries[0].Index on
+	Append(entries []Entry) error
+	// Save s, dropping the entries it covers.  Entries after it are kept
+	// only if the entry at s.Index has s.Term, otherwise the log differs
+	// from the one the snapshot was taken from and all of it is dropped.
+	SaveSnapshot(s *Snapshot) error
+}
+
+// Drop the entries s covers, or all of them if they do not lead up to it
+func trimEntries(entries []Entry, s *Snapshot) []Entry {
+	for i, e := range entries {
+		if e.Index == s.Index {
+			if e.Term == s.Term {
+				return append([]Entry{}, entries[i+1:]...)
+			}
+			break
+		}
+	}
+	if len(entries) > 0 && entries[0].Index > s.Index {
+		return entries
+	}
+	return nil
+}
+
+// Replace the entries from es[0].Index on with es
+func appendEntries(entries, es []Entry) []Entry {
+	if len(es) == 0 {
+		return entries
+	}
+	for i, e := range entries {
+		if e.Index >= es[0].Index {
+			entries = entries[:i]
+			break
+		}
+	}
+	return append(entries, es...)
+}
+
+// Keeps state in memory, so survives a node being stopped and a new one
+// started on it but not the process exiting
+type MemoryStorage struct {
+	lock     sync.Mutex
+	state    HardState
+	snapshot *Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state, s.snapshot, append([]Entry{}, s.entries...), nil
+}
+
+func (s *MemoryStorage) SaveHardState(state HardState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = appendEntries(s.entries, entries)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snapshot *Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshot = snapshot
+	s.entries = trimEntries(s.entries, snapshot)
+	return nil
+}
+
+// Keeps state in a directory: the hard state and latest snapshot as JSON
+// files replaced by atomic renames, and the log as JSON lines, one entry
+// to a line, appended to and rewritten whenever entries are replaced or
+// dropped.  A line cut short by a crash is discarded on opening.
+type FileStorage struct {
+	dir string
+
+	lock sync.Mutex
+	mem  MemoryStorage
+	log  *os.File
+}
+
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+)
+
+// Open the storage in dir, creating it if need be
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStorage{dir: dir}
+	if err := readJSON(filepath.Join(dir, stateFile), &s.mem.state); err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := readJSON(filepath.Join(dir, snapshotFile), &snapshot); err != nil {
+		return nil, err
+	} else if snapshot.Index > 0 {
+		s.mem.snapshot = &snapshot
+	}
+
+	torn, err := s.readLog()
+	if err != nil {
+		return nil, err
+	}
+	if s.mem.snapshot != nil {
+		s.mem.entries = trimEntries(s.mem.entries, s.mem.snapshot)
+		torn = true
+	}
+	if torn {
+		err = s.rewriteLog()
+	} else {
+		s.log, err = os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read a JSON file into v, leaving v alone if there is no file
+func readJSON(path string, v interface{}) error {
+	blob, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, v)
+}
+
+// Read the log into memory, returning whether it ended in a torn line
+func (s *FileStorage) readLog() (bool, error) {
+	f, err := os.Open(filepath.Join(s.dir, logFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return false, nil
+		}
+		var e Entry
+		if err != nil || json.Unmarshal(line, &e) != nil {
+			return true, nil
+		}
+		s.mem.entries = appendEntries(s.mem.entries, []Entry{e})
+	}
+}
+
+// Write path by way of a temporary file and a rename, so it is either
+// the old or the new contents after a crash
+func writeAtomic(path string, write func(w *bufio.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func writeJSON(path string, v interface{}) error {
+	return writeAtomic(path, func(w *bufio.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+func writeEntries(w *bufio.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) rewriteLog() error {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	path := filepath.Join(s.dir, logFile)
+	err := writeAtomic(path, func(w *bufio.Writer) error {
+		return writeEntries(w, s.mem.entries)
+	})
+	if err != nil {
+		return err
+	}
+	s.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (s *FileStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	return s.mem.Load()
+}
+
+func (s *FileStorage) SaveHardState(state HardState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := writeJSON(filepath.Join(s.dir, stateFile), state); err != nil {
+		return err
+	}
+	return s.mem.SaveHardState(state)
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	last := len(s.mem.entries) == 0 || s.mem.entries[len(s.mem.entries)-1].Index < entries[0].Index
+	s.mem.Append(entries)
+	if !last {
+		return s.rewriteLog()
+	}
+
+	w := bufio.NewWriter(s.log)
+	if err := writeEntries(w, entries); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+func (s *FileStorage) SaveSnapshot(snapshot *Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := writeJSON(filepath.Join(s.dir, snapshotFile), snapshot); err != nil {
+		return err
+	}
+	s.mem.SaveSnapshot(snapshot)
+	return s.rewriteLog()
+}
+
+func (s *FileStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
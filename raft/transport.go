@@ -0,0 +1,166 @@
+package raft
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Messages queued for a peer beyond this are dropped, Raft resends
+	peerQueueLen = 256
+	dialTimeout  = time.Second
+	writeTimeout = 5 * time.Second
+)
+
+// Carries messages over TCP, gob encoded, with a connection to each peer
+// opened when first needed and reopened after a failure
+type TCPTransport struct {
+	lock     sync.Mutex
+	peers    map[string]*peer
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// Messages waiting to go to one address
+type peer struct {
+	addr  string
+	queue chan Message
+	done  chan struct{}
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{peers: map[string]*peer{}, conns: map[net.Conn]bool{}}
+}
+
+func (t *TCPTransport) Send(to Member, m Message) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	p := t.peers[to.Addr]
+	if p == nil {
+		p = &peer{addr: to.Addr, queue: make(chan Message, peerQueueLen), done: make(chan struct{})}
+		t.peers[to.Addr] = p
+		go p.run()
+	}
+	t.lock.Unlock()
+
+	select {
+	case p.queue <- m:
+	default:
+	}
+}
+
+func (p *peer) run() {
+	var conn net.Conn
+	var enc *gob.Encoder
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var m Message
+		select {
+		case <-p.done:
+			return
+		case m = <-p.queue:
+		}
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", p.addr, dialTimeout)
+			if err != nil {
+				// Drop what queued up while the peer was unreachable
+				time.Sleep(dialTimeout / 10)
+				continue
+			}
+			conn, enc = c, gob.NewEncoder(c)
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := enc.Encode(&m); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// Accept connections on l, passing the messages that arrive to n, until
+// Close is called
+func (t *TCPTransport) Serve(l net.Listener, n *Node) error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	t.listener = l
+	t.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			t.lock.Lock()
+			closed := t.closed
+			t.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		t.conns[conn] = true
+		t.lock.Unlock()
+		go t.receive(conn, n)
+	}
+}
+
+func (t *TCPTransport) receive(conn net.Conn, n *Node) {
+	defer func() {
+		t.lock.Lock()
+		delete(t.conns, conn)
+		t.lock.Unlock()
+		conn.Close()
+	}()
+	dec := gob.NewDecoder(conn)
+	for {
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println("Raft receive failed ", err)
+			}
+			return
+		}
+		n.Step(m)
+	}
+}
+
+// Stop listening and close every connection
+func (t *TCPTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	for _, p := range t.peers {
+		close(p.done)
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
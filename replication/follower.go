@@ -0,0 +1,182 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+const (
+	defaultRetry = time.Second
+	// A leader not heard from for this long is taken to be gone
+	defaultTimeout = 5 * defaultHeartbeat
+)
+
+// Keeps a database a copy of the leader's by applying what it ships.  The
+// database is made read-only, so serves reads only.
+type Follower struct {
+	db     *kvdb.Db
+	leader string
+
+	// How long to wait before reconnecting, and for the leader to send
+	// something before giving up on it
+	retry   time.Duration
+	timeout time.Duration
+
+	lock           sync.Mutex
+	conn           net.Conn
+	connected      bool
+	leaderSequence uint64
+	lastContact    time.Time
+	err            error
+	closed         bool
+	done           chan struct{}
+	wg             sync.WaitGroup
+}
+
+func InitFollower(db *kvdb.Db, leader string) *Follower {
+	db.SetReadOnly(true)
+	return &Follower{
+		db:      db,
+		leader:  leader,
+		retry:   defaultRetry,
+		timeout: defaultTimeout,
+		done:    make(chan struct{}),
+	}
+}
+
+// Start following the leader, reconnecting whenever the connection is
+// lost, until Close is called
+func (f *Follower) Start() {
+	f.wg.Add(1)
+	go f.run()
+}
+
+// Disconnect from the leader.  The database stays read-only.
+func (f *Follower) Close() error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.lock.Unlock()
+	f.wg.Wait()
+	return nil
+}
+
+// The follower's sequence and how far behind the leader it is
+func (f *Follower) Status() Status {
+	sequence := f.db.LastSequence()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	st := Status{
+		Role:           RoleFollower,
+		Sequence:       sequence,
+		Leader:         f.leader,
+		Connected:      f.connected,
+		LeaderSequence: f.leaderSequence,
+	}
+	if f.leaderSequence > sequence {
+		st.Lag = f.leaderSequence - sequence
+	}
+	if !f.lastContact.IsZero() {
+		contact := f.lastContact.UTC()
+		st.LastContact = &contact
+	}
+	if f.err != nil {
+		st.Error = f.err.Error()
+	}
+	return st
+}
+
+func (f *Follower) run() {
+	defer f.wg.Done()
+	for {
+		err := f.follow()
+		f.lock.Lock()
+		f.conn, f.connected = nil, false
+		if f.closed {
+			f.lock.Unlock()
+			return
+		}
+		f.err = err
+		f.lock.Unlock()
+		fmt.Println("Replication from ", f.leader, " failed ", err)
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.retry):
+		}
+	}
+}
+
+// Connect to the leader and apply what it ships until the connection is
+// lost
+func (f *Follower) follow() error {
+	nc, err := net.DialTimeout("tcp", f.leader, f.timeout)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return nil
+	}
+	f.conn = nc
+	f.lock.Unlock()
+
+	r, w := bufio.NewReader(nc), bufio.NewWriter(nc)
+	writeUvarint(w, protocolVersion)
+	writeUvarint(w, f.db.LastSequence()+1)
+	nc.SetWriteDeadline(time.Now().Add(f.timeout))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		nc.SetReadDeadline(time.Now().Add(f.timeout))
+		fr, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		leaderSequence := fr.sequence
+		switch fr.kind {
+		case frameRecords:
+			err = f.db.ApplyLog(fr.records)
+		case frameSnapshot:
+			fmt.Println("Restoring snapshot at ", fr.sequence, " from ", f.leader)
+			err = f.db.RestoreSnapshotTable(bytes.NewReader(fr.snapshot), fr.sequence)
+		case frameError:
+			return leaderError(fr.message)
+		}
+		if err != nil {
+			return err
+		}
+
+		f.lock.Lock()
+		f.connected, f.err = true, nil
+		f.leaderSequence = leaderSequence
+		f.lastContact = time.Now()
+		f.lock.Unlock()
+
+		if fr.kind != frameHeartbeat {
+			writeUvarint(w, f.db.LastSequence())
+			nc.SetWriteDeadline(time.Now().Add(f.timeout))
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
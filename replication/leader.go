@@ -0,0 +1,247 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+const (
+	// How long the leader waits on a follower, to hear which sequence
+	// it wants or to take a frame, before dropping it
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 30 * time.Second
+
+	defaultHeartbeat = time.Second
+)
+
+// Ships a database's log to followers that connect to it, see protocol.go
+type Leader struct {
+	db *kvdb.Db
+
+	// How often a follower with nothing to ship hears from the leader
+	heartbeat time.Duration
+
+	lock      sync.Mutex
+	listener  net.Listener
+	followers map[net.Conn]*followerConn
+	closed    bool
+	done      chan struct{}
+}
+
+// A connected follower
+type followerConn struct {
+	addr      string
+	since     time.Time
+	sequence  uint64
+	snapshots int
+}
+
+func InitLeader(db *kvdb.Db) *Leader {
+	return &Leader{
+		db:        db,
+		heartbeat: defaultHeartbeat,
+		followers: map[net.Conn]*followerConn{},
+		done:      make(chan struct{}),
+	}
+}
+
+// Start the leader on addr, runs until Close is called
+func (l *Leader) StartServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// Accept followers on ln until Close is called
+func (l *Leader) Serve(ln net.Listener) error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	l.listener = ln
+	l.lock.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			l.lock.Lock()
+			closed := l.closed
+			l.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		l.lock.Lock()
+		if l.closed {
+			l.lock.Unlock()
+			nc.Close()
+			return nil
+		}
+		fc := &followerConn{addr: nc.RemoteAddr().String(), since: time.Now()}
+		l.followers[nc] = fc
+		l.lock.Unlock()
+		go l.serveFollower(nc, fc)
+	}
+}
+
+// Stop accepting followers and disconnect those connected
+func (l *Leader) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	for nc := range l.followers {
+		nc.Close()
+	}
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+	return nil
+}
+
+// The leader's sequence and the position of each follower
+func (l *Leader) Status() Status {
+	sequence := l.db.LastSequence()
+	st := Status{Role: RoleLeader, Sequence: sequence, Followers: []FollowerStatus{}}
+	l.lock.Lock()
+	for _, fc := range l.followers {
+		fs := FollowerStatus{Addr: fc.addr, Sequence: fc.sequence, ConnectedAt: fc.since.UTC(), Snapshots: fc.snapshots}
+		if sequence > fc.sequence {
+			fs.Lag = sequence - fc.sequence
+		}
+		st.Followers = append(st.Followers, fs)
+	}
+	l.lock.Unlock()
+	sort.Slice(st.Followers, func(i, j int) bool { return st.Followers[i].Addr < st.Followers[j].Addr })
+	return st
+}
+
+func (l *Leader) serveFollower(nc net.Conn, fc *followerConn) {
+	defer func() {
+		l.lock.Lock()
+		delete(l.followers, nc)
+		l.lock.Unlock()
+		nc.Close()
+	}()
+
+	r, w := bufio.NewReader(nc), bufio.NewWriter(nc)
+	nc.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	from, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if version != protocolVersion {
+		nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		writeErrorFrame(w, fmt.Sprintf("unsupported protocol version %d", version))
+		return
+	}
+	nc.SetReadDeadline(time.Time{})
+	if from == 0 {
+		from = 1
+	}
+	l.lock.Lock()
+	fc.sequence = from - 1
+	l.lock.Unlock()
+
+	// The follower's acknowledgements arrive while records are sent
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			sequence, err := binary.ReadUvarint(r)
+			if err != nil {
+				return
+			}
+			l.lock.Lock()
+			fc.sequence = sequence
+			l.lock.Unlock()
+		}
+	}()
+
+	if err := l.ship(nc, w, fc, from, gone); err != nil &&
+		err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("Replication to ", fc.addr, " failed ", err)
+	}
+}
+
+// Send the follower everything from sequence from on, until it goes away
+func (l *Leader) ship(nc net.Conn, w *bufio.Writer, fc *followerConn, from uint64, gone chan struct{}) error {
+	heartbeat := time.NewTicker(l.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		records, next, err := l.db.ReadLog(from, 0)
+		if err == kvdb.ErrLogTruncated {
+			from, err = l.sendSnapshot(nc, w, fc)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			writeErrorFrame(w, err.Error())
+			return err
+		}
+
+		nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if len(records) > 0 {
+			from = next
+			if err := writeRecords(w, l.db.LastSequence(), records); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-l.done:
+			return nil
+		case <-gone:
+			return nil
+		case <-l.db.WaitLog(from - 1):
+		case <-heartbeat.C:
+			if err := writeHeartbeat(w, l.db.LastSequence()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send a snapshot to a follower the log no longer reaches back to,
+// returning the sequence to ship from after it
+func (l *Leader) sendSnapshot(nc net.Conn, w *bufio.Writer, fc *followerConn) (uint64, error) {
+	var table bytes.Buffer
+	sequence, err := l.db.WriteSnapshotTable(&table)
+	if err != nil {
+		nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		writeErrorFrame(w, err.Error())
+		return 0, err
+	}
+	fmt.Println("Sending snapshot at ", sequence, " to ", fc.addr)
+	l.lock.Lock()
+	fc.snapshots++
+	l.lock.Unlock()
+	nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return sequence + 1, writeSnapshot(w, sequence, table.Bytes())
+}
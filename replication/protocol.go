@@ -0,0 +1,174 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// The replication protocol.  A follower connects to the leader and sends
+//
+//   <version> <from>
+//
+// as uvarints, from being the sequence after the last one it applied.
+// The leader then sends frames, each a type byte followed by
+//
+//   'R' <leader sequence> <count> then for each record <sequence> <length> <bytes>
+//   'S' <sequence> <length> <table>
+//   'H' <leader sequence>
+//   'E' <length> <message>
+//
+// with every number a uvarint.  R carries log records, S a snapshot table
+// to replace everything the follower has, H is sent while there is
+// nothing to ship so the follower knows the leader is there, and E ends
+// the stream.  The follower sends the sequence it has applied, as a
+// uvarint, after each R or S, which the leader reports as its position.
+
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+const protocolVersion = 1
+
+const (
+	frameRecords   = 'R'
+	frameSnapshot  = 'S'
+	frameHeartbeat = 'H'
+	frameError     = 'E'
+)
+
+// Limits on what the leader may send, a snapshot holds every key so is
+// allowed to be much larger than a record
+const (
+	maxRecordLen   = 64 << 20
+	maxSnapshotLen = 1 << 34
+	maxErrorLen    = 4 << 10
+)
+
+var errProtocol = errors.New("replication: malformed frame")
+
+// An error the leader sent in an E frame
+type leaderError string
+
+func (e leaderError) Error() string {
+	return "replication: leader: " + string(e)
+}
+
+// A decoded frame, only the fields its kind uses are set
+type frame struct {
+	kind     byte
+	sequence uint64
+	records  []kvdb.LogRecord
+	snapshot []byte
+	message  string
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeBytes(w *bufio.Writer, b []byte) {
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func writeRecords(w *bufio.Writer, leaderSequence uint64, records []kvdb.LogRecord) error {
+	w.WriteByte(frameRecords)
+	writeUvarint(w, leaderSequence)
+	writeUvarint(w, uint64(len(records)))
+	for _, r := range records {
+		writeUvarint(w, r.Sequence)
+		writeBytes(w, r.Data)
+	}
+	return w.Flush()
+}
+
+func writeSnapshot(w *bufio.Writer, sequence uint64, table []byte) error {
+	w.WriteByte(frameSnapshot)
+	writeUvarint(w, sequence)
+	writeBytes(w, table)
+	return w.Flush()
+}
+
+func writeHeartbeat(w *bufio.Writer, leaderSequence uint64) error {
+	w.WriteByte(frameHeartbeat)
+	writeUvarint(w, leaderSequence)
+	return w.Flush()
+}
+
+func writeErrorFrame(w *bufio.Writer, msg string) error {
+	if len(msg) > maxErrorLen {
+		msg = msg[:maxErrorLen]
+	}
+	w.WriteByte(frameError)
+	writeBytes(w, []byte(msg))
+	return w.Flush()
+}
+
+func readBytes(r *bufio.Reader, max uint64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, errProtocol
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{kind: kind}
+	switch kind {
+	case frameRecords:
+		if f.sequence, err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			sequence, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			data, err := readBytes(r, maxRecordLen)
+			if err != nil {
+				return nil, err
+			}
+			f.records = append(f.records, kvdb.LogRecord{Sequence: sequence, Data: data})
+		}
+	case frameSnapshot:
+		if f.sequence, err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+		if f.snapshot, err = readBytes(r, maxSnapshotLen); err != nil {
+			return nil, err
+		}
+	case frameHeartbeat:
+		if f.sequence, err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+	case frameError:
+		msg, err := readBytes(r, maxErrorLen)
+		if err != nil {
+			return nil, err
+		}
+		f.message = string(msg)
+	default:
+		return nil, fmt.Errorf("replication: unknown frame type %q", kind)
+	}
+	return f, nil
+}
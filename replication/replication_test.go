@@ -0,0 +1,174 @@
+package replication
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func openDb(t *testing.T, config *kvdb.DbConfig) *kvdb.Db {
+	db, err := kvdb.InitDb(config)
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	return db
+}
+
+// Start a leader on a loopback port
+func startLeader(t *testing.T, db *kvdb.Db, addr string) (*Leader, string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Errorf("Listen failed: %v", err)
+		t.FailNow()
+	}
+	leader := InitLeader(db)
+	leader.heartbeat = 20 * time.Millisecond
+	go leader.Serve(l)
+	return leader, l.Addr().String()
+}
+
+func startFollower(db *kvdb.Db, addr string) *Follower {
+	f := InitFollower(db, addr)
+	f.retry, f.timeout = 20*time.Millisecond, time.Second
+	f.Start()
+	return f
+}
+
+// Wait until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Errorf("timed out waiting for %s", what)
+			t.FailNow()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func caughtUp(leader, follower *kvdb.Db) func() bool {
+	return func() bool { return follower.LastSequence() == leader.LastSequence() }
+}
+
+func expectValues(t *testing.T, db *kvdb.Db, expect map[string]string) {
+	for k, v := range expect {
+		got, err := db.Get([]byte(k))
+		if err != nil || string(got) != v {
+			t.Errorf("%s = %q %v, expected %q", k, got, err, v)
+		}
+	}
+}
+
+func TestShipping(t *testing.T) {
+	db := openDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	leader, addr := startLeader(t, db, "127.0.0.1:0")
+	defer leader.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	// Two followers, one with a directory and one without
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	followers := []*kvdb.Db{openDb(t, &kvdb.DbConfig{Dir: dir}), openDb(t, &kvdb.DbConfig{})}
+	for _, fdb := range followers {
+		defer fdb.Close()
+		f := startFollower(fdb, addr)
+		defer f.Close()
+	}
+
+	db.Put([]byte("b"), []byte("2"))
+	batch := kvdb.NewWriteBatch()
+	batch.Put([]byte("c"), []byte("3"))
+	batch.Delete([]byte("a"))
+	db.Write(batch)
+	for _, fdb := range followers {
+		waitFor(t, "followers", caughtUp(db, fdb))
+		expectValues(t, fdb, map[string]string{"a": "", "b": "2", "c": "3"})
+		if err := fdb.Put([]byte("x"), []byte("y")); err != kvdb.ErrReadOnly {
+			t.Errorf("Put on a follower: %v", err)
+		}
+	}
+
+	waitFor(t, "acknowledgements", func() bool {
+		st := leader.Status()
+		return len(st.Followers) == 2 && st.Followers[0].Lag == 0 && st.Followers[1].Lag == 0
+	})
+	if st := leader.Status(); st.Role != RoleLeader || st.Sequence != 4 || st.Followers[0].Snapshots != 0 {
+		t.Errorf("leader status %+v", st)
+	}
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	db := openDb(t, &kvdb.DbConfig{WatchHistory: 2})
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+	}
+	db.Delete([]byte("k05"))
+	leader, addr := startLeader(t, db, "127.0.0.1:0")
+	defer leader.Close()
+
+	dir, _ := ioutil.TempDir("", "kvdb")
+	defer os.RemoveAll(dir)
+	fdb := openDb(t, &kvdb.DbConfig{Dir: dir})
+	defer fdb.Close()
+	f := startFollower(fdb, addr)
+	defer f.Close()
+
+	waitFor(t, "snapshot", caughtUp(db, fdb))
+	expectValues(t, fdb, map[string]string{"k00": "0", "k05": "", "k19": "19"})
+	db.Put([]byte("k05"), []byte("back"))
+	waitFor(t, "records after the snapshot", caughtUp(db, fdb))
+	expectValues(t, fdb, map[string]string{"k05": "back"})
+	waitFor(t, "status", func() bool {
+		st := leader.Status()
+		return len(st.Followers) == 1 && st.Followers[0].Snapshots == 1
+	})
+}
+
+func TestLagAndReconnect(t *testing.T) {
+	db := openDb(t, &kvdb.DbConfig{})
+	defer db.Close()
+	leader, addr := startLeader(t, db, "127.0.0.1:0")
+	fdb := openDb(t, &kvdb.DbConfig{})
+	defer fdb.Close()
+	f := startFollower(fdb, addr)
+	defer f.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	waitFor(t, "follower", caughtUp(db, fdb))
+	waitFor(t, "connected", func() bool { return f.Status().Connected })
+	st := f.Status()
+	if st.Role != RoleFollower || st.Leader != addr || st.Sequence != 1 || st.LeaderSequence != 1 ||
+		st.Lag != 0 || st.LastContact == nil || st.Error != "" {
+		t.Errorf("follower status %+v", st)
+	}
+
+	// While the leader is away the follower serves what it has
+	leader.Close()
+	waitFor(t, "disconnect", func() bool { st := f.Status(); return !st.Connected && st.Error != "" })
+	db.Put([]byte("a"), []byte("2"))
+	db.Put([]byte("b"), []byte("3"))
+	expectValues(t, fdb, map[string]string{"a": "1"})
+
+	// Heard of but not yet applied changes are lag
+	fdb2 := openDb(t, &kvdb.DbConfig{})
+	defer fdb2.Close()
+	f2 := InitFollower(fdb2, addr)
+	f2.leaderSequence = db.LastSequence()
+	if st := f2.Status(); st.Lag != 3 || st.Connected {
+		t.Errorf("lagging follower status %+v", st)
+	}
+
+	leader, _ = startLeader(t, db, addr)
+	defer leader.Close()
+	waitFor(t, "reconnect", caughtUp(db, fdb))
+	expectValues(t, fdb, map[string]string{"a": "2", "b": "3"})
+	waitFor(t, "lag to clear", func() bool { st := f.Status(); return st.Connected && st.Lag == 0 && st.Error == "" })
+}
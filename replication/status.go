@@ -0,0 +1,36 @@
+package replication
+
+import "time"
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// Where a leader or follower is in the log.  Lag counts the mutations a
+// follower is known to be behind the leader by.
+type Status struct {
+	Role     string `json:"role"`
+	Sequence uint64 `json:"sequence"`
+
+	// Set for a follower
+	Leader         string     `json:"leader,omitempty"`
+	Connected      bool       `json:"connected,omitempty"`
+	LeaderSequence uint64     `json:"leader_sequence,omitempty"`
+	Lag            uint64     `json:"lag"`
+	LastContact    *time.Time `json:"last_contact,omitempty"`
+	Error          string     `json:"error,omitempty"`
+
+	// Set for a leader
+	Followers []FollowerStatus `json:"followers,omitempty"`
+}
+
+// A follower as its leader sees it, Sequence being the last it has
+// acknowledged applying
+type FollowerStatus struct {
+	Addr        string    `json:"addr"`
+	Sequence    uint64    `json:"sequence"`
+	Lag         uint64    `json:"lag"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Snapshots   int       `json:"snapshots"`
+}
@@ -0,0 +1,422 @@
+package resp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+const (
+	serverName    = "simple-kv"
+	serverVersion = "0.1.0"
+
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+)
+
+// An empty value is stored as such but may read back as nil, which would
+// reply null as for a missing key
+func nonNil(v []byte) []byte {
+	if v == nil {
+		return []byte{}
+	}
+	return v
+}
+
+func parseInt(arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	return n, err == nil
+}
+
+// Convert an expiry given in unit to a duration, false if it is not a
+// positive integer or does not fit
+func parseTTL(arg []byte, unit time.Duration) (time.Duration, bool) {
+	n, ok := parseInt(arg)
+	if !ok || n <= 0 || n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// PING [message]
+func (c *conn) ping(args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// ECHO message
+func (c *conn) echo(args [][]byte) {
+	c.w.bulk(args[1])
+}
+
+// QUIT
+func (c *conn) quitCmd(args [][]byte) {
+	c.w.simple("OK")
+	c.quit = true
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]].  There
+// is no authentication, any credentials are accepted.
+func (c *conn) hello(args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, ok := parseInt(args[1])
+		if !ok {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		} else if v != 2 && v != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = int(v)
+	}
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+			i++
+			name = string(args[i])
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+	c.w.proto = proto
+	c.name = name
+
+	c.w.mapOf(7)
+	c.w.bulk([]byte("server"))
+	c.w.bulk([]byte(serverName))
+	c.w.bulk([]byte("version"))
+	c.w.bulk([]byte(serverVersion))
+	c.w.bulk([]byte("proto"))
+	c.w.integer(int64(proto))
+	c.w.bulk([]byte("id"))
+	c.w.integer(c.id)
+	c.w.bulk([]byte("mode"))
+	c.w.bulk([]byte("standalone"))
+	c.w.bulk([]byte("role"))
+	c.w.bulk([]byte("master"))
+	c.w.bulk([]byte("modules"))
+	c.w.array(0)
+}
+
+// CLIENT ID | GETNAME | SETNAME name | SETINFO attr value
+func (c *conn) client(args [][]byte) {
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "ID" && len(args) == 2:
+		c.w.integer(c.id)
+	case sub == "GETNAME" && len(args) == 2:
+		if c.name == "" {
+			c.w.null()
+		} else {
+			c.w.bulk([]byte(c.name))
+		}
+	case sub == "SETNAME" && len(args) == 3:
+		c.name = string(args[2])
+		c.w.simple("OK")
+	case sub == "SETINFO" && len(args) == 4:
+		c.w.simple("OK")
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", args[1]))
+	}
+}
+
+// SELECT index, there is only database 0
+func (c *conn) selectCmd(args [][]byte) {
+	if n, ok := parseInt(args[1]); !ok {
+		c.w.error(errNotInteger)
+	} else if n != 0 {
+		c.w.error("ERR DB index is out of range")
+	} else {
+		c.w.simple("OK")
+	}
+}
+
+// COMMAND [subcommand], describes no commands
+func (c *conn) commandCmd(args [][]byte) {
+	c.w.array(0)
+}
+
+// GET key
+func (c *conn) get(args [][]byte) {
+	v, version, err := c.server.db.GetVersion(args[1])
+	if err != nil {
+		c.dbError(err)
+	} else if version == 0 {
+		c.w.null()
+	} else {
+		c.w.bulk(nonNil(v))
+	}
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX].  Expiry times
+// are kept to the second, rounded up.
+func (c *conn) set(args [][]byte) {
+	key, value := args[1], args[2]
+	var opts kvdb.PutOptions
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if opts.TTL != 0 || i+1 == len(args) {
+				c.w.error(errSyntax)
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			i++
+			ttl, ok := parseTTL(args[i], unit)
+			if !ok {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			opts.TTL = ttl
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		c.w.error(errSyntax)
+		return
+	}
+
+	db := c.server.db
+	if !nx && !xx {
+		if err := db.PutWithOptions(key, value, opts); err != nil {
+			c.dbError(err)
+			return
+		}
+		c.w.simple("OK")
+		return
+	}
+
+	// The write is made against the version the condition was checked
+	// on, and checked again if another write got in between
+	for {
+		_, version, err := db.GetVersion(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		}
+		if nx && version != 0 || xx && version == 0 {
+			c.w.null()
+			return
+		}
+		_, err = db.PutIfVersionWithOptions(key, value, version, opts)
+		if err == kvdb.ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			c.dbError(err)
+			return
+		}
+		c.w.simple("OK")
+		return
+	}
+}
+
+// DEL key [key ...], replies with the number of keys deleted
+func (c *conn) del(args [][]byte) {
+	db := c.server.db
+	deleted := int64(0)
+	for _, key := range args[1:] {
+		for {
+			_, version, err := db.GetVersion(key)
+			if err != nil {
+				c.dbError(err)
+				return
+			} else if version == 0 {
+				break
+			}
+			err = db.DeleteIfVersion(key, version)
+			if err == kvdb.ErrVersionMismatch {
+				continue
+			} else if err != nil {
+				c.dbError(err)
+				return
+			}
+			deleted++
+			break
+		}
+	}
+	c.w.integer(deleted)
+}
+
+// EXISTS key [key ...], replies with how many of the keys exist, counting
+// a key named twice twice
+func (c *conn) exists(args [][]byte) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		_, version, err := c.server.db.GetVersion(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		} else if version != 0 {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+// MGET key [key ...], read from one snapshot
+func (c *conn) mget(args [][]byte) {
+	snapshot := c.server.db.NewSnapshot()
+	defer snapshot.Release()
+	values := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		v, err := snapshot.Get(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		}
+		values = append(values, v)
+	}
+	c.w.array(len(values))
+	for _, v := range values {
+		c.w.bulk(v)
+	}
+}
+
+// MSET key value [key value ...], written as one batch
+func (c *conn) mset(args [][]byte) {
+	if len(args)%2 == 0 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batch := kvdb.NewWriteBatch()
+	for i := 1; i < len(args); i += 2 {
+		batch.Put(args[i], args[i+1])
+	}
+	if err := c.server.db.Write(batch); err != nil {
+		c.dbError(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// INCR key, a missing key counts as 0.  The key keeps its TTL.
+func (c *conn) incr(args [][]byte) {
+	db := c.server.db
+	key := args[1]
+	for {
+		v, info, err := db.GetWithInfo(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		}
+		n, version := int64(0), uint64(0)
+		var opts kvdb.PutOptions
+		if info != nil {
+			var ok bool
+			if n, ok = parseInt(v); !ok {
+				c.w.error(errNotInteger)
+				return
+			}
+			version = info.Version
+			opts = kvdb.PutOptions{ExpiresAt: info.Expires, ContentType: info.ContentType}
+		}
+		if n == math.MaxInt64 {
+			c.w.error("ERR increment or decrement would overflow")
+			return
+		}
+		n++
+
+		_, err = db.PutIfVersionWithOptions(key, []byte(strconv.FormatInt(n, 10)), version, opts)
+		if err == kvdb.ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			c.dbError(err)
+			return
+		}
+		c.w.integer(n)
+		return
+	}
+}
+
+// TTL key, replies with the whole seconds until key expires, -1 if it has
+// no TTL and -2 if it does not exist.  Expiry times are rounded up when
+// set, so the seconds are rounded down to give back the TTL set.
+func (c *conn) ttl(args [][]byte) {
+	info, err := c.server.db.Stat(args[1])
+	if err != nil {
+		c.dbError(err)
+	} else if info == nil {
+		c.w.integer(-2)
+	} else if info.Expires.IsZero() {
+		c.w.integer(-1)
+	} else if ttl := time.Until(info.Expires); ttl > 0 {
+		c.w.integer(int64(ttl / time.Second))
+	} else {
+		c.w.integer(0)
+	}
+}
+
+// EXPIRE key seconds, replies 1 if key exists and 0 otherwise.  A TTL
+// that is not positive deletes the key.
+func (c *conn) expire(args [][]byte) {
+	db := c.server.db
+	key := args[1]
+	seconds, ok := parseInt(args[2])
+	if !ok {
+		c.w.error(errNotInteger)
+		return
+	}
+	ttl, ok := parseTTL(args[2], time.Second)
+	if !ok && seconds > 0 {
+		c.w.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+
+	for {
+		v, info, err := db.GetWithInfo(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		} else if info == nil {
+			c.w.integer(0)
+			return
+		}
+		if seconds <= 0 {
+			err = db.DeleteIfVersion(key, info.Version)
+		} else {
+			opts := kvdb.PutOptions{TTL: ttl, ContentType: info.ContentType}
+			_, err = db.PutIfVersionWithOptions(key, v, info.Version, opts)
+		}
+		if err == kvdb.ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			c.dbError(err)
+			return
+		}
+		c.w.integer(1)
+		return
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// The Redis serialization protocol.  Clients send commands as arrays of
+// bulk strings:
+//
+//   *<count>\r\n then for each argument $<length>\r\n<bytes>\r\n
+//
+// or, as telnet does, as an inline line of space separated words.  Replies
+// are simple strings (+), errors (-), integers (:), bulk strings ($) and
+// arrays (*).  RESP3, asked for with HELLO 3, adds a null (_) and maps (%),
+// which under RESP2 are sent as a null bulk string and a flat array.
+
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+const (
+	// Limits on what a client may send, as Redis has.  A line longer
+	// than the read buffer, maxInlineLen, is refused.
+	maxBulkLen   = 512 << 20
+	maxArrayLen  = 1 << 20
+	maxInlineLen = 64 << 10
+)
+
+// A malformed request, the connection is closed after replying
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// Read a line ending in \r\n, returned without it
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big inline request")
+	} else if err == io.EOF && len(line) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, protocolError("expected '\\r\\n'")
+	}
+	return line[:len(line)-2], nil
+}
+
+// Parse the length after a * or $ type byte
+func parseLength(line []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > max {
+		return 0, protocolError("invalid length")
+	}
+	return n, nil
+}
+
+// Read the next command, a non-empty list of its name and arguments
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			// line is in the reader's buffer, which the next read
+			// overwrites, and arguments may be stored as they are
+			args := bytes.Fields(append([]byte{}, line...))
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		n, err := parseLength(line, maxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+		args := make([][]byte, n)
+		for i := range args {
+			line, err := readLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, protocolError("expected '$'")
+			}
+			size, err := parseLength(line, maxBulkLen)
+			if err != nil || size < 0 {
+				return nil, protocolError("invalid bulk length")
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(arg, []byte("\r\n")) {
+				return nil, protocolError("expected '\\r\\n'")
+			}
+			args[i] = arg[:size]
+		}
+		return args, nil
+	}
+}
+
+// Encodes replies in the protocol version the client asked for, 2 unless
+// it has sent HELLO 3
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) line(kind byte, s string) {
+	w.w.WriteByte(kind)
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) simple(s string) {
+	w.line('+', s)
+}
+
+// msg starts with the error code, ERR for most errors
+func (w *writer) error(msg string) {
+	w.line('-', msg)
+}
+
+func (w *writer) integer(n int64) {
+	w.line(':', strconv.FormatInt(n, 10))
+}
+
+// A bulk string, or null if b is nil
+func (w *writer) bulk(b []byte) {
+	if b == nil {
+		w.null()
+		return
+	}
+	w.line('$', strconv.Itoa(len(b)))
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.w.WriteString("_\r\n")
+	} else {
+		w.w.WriteString("$-1\r\n")
+	}
+}
+
+// Start an array of n elements, which must follow
+func (w *writer) array(n int) {
+	w.line('*', strconv.Itoa(n))
+}
+
+// Start a map of n pairs, each a key then a value, which must follow
+func (w *writer) mapOf(n int) {
+	if w.proto >= 3 {
+		w.line('%', strconv.Itoa(n))
+	} else {
+		w.array(2 * n)
+	}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
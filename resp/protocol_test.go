@@ -0,0 +1,122 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$4\r\na\x00\r\n\r\n" +
+		"\r\n" +
+		"PING  hello \r\n" +
+		"*0\r\n" +
+		"*1\r\n$0\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+	for _, expect := range [][]string{{"GET", "a\x00\r\n"}, {"PING", "hello"}, {""}} {
+		args, err := readCommand(r)
+		if err != nil {
+			t.Errorf("readCommand failed: %v", err)
+			t.FailNow()
+		}
+		got := []string{}
+		for _, arg := range args {
+			got = append(got, string(arg))
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", expect) {
+			t.Errorf("%q != %q", got, expect)
+		}
+	}
+	if _, err := readCommand(r); err != io.EOF {
+		t.Errorf("end of input: %v", err)
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	for input, expect := range map[string]error{
+		"*1\r\n$3\r\nGET":      io.ErrUnexpectedEOF,
+		"*1\r\n$3\r\nGE":       io.ErrUnexpectedEOF,
+		"*1\r\n$3\r\nGETxx":    protocolError("expected '\\r\\n'"),
+		"*1\r\n:3\r\n":         protocolError("expected '$'"),
+		"*x\r\n":               protocolError("invalid length"),
+		"*1\r\n$-1\r\n":        protocolError("invalid bulk length"),
+		"*1\r\n$536870913\r\n": protocolError("invalid bulk length"),
+		"PING\n":               protocolError("expected '\\r\\n'"),
+		"PING " + strings.Repeat("x", 100) + "\r\n": protocolError("too big inline request"),
+	} {
+		r := bufio.NewReaderSize(strings.NewReader(input), 64)
+		if _, err := readCommand(r); err != expect {
+			t.Errorf("%q: %v != %v", input, err, expect)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for proto, expect := range map[int]string{
+		2: "+OK\r\n-ERR bad\r\n:-3\r\n$2\r\n\x00\xff\r\n$0\r\n\r\n$-1\r\n*2\r\n*4\r\n",
+		3: "+OK\r\n-ERR bad\r\n:-3\r\n$2\r\n\x00\xff\r\n$0\r\n\r\n_\r\n*2\r\n%2\r\n",
+	} {
+		var buf bytes.Buffer
+		w := &writer{bufio.NewWriter(&buf), proto}
+		w.simple("OK")
+		w.error("ERR bad")
+		w.integer(-3)
+		w.bulk([]byte{0, 0xff})
+		w.bulk([]byte{})
+		w.bulk(nil)
+		w.array(2)
+		w.mapOf(2)
+		w.flush()
+		if buf.String() != expect {
+			t.Errorf("RESP%d: %q != %q", proto, buf.String(), expect)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"*:1", "user:1", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"\x00*", "\x00\xff", true},
+	} {
+		if matchGlob([]byte(test.pattern), []byte(test.s)) != test.match {
+			t.Errorf("matchGlob(%q, %q) != %v", test.pattern, test.s, test.match)
+		}
+	}
+
+	for pattern, prefix := range map[string]string{
+		"":        "",
+		"user:*":  "user:",
+		"a?c":     "a",
+		`a\*b*`:   "a*b",
+		"[ab]cd":  "",
+		"literal": "literal",
+	} {
+		if p := globPrefix([]byte(pattern)); string(p) != prefix {
+			t.Errorf("globPrefix(%q) = %q != %q", pattern, p, prefix)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultScanCount = 10
+
+	// Resume keys kept for scans to continue from, and for how long
+	maxScanCursors = 4096
+	scanCursorTTL  = 10 * time.Minute
+
+	// A cursor is the first scanPrefixBytes of the key it resumes from
+	// followed by scanRandomBits, leaving the top bit clear for clients
+	// that read cursors as signed
+	scanPrefixBytes = 4
+	scanRandomBits  = 31
+)
+
+// Redis clients expect a SCAN cursor to be a number, so the key a scan
+// stopped at is kept here under one, shared by every connection so a
+// scan may go on over any of them.  A key forgotten once it is older
+// than scanCursorTTL or pushed out by newer ones, or lost to a restart,
+// is not an error: the scan resumes from the prefix in the cursor, which
+// sorts no later than the key, so nothing is missed but keys sharing the
+// prefix may be returned again.  A scan whose cursors were forgotten on
+// every call would not get past such keys, which takes maxScanCursors
+// other pages being handed out between its calls.  0 starts a scan and
+// ends it.
+type scanCursors struct {
+	lock  sync.Mutex
+	rand  *rand.Rand
+	keys  map[uint64]savedCursor
+	order []uint64
+}
+
+type savedCursor struct {
+	key     []byte
+	expires time.Time
+}
+
+func newScanCursors() scanCursors {
+	return scanCursors{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		keys: map[uint64]savedCursor{},
+	}
+}
+
+// Remember key, returning the cursor to resume from it
+func (sc *scanCursors) save(key []byte, now time.Time) uint64 {
+	var b [8]byte
+	copy(b[:scanPrefixBytes], key)
+	prefix := binary.BigEndian.Uint64(b[:]) >> (64 - 8*scanPrefixBytes) << scanRandomBits
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for len(sc.order) > 0 && (len(sc.order) >= maxScanCursors || now.After(sc.keys[sc.order[0]].expires)) {
+		delete(sc.keys, sc.order[0])
+		sc.order = sc.order[1:]
+	}
+	// Far fewer cursors are kept than there are for any prefix
+	for {
+		cursor := prefix | uint64(sc.rand.Int63n(1<<scanRandomBits))
+		if _, taken := sc.keys[cursor]; !taken && cursor != 0 {
+			sc.keys[cursor] = savedCursor{append([]byte{}, key...), now.Add(scanCursorTTL)}
+			sc.order = append(sc.order, cursor)
+			return cursor
+		}
+	}
+}
+
+// The key to resume a scan from at cursor
+func (sc *scanCursors) load(cursor uint64, now time.Time) []byte {
+	sc.lock.Lock()
+	saved, ok := sc.keys[cursor]
+	sc.lock.Unlock()
+	if ok && !now.After(saved.expires) {
+		return saved.key
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, cursor>>scanRandomBits<<(64-8*scanPrefixBytes))
+	return bytes.TrimRight(b[:scanPrefixBytes], "\x00")
+}
+
+// Match s against a Redis glob pattern: * matches any run of bytes, ?
+// any one byte, [abc], [^abc] and [a-z] a byte in or out of a set, and \
+// escapes the next byte
+func matchGlob(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Match b against the class at the start of pattern, just after its [,
+// returning whether it matched and the pattern after the class.  An
+// unterminated class extends to the end of the pattern.
+func matchClass(pattern []byte, b byte) (bool, []byte) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		c := pattern[0]
+		if c == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			c = pattern[0]
+		}
+		if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			lo, hi := c, pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || lo <= b && b <= hi
+			pattern = pattern[3:]
+			continue
+		}
+		match = match || c == b
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return match != negate, pattern
+}
+
+// The bytes every key matching pattern begins with
+func globPrefix(pattern []byte) []byte {
+	prefix := []byte{}
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return prefix
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix = append(prefix, pattern[i])
+	}
+	return prefix
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].  Examines count
+// keys in order from where the cursor left off and replies with the
+// cursor to continue from, 0 once every key has been seen, and those
+// that match.  Every key is a string so any other TYPE matches nothing.
+// A key that exists for the whole scan is returned at least once, and
+// only once unless the scan's cursor was forgotten, see scanCursors.
+func (c *conn) scan(args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := defaultScanCount
+	onlyStrings := true
+	for i := 2; i < len(args); i++ {
+		if i+1 == len(args) {
+			c.w.error(errSyntax)
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, ok := parseInt(args[i+1])
+			if !ok || n < 1 {
+				c.w.error(errNotInteger)
+				return
+			}
+			count = int(n)
+		case "TYPE":
+			onlyStrings = strings.EqualFold(string(args[i+1]), "string")
+		default:
+			c.w.error(errSyntax)
+			return
+		}
+		i++
+	}
+
+	prefix := globPrefix(pattern)
+	start := prefix
+	if cursor != 0 {
+		if key := c.server.cursors.load(cursor, time.Now()); bytes.Compare(key, start) > 0 {
+			start = key
+		}
+	}
+
+	it := c.server.db.NewIterator()
+	defer it.Close()
+	keys := [][]byte{}
+	next := uint64(0)
+	examined := 0
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		if examined == count {
+			next = c.server.cursors.save(it.Key(), time.Now())
+			break
+		}
+		examined++
+		if onlyStrings && (pattern == nil || matchGlob(pattern, it.Key())) {
+			keys = append(keys, append([]byte{}, it.Key()...))
+		}
+	}
+	if err := it.Err(); err != nil {
+		c.dbError(err)
+		return
+	}
+
+	c.w.array(2)
+	c.w.bulk([]byte(strconv.FormatUint(next, 10)))
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
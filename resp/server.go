@@ -0,0 +1,198 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Serves the database over the Redis protocol, so Redis clients can use
+// it.  Only the commands in commands are understood and every key holds a
+// string, there is a single database and no authentication.
+type Server struct {
+	db *kvdb.Db
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	lastID   int64
+
+	cursors scanCursors
+}
+
+// A client connection
+type conn struct {
+	server *Server
+	id     int64
+	name   string
+	r      *bufio.Reader
+	w      *writer
+
+	// Set by QUIT, the connection closes once the reply is sent
+	quit bool
+}
+
+func InitServer(db *kvdb.Db) *Server {
+	return &Server{db: db, conns: map[net.Conn]bool{}, cursors: newScanCursors()}
+}
+
+// Start the server on addr, runs until Close is called
+func (s *Server) StartServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Accept connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			nc.Close()
+			return nil
+		}
+		s.conns[nc] = true
+		s.lastID++
+		c := &conn{
+			server: s,
+			id:     s.lastID,
+			r:      bufio.NewReaderSize(nc, maxInlineLen),
+			w:      &writer{bufio.NewWriter(nc), 2},
+		}
+		s.lock.Unlock()
+		go s.serveConn(nc, c)
+	}
+}
+
+// Stop accepting connections and close those open
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for nc := range s.conns {
+		nc.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(nc net.Conn, c *conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, nc)
+		s.lock.Unlock()
+		nc.Close()
+	}()
+
+	for !c.quit {
+		args, err := readCommand(c.r)
+		var perr protocolError
+		if errors.As(err, &perr) {
+			c.w.error("ERR " + perr.Error())
+			c.w.flush()
+			return
+		} else if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println("Read failed ", err)
+			}
+			return
+		}
+
+		c.dispatch(args)
+		// Replies to pipelined commands go out together
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// A command's handler and its arity, which as in Redis counts the command
+// name and is negated when it is a minimum
+type command struct {
+	run   func(c *conn, args [][]byte)
+	arity int
+}
+
+var commands = map[string]command{
+	"ping":   {(*conn).ping, -1},
+	"echo":   {(*conn).echo, 2},
+	"quit":   {(*conn).quitCmd, 1},
+	"hello":  {(*conn).hello, -1},
+	"client": {(*conn).client, -2},
+	"select": {(*conn).selectCmd, 2},
+	// Clients such as redis-cli ask for command docs, there are none
+	"command": {(*conn).commandCmd, -1},
+
+	"get":    {(*conn).get, 2},
+	"set":    {(*conn).set, -3},
+	"del":    {(*conn).del, -2},
+	"exists": {(*conn).exists, -2},
+	"mget":   {(*conn).mget, -2},
+	"mset":   {(*conn).mset, -3},
+	"incr":   {(*conn).incr, 2},
+	"ttl":    {(*conn).ttl, 2},
+	"expire": {(*conn).expire, 3},
+	"scan":   {(*conn).scan, -2},
+}
+
+func (c *conn) dispatch(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.run(c, args)
+}
+
+// Reply with the error a database call failed with
+func (c *conn) dbError(err error) {
+	if err == kvdb.ErrReadOnly {
+		// What Redis replicas reply, which clients recognise
+		c.w.error("READONLY You can't write against a read only replica.")
+		return
+	}
+	fmt.Println("Command failed ", err)
+	c.w.error("ERR " + err.Error())
+}
@@ -0,0 +1,446 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func startTestServer(t *testing.T) (*Server, *kvdb.Db, string) {
+	db, err := kvdb.InitDb(&kvdb.DbConfig{})
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	s := InitServer(db)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Listen failed: %v", err)
+		t.FailNow()
+	}
+	go s.Serve(l)
+	return s, db, l.Addr().String()
+}
+
+// A minimal client, replies are decoded to strings, int64s, nil, errors
+// and slices of them, with maps flattened
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Dial failed: %v", err)
+		t.FailNow()
+	}
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.Write([]byte(b.String()))
+}
+
+type replyError string
+
+func (c *testClient) reply() interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Errorf("reading reply: %v", err)
+		c.t.FailNow()
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return replyError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Errorf("reading reply: %v", err)
+			c.t.FailNow()
+		}
+		return string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		elems := []interface{}{}
+		for i := 0; i < n; i++ {
+			elems = append(elems, c.reply())
+		}
+		return elems
+	}
+	c.t.Errorf("unknown reply %q", line)
+	c.t.FailNow()
+	return nil
+}
+
+// Send a command and check its reply, formatted with %v
+func (c *testClient) expect(expect string, args ...string) interface{} {
+	c.send(args...)
+	reply := c.reply()
+	if got := fmt.Sprintf("%v", reply); got != expect {
+		c.t.Errorf("%q: %q != %q", args, got, expect)
+	}
+	return reply
+}
+
+func TestStringCommands(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+	c := dialTestClient(t, addr)
+
+	c.expect("PONG", "PING")
+	c.expect("hi", "PING", "hi")
+	c.expect("<nil>", "GET", "a")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("1", "GET", "a")
+	c.expect("OK", "set", "empty", "")
+	c.expect("", "GET", "empty")
+
+	// Binary safe
+	c.expect("OK", "SET", "k\x00\xff", "v\r\n\x00")
+	c.expect("v\r\n\x00", "GET", "k\x00\xff")
+
+	c.expect("<nil>", "SET", "a", "2", "NX")
+	c.expect("OK", "SET", "b", "2", "NX")
+	c.expect("<nil>", "SET", "c", "3", "XX")
+	c.expect("OK", "SET", "a", "3", "XX")
+	c.expect("3", "GET", "a")
+	c.expect("ERR syntax error", "SET", "a", "3", "NX", "XX")
+	c.expect("ERR syntax error", "SET", "a", "3", "EX")
+	c.expect("ERR syntax error", "SET", "a", "3", "EX", "1", "PX", "1")
+	c.expect("ERR invalid expire time in 'set' command", "SET", "a", "3", "EX", "0")
+	c.expect("ERR wrong number of arguments for 'set' command", "SET", "a")
+
+	c.expect("2", "EXISTS", "a", "b", "c")
+	c.expect("2", "EXISTS", "a", "a")
+	c.expect("OK", "MSET", "c", "x", "d", "y")
+	c.expect("ERR wrong number of arguments for 'mset' command", "MSET", "c", "x", "d")
+	c.expect("[3 x <nil> y]", "MGET", "a", "c", "missing", "d")
+
+	c.expect("4", "INCR", "a")
+	c.expect("1", "INCR", "counter")
+	c.expect("ERR value is not an integer or out of range", "INCR", "c")
+	c.expect("OK", "SET", "max", strconv.FormatInt(1<<63-1, 10))
+	c.expect("ERR increment or decrement would overflow", "INCR", "max")
+
+	c.expect("3", "DEL", "a", "b", "c", "missing")
+	c.expect("0", "EXISTS", "a", "b", "c")
+
+	c.expect("ERR unknown command 'BOGUS'", "BOGUS")
+	c.expect("OK", "SELECT", "0")
+	c.expect("ERR DB index is out of range", "SELECT", "1")
+	c.expect("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("connection open after QUIT")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+	c := dialTestClient(t, addr)
+
+	c.expect("OK", "SET", "a", "1")
+	db.SetReadOnly(true)
+	c.expect("1", "GET", "a")
+	c.expect("READONLY You can't write against a read only replica.", "SET", "a", "2")
+	c.expect("READONLY You can't write against a read only replica.", "DEL", "a")
+	c.expect("1", "GET", "a")
+}
+
+func TestExpiry(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+	c := dialTestClient(t, addr)
+
+	c.expect("-2", "TTL", "a")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("-1", "TTL", "a")
+	c.expect("OK", "SET", "a", "1", "EX", "100")
+	c.expect("100", "TTL", "a")
+	c.expect("OK", "SET", "a", "1", "PX", "200000")
+	c.expect("200", "TTL", "a")
+
+	// INCR keeps the TTL, a plain SET clears it
+	c.expect("2", "INCR", "a")
+	c.expect("200", "TTL", "a")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("-1", "TTL", "a")
+
+	c.expect("1", "EXPIRE", "a", "50")
+	c.expect("50", "TTL", "a")
+	c.expect("1", "GET", "a")
+	c.expect("0", "EXPIRE", "missing", "50")
+	c.expect("ERR value is not an integer or out of range", "EXPIRE", "a", "x")
+	c.expect("1", "EXPIRE", "a", "0")
+	c.expect("<nil>", "GET", "a")
+
+	c.expect("OK", "SET", "b", "1", "PX", "1")
+	time.Sleep(1100 * time.Millisecond)
+	c.expect("<nil>", "GET", "b")
+	c.expect("-2", "TTL", "b")
+}
+
+func TestScan(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+	c := dialTestClient(t, addr)
+
+	expect := []string{}
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		db.Put([]byte(key), []byte("v"))
+		expect = append(expect, key)
+	}
+	db.Put([]byte("other"), []byte("v"))
+
+	scanAll := func(args ...string) []string {
+		keys := []string{}
+		cursor := "0"
+		for pages := 0; pages < 100; pages++ {
+			c.send(append([]string{"SCAN", cursor}, args...)...)
+			reply, ok := c.reply().([]interface{})
+			if !ok || len(reply) != 2 {
+				t.Errorf("SCAN replied %v", reply)
+				t.FailNow()
+			}
+			for _, key := range reply[1].([]interface{}) {
+				keys = append(keys, key.(string))
+			}
+			// Keys written mid scan are seen if after the cursor
+			if pages == 1 {
+				db.Put([]byte("user:99"), []byte("late"))
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	got := scanAll("MATCH", "user:*", "COUNT", "4")
+	if fmt.Sprint(got) != fmt.Sprint(append(expect, "user:99")) {
+		t.Errorf("scanned %v", got)
+	}
+	if got := scanAll("MATCH", "*:1?"); fmt.Sprint(got) != fmt.Sprint(expect[10:20]) {
+		t.Errorf("scanned %v", got)
+	}
+	if got := scanAll("COUNT", "1000"); len(got) != 27 {
+		t.Errorf("scanned %d keys", len(got))
+	}
+	if got := scanAll("TYPE", "hash"); len(got) != 0 {
+		t.Errorf("scanned %v for hashes", got)
+	}
+	c.expect("ERR invalid cursor", "SCAN", "-1")
+	c.expect("ERR syntax error", "SCAN", "0", "MATCH")
+}
+
+// A scan can go on over another connection, pages keep to COUNT even
+// among keys sharing a long prefix, and a scan whose cursor is forgotten
+// still sees every key
+func TestScanCursors(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+
+	expect := []string{}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("longprefix:%02d", i)
+		db.Put([]byte(key), []byte("v"))
+		expect = append(expect, key)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		db.Put([]byte(key), []byte("v"))
+		expect = append(expect, key)
+	}
+	sort.Strings(expect)
+
+	clients := []*testClient{dialTestClient(t, addr), dialTestClient(t, addr)}
+	scanAll := func(forget bool) []string {
+		keys := []string{}
+		cursor := "0"
+		for pages := 0; pages < 100; pages++ {
+			c := clients[pages%2]
+			c.send("SCAN", cursor, "COUNT", "3")
+			reply := c.reply().([]interface{})
+			if page := reply[1].([]interface{}); len(page) > 3 {
+				t.Errorf("page of %d keys", len(page))
+			}
+			for _, key := range reply[1].([]interface{}) {
+				keys = append(keys, key.(string))
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+			if forget && pages == 3 {
+				s.cursors.lock.Lock()
+				s.cursors.keys = map[uint64]savedCursor{}
+				s.cursors.order = nil
+				s.cursors.lock.Unlock()
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	if keys := scanAll(false); fmt.Sprint(keys) != fmt.Sprint(expect) {
+		t.Errorf("scanned %v", keys)
+	}
+	seen := map[string]bool{}
+	for _, key := range scanAll(true) {
+		seen[key] = true
+	}
+	if len(seen) != len(expect) {
+		t.Errorf("scan with forgotten cursors saw %d keys", len(seen))
+	}
+}
+
+// Cursors expire and the oldest are dropped once too many are kept
+func TestScanCursorsExpire(t *testing.T) {
+	sc := newScanCursors()
+	now := time.Now()
+	first := sc.save([]byte("user:0001"), now)
+	if key := sc.load(first, now); string(key) != "user:0001" {
+		t.Errorf("loaded %q", key)
+	}
+	if first == 0 || first>>63 != 0 {
+		t.Errorf("cursor %d", first)
+	}
+	if key := sc.load(first, now.Add(scanCursorTTL+time.Second)); string(key) != "user" {
+		t.Errorf("expired cursor loaded %q", key)
+	}
+	for i := 0; i < maxScanCursors; i++ {
+		sc.save([]byte("other"), now)
+	}
+	if len(sc.keys) != maxScanCursors || len(sc.order) != maxScanCursors {
+		t.Errorf("%d cursors kept", len(sc.keys))
+	}
+	if key := sc.load(first, now); string(key) != "user" {
+		t.Errorf("dropped cursor loaded %q", key)
+	}
+}
+
+func TestHello(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer s.Close()
+	defer db.Close()
+	c := dialTestClient(t, addr)
+
+	c.expect("NOPROTO unsupported protocol version", "HELLO", "4")
+	reply := c.expect("[server simple-kv version 0.1.0 proto 2 id 1 mode standalone role master modules []]",
+		"HELLO", "2")
+	if _, ok := reply.([]interface{}); !ok {
+		t.Errorf("RESP2 HELLO replied %v", reply)
+	}
+	c.expect("<nil>", "GET", "missing")
+
+	c.send("HELLO", "3", "AUTH", "default", "pw", "SETNAME", "tool")
+	line, _ := c.r.ReadString('\n')
+	if line != "%7\r\n" {
+		t.Errorf("RESP3 HELLO replied %q", line)
+	}
+	for i := 0; i < 14; i++ {
+		c.reply()
+	}
+	c.expect("tool", "CLIENT", "GETNAME")
+	c.send("GET", "missing")
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("RESP3 null %q", line)
+	}
+	c.expect("OK", "CLIENT", "SETINFO", "LIB-NAME", "test")
+}
+
+// Pipelined and inline commands, and clients running concurrently
+func TestPipelining(t *testing.T) {
+	s, db, addr := startTestServer(t)
+	defer db.Close()
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dialTestClient(t, addr)
+			defer c.conn.Close()
+			for j := 0; j < 100; j++ {
+				c.send("INCR", "n")
+			}
+			c.conn.Write([]byte("PING\r\n"))
+			for j := 0; j < 100; j++ {
+				if _, ok := c.reply().(int64); !ok {
+					t.Errorf("INCR reply not an integer")
+				}
+			}
+			if reply := c.reply(); reply != "PONG" {
+				t.Errorf("inline PING replied %v", reply)
+			}
+		}()
+	}
+	wg.Wait()
+	if v := db.GetString("n"); string(v) != "400" {
+		t.Errorf("n = %s", v)
+	}
+
+	// Inline commands sent together share the server's read buffer,
+	// every key and value must outlive it
+	c := dialTestClient(t, addr)
+	var inline strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&inline, "SET %s %s\r\n", strings.Repeat("k", 20-i), strings.Repeat("v", i+1))
+	}
+	c.conn.Write([]byte(inline.String()))
+	for i := 0; i < 20; i++ {
+		if reply := c.reply(); reply != "OK" {
+			t.Errorf("inline SET replied %v", reply)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		key, value := strings.Repeat("k", 20-i), strings.Repeat("v", i+1)
+		c.expect(value, "GET", key)
+		if v := db.GetString(key); string(v) != value {
+			t.Errorf("%s = %q", key, v)
+		}
+	}
+
+	c.conn.Write([]byte("*1\r\n:1\r\n"))
+	if reply := c.reply(); reply != replyError("ERR Protocol error: expected '$'") {
+		t.Errorf("bad request replied %v", reply)
+	}
+}
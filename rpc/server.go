@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/rpc/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Serves the database as the gRPC service in kvpb/kv.proto, for callers
+// that want typed requests and binary keys and values without the JSON
+// of the HTTP API
+type Server struct {
+	kvpb.UnimplementedKVServer
+
+	db   *kvdb.Db
+	grpc *grpc.Server
+}
+
+func InitServer(db *kvdb.Db) *Server {
+	s := &Server{db: db, grpc: grpc.NewServer()}
+	kvpb.RegisterKVServer(s.grpc, s)
+	return s
+}
+
+// Start the server on addr, runs until Close is called
+func (s *Server) StartServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Accept connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	return s.grpc.Serve(l)
+}
+
+// Stop accepting connections and close those open, ending any streams
+func (s *Server) Close() error {
+	s.grpc.Stop()
+	return nil
+}
+
+// The status a database call failed with
+func dbError(err error) error {
+	switch err {
+	case kvdb.ErrClosed:
+		return status.Error(codes.Unavailable, err.Error())
+	case kvdb.ErrInvalidTTL:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case kvdb.ErrVersionMismatch:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case kvdb.ErrWatchCompacted:
+		return status.Error(codes.OutOfRange, err.Error())
+	case kvdb.ErrReadOnly:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	fmt.Println("Request failed ", err)
+	return status.Error(codes.Internal, err.Error())
+}
+
+var errNoKey = status.Error(codes.InvalidArgument, "key is required")
+
+func (s *Server) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	v, info, err := s.db.GetWithInfo(req.Key)
+	if err != nil {
+		return nil, dbError(err)
+	} else if info == nil {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+	resp := &kvpb.GetResponse{
+		Value:       v,
+		Version:     info.Version,
+		ContentType: info.ContentType,
+		Timestamp:   timestamppb.New(info.Timestamp),
+	}
+	if !info.Expires.IsZero() {
+		resp.Expires = timestamppb.New(info.Expires)
+	}
+	return resp, nil
+}
+
+// With if_version the key is written only if it is still at that
+// version, otherwise whatever it is at
+func (s *Server) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, errNoKey
+	}
+	opts := kvdb.PutOptions{ContentType: req.ContentType}
+	if req.Ttl != nil {
+		if err := req.Ttl.CheckValid(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts.TTL = req.Ttl.AsDuration()
+	}
+	var version uint64
+	var err error
+	if req.IfVersion != nil {
+		version, err = s.db.PutIfVersionWithOptions(req.Key, req.Value, *req.IfVersion, opts)
+	} else {
+		version, err = s.db.PutAnyVersion(req.Key, req.Value, opts)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &kvpb.PutResponse{Version: version}, nil
+}
+
+// Deleting a key that does not exist succeeds with deleted false, as does
+// deleting one with an if_version of 0 that still does not exist
+func (s *Server) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, errNoKey
+	}
+	if req.IfVersion == nil {
+		deleted, err := s.db.DeleteAnyVersion(req.Key)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		return &kvpb.DeleteResponse{Deleted: deleted}, nil
+	}
+	if *req.IfVersion == 0 {
+		_, version, err := s.db.GetVersion(req.Key)
+		if err == nil && version != 0 {
+			err = kvdb.ErrVersionMismatch
+		}
+		if err != nil {
+			return nil, dbError(err)
+		}
+		return &kvpb.DeleteResponse{}, nil
+	}
+	if err := s.db.DeleteIfVersion(req.Key, *req.IfVersion); err != nil {
+		return nil, dbError(err)
+	}
+	return &kvpb.DeleteResponse{Deleted: true}, nil
+}
+
+func (s *Server) BatchWrite(ctx context.Context, req *kvpb.BatchWriteRequest) (*kvpb.BatchWriteResponse, error) {
+	batch := kvdb.NewWriteBatch()
+	for i, m := range req.Mutations {
+		if len(m.Key) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "mutation %d: key is required", i)
+		}
+		switch m.Type {
+		case kvpb.MutationType_MUTATION_TYPE_PUT:
+			batch.Put(m.Key, m.Value)
+		case kvpb.MutationType_MUTATION_TYPE_DELETE:
+			batch.Delete(m.Key)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "mutation %d: unknown type %v", i, m.Type)
+		}
+	}
+	if err := s.db.Write(batch); err != nil {
+		return nil, dbError(err)
+	}
+	return &kvpb.BatchWriteResponse{}, nil
+}
+
+// Stream the keys in [start, end) beginning with prefix.  The iterator
+// reads the database as it was when the scan began.
+func (s *Server) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	start := req.Start
+	if bytes.Compare(req.Prefix, start) > 0 {
+		start = req.Prefix
+	}
+	it := s.db.NewIterator()
+	defer it.Close()
+
+	n := uint32(0)
+	for it.Seek(start); it.Valid(); it.Next() {
+		if len(req.End) > 0 && bytes.Compare(it.Key(), req.End) >= 0 ||
+			!bytes.HasPrefix(it.Key(), req.Prefix) ||
+			req.Limit > 0 && n == req.Limit {
+			break
+		}
+		if err := stream.Send(&kvpb.KeyValue{Key: it.Key(), Value: it.Value()}); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+// Stream changes until the client goes away.  A client that cannot keep
+// up is cut off with RESOURCE_EXHAUSTED rather than slowing writes.
+func (s *Server) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	w, err := s.db.Watch(req.Prefix, req.FromSequence)
+	if err != nil {
+		return dbError(err)
+	}
+	defer w.Close()
+	// Headers go out now so the client knows the watch has started
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case e, ok := <-w.Events():
+			if !ok {
+				if err := w.Err(); err == kvdb.ErrWatchOverflow {
+					return status.Error(codes.ResourceExhausted, err.Error())
+				}
+				return dbError(w.Err())
+			}
+			event := &kvpb.WatchEvent{
+				Type:      kvpb.EventType_EVENT_TYPE_PUT,
+				Key:       e.Key,
+				Value:     e.Value,
+				Sequence:  e.Sequence,
+				Timestamp: timestamppb.New(e.Timestamp),
+			}
+			if e.Type == kvdb.EventDelete {
+				event.Type = kvpb.EventType_EVENT_TYPE_DELETE
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+	"github.com/jlitzingerdev/simple-kv/rpc/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Start a server on an in-process listener and connect a client to it
+func startTestServer(t *testing.T) (kvpb.KVClient, *kvdb.Db, func()) {
+	db, err := kvdb.InitDb(&kvdb.DbConfig{})
+	if err != nil {
+		t.Errorf("InitDb failed: %v", err)
+		t.FailNow()
+	}
+	s := InitServer(db)
+	l := bufconn.Listen(1 << 20)
+	go s.Serve(l)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Errorf("Dial failed: %v", err)
+		t.FailNow()
+	}
+	return kvpb.NewKVClient(conn), db, func() {
+		conn.Close()
+		s.Close()
+		db.Close()
+	}
+}
+
+func expectCode(t *testing.T, what string, err error, code codes.Code) {
+	if status.Code(err) != code {
+		t.Errorf("%s: %v, expected %v", what, err, code)
+	}
+}
+
+func TestGetPutDelete(t *testing.T) {
+	client, db, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+	key := []byte("k\x00\xff")
+
+	_, err := client.Get(ctx, &kvpb.GetRequest{Key: key})
+	expectCode(t, "Get missing key", err, codes.NotFound)
+
+	put, err := client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte{0, 1, 2}, ContentType: "application/x-test"})
+	if err != nil || put.Version == 0 {
+		t.Errorf("Put failed: %v %v", put, err)
+		t.FailNow()
+	}
+	get, err := client.Get(ctx, &kvpb.GetRequest{Key: key})
+	if err != nil {
+		t.Errorf("Get failed: %v", err)
+		t.FailNow()
+	}
+	if string(get.Value) != "\x00\x01\x02" || get.Version != put.Version ||
+		get.ContentType != "application/x-test" || get.Expires != nil ||
+		get.Timestamp.AsTime().IsZero() {
+		t.Errorf("Get = %v", get)
+	}
+
+	// Conditional writes
+	_, err = client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte("x"), IfVersion: proto64(0)})
+	expectCode(t, "create over existing key", err, codes.FailedPrecondition)
+	put2, err := client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte("2"), IfVersion: proto64(put.Version)})
+	if err != nil || put2.Version <= put.Version {
+		t.Errorf("conditional Put: %v %v", put2, err)
+	}
+	_, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: key, IfVersion: proto64(put.Version)})
+	expectCode(t, "Delete at old version", err, codes.FailedPrecondition)
+
+	del, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: key, IfVersion: proto64(put2.Version)})
+	if err != nil || !del.Deleted {
+		t.Errorf("Delete: %v %v", del, err)
+	}
+	del, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: key})
+	if err != nil || del.Deleted {
+		t.Errorf("Delete missing key: %v %v", del, err)
+	}
+	del, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: key, IfVersion: proto64(0)})
+	if err != nil || del.Deleted {
+		t.Errorf("Delete missing key at version 0: %v %v", del, err)
+	}
+
+	// Unconditional writes
+	put3, err := client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte("3")})
+	if _, v, _ := db.GetVersion(key); err != nil || put3.Version != v {
+		t.Errorf("Put = %v %v, version is %d", put3, err, v)
+	}
+	_, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: key, IfVersion: proto64(0)})
+	expectCode(t, "Delete existing key at version 0", err, codes.FailedPrecondition)
+	del, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: key})
+	if err != nil || !del.Deleted {
+		t.Errorf("unconditional Delete: %v %v", del, err)
+	}
+	_, err = client.Get(ctx, &kvpb.GetRequest{Key: key})
+	expectCode(t, "Get deleted key", err, codes.NotFound)
+
+	_, err = client.Put(ctx, &kvpb.PutRequest{Value: []byte("v")})
+	expectCode(t, "Put without key", err, codes.InvalidArgument)
+
+	db.SetReadOnly(true)
+	_, err = client.Put(ctx, &kvpb.PutRequest{Key: key, Value: []byte("v")})
+	expectCode(t, "Put on a follower", err, codes.PermissionDenied)
+}
+
+func proto64(v uint64) *uint64 {
+	return &v
+}
+
+func TestPutTTL(t *testing.T) {
+	client, _, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+
+	_, err := client.Put(ctx, &kvpb.PutRequest{Key: []byte("a"), Value: []byte("1"), Ttl: durationpb.New(time.Minute)})
+	if err != nil {
+		t.Errorf("Put failed: %v", err)
+		t.FailNow()
+	}
+	get, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a")})
+	if err != nil || get.Expires == nil || time.Until(get.Expires.AsTime()) > time.Minute+time.Second {
+		t.Errorf("Get = %v %v", get, err)
+	}
+	_, err = client.Put(ctx, &kvpb.PutRequest{Key: []byte("a"), Value: []byte("1"), Ttl: durationpb.New(-time.Minute)})
+	expectCode(t, "negative TTL", err, codes.InvalidArgument)
+}
+
+func scanAll(t *testing.T, client kvpb.KVClient, req *kvpb.ScanRequest) []string {
+	stream, err := client.Scan(context.Background(), req)
+	if err != nil {
+		t.Errorf("Scan failed: %v", err)
+		t.FailNow()
+	}
+	got := []string{}
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			return got
+		} else if err != nil {
+			t.Errorf("Scan failed: %v", err)
+			t.FailNow()
+		}
+		got = append(got, string(kv.Key)+"="+string(kv.Value))
+	}
+}
+
+func TestBatchWriteScan(t *testing.T) {
+	client, _, stop := startTestServer(t)
+	defer stop()
+	ctx := context.Background()
+
+	mutations := []*kvpb.Mutation{}
+	for _, key := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		mutations = append(mutations, &kvpb.Mutation{
+			Type: kvpb.MutationType_MUTATION_TYPE_PUT, Key: []byte(key), Value: []byte("v" + key)})
+	}
+	mutations = append(mutations, &kvpb.Mutation{Type: kvpb.MutationType_MUTATION_TYPE_DELETE, Key: []byte("a")})
+	if _, err := client.BatchWrite(ctx, &kvpb.BatchWriteRequest{Mutations: mutations}); err != nil {
+		t.Errorf("BatchWrite failed: %v", err)
+		t.FailNow()
+	}
+
+	for _, test := range []struct {
+		req    *kvpb.ScanRequest
+		expect string
+	}{
+		{&kvpb.ScanRequest{}, "[b/1=vb/1 b/2=vb/2 b/3=vb/3 c=vc]"},
+		{&kvpb.ScanRequest{Prefix: []byte("b/")}, "[b/1=vb/1 b/2=vb/2 b/3=vb/3]"},
+		{&kvpb.ScanRequest{Start: []byte("b/2"), End: []byte("c")}, "[b/2=vb/2 b/3=vb/3]"},
+		{&kvpb.ScanRequest{Start: []byte("b/2"), Prefix: []byte("b/")}, "[b/2=vb/2 b/3=vb/3]"},
+		{&kvpb.ScanRequest{Limit: 2}, "[b/1=vb/1 b/2=vb/2]"},
+	} {
+		if got := fmt.Sprint(scanAll(t, client, test.req)); got != test.expect {
+			t.Errorf("Scan(%v) = %s, expected %s", test.req, got, test.expect)
+		}
+	}
+
+	_, err := client.BatchWrite(ctx, &kvpb.BatchWriteRequest{Mutations: []*kvpb.Mutation{{Key: []byte("x")}}})
+	expectCode(t, "mutation without a type", err, codes.InvalidArgument)
+}
+
+func TestWatch(t *testing.T) {
+	client, db, stop := startTestServer(t)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &kvpb.WatchRequest{Prefix: []byte("config/")})
+	if err == nil {
+		// The server sends headers once it is watching
+		_, err = stream.Header()
+	}
+	if err != nil {
+		t.Errorf("Watch failed: %v", err)
+		t.FailNow()
+	}
+
+	db.Put([]byte("config/a"), []byte("1"))
+	db.Put([]byte("other"), []byte("2"))
+	db.Delete([]byte("config/a"))
+
+	expect := []string{"EVENT_TYPE_PUT config/a=1", "EVENT_TYPE_DELETE config/a="}
+	first := expectEvents(t, stream, expect)
+
+	// Watching again from the first sequence replays the same events
+	replay, err := client.Watch(ctx, &kvpb.WatchRequest{Prefix: []byte("config/"), FromSequence: first})
+	if err != nil {
+		t.Errorf("Watch failed: %v", err)
+		t.FailNow()
+	}
+	expectEvents(t, replay, expect)
+
+	// Closing the database ends the stream
+	db.Close()
+	_, err = stream.Recv()
+	expectCode(t, "Recv after close", err, codes.Unavailable)
+}
+
+// Receive the events in expect from stream, returning the sequence of
+// the first
+func expectEvents(t *testing.T, stream kvpb.KV_WatchClient, expect []string) uint64 {
+	first := uint64(0)
+	for _, expect := range expect {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Errorf("Recv failed: %v", err)
+			t.FailNow()
+		}
+		if got := fmt.Sprintf("%v %s=%s", e.Type, e.Key, e.Value); got != expect || e.Sequence == 0 {
+			t.Errorf("event %s, expected %s", got, expect)
+		}
+		if first == 0 {
+			first = e.Sequence
+		}
+	}
+	return first
+}
+
+func TestWatchCompacted(t *testing.T) {
+	client, db, stop := startTestServer(t)
+	defer stop()
+
+	for i := 0; i < 5000; i++ {
+		db.Put([]byte("k"), []byte("v"))
+	}
+	stream, err := client.Watch(context.Background(), &kvpb.WatchRequest{FromSequence: 1})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	expectCode(t, "Watch from a dropped sequence", err, codes.OutOfRange)
+}
@@ -0,0 +1,167 @@
+package shard
+
+import (
+	"bytes"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Walks every range in order, each with an iterator over the shard
+// holding it kept to the range's keys
+type rangeIterator struct {
+	ranges   []Range
+	children []kvdb.Iterator
+	// The range the iterator is in, len(ranges) or -1 past either end
+	current int
+}
+
+// An iterator over every key, in order.  Each shard is read at a
+// snapshot taken when the iterator is made, so writes made afterwards
+// are not seen, but the shards' snapshots are not taken at one instant.
+// Close must be called once it is no longer needed.
+func (r *Router) NewIterator() kvdb.Iterator {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	it := &rangeIterator{}
+	for _, s := range r.spans {
+		it.ranges = append(it.ranges, s.Range)
+		it.children = append(it.children, r.shards[s.Shard].NewIterator())
+	}
+	return it
+}
+
+// Position range i's iterator at its first key
+func (it *rangeIterator) first(i int) {
+	if it.ranges[i].Start == nil {
+		it.children[i].SeekToFirst()
+	} else {
+		it.children[i].Seek(it.ranges[i].Start)
+	}
+}
+
+// Position range i's iterator at its last key
+func (it *rangeIterator) last(i int) {
+	child := it.children[i]
+	if it.ranges[i].End == nil {
+		child.SeekToLast()
+		return
+	}
+	child.Seek(it.ranges[i].End)
+	if child.Valid() {
+		child.Prev()
+	} else if child.Err() == nil {
+		child.SeekToLast()
+	}
+}
+
+// Move forward from the current range until on a key inside one
+func (it *rangeIterator) settleForward() {
+	for it.current < len(it.ranges) {
+		child := it.children[it.current]
+		if child.Valid() && it.ranges[it.current].Contains(child.Key()) {
+			return
+		}
+		if child.Err() != nil {
+			return
+		}
+		it.current++
+		if it.current < len(it.ranges) {
+			it.first(it.current)
+		}
+	}
+}
+
+// Move backward from the current range until on a key inside one
+func (it *rangeIterator) settleBackward() {
+	for it.current >= 0 {
+		child := it.children[it.current]
+		if child.Valid() && it.ranges[it.current].Contains(child.Key()) {
+			return
+		}
+		if child.Err() != nil {
+			return
+		}
+		it.current--
+		if it.current >= 0 {
+			it.last(it.current)
+		}
+	}
+}
+
+func (it *rangeIterator) Seek(key []byte) {
+	it.current = 0
+	for it.current < len(it.ranges)-1 && !it.ranges[it.current].Contains(key) {
+		it.current++
+	}
+	if it.current < len(it.ranges) {
+		if bytes.Compare(key, it.ranges[it.current].Start) < 0 {
+			it.first(it.current)
+		} else {
+			it.children[it.current].Seek(key)
+		}
+	}
+	it.settleForward()
+}
+
+func (it *rangeIterator) SeekToFirst() {
+	it.current = 0
+	if len(it.ranges) > 0 {
+		it.first(0)
+	}
+	it.settleForward()
+}
+
+func (it *rangeIterator) SeekToLast() {
+	it.current = len(it.ranges) - 1
+	if it.current >= 0 {
+		it.last(it.current)
+	}
+	it.settleBackward()
+}
+
+func (it *rangeIterator) Next() {
+	if it.Valid() {
+		it.children[it.current].Next()
+		it.settleForward()
+	}
+}
+
+func (it *rangeIterator) Prev() {
+	if it.Valid() {
+		it.children[it.current].Prev()
+		it.settleBackward()
+	}
+}
+
+func (it *rangeIterator) Valid() bool {
+	return it.current >= 0 && it.current < len(it.ranges) &&
+		it.children[it.current].Valid() &&
+		it.ranges[it.current].Contains(it.children[it.current].Key())
+}
+
+func (it *rangeIterator) Key() []byte {
+	return it.children[it.current].Key()
+}
+
+func (it *rangeIterator) Value() []byte {
+	return it.children[it.current].Value()
+}
+
+func (it *rangeIterator) Err() error {
+	for _, child := range it.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *rangeIterator) Close() error {
+	var err error
+	for _, child := range it.children {
+		if e := child.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package shard
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+// Deletes are written in batches of this many keys
+const deleteBatch = 1000
+
+// Replace old with the spans in with, returning the new list
+func replaceSpan(spans []*span, old *span, with ...*span) []*span {
+	out := make([]*span, 0, len(spans)+len(with)-1)
+	for _, s := range spans {
+		if s == old {
+			out = append(out, with...)
+		} else {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Cut the range holding key in two, the second half starting at key.
+// Both stay on the same shard, so only the map changes.  The halves get
+// new IDs.
+func (r *Router) Split(key []byte) error {
+	r.adminLock.Lock()
+	defer r.adminLock.Unlock()
+	return r.split(key)
+}
+
+func (r *Router) split(key []byte) error {
+	r.lock.RLock()
+	s := r.lookup(key)
+	r.lock.RUnlock()
+	if bytes.Equal(s.Start, key) {
+		return ErrSplitBoundary
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key = append([]byte{}, key...)
+	left := &span{Range: Range{ID: r.nextID, Start: s.Start, End: key, Shard: s.Shard}}
+	right := &span{Range: Range{ID: r.nextID + 1, Start: key, End: s.End, Shard: s.Shard}}
+	spans := replaceSpan(r.spans, s, left, right)
+	if err := r.saveMap(spans, r.version+1); err != nil {
+		return err
+	}
+	r.spans, r.version, r.nextID = spans, r.version+1, r.nextID+2
+	s.retired = true
+	return nil
+}
+
+// Move the range with id to shard.  Writes to the range wait until it is
+// copied and the map switched over.
+func (r *Router) Move(id uint64, shard int) error {
+	r.adminLock.Lock()
+	defer r.adminLock.Unlock()
+	return r.move(id, shard)
+}
+
+func (r *Router) move(id uint64, shard int) error {
+	if shard < 0 || shard >= len(r.shards) {
+		return ErrNoShard
+	}
+	r.lock.RLock()
+	s := r.find(id)
+	r.lock.RUnlock()
+	if s == nil {
+		return ErrNoRange
+	} else if s.Shard == shard {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	from, to := r.shards[s.Shard], r.shards[shard]
+	// Anything there is left from a move that did not finish
+	if err := deleteRange(to, &s.Range); err != nil {
+		return err
+	}
+	if err := copyRange(from, to, &s.Range); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	moved := &span{Range: s.Range}
+	moved.Shard = shard
+	spans := replaceSpan(r.spans, s, moved)
+	if err := r.saveMap(spans, r.version+1); err != nil {
+		r.lock.Unlock()
+		deleteRange(to, &s.Range)
+		return err
+	}
+	r.spans, r.version = spans, r.version+1
+	s.retired = true
+	r.lock.Unlock()
+
+	// No read can reach the old copy now
+	return deleteRange(from, &s.Range)
+}
+
+// Copy the keys of rg from one Db to another, keeping their content
+// types and when they expire
+func copyRange(from, to *kvdb.Db, rg *Range) error {
+	it := from.NewIterator()
+	defer it.Close()
+	for seekRange(it, rg); it.Valid() && rg.Contains(it.Key()); it.Next() {
+		info, err := from.Stat(it.Key())
+		if err != nil {
+			return err
+		} else if info == nil {
+			// Expired since the iterator was made
+			continue
+		}
+		if !info.Expires.IsZero() && !info.Expires.After(time.Now()) {
+			continue
+		}
+		opts := kvdb.PutOptions{ContentType: info.ContentType, ExpiresAt: info.Expires}
+		if err := to.PutWithOptions(it.Key(), it.Value(), opts); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// Delete every key of rg from db
+func deleteRange(db *kvdb.Db, rg *Range) error {
+	it := db.NewIterator()
+	defer it.Close()
+	batch := kvdb.NewWriteBatch()
+	for seekRange(it, rg); it.Valid() && rg.Contains(it.Key()); it.Next() {
+		batch.Delete(it.Key())
+		if batch.Len() == deleteBatch {
+			if err := db.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return db.Write(batch)
+}
+
+func seekRange(it kvdb.Iterator, rg *Range) {
+	if rg.Start == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(rg.Start)
+	}
+}
+
+// The number of keys in rg and, if it has at least two, the key half of
+// them come before
+func countRange(db *kvdb.Db, rg *Range) (int, []byte, error) {
+	it := db.NewIterator()
+	defer it.Close()
+	keys := [][]byte{}
+	for seekRange(it, rg); it.Valid() && rg.Contains(it.Key()); it.Next() {
+		keys = append(keys, append([]byte{}, it.Key()...))
+	}
+	if len(keys) < 2 {
+		return len(keys), nil, it.Err()
+	}
+	return len(keys), keys[len(keys)/2], it.Err()
+}
+
+// Even out the number of keys each shard holds.  Ranges with more than
+// their share of keys are split at their middle key, then ranges are
+// moved from the shards with the most keys to those with the fewest
+// while that brings them closer.  The counts are taken as it starts, so
+// the result is only as even as writes made meanwhile allow.  Returns
+// the number of ranges moved.
+func (r *Router) Rebalance() (int, error) {
+	r.adminLock.Lock()
+	defer r.adminLock.Unlock()
+
+	// Split until no range holds more than a shard's share
+	for {
+		counts, middles, total, err := r.countSpans()
+		if err != nil {
+			return 0, err
+		}
+		share := (total + len(r.shards) - 1) / len(r.shards)
+		split := false
+		for i, count := range counts {
+			if count > share && middles[i] != nil {
+				if err := r.split(middles[i]); err != nil && err != ErrSplitBoundary {
+					return 0, err
+				}
+				split = true
+			}
+		}
+		if !split {
+			break
+		}
+	}
+
+	counts, _, _, err := r.countSpans()
+	if err != nil {
+		return 0, err
+	}
+	r.lock.RLock()
+	ranges := mapOf(r.spans, r.version, len(r.shards)).Ranges
+	r.lock.RUnlock()
+	totals := make([]int, len(r.shards))
+	for i, rg := range ranges {
+		totals[rg.Shard] += counts[i]
+	}
+
+	moved := 0
+	for {
+		most, fewest := 0, 0
+		for i, total := range totals {
+			if total > totals[most] {
+				most = i
+			}
+			if total < totals[fewest] {
+				fewest = i
+			}
+		}
+		// Moving a range with fewer keys than the difference narrows it
+		best := -1
+		for i, rg := range ranges {
+			if rg.Shard == most && counts[i] > 0 && counts[i] < totals[most]-totals[fewest] &&
+				(best < 0 || counts[i] > counts[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return moved, nil
+		}
+		if err := r.move(ranges[best].ID, fewest); err != nil {
+			return moved, err
+		}
+		ranges[best].Shard = fewest
+		totals[most] -= counts[best]
+		totals[fewest] += counts[best]
+		moved++
+	}
+}
+
+// The number of keys in each span, their middle keys, and the total
+func (r *Router) countSpans() ([]int, [][]byte, int, error) {
+	r.lock.RLock()
+	ranges := mapOf(r.spans, r.version, len(r.shards)).Ranges
+	r.lock.RUnlock()
+	counts := make([]int, len(ranges))
+	middles := make([][]byte, len(ranges))
+	total := 0
+	for i := range ranges {
+		var err error
+		counts[i], middles[i], err = countRange(r.shards[ranges[i].Shard], &ranges[i])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		total += counts[i]
+	}
+	return counts, middles, total, nil
+}
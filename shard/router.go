@@ -0,0 +1,400 @@
+// Copyright 2020 Jason Litzinger
+
+// Use of this software is governed be the MIT license in
+// LICENSE.txt.
+
+// Range sharding over several Dbs in one process.  The keyspace is cut
+// into ranges, each held by one shard, and a Router sends every read and
+// write to the shard holding its key.  Each shard is a full Db with its
+// own memtable, log and tables.
+//
+// The shard map is kept in shards.json next to the shards and changes in
+// two ways, both while the router serves:
+//
+//   - Split cuts a range in two at a key.  Both halves stay on the same
+//     shard, so no data moves and only the map changes.
+//   - Move copies a range to another shard, then switches the map over
+//     and deletes it from the old one.  Writes to that range wait while
+//     it is copied; reads, and writes to every other range, carry on.
+//
+// Rebalance splits and moves ranges until the shards hold about as many
+// keys each.
+//
+// A batch is atomic as on a single Db, so long as every key it writes is
+// held by the same shard, otherwise it is refused with ErrCrossShard.
+// Versions are sequences of the shard holding the key and change when
+// its range moves, as does its history, which is not copied.
+
+package shard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+var ErrCrossShard = errors.New("shard: batch writes keys held by different shards")
+
+var ErrNoRange = errors.New("shard: no such range")
+
+var ErrNoShard = errors.New("shard: no such shard")
+
+var ErrSplitBoundary = errors.New("shard: split key is already a range boundary")
+
+const mapFile = "shards.json"
+
+type Config struct {
+	// Directory holding the shard map and a subdirectory for each shard.
+	// When empty every shard lives only in memory.
+	Dir string
+
+	// Number of shards, defaults to 1.  Shards may be added when the
+	// router is next started, they begin empty and Rebalance moves
+	// ranges onto them, but not removed.
+	Shards int
+
+	// Options for every shard's Db, except Dir
+	Db kvdb.DbConfig
+}
+
+// The keys from Start up to, but not including, End, held by Shard.  A
+// nil Start is the start of the keyspace and a nil End its end.
+type Range struct {
+	ID    uint64 `json:"id"`
+	Start []byte `json:"start"`
+	End   []byte `json:"end"`
+	Shard int    `json:"shard"`
+}
+
+// Whether key is in the range
+func (r *Range) Contains(key []byte) bool {
+	return bytes.Compare(key, r.Start) >= 0 && (r.End == nil || bytes.Compare(key, r.End) < 0)
+}
+
+// Which shard holds each part of the keyspace.  The ranges are in order
+// and cover every key.  Version goes up with every split and move.
+type Map struct {
+	Version uint64  `json:"version"`
+	Shards  int     `json:"shards"`
+	Ranges  []Range `json:"ranges"`
+}
+
+// A range in the router's map.  A split or move replaces it rather than
+// changing it, marking it retired, so a writer that looked it up before
+// finds out once it holds the lock and looks again.
+type span struct {
+	Range
+	// Held for reading by writes to the range, and for writing by a
+	// split or move
+	lock    sync.RWMutex
+	retired bool
+}
+
+type Router struct {
+	config Config
+	shards []*kvdb.Db
+
+	// Splits and moves are made one at a time
+	adminLock sync.Mutex
+
+	// Held for reading while a key is looked up and, for reads, while
+	// the shard is read, so once a move has switched the map no read is
+	// still using the old shard
+	lock    sync.RWMutex
+	version uint64
+	nextID  uint64
+	spans   []*span
+}
+
+// Open the shards and map in config.Dir, creating them if need be.  A
+// new map has one range, covering every key, on shard 0.
+func InitRouter(config *Config) (*Router, error) {
+	r := &Router{config: *config}
+	if r.config.Shards <= 0 {
+		r.config.Shards = 1
+	}
+
+	m, err := r.loadMap()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = &Map{Version: 1, Ranges: []Range{{ID: 1}}}
+	}
+	if m.Shards > r.config.Shards {
+		return nil, fmt.Errorf("shard: map has %d shards, only %d configured", m.Shards, r.config.Shards)
+	}
+	for _, rg := range m.Ranges {
+		r.spans = append(r.spans, &span{Range: rg})
+		if rg.ID >= r.nextID {
+			r.nextID = rg.ID + 1
+		}
+	}
+	r.version = m.Version
+
+	for i := 0; i < r.config.Shards; i++ {
+		dbConfig := r.config.Db
+		if r.config.Dir != "" {
+			dbConfig.Dir = filepath.Join(r.config.Dir, fmt.Sprintf("shard-%d", i))
+			if err := os.MkdirAll(dbConfig.Dir, 0755); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		db, err := kvdb.InitDb(&dbConfig)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.shards = append(r.shards, db)
+	}
+	if m.Shards != r.config.Shards {
+		if err := r.saveMap(r.spans, r.version); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Router) loadMap() (*Map, error) {
+	if r.config.Dir == "" {
+		return nil, nil
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(r.config.Dir, mapFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m Map
+	if err := json.Unmarshal(blob, &m); err != nil {
+		return nil, fmt.Errorf("shard: bad map: %v", err)
+	}
+	return &m, nil
+}
+
+// Write the map made of spans, replacing the file so a crash leaves
+// either the old map or the new one
+func (r *Router) saveMap(spans []*span, version uint64) error {
+	if r.config.Dir == "" {
+		return nil
+	}
+	blob, err := json.MarshalIndent(mapOf(spans, version, r.config.Shards), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(r.config.Dir, mapFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(blob); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.config.Dir, mapFile))
+}
+
+func mapOf(spans []*span, version uint64, shards int) *Map {
+	m := &Map{Version: version, Shards: shards, Ranges: make([]Range, len(spans))}
+	for i, s := range spans {
+		m.Ranges[i] = s.Range
+	}
+	return m
+}
+
+// The current shard map
+func (r *Router) Map() *Map {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return mapOf(r.spans, r.version, len(r.shards))
+}
+
+// The Db of shard i, for reading it directly.  Keys outside the ranges
+// the map gives it may be left over from a move.
+func (r *Router) Shard(i int) (*kvdb.Db, error) {
+	if i < 0 || i >= len(r.shards) {
+		return nil, ErrNoShard
+	}
+	return r.shards[i], nil
+}
+
+// Close every shard
+func (r *Router) Close() error {
+	var err error
+	for _, db := range r.shards {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// The span holding key, r.lock must be held
+func (r *Router) lookup(key []byte) *span {
+	i := sort.Search(len(r.spans), func(i int) bool {
+		end := r.spans[i].End
+		return end == nil || bytes.Compare(key, end) < 0
+	})
+	return r.spans[i]
+}
+
+// The span with id, nil if there is none.  r.lock must be held.
+func (r *Router) find(id uint64) *span {
+	for _, s := range r.spans {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// The Db holding key, r.lock must be held for as long as it is read
+func (r *Router) dbFor(key []byte) *kvdb.Db {
+	return r.shards[r.lookup(key).Shard]
+}
+
+func (r *Router) Get(key []byte) ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).Get(key)
+}
+
+func (r *Router) GetWithInfo(key []byte) ([]byte, *kvdb.KeyInfo, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).GetWithInfo(key)
+}
+
+func (r *Router) Stat(key []byte) (*kvdb.KeyInfo, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).Stat(key)
+}
+
+func (r *Router) GetVersion(key []byte) ([]byte, uint64, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).GetVersion(key)
+}
+
+func (r *Router) History(key []byte) ([]kvdb.Version, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).History(key)
+}
+
+func (r *Router) GetAt(key []byte, t time.Time) ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dbFor(key).GetAt(key, t)
+}
+
+// Call write with the shard holding every key, while no move of their
+// ranges can start
+func (r *Router) write(keys [][]byte, write func(db *kvdb.Db) error) error {
+	for {
+		r.lock.RLock()
+		spans := []*span{}
+		for _, key := range keys {
+			s := r.lookup(key)
+			if !containsSpan(spans, s) {
+				spans = append(spans, s)
+			}
+		}
+		r.lock.RUnlock()
+
+		// Always lock in key order
+		sort.Slice(spans, func(i, j int) bool {
+			return bytes.Compare(spans[i].Start, spans[j].Start) < 0
+		})
+		retired, cross := false, false
+		for _, s := range spans {
+			s.lock.RLock()
+			retired = retired || s.retired
+			cross = cross || s.Shard != spans[0].Shard
+		}
+		var err error
+		if !retired && cross {
+			err = ErrCrossShard
+		} else if !retired {
+			err = write(r.shards[spans[0].Shard])
+		}
+		for _, s := range spans {
+			s.lock.RUnlock()
+		}
+		if !retired {
+			return err
+		}
+	}
+}
+
+func containsSpan(spans []*span, s *span) bool {
+	for _, t := range spans {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) Put(key, value []byte) error {
+	return r.PutWithOptions(key, value, kvdb.PutOptions{})
+}
+
+func (r *Router) PutWithOptions(key, value []byte, opts kvdb.PutOptions) error {
+	return r.write([][]byte{key}, func(db *kvdb.Db) error {
+		return db.PutWithOptions(key, value, opts)
+	})
+}
+
+func (r *Router) PutIfVersionWithOptions(key, value []byte, version uint64, opts kvdb.PutOptions) (uint64, error) {
+	var newVersion uint64
+	err := r.write([][]byte{key}, func(db *kvdb.Db) error {
+		var err error
+		newVersion, err = db.PutIfVersionWithOptions(key, value, version, opts)
+		return err
+	})
+	return newVersion, err
+}
+
+func (r *Router) Delete(key []byte) error {
+	return r.write([][]byte{key}, func(db *kvdb.Db) error {
+		return db.Delete(key)
+	})
+}
+
+func (r *Router) DeleteIfVersion(key []byte, version uint64) error {
+	return r.write([][]byte{key}, func(db *kvdb.Db) error {
+		return db.DeleteIfVersion(key, version)
+	})
+}
+
+// Apply batch atomically, failing with ErrCrossShard if its keys are
+// held by more than one shard
+func (r *Router) Write(batch *kvdb.WriteBatch) error {
+	keys := batch.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.write(keys, func(db *kvdb.Db) error {
+		return db.Write(batch)
+	})
+}
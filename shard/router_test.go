@@ -0,0 +1,303 @@
+package shard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlitzingerdev/simple-kv/kvdb"
+)
+
+func openTestRouter(t *testing.T, config *Config) *Router {
+	r, err := InitRouter(config)
+	if err != nil {
+		t.Errorf("InitRouter failed: %v", err)
+		t.FailNow()
+	}
+	return r
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%03d", i))
+}
+
+// The range holding key in the router's map
+func rangeOf(r *Router, key []byte) Range {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.lookup(key).Range
+}
+
+func TestRouting(t *testing.T) {
+	r := openTestRouter(t, &Config{Shards: 3})
+	defer r.Close()
+	for i := 0; i < 100; i++ {
+		r.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+
+	if err := r.Split(key(50)); err != nil {
+		t.Errorf("Split failed: %v", err)
+	}
+	if err := r.Split(key(50)); err != ErrSplitBoundary {
+		t.Errorf("splitting at a boundary: %v", err)
+	}
+	upper := rangeOf(r, key(50))
+	if err := r.Move(upper.ID, 2); err != nil {
+		t.Errorf("Move failed: %v", err)
+	}
+	if err := r.Move(upper.ID, 3); err != ErrNoShard {
+		t.Errorf("moving to a missing shard: %v", err)
+	}
+	if err := r.Move(99, 1); err != ErrNoRange {
+		t.Errorf("moving a missing range: %v", err)
+	}
+
+	m := r.Map()
+	if m.Version != 3 || m.Shards != 3 || len(m.Ranges) != 2 ||
+		m.Ranges[0].Shard != 0 || string(m.Ranges[0].End) != string(key(50)) ||
+		m.Ranges[1].Shard != 2 || m.Ranges[1].End != nil {
+		t.Errorf("map %+v", m)
+	}
+	shard0, _ := r.Shard(0)
+	shard2, _ := r.Shard(2)
+	for i := 0; i < 100; i++ {
+		if v, _ := r.Get(key(i)); string(v) != fmt.Sprint(i) {
+			t.Errorf("%s=%q", key(i), v)
+		}
+		v0, _ := shard0.Get(key(i))
+		v2, _ := shard2.Get(key(i))
+		if i < 50 && (v0 == nil || v2 != nil) || i >= 50 && (v0 != nil || v2 == nil) {
+			t.Errorf("%s held by the wrong shard", key(i))
+		}
+	}
+
+	// Writes go to the shard now holding the key
+	r.Delete(key(60))
+	r.PutWithOptions(key(61), []byte("new"), kvdb.PutOptions{ContentType: "text/plain"})
+	if v, _ := shard2.Get(key(60)); v != nil {
+		t.Errorf("delete did not reach shard 2")
+	}
+	if _, info, _ := r.GetWithInfo(key(61)); info == nil || info.ContentType != "text/plain" {
+		t.Errorf("info %+v", info)
+	}
+	_, version, _ := r.GetVersion(key(62))
+	if _, err := r.PutIfVersionWithOptions(key(62), []byte("x"), version+1, kvdb.PutOptions{}); err != kvdb.ErrVersionMismatch {
+		t.Errorf("PutIfVersion with the wrong version: %v", err)
+	}
+	if err := r.DeleteIfVersion(key(62), version); err != nil {
+		t.Errorf("DeleteIfVersion failed: %v", err)
+	}
+
+	// A batch within one shard is applied, one across shards refused
+	batch := kvdb.NewWriteBatch()
+	batch.Put(key(1), []byte("a"))
+	batch.Put(key(2), []byte("b"))
+	if err := r.Write(batch); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	batch.Put(key(70), []byte("c"))
+	if err := r.Write(batch); err != ErrCrossShard {
+		t.Errorf("Write across shards: %v", err)
+	}
+	if v, _ := r.Get(key(70)); string(v) != "70" {
+		t.Errorf("part of a refused batch was written")
+	}
+}
+
+func TestMoveKeepsOptions(t *testing.T) {
+	r := openTestRouter(t, &Config{Shards: 2})
+	defer r.Close()
+	r.PutWithOptions([]byte("ttl"), []byte("v"), kvdb.PutOptions{TTL: time.Hour, ContentType: "image/png"})
+	r.PutWithOptions([]byte("gone"), []byte("v"), kvdb.PutOptions{ExpiresAt: time.Now().Add(-time.Minute)})
+	_, before, _ := r.GetWithInfo([]byte("ttl"))
+
+	if err := r.Move(r.Map().Ranges[0].ID, 1); err != nil {
+		t.Errorf("Move failed: %v", err)
+	}
+	_, after, _ := r.GetWithInfo([]byte("ttl"))
+	if after == nil || after.ContentType != "image/png" || after.Expires.Unix() != before.Expires.Unix() {
+		t.Errorf("before %+v after %+v", before, after)
+	}
+	shard1, _ := r.Shard(1)
+	if info, _ := shard1.Stat([]byte("gone")); info != nil {
+		t.Errorf("expired key was copied")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	r := openTestRouter(t, &Config{Shards: 3})
+	defer r.Close()
+	for i := 0; i < 30; i++ {
+		r.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+	r.Split(key(10))
+	r.Split(key(20))
+	m := r.Map()
+	r.Move(m.Ranges[0].ID, 2)
+	r.Move(m.Ranges[2].ID, 1)
+	// Left behind by a move that did not finish, never seen
+	shard0, _ := r.Shard(0)
+	shard0.Put(key(5), []byte("stale"))
+	shard0.Put(key(25), []byte("stale"))
+
+	it := r.NewIterator()
+	defer it.Close()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if string(it.Key()) != string(key(n)) || string(it.Value()) != fmt.Sprint(n) {
+			t.Errorf("at %d: %s=%s", n, it.Key(), it.Value())
+		}
+		n++
+	}
+	if n != 30 {
+		t.Errorf("iterated over %d keys", n)
+	}
+	n = 29
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if string(it.Key()) != string(key(n)) {
+			t.Errorf("backward at %d: %s", n, it.Key())
+		}
+		n--
+	}
+	if n != -1 {
+		t.Errorf("stopped backward at %d", n)
+	}
+	it.Seek([]byte("key0095"))
+	if !it.Valid() || string(it.Key()) != string(key(10)) {
+		t.Errorf("Seek across a boundary found %s", it.Key())
+	}
+	it.Prev()
+	if !it.Valid() || string(it.Key()) != string(key(9)) {
+		t.Errorf("Prev across a boundary found %s", it.Key())
+	}
+	if it.Seek([]byte("z")); it.Valid() {
+		t.Errorf("Seek past the end found %s", it.Key())
+	}
+
+	// Writes after the iterator is made are not seen
+	it2 := r.NewIterator()
+	defer it2.Close()
+	r.Put([]byte("a"), []byte("new"))
+	if it2.SeekToFirst(); string(it2.Key()) != string(key(0)) {
+		t.Errorf("iterator saw %s", it2.Key())
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	r := openTestRouter(t, &Config{Shards: 4})
+	defer r.Close()
+	for i := 0; i < 400; i++ {
+		r.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+	moved, err := r.Rebalance()
+	if err != nil || moved == 0 {
+		t.Errorf("Rebalance = %d, %v", moved, err)
+	}
+	counts, _, _, _ := r.countSpans()
+	totals := make([]int, 4)
+	for i, rg := range r.Map().Ranges {
+		totals[rg.Shard] += counts[i]
+	}
+	for i, total := range totals {
+		if total < 75 || total > 125 {
+			t.Errorf("shard %d holds %d keys: %v", i, total, totals)
+		}
+	}
+	for i := 0; i < 400; i++ {
+		if v, _ := r.Get(key(i)); string(v) != fmt.Sprint(i) {
+			t.Errorf("%s=%q after rebalancing", key(i), v)
+		}
+	}
+	if moved, _ := r.Rebalance(); moved != 0 {
+		t.Errorf("balanced shards moved %d ranges", moved)
+	}
+}
+
+// Writes made while ranges split and move all land
+func TestOnlineMove(t *testing.T) {
+	r := openTestRouter(t, &Config{Shards: 3})
+	defer r.Close()
+	for i := 0; i < 100; i++ {
+		r.Put(key(i), []byte("0"))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	last := make([]int, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 1; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := w; i < 100; i += 4 {
+					if err := r.Put(key(i), []byte(fmt.Sprint(n))); err != nil {
+						t.Errorf("Put failed: %v", err)
+						return
+					}
+				}
+				last[w] = n
+			}
+		}(w)
+	}
+
+	for i := 10; i < 100; i += 10 {
+		r.Split(key(i))
+	}
+	for round := 0; round < 3; round++ {
+		for i, rg := range r.Map().Ranges {
+			if err := r.Move(rg.ID, (i+round)%3); err != nil {
+				t.Errorf("Move failed: %v", err)
+			}
+		}
+	}
+	r.Rebalance()
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		if v, _ := r.Get(key(i)); string(v) != fmt.Sprint(last[i%4]) {
+			t.Errorf("%s=%s, last written %d", key(i), v, last[i%4])
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shard")
+	defer os.RemoveAll(dir)
+	r := openTestRouter(t, &Config{Dir: dir, Shards: 2})
+	for i := 0; i < 20; i++ {
+		r.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+	r.Split(key(10))
+	r.Move(rangeOf(r, key(10)).ID, 1)
+	before := r.Map()
+	r.Close()
+
+	if _, err := InitRouter(&Config{Dir: dir, Shards: 1}); err == nil {
+		t.Errorf("opened with fewer shards than the map")
+	}
+
+	// A shard added on reopening starts empty
+	r = openTestRouter(t, &Config{Dir: dir, Shards: 3})
+	defer r.Close()
+	m := r.Map()
+	if m.Version != before.Version || m.Shards != 3 || len(m.Ranges) != 2 || m.Ranges[1].Shard != 1 {
+		t.Errorf("reopened map %+v, before %+v", m, before)
+	}
+	for i := 0; i < 20; i++ {
+		if v, _ := r.Get(key(i)); string(v) != fmt.Sprint(i) {
+			t.Errorf("%s=%q after reopening", key(i), v)
+		}
+	}
+	if moved, err := r.Rebalance(); err != nil || moved == 0 {
+		t.Errorf("Rebalance onto the new shard = %d, %v", moved, err)
+	}
+}